@@ -18,7 +18,9 @@ import (
 	"ehang.io/nps/lib/conn"
 	"ehang.io/nps/lib/crypt"
 	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/proxyproto"
 	"ehang.io/nps/lib/version"
+	"ehang.io/nps/server/cluster"
 	"ehang.io/nps/server/connection"
 	"ehang.io/nps/server/tool"
 	"github.com/astaxie/beego"
@@ -27,21 +29,121 @@ import (
 
 var ServerTlsEnable bool = false
 
+// the clients which do not negotiate connect without any feature
+var AllowLegacyClient = true
+
+const maxTunnelNum = 32
+
 type Client struct {
-	tunnel    *nps_mux.Mux
-	signal    *conn.Conn
-	file      *nps_mux.Mux
-	Version   string
-	retryTime int // it will be add 1 when ping not ok until to 3 will close the client
+	tunnels    []*nps_mux.Mux // the new streams are spread across them
+	tunnelLock sync.Mutex
+	signal     *conn.Conn
+	signalLock sync.Mutex
+	file       *nps_mux.Mux
+	Version    string
+	Capability *version.Capability
+	retryTime  int // it will be add 1 when ping not ok until to 3 will close the client
+}
+
+func NewClient(t, f *nps_mux.Mux, s *conn.Conn, vs string, capability *version.Capability) *Client {
+	c := &Client{
+		signal:     s,
+		file:       f,
+		Version:    vs,
+		Capability: capability,
+	}
+	if t != nil {
+		c.tunnels = []*nps_mux.Mux{t}
+	}
+	return c
+}
+
+func (s *Client) HasFeature(feature string) bool {
+	return s.Capability.Has(feature)
+}
+
+func (s *Client) addTunnel(t *nps_mux.Mux) error {
+	s.tunnelLock.Lock()
+	defer s.tunnelLock.Unlock()
+	if len(s.tunnels) >= maxTunnelNum {
+		return errors.New(fmt.Sprintf("the number of the data connections exceeds %d", maxTunnelNum))
+	}
+	s.tunnels = append(s.tunnels, t)
+	return nil
 }
 
-func NewClient(t, f *nps_mux.Mux, s *conn.Conn, vs string) *Client {
-	return &Client{
-		signal:  s,
-		tunnel:  t,
-		file:    f,
-		Version: vs,
+// the least loaded one, weighted by the latency and the bandwidth
+func (s *Client) getTunnel() *nps_mux.Mux {
+	s.tunnelLock.Lock()
+	defer s.tunnelLock.Unlock()
+	var maxBw float64
+	for _, t := range s.tunnels {
+		if bw := t.Bandwidth(); bw > maxBw {
+			maxBw = bw
+		}
+	}
+	var tunnel *nps_mux.Mux
+	var minLoad float64
+	for _, t := range s.tunnels {
+		if t.IsClose {
+			continue
+		}
+		// not measured yet, treat it as the best one
+		bw := t.Bandwidth()
+		if bw <= 0 {
+			bw = maxBw
+		}
+		if bw <= 0 {
+			bw = 1
+		}
+		load := float64(t.NumConn()+1) * (t.Latency() + 0.001) / bw
+		if tunnel == nil || load < minLoad {
+			tunnel, minLoad = t, load
+		}
+	}
+	return tunnel
+}
+
+// drop the closed data connections
+func (s *Client) checkTunnel() (alive, closed int) {
+	s.tunnelLock.Lock()
+	defer s.tunnelLock.Unlock()
+	tunnels := s.tunnels[:0]
+	for _, t := range s.tunnels {
+		if t.IsClose {
+			closed++
+		} else {
+			tunnels = append(tunnels, t)
+		}
 	}
+	s.tunnels = tunnels
+	return len(tunnels), closed
+}
+
+func (s *Client) writeSignal(flag string, contents ...[]byte) error {
+	s.signalLock.Lock()
+	defer s.signalLock.Unlock()
+	if s.signal == nil {
+		return errors.New("the signal connection of the client is not established")
+	}
+	if _, err := s.signal.Write([]byte(flag)); err != nil {
+		return err
+	}
+	for _, v := range contents {
+		if err := s.signal.WriteLenContent(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Client) closeTunnel() {
+	s.tunnelLock.Lock()
+	defer s.tunnelLock.Unlock()
+	for _, t := range s.tunnels {
+		t.Close()
+	}
+	s.tunnels = nil
 }
 
 type Bridge struct {
@@ -52,10 +154,13 @@ type Bridge struct {
 	OpenTask       chan *file.Tunnel
 	CloseTask      chan *file.Tunnel
 	CloseClient    chan int
+	ApplyProfile   chan int // called once the client is connected, creates the profile tasks
 	SecretChan     chan *conn.Secret
 	ipVerify       bool
 	runList        sync.Map //map[int]interface{}
 	disconnectTime int
+	Cluster        *cluster.Node // forwards the links of the clients held by the other nodes
+	healthChecking sync.Map      // *file.Health -> the check of the targets is running
 }
 
 func NewTunnel(tunnelPort int, tunnelType string, ipVerify bool, runList sync.Map, disconnectTime int) *Bridge {
@@ -65,6 +170,7 @@ func NewTunnel(tunnelPort int, tunnelType string, ipVerify bool, runList sync.Ma
 		OpenTask:       make(chan *file.Tunnel),
 		CloseTask:      make(chan *file.Tunnel),
 		CloseClient:    make(chan int),
+		ApplyProfile:   make(chan int),
 		SecretChan:     make(chan *conn.Secret),
 		ipVerify:       ipVerify,
 		runList:        runList,
@@ -74,11 +180,18 @@ func NewTunnel(tunnelPort int, tunnelType string, ipVerify bool, runList sync.Ma
 
 func (s *Bridge) StartTunnel() error {
 	go s.ping()
+	go s.healthCheck()
+	s.startWsTunnel()
 	if s.tunnelType == "kcp" {
 		logs.Info("server start, the bridge type is %s, the bridge port is %d", s.tunnelType, s.TunnelPort)
 		return conn.NewKcpListenerAndProcess(beego.AppConfig.String("bridge_ip")+":"+beego.AppConfig.String("bridge_port"), func(c net.Conn) {
 			s.cliProcess(conn.NewConn(c))
 		})
+	} else if s.tunnelType == "quic" {
+		logs.Info("server start, the bridge type is %s, the bridge port is %d", s.tunnelType, s.TunnelPort)
+		return conn.NewQuicListenerAndProcess(beego.AppConfig.String("bridge_ip")+":"+beego.AppConfig.String("bridge_port"), func(c net.Conn) {
+			s.cliProcess(conn.NewConn(c))
+		})
 	} else {
 
 		go func() {
@@ -106,8 +219,8 @@ func (s *Bridge) StartTunnel() error {
 					os.Exit(0)
 					return
 				}
-				conn.Accept(tlsListener, func(c net.Conn) {
-					s.cliProcess(conn.NewConn(tls.Server(c, &tls.Config{Certificates: []tls.Certificate{crypt.GetCert()}})))
+				conn.Accept(proxyproto.NewListener(tlsListener), func(c net.Conn) {
+					s.cliProcess(conn.NewConn(tls.Server(c, crypt.GetServerTlsConfig())))
 				})
 			}()
 		}
@@ -115,67 +228,43 @@ func (s *Bridge) StartTunnel() error {
 	return nil
 }
 
+// the websocket bridge is served on the http proxy port, and on ws_bridge_port if it is set
+func (s *Bridge) startWsTunnel() {
+	conn.WsBridgePath = beego.AppConfig.String("ws_bridge_path")
+	if conn.WsBridgePath == "" {
+		return
+	}
+	for _, v := range strings.Split(beego.AppConfig.String("ws_bridge_host"), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			conn.WsBridgeHosts = append(conn.WsBridgeHosts, v)
+		}
+	}
+	if port := beego.AppConfig.DefaultInt("ws_bridge_port", 0); port > 0 {
+		go func() {
+			logs.Info("websocket server start, the websocket bridge port is %d, the path is %s", port, conn.WsBridgePath)
+			err := conn.NewWsListenerAndProcess(beego.AppConfig.String("bridge_ip")+":"+strconv.Itoa(port), beego.AppConfig.DefaultBool("ws_bridge_tls", false), s.ProcessConn)
+			if err != nil {
+				logs.Error(err)
+				os.Exit(0)
+			}
+		}()
+	}
+}
+
+// for the connections accepted elsewhere, e.g. the websocket bridge
+func (s *Bridge) ProcessConn(c net.Conn) {
+	s.cliProcess(conn.NewConn(c))
+}
+
 // get health information form client
 func (s *Bridge) GetHealthFromClient(id int, c *conn.Conn) {
 	for {
-		if info, status, err := c.GetHealthInfo(); err != nil {
+		info, status, err := c.GetHealthInfo()
+		if err != nil {
 			break
-		} else if !status { //the status is true , return target to the targetArr
-			file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
-				v := value.(*file.Tunnel)
-				if v.Client.Id == id && v.Mode == "tcp" && strings.Contains(v.Target.TargetStr, info) {
-					v.Lock()
-					if v.Target.TargetArr == nil || (len(v.Target.TargetArr) == 0 && len(v.HealthRemoveArr) == 0) {
-						v.Target.TargetArr = common.TrimArr(strings.Split(v.Target.TargetStr, "\n"))
-					}
-					v.Target.TargetArr = common.RemoveArrVal(v.Target.TargetArr, info)
-					if v.HealthRemoveArr == nil {
-						v.HealthRemoveArr = make([]string, 0)
-					}
-					v.HealthRemoveArr = append(v.HealthRemoveArr, info)
-					v.Unlock()
-				}
-				return true
-			})
-			file.GetDb().JsonDb.Hosts.Range(func(key, value interface{}) bool {
-				v := value.(*file.Host)
-				if v.Client.Id == id && strings.Contains(v.Target.TargetStr, info) {
-					v.Lock()
-					if v.Target.TargetArr == nil || (len(v.Target.TargetArr) == 0 && len(v.HealthRemoveArr) == 0) {
-						v.Target.TargetArr = common.TrimArr(strings.Split(v.Target.TargetStr, "\n"))
-					}
-					v.Target.TargetArr = common.RemoveArrVal(v.Target.TargetArr, info)
-					if v.HealthRemoveArr == nil {
-						v.HealthRemoveArr = make([]string, 0)
-					}
-					v.HealthRemoveArr = append(v.HealthRemoveArr, info)
-					v.Unlock()
-				}
-				return true
-			})
-		} else { //the status is false,remove target from the targetArr
-			file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
-				v := value.(*file.Tunnel)
-				if v.Client.Id == id && v.Mode == "tcp" && common.IsArrContains(v.HealthRemoveArr, info) && !common.IsArrContains(v.Target.TargetArr, info) {
-					v.Lock()
-					v.Target.TargetArr = append(v.Target.TargetArr, info)
-					v.HealthRemoveArr = common.RemoveArrVal(v.HealthRemoveArr, info)
-					v.Unlock()
-				}
-				return true
-			})
-
-			file.GetDb().JsonDb.Hosts.Range(func(key, value interface{}) bool {
-				v := value.(*file.Host)
-				if v.Client.Id == id && common.IsArrContains(v.HealthRemoveArr, info) && !common.IsArrContains(v.Target.TargetArr, info) {
-					v.Lock()
-					v.Target.TargetArr = append(v.Target.TargetArr, info)
-					v.HealthRemoveArr = common.RemoveArrVal(v.HealthRemoveArr, info)
-					v.Unlock()
-				}
-				return true
-			})
 		}
+		//the status is true, return target to the targetArr, otherwise remove it
+		setTargetHealth(id, info, status)
 	}
 	s.DelClient(id)
 }
@@ -195,11 +284,10 @@ func (s *Bridge) cliProcess(c *conn.Conn) {
 		logs.Info("The client %s connect error", c.Conn.RemoteAddr(), err.Error())
 		return
 	}
-	//version check
-	if b, err := c.GetShortLenContent(); err != nil || string(b) != version.GetVersion() {
-		//logs.Info("The client %s version does not match", c.Conn.RemoteAddr())
-		//c.Close()
-		//return
+	//version check, the same core version negotiates after the verification
+	var negotiate bool
+	if b, err := c.GetShortLenContent(); err == nil && string(b) == version.GetVersion() {
+		negotiate = true
 	}
 	//version get
 	var vs []byte
@@ -218,29 +306,68 @@ func (s *Bridge) cliProcess(c *conn.Conn) {
 		c.Close()
 		return
 	}
-	//verify
-	id, err := file.GetDb().GetIdByVerifyKey(string(buf), c.Conn.RemoteAddr().String())
+	//verify, a client certificate replaces the vkey
+	var id int
+	if cert := c.GetPeerCertificate(); cert != nil {
+		id, err = file.GetDb().GetIdByCertSerial(crypt.GetSerial(cert.SerialNumber), c.Conn.RemoteAddr().String())
+	} else {
+		id, err = file.GetDb().GetIdByVerifyKey(string(buf), c.Conn.RemoteAddr().String())
+	}
 	if err != nil {
 		logs.Info("Current client connection validation error, close this client:", c.Conn.RemoteAddr())
 		s.verifyError(c)
 		return
-	} else {
-		s.verifySuccess(c)
+	}
+	if !negotiate && !AllowLegacyClient {
+		logs.Warn("the client %d %s of version %s does not negotiate the capabilities, it is rejected, please upgrade it", id, c.Conn.RemoteAddr(), string(vs))
+		s.verifyError(c)
+		return
+	}
+	s.verifySuccess(c)
+	capability := version.NewLegacyCapability(string(vs))
+	if negotiate {
+		if capability, err = s.negotiate(c); err != nil {
+			logs.Warn("negotiate the capabilities with the client %d %s error %s", id, c.Conn.RemoteAddr(), err.Error())
+			c.Close()
+			return
+		}
 	}
 	if flag, err := c.ReadFlag(); err == nil {
-		s.typeDeal(flag, c, id, string(vs))
+		s.typeDeal(flag, c, id, string(vs), capability)
 	} else {
 		logs.Warn(err, flag)
 	}
 	return
 }
 
+func (s *Bridge) negotiate(c *conn.Conn) (*version.Capability, error) {
+	peer, err := c.GetCapability()
+	if err != nil {
+		return nil, err
+	}
+	capability := version.NewCapability().Negotiate(peer)
+	if peer.Protocol != version.PROTOCOL {
+		capability.Error = fmt.Sprintf("the protocol %d of the client is not supported by the server of the protocol %d", peer.Protocol, version.PROTOCOL)
+	}
+	if _, err := c.SendInfo(capability, ""); err != nil {
+		return nil, err
+	}
+	if capability.Error != "" {
+		return nil, errors.New(capability.Error)
+	}
+	capability.Version = peer.Version
+	return capability, nil
+}
+
 func (s *Bridge) DelClient(id int) {
 	if v, ok := s.Client.Load(id); ok {
 		if v.(*Client).signal != nil {
 			v.(*Client).signal.Close()
 		}
 		s.Client.Delete(id)
+		if s.Cluster != nil {
+			s.Cluster.SetPresence(id, false)
+		}
 		if file.GetDb().IsPubClient(id) {
 			return
 		}
@@ -251,7 +378,7 @@ func (s *Bridge) DelClient(id int) {
 }
 
 // use different
-func (s *Bridge) typeDeal(typeVal string, c *conn.Conn, id int, vs string) {
+func (s *Bridge) typeDeal(typeVal string, c *conn.Conn, id int, vs string, capability *version.Capability) {
 	isPub := file.GetDb().IsPubClient(id)
 	switch typeVal {
 	case common.WORK_MAIN:
@@ -259,26 +386,44 @@ func (s *Bridge) typeDeal(typeVal string, c *conn.Conn, id int, vs string) {
 			c.Close()
 			return
 		}
-		tcpConn, ok := c.Conn.(*net.TCPConn)
+		rawConn := c.Conn
+		if pc, ok := rawConn.(*proxyproto.Conn); ok {
+			rawConn = pc.Conn
+		}
+		tcpConn, ok := rawConn.(*net.TCPConn)
 		if ok {
 			// add tcp keep alive option for signal connection
 			_ = tcpConn.SetKeepAlive(true)
 			_ = tcpConn.SetKeepAlivePeriod(5 * time.Second)
 		}
 		//the vKey connect by another ,close the client of before
-		if v, ok := s.Client.LoadOrStore(id, NewClient(nil, nil, c, vs)); ok {
+		if v, ok := s.Client.LoadOrStore(id, NewClient(nil, nil, c, vs, capability)); ok {
 			if v.(*Client).signal != nil {
 				v.(*Client).signal.WriteClose()
+				v.(*Client).closeTunnel()
 			}
 			v.(*Client).signal = c
 			v.(*Client).Version = vs
+			v.(*Client).Capability = capability
+		}
+		if s.Cluster != nil {
+			s.Cluster.SetPresence(id, true)
 		}
 		go s.GetHealthFromClient(id, c)
-		logs.Info("clientId %d connection succeeded, address:%s ", id, c.Conn.RemoteAddr())
+		logs.Info("clientId %d connection succeeded, address:%s, features:%s", id, c.Conn.RemoteAddr(), strings.Join(capability.Features, ","))
+		// still notify, so the client clears the profile applied before
+		if client, err := file.GetDb().GetClient(id); err == nil && !client.NoStore && !client.GetProfile().IsEmpty() {
+			s.ApplyProfile <- id
+		} else {
+			s.NotifyProfile(id)
+		}
 	case common.WORK_CHAN:
 		muxConn := nps_mux.NewMux(c.Conn, s.tunnelType, s.disconnectTime)
-		if v, ok := s.Client.LoadOrStore(id, NewClient(muxConn, nil, nil, vs)); ok {
-			v.(*Client).tunnel = muxConn
+		if v, ok := s.Client.LoadOrStore(id, NewClient(muxConn, nil, nil, vs, capability)); ok {
+			if err := v.(*Client).addTunnel(muxConn); err != nil {
+				logs.Warn("the client %d %s, %s", id, c.Conn.RemoteAddr(), err.Error())
+				muxConn.Close()
+			}
 		}
 	case common.WORK_CONFIG:
 		client, err := file.GetDb().GetClient(id)
@@ -288,8 +433,22 @@ func (s *Bridge) typeDeal(typeVal string, c *conn.Conn, id int, vs string) {
 		}
 		binary.Write(c, binary.LittleEndian, isPub)
 		go s.getConfig(c, isPub, client)
+	case common.WORK_PROFILE:
+		client, err := file.GetDb().GetClient(id)
+		if err != nil || isPub {
+			c.Close()
+			return
+		}
+		profile := client.Profile
+		if profile == nil {
+			profile = new(file.Profile)
+		}
+		c.SendInfo(profile, "")
+		c.Close()
 	case common.WORK_REGISTER:
 		go s.register(c)
+	case common.WORK_PROBE:
+		c.Close()
 	case common.WORK_SECRET:
 		if b, err := c.GetShortContent(32); err == nil {
 			s.SecretChan <- conn.NewSecret(string(b), c)
@@ -298,7 +457,7 @@ func (s *Bridge) typeDeal(typeVal string, c *conn.Conn, id int, vs string) {
 		}
 	case common.WORK_FILE:
 		muxConn := nps_mux.NewMux(c.Conn, s.tunnelType, s.disconnectTime)
-		if v, ok := s.Client.LoadOrStore(id, NewClient(nil, muxConn, nil, vs)); ok {
+		if v, ok := s.Client.LoadOrStore(id, NewClient(nil, muxConn, nil, vs, capability)); ok {
 			v.(*Client).file = muxConn
 		}
 	case common.WORK_P2P:
@@ -312,14 +471,8 @@ func (s *Bridge) typeDeal(typeVal string, c *conn.Conn, id int, vs string) {
 				return
 			} else {
 				//向密钥对应的客户端发送与服务端udp建立连接信息，地址，密钥
-				v.(*Client).signal.Write([]byte(common.NEW_UDP_CONN))
 				svrAddr := beego.AppConfig.String("p2p_ip") + ":" + beego.AppConfig.String("p2p_port")
-				if err != nil {
-					logs.Warn("get local udp addr error")
-					return
-				}
-				v.(*Client).signal.WriteLenContent([]byte(svrAddr))
-				v.(*Client).signal.WriteLenContent(b)
+				v.(*Client).writeSignal(common.NEW_UDP_CONN, []byte(svrAddr), b)
 				//向该请求者发送建立连接请求,服务器地址
 				c.WriteLenContent([]byte(svrAddr))
 			}
@@ -343,23 +496,39 @@ func (s *Bridge) SendLinkInfo(clientId int, link *conn.Link, t *file.Tunnel) (ta
 		target, err = net.Dial("tcp", link.Host)
 		return
 	}
-	if v, ok := s.Client.Load(clientId); ok {
-		//If ip is restricted to do ip verification
-		if s.ipVerify {
-			ip := common.GetIpByAddr(link.RemoteAddr)
-			if v, ok := s.Register.Load(ip); !ok {
-				return nil, errors.New(fmt.Sprintf("The ip %s is not in the validation list", ip))
-			} else {
-				if !v.(time.Time).After(time.Now()) {
-					return nil, errors.New(fmt.Sprintf("The validity of the ip %s has expired", ip))
-				}
+	//If ip is restricted to do ip verification
+	if s.ipVerify {
+		ip := common.GetIpByAddr(link.RemoteAddr)
+		if v, ok := s.Register.Load(ip); !ok {
+			return nil, errors.New(fmt.Sprintf("The ip %s is not in the validation list", ip))
+		} else {
+			if !v.(time.Time).After(time.Now()) {
+				return nil, errors.New(fmt.Sprintf("The validity of the ip %s has expired", ip))
 			}
 		}
+	}
+	isFile := t != nil && t.Mode == "file"
+	if _, ok := s.Client.Load(clientId); !ok && s.Cluster != nil {
+		// held by another node, crypt and compress are still done here
+		if target, err = s.Cluster.SendLinkInfo(clientId, link, isFile); err == nil && isFile {
+			link.Crypt = false
+			link.Compress = false
+		}
+		return
+	}
+	return s.SendLocalLinkInfo(clientId, link, isFile)
+}
+
+func (s *Bridge) SendLocalLinkInfo(clientId int, link *conn.Link, isFile bool) (target net.Conn, err error) {
+	if v, ok := s.Client.Load(clientId); ok {
+		if err = checkLinkFeature(v.(*Client), link); err != nil {
+			return
+		}
 		var tunnel *nps_mux.Mux
-		if t != nil && t.Mode == "file" {
+		if isFile {
 			tunnel = v.(*Client).file
 		} else {
-			tunnel = v.(*Client).tunnel
+			tunnel = v.(*Client).getTunnel()
 		}
 		if tunnel == nil {
 			err = errors.New("the client connect error")
@@ -368,22 +537,91 @@ func (s *Bridge) SendLinkInfo(clientId int, link *conn.Link, t *file.Tunnel) (ta
 		if target, err = tunnel.NewConn(); err != nil {
 			return
 		}
-		if t != nil && t.Mode == "file" {
+		if isFile {
 			//TODO if t.mode is file ,not use crypt or compress
 			link.Crypt = false
 			link.Compress = false
 			return
 		}
+		link.DialResult = v.(*Client).HasFeature(version.FEATURE_DIAL_RESULT) && link.ConnType != "udp5" && link.ConnType != common.CONN_CMD
 		if _, err = conn.NewConn(target).SendInfo(link, ""); err != nil {
 			logs.Info("new connect error ,the target %s refuse to connect", link.Host)
 			return
 		}
+		if link.DialResult {
+			if err = readDialResult(target, link); err != nil {
+				target.Close()
+				target = nil
+				return
+			}
+		}
 	} else {
 		err = errors.New(fmt.Sprintf("the client %d is not connect", clientId))
 	}
 	return
 }
 
+func (s *Bridge) GetLocalClients() []int {
+	clients := make([]int, 0)
+	s.Client.Range(func(key, value interface{}) bool {
+		if value.(*Client).signal != nil {
+			clients = append(clients, key.(int))
+		}
+		return true
+	})
+	return clients
+}
+
+// not a visitor, so the ip is not verified
+func (s *Bridge) SendCommand(clientId int, cmd *conn.Command) (*conn.CommandResult, error) {
+	link := conn.NewLink(common.CONN_CMD, "", false, false, "", false)
+	var target net.Conn
+	var err error
+	if _, ok := s.Client.Load(clientId); !ok && s.Cluster != nil {
+		target, err = s.Cluster.SendLinkInfo(clientId, link, false)
+	} else {
+		target, err = s.SendLocalLinkInfo(clientId, link, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer target.Close()
+	c := conn.NewConn(target)
+	if _, err = c.SendInfo(cmd, ""); err != nil {
+		return nil, err
+	}
+	// let the client reply the timeout error first
+	target.SetReadDeadline(time.Now().Add(time.Duration(cmd.Timeout+5) * time.Second))
+	return c.GetCommandResult()
+}
+
+// the old clients would silently ignore these options
+func checkLinkFeature(c *Client, link *conn.Link) error {
+	if link.ConnType == common.CONN_CMD && !c.HasFeature(version.FEATURE_COMMAND) {
+		return errors.New(fmt.Sprintf("the client of version %s does not support the commands, please upgrade it", c.Version))
+	}
+	if link.Option.Tls != nil && !c.HasFeature(version.FEATURE_TARGET_TLS) {
+		return errors.New(fmt.Sprintf("the client of version %s does not support the tls to the target, please upgrade it", c.Version))
+	}
+	if link.Option.ProxyProtocol != 0 && !c.HasFeature(version.FEATURE_PROXY_PROTOCOL) {
+		return errors.New(fmt.Sprintf("the client of version %s does not support the proxy protocol, please upgrade it", c.Version))
+	}
+	return nil
+}
+
+func readDialResult(target net.Conn, link *conn.Link) error {
+	target.SetReadDeadline(time.Now().Add(link.Option.Timeout + 5*time.Second))
+	defer target.SetReadDeadline(time.Time{})
+	flag, err := conn.NewConn(target).ReadFlag()
+	if err != nil {
+		return errors.New(fmt.Sprintf("read the result of connecting to %s error %s", link.Host, err.Error()))
+	}
+	if flag != common.DIAL_SUCCESS {
+		return errors.New(fmt.Sprintf("the client can not connect to %s", link.Host))
+	}
+	return nil
+}
+
 func (s *Bridge) ping() {
 	ticker := time.NewTicker(time.Second * 5)
 	defer ticker.Stop()
@@ -393,15 +631,17 @@ func (s *Bridge) ping() {
 			arr := make([]int, 0)
 			s.Client.Range(func(key, value interface{}) bool {
 				v := value.(*Client)
-				if v.tunnel == nil || v.signal == nil {
+				alive, closed := v.checkTunnel()
+				//all the data connections are lost
+				if alive == 0 && closed > 0 {
+					arr = append(arr, key.(int))
+					return true
+				}
+				if alive == 0 || v.signal == nil {
 					v.retryTime += 1
 					if v.retryTime >= 3 {
 						arr = append(arr, key.(int))
 					}
-					return true
-				}
-				if v.tunnel.IsClose {
-					arr = append(arr, key.(int))
 				}
 				return true
 			})
@@ -464,7 +704,7 @@ loop:
 				}
 				c.WriteAddOk()
 				c.Write([]byte(client.VerifyKey))
-				s.Client.Store(client.Id, NewClient(nil, nil, nil, ""))
+				s.Client.Store(client.Id, NewClient(nil, nil, nil, "", nil))
 			}
 		case common.NEW_HOST:
 			h, err := c.GetHostInfo()
@@ -473,9 +713,11 @@ loop:
 				c.WriteAddFail()
 				break loop
 			}
-			h.Client = client
-			if h.Location == "" {
-				h.Location = "/"
+			if err := PrepareConfigHost(h, client); err != nil {
+				logs.Warn(err)
+				fail = true
+				c.WriteAddFail()
+				break loop
 			}
 			if !client.HasHost(h) {
 				if file.GetDb().IsHostExist(h) {
@@ -495,46 +737,14 @@ loop:
 				c.WriteAddFail()
 				break loop
 			} else {
-				ports := common.GetPorts(t.Ports)
-				targets := common.GetPorts(t.Target.TargetStr)
-				if len(ports) > 1 && (t.Mode == "tcp" || t.Mode == "udp") && (len(ports) != len(targets)) {
-					fail = true
-					c.WriteAddFail()
-					break loop
-				} else if t.Mode == "secret" || t.Mode == "p2p" {
-					ports = append(ports, 0)
-				}
-				if len(ports) == 0 {
+				tasks, err := SplitConfigTask(t, client)
+				if err != nil {
 					fail = true
 					c.WriteAddFail()
 					break loop
 				}
-				for i := 0; i < len(ports); i++ {
-					tl := new(file.Tunnel)
-					tl.Mode = t.Mode
-					tl.Port = ports[i]
-					tl.ServerIp = t.ServerIp
-					if len(ports) == 1 {
-						tl.Target = t.Target
-						tl.Remark = t.Remark
-					} else {
-						tl.Remark = t.Remark + "_" + strconv.Itoa(tl.Port)
-						tl.Target = new(file.Target)
-						if t.TargetAddr != "" {
-							tl.Target.TargetStr = t.TargetAddr + ":" + strconv.Itoa(targets[i])
-						} else {
-							tl.Target.TargetStr = strconv.Itoa(targets[i])
-						}
-					}
+				for _, tl := range tasks {
 					tl.Id = int(file.GetDb().JsonDb.GetTaskId())
-					tl.Status = true
-					tl.Flow = new(file.Flow)
-					tl.NoStore = true
-					tl.Client = client
-					tl.Password = t.Password
-					tl.LocalPath = t.LocalPath
-					tl.StripPre = t.StripPre
-					tl.MultiAccount = t.MultiAccount
 					if !client.HasTunnel(tl) {
 						if err := file.GetDb().NewTask(tl); err != nil {
 							logs.Notice("Add task error ", err.Error())
@@ -560,3 +770,78 @@ loop:
 	}
 	c.Close()
 }
+
+func (s *Bridge) NotifyProfile(id int) {
+	if v, ok := s.Client.Load(id); ok && v.(*Client).HasFeature(version.FEATURE_PROFILE) {
+		if err := v.(*Client).writeSignal(common.NEW_PROFILE); err != nil {
+			logs.Warn("notify the client %d of the profile error %s", id, err.Error())
+		}
+	}
+}
+
+// a host of the client must not serve a directory of the server
+func PrepareConfigHost(h *file.Host, client *file.Client) error {
+	if h.Action == "dir" || h.StaticDir != "" {
+		return errors.New(fmt.Sprintf("the directory action of the host %s from the client %d is not allowed", h.Host, client.Id))
+	}
+	h.Client = client
+	h.AuthUsers = file.HashAuthUsers(h.AuthUsers)
+	if h.Location == "" {
+		h.Location = "/"
+	}
+	return nil
+}
+
+// the tasks are not stored and have no id
+func SplitConfigTask(t *file.Tunnel, client *file.Client) ([]*file.Tunnel, error) {
+	ports := common.GetPorts(t.Ports)
+	targets := common.GetPorts(t.Target.TargetStr)
+	if len(ports) > 1 && (t.Mode == "tcp" || t.Mode == "udp") && (len(ports) != len(targets)) {
+		return nil, errors.New(fmt.Sprintf("the number of the ports and the targets of the task %s are not the same", t.Remark))
+	} else if t.Mode == "secret" || t.Mode == "p2p" {
+		ports = append(ports, 0)
+	}
+	if len(ports) == 0 {
+		return nil, errors.New(fmt.Sprintf("the port of the task %s is empty", t.Remark))
+	}
+	tasks := make([]*file.Tunnel, 0, len(ports))
+	for i := 0; i < len(ports); i++ {
+		tl := new(file.Tunnel)
+		tl.Mode = t.Mode
+		tl.Port = ports[i]
+		tl.ServerIp = t.ServerIp
+		if len(ports) == 1 {
+			tl.Target = t.Target
+			tl.Remark = t.Remark
+		} else {
+			tl.Remark = t.Remark + "_" + strconv.Itoa(tl.Port)
+			tl.Target = new(file.Target)
+			if t.TargetAddr != "" {
+				tl.Target.TargetStr = t.TargetAddr + ":" + strconv.Itoa(targets[i])
+			} else {
+				tl.Target.TargetStr = strconv.Itoa(targets[i])
+			}
+		}
+		tl.Status = true
+		tl.Flow = new(file.Flow)
+		tl.PortConfig = new(file.PortConfig)
+		tl.NoStore = true
+		tl.Client = client
+		tl.Password = t.Password
+		tl.LocalPath = t.LocalPath
+		tl.StripPre = t.StripPre
+		tl.MultiAccount = t.MultiAccount
+		tl.ProxyProtocol = t.ProxyProtocol
+		tl.ServerName = t.ServerName
+		tl.Alpn = t.Alpn
+		tl.CertFile = t.CertFile
+		tl.KeyFile = t.KeyFile
+		tl.ClientCa = t.ClientCa
+		tl.TargetTls = t.TargetTls
+		tl.TargetTlsServerName = t.TargetTlsServerName
+		tl.TargetTlsInsecure = t.TargetTlsInsecure
+		tl.TargetTlsCa = t.TargetTlsCa
+		tasks = append(tasks, tl)
+	}
+	return tasks, nil
+}
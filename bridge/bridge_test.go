@@ -0,0 +1,237 @@
+package bridge
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/nps_mux"
+	"ehang.io/nps/lib/version"
+)
+
+const testVkey = "bridge-test"
+
+func initTestDb(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "conf"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"clients.json", "tasks.json", "hosts.json", "global.json"} {
+		if err := os.WriteFile(filepath.Join(dir, "conf", name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	common.ConfPath = dir
+	client := file.NewClient(testVkey, false, false)
+	client.Id = 1
+	if err := file.GetDb().NewClient(client); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// the npc handshake, capability is nil for a client which does not negotiate
+func dialBridge(t *testing.T, s *Bridge, core, vs string, capability *version.Capability) (*conn.Conn, *version.Capability, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			s.cliProcess(conn.NewConn(c))
+		}
+	}()
+	raw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := conn.NewConn(raw)
+	c.Write([]byte(common.CONN_TEST))
+	c.WriteLenContent([]byte(core))
+	c.WriteLenContent([]byte(vs))
+	if _, err := c.GetShortContent(32); err != nil {
+		return nil, nil, err
+	}
+	c.Write([]byte(common.Getverifyval(testVkey)))
+	if b, err := c.GetShortContent(4); err != nil {
+		return nil, nil, err
+	} else if string(b) != common.VERIFY_SUCCESS {
+		return nil, nil, errors.New("the client is rejected")
+	}
+	var negotiated *version.Capability
+	if capability != nil {
+		c.SendInfo(capability, "")
+		if negotiated, err = c.GetCapability(); err != nil {
+			return nil, nil, err
+		}
+	}
+	c.Write([]byte(common.WORK_MAIN))
+	return c, negotiated, nil
+}
+
+func TestNegotiateCapability(t *testing.T) {
+	initTestDb(t)
+	s := NewTunnel(0, "tcp", false, sync.Map{}, 60)
+	go func() {
+		for {
+			select {
+			case <-s.CloseClient:
+			case <-s.ApplyProfile:
+			}
+		}
+	}()
+	loadClient := func() *Client {
+		for i := 0; i < 100; i++ {
+			if v, ok := s.Client.Load(1); ok && v.(*Client).signal != nil {
+				return v.(*Client)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatal("the client is not connected")
+		return nil
+	}
+
+	// 0.26.0 does not negotiate, so no feature is used
+	c, _, err := dialBridge(t, s, version.LEGACY_VERSION, "0.26.0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := loadClient()
+	if client.Version != "0.26.0" || len(client.Capability.Features) != 0 {
+		t.Fatalf("the legacy client is connected with %+v", client.Capability)
+	}
+	link := conn.NewLink(common.CONN_TCP, "127.0.0.1:80", false, false, "", false, conn.LinkTargetTls(&conn.TargetTls{}))
+	if err := checkLinkFeature(client, link); err == nil {
+		t.Fatal("the tls to the target is sent to the legacy client")
+	}
+	if err := checkLinkFeature(client, conn.NewLink(common.CONN_TCP, "127.0.0.1:80", false, false, "", false, conn.LinkProxyProtocol(1))); err == nil {
+		t.Fatal("the proxy protocol is sent to the legacy client")
+	}
+	if err := checkLinkFeature(client, conn.NewLink(common.CONN_TCP, "127.0.0.1:80", false, false, "", false)); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	s.DelClient(1)
+
+	peer := &version.Capability{Protocol: version.PROTOCOL, Version: "0.27.1", Features: []string{version.FEATURE_TARGET_TLS, "unknown"}}
+	c, negotiated, err := dialBridge(t, s, version.GetVersion(), "0.27.1", peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if negotiated.Error != "" || len(negotiated.Features) != 1 || negotiated.Features[0] != version.FEATURE_TARGET_TLS {
+		t.Fatalf("the negotiated capability is %+v", negotiated)
+	}
+	client = loadClient()
+	if !client.HasFeature(version.FEATURE_TARGET_TLS) || client.HasFeature(version.FEATURE_DIAL_RESULT) || checkLinkFeature(client, link) != nil {
+		t.Fatalf("the client is connected with %+v", client.Capability)
+	}
+	c.Close()
+	s.DelClient(1)
+
+	// another protocol is told why
+	peer.Protocol = version.PROTOCOL + 1
+	if _, negotiated, err = dialBridge(t, s, version.GetVersion(), "0.28.0", peer); err != nil || negotiated.Error == "" {
+		t.Fatalf("the client of the other protocol is accepted, %+v %v", negotiated, err)
+	}
+
+	// the legacy clients can be rejected
+	defer func(allow bool) { AllowLegacyClient = allow }(AllowLegacyClient)
+	AllowLegacyClient = false
+	if _, _, err = dialBridge(t, s, version.LEGACY_VERSION, "0.26.0", nil); err == nil {
+		t.Fatal("the legacy client is accepted")
+	}
+}
+
+func TestCapability(t *testing.T) {
+	c := version.NewCapability()
+	if n := c.Negotiate(version.NewLegacyCapability("0.26.0")); len(n.Features) != 0 || n.Version != version.VERSION {
+		t.Fatalf("the features with the legacy peer are %v", n.Features)
+	}
+	if n := c.Negotiate(version.NewCapability()); len(n.Features) != len(c.Features) {
+		t.Fatalf("the features with the same version are %v", n.Features)
+	}
+	var nilCapability *version.Capability
+	if nilCapability.Has(version.FEATURE_COMMAND) {
+		t.Fatal("the nil capability has the feature")
+	}
+}
+
+// the peer accepts the streams opened by the returned mux
+func newMuxPair(t *testing.T) *nps_mux.Mux {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := nps_mux.NewMux(<-accepted, "tcp", 60)
+	t.Cleanup(func() { peer.Close() })
+	go func() {
+		for {
+			if _, err := peer.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	m := nps_mux.NewMux(c, "tcp", 60)
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func TestSpreadTunnel(t *testing.T) {
+	client := NewClient(newMuxPair(t), nil, nil, "", nil)
+	if err := client.addTunnel(newMuxPair(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.addTunnel(newMuxPair(t)); err != nil {
+		t.Fatal(err)
+	}
+	// the new streams are spread across the data connections
+	for i := 0; i < 9; i++ {
+		if _, err := client.getTunnel().NewConn(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, tunnel := range client.tunnels {
+		if tunnel.NumConn() == 0 {
+			t.Fatalf("no stream is opened on the data connection %d", i)
+		}
+	}
+
+	closed := client.tunnels[0]
+	closed.Close()
+	for i := 0; i < 6; i++ {
+		if tunnel := client.getTunnel(); tunnel == closed {
+			t.Fatal("the closed data connection is used")
+		}
+	}
+	if alive, n := client.checkTunnel(); alive != 2 || n != 1 {
+		t.Fatalf("the alive data connections are %d, the closed ones are %d", alive, n)
+	}
+
+	for len(client.tunnels) < maxTunnelNum {
+		client.tunnels = append(client.tunnels, client.tunnels[0])
+	}
+	if err := client.addTunnel(newMuxPair(t)); err == nil {
+		t.Fatal("the data connection over the limit is added")
+	}
+	client.closeTunnel()
+	if client.getTunnel() != nil {
+		t.Fatal("the data connection is used after the client is closed")
+	}
+}
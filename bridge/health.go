@@ -0,0 +1,187 @@
+package bridge
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/version"
+	"github.com/astaxie/beego/logs"
+)
+
+// 服务端健康检查，探测经客户端发往目标
+func (s *Bridge) healthCheck() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
+				v := value.(*file.Tunnel)
+				if v.Status && v.Mode == "tcp" && v.Client != nil && v.Target != nil && isCheckTime(&v.Health, now) {
+					s.startCheckTargets(v.Client.Id, &v.Health, v.Target)
+				}
+				return true
+			})
+			file.GetDb().JsonDb.Hosts.Range(func(key, value interface{}) bool {
+				v := value.(*file.Host)
+				if !v.IsClose && v.Client != nil && v.Target != nil && isCheckTime(&v.Health, now) {
+					s.startCheckTargets(v.Client.Id, &v.Health, v.Target)
+				}
+				return true
+			})
+		}
+	}
+}
+
+// it also moves the next check time forward
+func isCheckTime(h *file.Health, now time.Time) bool {
+	if !h.IsHealthCheck() {
+		return false
+	}
+	h.Lock()
+	defer h.Unlock()
+	if h.HealthNextTime.After(now) {
+		return false
+	}
+	h.HealthNextTime = now.Add(time.Duration(h.HealthCheckInterval) * time.Second)
+	return true
+}
+
+// the check is skipped if the previous one is still running
+func (s *Bridge) startCheckTargets(clientId int, h *file.Health, t *file.Target) {
+	if _, ok := s.healthChecking.LoadOrStore(h, true); ok {
+		return
+	}
+	go func() {
+		defer s.healthChecking.Delete(h)
+		s.checkTargets(clientId, h, t)
+	}()
+}
+
+func (s *Bridge) checkTargets(clientId int, h *file.Health, t *file.Target) {
+	for _, target := range t.GetTargets() {
+		err := s.probe(clientId, h, target, t.LocalProxy)
+		h.Lock()
+		if h.HealthMap == nil {
+			h.HealthMap = make(map[string]int)
+		}
+		if err != nil {
+			h.HealthMap[target] += 1
+		} else {
+			h.HealthMap[target] = 0
+		}
+		fail := h.HealthMap[target]
+		h.Unlock()
+		if err == nil {
+			if t.SetHealth(h, target, true) {
+				logs.Info("health check of target %s of client %d is ok, recover it", target, clientId)
+			}
+		} else if fail >= h.HealthMaxFail {
+			if t.SetHealth(h, target, false) {
+				logs.Warn("health check of target %s of client %d failed %d times, remove it, %s", target, clientId, fail, err.Error())
+			}
+		}
+	}
+}
+
+func (s *Bridge) probe(clientId int, h *file.Health, target string, localProxy bool) (err error) {
+	timeout := time.Duration(h.HealthCheckTimeout) * time.Second
+	var c net.Conn
+	dialed := true
+	if localProxy {
+		c, err = net.DialTimeout(common.CONN_TCP, target, timeout)
+	} else {
+		c, dialed, err = s.newProbeConn(clientId, conn.NewLink(common.CONN_TCP, target, false, false, "", false, conn.LinkTimeout(timeout)))
+	}
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	// one more second for the client to dial
+	c.SetDeadline(time.Now().Add(timeout + time.Second))
+	if h.HealthCheckType == "http" {
+		var r *http.Request
+		if r, err = http.NewRequest("GET", "http://"+target+h.HttpHealthUrl, nil); err != nil {
+			return
+		}
+		r.Close = true
+		if err = r.Write(c); err != nil {
+			return
+		}
+		var resp *http.Response
+		if resp, err = http.ReadResponse(bufio.NewReader(c), r); err != nil {
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return errors.New("status code is not match")
+		}
+		return
+	}
+	if dialed {
+		return
+	}
+	// the old client does not reply the result of the dial, it closes the link if the target can not be connected
+	if _, err = c.Read(make([]byte, 1)); err != nil {
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return nil
+		}
+		return errors.New("the target refuse to connect")
+	}
+	return
+}
+
+// not a visitor, so the ip verification of SendLinkInfo is skipped.
+// dialed reports whether the client confirmed the dial
+func (s *Bridge) newProbeConn(clientId int, link *conn.Link) (net.Conn, bool, error) {
+	v, ok := s.Client.Load(clientId)
+	if !ok {
+		return nil, false, errors.New(fmt.Sprintf("the client %d is not connect", clientId))
+	}
+	tunnel := v.(*Client).getTunnel()
+	if tunnel == nil {
+		return nil, false, errors.New("the client connect error")
+	}
+	target, err := tunnel.NewConn()
+	if err != nil {
+		return nil, false, err
+	}
+	link.DialResult = v.(*Client).HasFeature(version.FEATURE_DIAL_RESULT)
+	if _, err = conn.NewConn(target).SendInfo(link, ""); err != nil {
+		target.Close()
+		return nil, false, err
+	}
+	if link.DialResult {
+		if err = readDialResult(target, link); err != nil {
+			target.Close()
+			return nil, false, err
+		}
+	}
+	return target, link.DialResult, nil
+}
+
+// health info sent by the client
+func setTargetHealth(clientId int, target string, online bool) {
+	file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
+		v := value.(*file.Tunnel)
+		if v.Client != nil && v.Client.Id == clientId && v.Target != nil {
+			v.Target.SetClientHealth(&v.Health, target, online)
+		}
+		return true
+	})
+	file.GetDb().JsonDb.Hosts.Range(func(key, value interface{}) bool {
+		v := value.(*file.Host)
+		if v.Client != nil && v.Client.Id == clientId && v.Target != nil {
+			v.Target.SetClientHealth(&v.Health, target, online)
+		}
+		return true
+	})
+}
@@ -0,0 +1,53 @@
+package bridge
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/file"
+)
+
+func TestCheckTargets(t *testing.T) {
+	// the target accepts the connection but never responds
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	s := new(Bridge)
+	target := &file.Target{TargetStr: l.Addr().String(), LocalProxy: true}
+
+	// the tcp check is passed once the target is connected
+	h := &file.Health{HealthCheckTimeout: 1, HealthMaxFail: 1, HealthCheckType: "tcp"}
+	start := time.Now()
+	s.checkTargets(0, h, target)
+	if h.HealthMap[target.TargetStr] != 0 || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("the tcp check fails %d times in %s", h.HealthMap[target.TargetStr], time.Since(start))
+	}
+
+	// the http check of the stalled target fails, the next one is skipped while it is running
+	h = &file.Health{HealthCheckTimeout: 1, HealthMaxFail: 1, HealthCheckType: "http", HttpHealthUrl: "/"}
+	s.startCheckTargets(0, h, target)
+	s.startCheckTargets(0, h, target)
+	for i := 0; i < 50; i++ {
+		if _, ok := s.healthChecking.Load(h); !ok {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	h.RLock()
+	defer h.RUnlock()
+	if h.HealthMap[target.TargetStr] != 1 || len(h.HealthRemoveArr) != 1 {
+		t.Fatalf("the stalled target fails %d times, removed %v", h.HealthMap[target.TargetStr], h.HealthRemoveArr)
+	}
+}
@@ -3,7 +3,11 @@ package client
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"ehang.io/nps/lib/nps_mux"
+	"errors"
+	"io"
 	"net"
 	"net/http"
 	"strconv"
@@ -18,32 +22,41 @@ import (
 	"ehang.io/nps/lib/config"
 	"ehang.io/nps/lib/conn"
 	"ehang.io/nps/lib/crypt"
+	"ehang.io/nps/lib/proxyproto"
 )
 
 type TRPClient struct {
 	svrAddr        string
+	servers        *ServerList
 	bridgeConnType string
 	proxyUrl       string
 	vKey           string
 	p2pAddr        map[string]string
-	tunnel         *nps_mux.Mux
+	tunnels        []*nps_mux.Mux
+	muxNum         int // MuxNum unless the profile sets it
+	tunnelLock     sync.Mutex
 	signal         *conn.Conn
 	ticker         *time.Ticker
 	cnf            *config.Config
 	disconnectTime int
 	once           sync.Once
+	closed         bool
 }
 
 // new client
+// svraddr may list several servers, see ServerMode
 func NewRPClient(svraddr string, vKey string, bridgeConnType string, proxyUrl string, cnf *config.Config, disconnectTime int) *TRPClient {
+	servers := GetServerList(svraddr)
 	return &TRPClient{
-		svrAddr:        svraddr,
+		svrAddr:        servers.Get(),
+		servers:        servers,
 		p2pAddr:        make(map[string]string, 0),
 		vKey:           vKey,
 		bridgeConnType: bridgeConnType,
 		proxyUrl:       proxyUrl,
 		cnf:            cnf,
 		disconnectTime: disconnectTime,
+		muxNum:         MuxNum,
 		once:           sync.Once{},
 	}
 }
@@ -51,6 +64,9 @@ func NewRPClient(svraddr string, vKey string, bridgeConnType string, proxyUrl st
 var NowStatus int
 var CloseClient bool
 
+// the data connections with the server by default, the server spreads the streams across them
+var MuxNum = 1
+
 // start
 func (s *TRPClient) Start() {
 	CloseClient = false
@@ -62,6 +78,10 @@ retry:
 	c, err := NewConn(s.bridgeConnType, s.vKey, s.svrAddr, common.WORK_MAIN, s.proxyUrl)
 	if err != nil {
 		logs.Error("The connection server failed and will be reconnected in five seconds, error", err.Error())
+		//register the config file to the next server
+		if s.switchServer() && s.cnf != nil {
+			return
+		}
 		time.Sleep(time.Second * 5)
 		goto retry
 	}
@@ -73,9 +93,15 @@ retry:
 	logs.Info("Successful connection with server %s", s.svrAddr)
 	//monitor the connection
 	go s.ping()
+	go s.checkPrimary()
 	s.signal = c
-	//start a channel connection
-	go s.newChan()
+	num := s.getMuxNum()
+	if num < 1 {
+		num = 1
+	}
+	for i := 0; i < num; i++ {
+		go s.newChan()
+	}
 	//start health check if the it's open
 	if s.cnf != nil && len(s.cnf.Healths) > 0 {
 		go heathCheck(s.cnf.Healths, s.signal)
@@ -83,6 +109,9 @@ retry:
 	NowStatus = 1
 	//msg connection, eg udp
 	s.handleMain()
+	if ServerMode == SERVER_MODE_ROUND {
+		s.servers.Next(s.svrAddr)
+	}
 }
 
 // handle main connection
@@ -94,6 +123,8 @@ func (s *TRPClient) handleMain() {
 			break
 		}
 		switch flags {
+		case common.NEW_PROFILE:
+			go s.pullProfile()
 		case common.NEW_UDP_CONN:
 			//read server udp addr and password
 			if lAddr, err := s.signal.GetShortLenContent(); err != nil {
@@ -152,23 +183,98 @@ func (s *TRPClient) newUdpConn(localAddr, rAddr string, md5Password string) {
 	}
 }
 
-// pmux tunnel
+// pmux tunnel, reconnected if it is lost while the others are alive
 func (s *TRPClient) newChan() {
-	tunnel, err := NewConn(s.bridgeConnType, s.vKey, s.svrAddr, common.WORK_CHAN, s.proxyUrl)
-	if err != nil {
-		logs.Error("connect to ", s.svrAddr, "error:", err)
-		return
-	}
-	s.tunnel = nps_mux.NewMux(tunnel.Conn, s.bridgeConnType, s.disconnectTime)
+	var reconnect bool
 	for {
-		src, err := s.tunnel.Accept()
+		tunnel, err := NewConn(s.bridgeConnType, s.vKey, s.svrAddr, common.WORK_CHAN, s.proxyUrl)
 		if err != nil {
-			logs.Warn(err)
+			logs.Error("connect to ", s.svrAddr, "error:", err)
+			if !reconnect || s.isClosed() || s.tunnelNum() == 0 {
+				return
+			}
+			time.Sleep(time.Second * 5)
+			continue
+		}
+		muxConn := nps_mux.NewMux(tunnel.Conn, s.bridgeConnType, s.disconnectTime)
+		if !s.addTunnel(muxConn) {
+			muxConn.Close()
+			return
+		}
+		for {
+			src, err := muxConn.Accept()
+			if err != nil {
+				logs.Warn(err)
+				break
+			}
+			go s.handleChan(src)
+		}
+		num := s.delTunnel(muxConn)
+		if num == 0 || s.isClosed() {
 			s.Close()
+			return
+		}
+		//closed since mux_num of the profile is decreased
+		if num >= s.getMuxNum() {
+			return
+		}
+		logs.Warn("a data connection with the server is lost, reconnect it")
+		reconnect = true
+	}
+}
+
+// false if the client is closed
+func (s *TRPClient) addTunnel(t *nps_mux.Mux) bool {
+	s.tunnelLock.Lock()
+	defer s.tunnelLock.Unlock()
+	if s.closed {
+		return false
+	}
+	s.tunnels = append(s.tunnels, t)
+	return true
+}
+
+// returns the number of the others
+func (s *TRPClient) delTunnel(t *nps_mux.Mux) int {
+	s.tunnelLock.Lock()
+	defer s.tunnelLock.Unlock()
+	for i, v := range s.tunnels {
+		if v == t {
+			s.tunnels = append(s.tunnels[:i], s.tunnels[i+1:]...)
 			break
 		}
-		go s.handleChan(src)
 	}
+	return len(s.tunnels)
+}
+
+// the extra connections are closed, the others are kept
+func (s *TRPClient) setMuxNum(num int) {
+	s.tunnelLock.Lock()
+	s.muxNum = num
+	n := len(s.tunnels)
+	var extra []*nps_mux.Mux
+	if n > num {
+		extra = append(extra, s.tunnels[num:]...)
+	}
+	s.tunnelLock.Unlock()
+	for _, t := range extra {
+		t.Close()
+	}
+	for i := n; i < num; i++ {
+		go s.newChan()
+	}
+}
+
+func (s *TRPClient) getMuxNum() int {
+	s.tunnelLock.Lock()
+	defer s.tunnelLock.Unlock()
+	return s.muxNum
+}
+
+func (s *TRPClient) tunnelNum() int {
+	s.tunnelLock.Lock()
+	defer s.tunnelLock.Unlock()
+	return len(s.tunnels)
 }
 
 func (s *TRPClient) handleChan(src net.Conn) {
@@ -178,15 +284,25 @@ func (s *TRPClient) handleChan(src net.Conn) {
 		logs.Error("get connection info from server error ", err)
 		return
 	}
+	if lk.ConnType == common.CONN_CMD {
+		s.handleCommand(src)
+		return
+	}
 	//host for target processing
 	lk.Host = common.FormatAddress(lk.Host)
 	//if Conn type is http, read the request and log
 	if lk.ConnType == "http" {
-		if targetConn, err := net.DialTimeout(common.CONN_TCP, lk.Host, lk.Option.Timeout); err != nil {
+		if targetConn, err := dialTarget(common.CONN_TCP, lk); err != nil {
 			logs.Warn("connect to %s error %s", lk.Host, err.Error())
+			writeDialResult(src, lk, false)
 			src.Close()
+		} else if err := writeDialResult(src, lk, true); err != nil {
+			targetConn.Close()
+			src.Close()
+		} else if srcConn, err := s.getLinkConn(src, lk); err != nil {
+			logs.Warn("the tls handshake of the link error %s", err.Error())
+			targetConn.Close()
 		} else {
-			srcConn := conn.GetConn(src, lk.Crypt, lk.Compress, nil, false)
 			go func() {
 				common.CopyBuffer(srcConn, targetConn)
 				srcConn.Close()
@@ -211,19 +327,95 @@ func (s *TRPClient) handleChan(src net.Conn) {
 	}
 	if lk.ConnType == "udp5" {
 		logs.Trace("new %s connection with the goal of %s, remote address:%s", lk.ConnType, lk.Host, lk.RemoteAddr)
-		s.handleUdp(src)
+		s.handleUdp(src, lk)
 	}
 	//connect to target if conn type is tcp or udp
-	if targetConn, err := net.DialTimeout(lk.ConnType, lk.Host, lk.Option.Timeout); err != nil {
+	if targetConn, err := dialTarget(lk.ConnType, lk); err != nil {
 		logs.Warn("connect to %s error %s", lk.Host, err.Error())
+		writeDialResult(src, lk, false)
+		src.Close()
+	} else if err := writeDialResult(src, lk, true); err != nil {
+		targetConn.Close()
 		src.Close()
 	} else {
 		logs.Trace("new %s connection with the goal of %s, remote address:%s", lk.ConnType, lk.Host, lk.RemoteAddr)
-		conn.CopyWaitGroup(src, targetConn, lk.Crypt, lk.Compress, nil, nil, false, nil, nil)
+		if !lk.Crypt {
+			conn.CopyWaitGroup(src, targetConn, false, lk.Compress, nil, nil, false, nil, nil)
+		} else if c, err := crypt.NewTlsClientConn(src, common.GetIpByAddr(s.svrAddr)); err != nil {
+			logs.Warn("the tls handshake of the link error %s", err.Error())
+			targetConn.Close()
+		} else {
+			conn.CopyWaitGroup(c, targetConn, false, false, nil, nil, false, nil, nil)
+		}
+	}
+}
+
+// the mux does not know the server, so the tls of the link is verified by the name of this session's server
+func (s *TRPClient) getLinkConn(src net.Conn, lk *conn.Link) (io.ReadWriteCloser, error) {
+	if lk.Crypt {
+		return crypt.NewTlsClientConn(src, common.GetIpByAddr(s.svrAddr))
 	}
+	return conn.GetConn(src, false, lk.Compress, nil, false)
 }
 
-func (s *TRPClient) handleUdp(serverConn net.Conn) {
+func writeDialResult(src net.Conn, lk *conn.Link, ok bool) error {
+	if !lk.DialResult {
+		return nil
+	}
+	flag := common.DIAL_SUCCESS
+	if !ok {
+		flag = common.DIAL_FAIL
+	}
+	_, err := src.Write([]byte(flag))
+	return err
+}
+
+func dialTarget(network string, lk *conn.Link) (net.Conn, error) {
+	targetConn, err := net.DialTimeout(network, lk.Host, lk.Option.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := targetConn
+	if lk.Option.ProxyProtocol != 0 {
+		if c, err = proxyproto.NewTargetConn(targetConn, lk.Option.ProxyProtocol, lk.RemoteAddr); err != nil {
+			targetConn.Close()
+			return nil, err
+		}
+	}
+	// the proxy protocol header goes before the tls handshake
+	if lk.Option.Tls != nil && network == common.CONN_TCP {
+		if c, err = newTargetTlsConn(c, lk); err != nil {
+			targetConn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func newTargetTlsConn(c net.Conn, lk *conn.Link) (net.Conn, error) {
+	config := &tls.Config{
+		ServerName:         lk.Option.Tls.ServerName,
+		InsecureSkipVerify: lk.Option.Tls.Insecure,
+	}
+	if config.ServerName == "" {
+		config.ServerName = common.GetIpByAddr(lk.Host)
+	}
+	if lk.Option.Tls.Ca != "" {
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM([]byte(lk.Option.Tls.Ca)) {
+			return nil, errors.New("the ca of the target is invalid")
+		}
+	}
+	tlsConn := tls.Client(c, config)
+	tlsConn.SetDeadline(time.Now().Add(lk.Option.Timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+func (s *TRPClient) handleUdp(serverConn net.Conn, lk *conn.Link) {
 	// bind a local udp port
 	local, err := net.ListenUDP("udp", nil)
 	defer serverConn.Close()
@@ -274,7 +466,15 @@ func (s *TRPClient) handleUdp(serverConn net.Conn) {
 			logs.Error("build remote addr err", err.Error())
 			continue // drop silently
 		}
-		_, err = local.WriteTo(udpData.Data, raddr)
+		data := udpData.Data
+		if lk.Option.ProxyProtocol > 0 {
+			// udp needs version 2
+			ip, port := proxyproto.ParseAddr(lk.RemoteAddr)
+			if header, err := proxyproto.BuildHeader(2, common.CONN_UDP, &net.UDPAddr{IP: ip, Port: port}, raddr); err == nil {
+				data = append(header, data...)
+			}
+		}
+		_, err = local.WriteTo(data, raddr)
 		if err != nil {
 			logs.Error("write data to remote ", raddr.String(), "error", err.Error())
 			return
@@ -289,7 +489,7 @@ loop:
 	for {
 		select {
 		case <-s.ticker.C:
-			if s.tunnel != nil && s.tunnel.IsClose {
+			if s.isTunnelClose() {
 				s.Close()
 				break loop
 			}
@@ -297,6 +497,23 @@ loop:
 	}
 }
 
+func (s *TRPClient) isTunnelClose() bool {
+	s.tunnelLock.Lock()
+	defer s.tunnelLock.Unlock()
+	for _, t := range s.tunnels {
+		if !t.IsClose {
+			return false
+		}
+	}
+	return len(s.tunnels) > 0
+}
+
+func (s *TRPClient) isClosed() bool {
+	s.tunnelLock.Lock()
+	defer s.tunnelLock.Unlock()
+	return s.closed
+}
+
 func (s *TRPClient) Close() {
 	s.once.Do(s.closing)
 }
@@ -304,9 +521,13 @@ func (s *TRPClient) Close() {
 func (s *TRPClient) closing() {
 	CloseClient = true
 	NowStatus = 0
-	if s.tunnel != nil {
-		_ = s.tunnel.Close()
+	s.tunnelLock.Lock()
+	s.closed = true
+	for _, t := range s.tunnels {
+		_ = t.Close()
 	}
+	s.tunnels = nil
+	s.tunnelLock.Unlock()
 	if s.signal != nil {
 		_ = s.signal.Close()
 	}
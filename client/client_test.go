@@ -0,0 +1,112 @@
+package client
+
+import (
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/crypt"
+	"ehang.io/nps/lib/nps_mux"
+)
+
+func TestDialTargetTls(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer target.Close()
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: target.Certificate().Raw}))
+	addr := target.Listener.Addr().String()
+
+	for _, v := range []struct {
+		tls *conn.TargetTls
+		ok  bool
+	}{
+		// the certificate of httptest is issued to example.com and 127.0.0.1
+		{&conn.TargetTls{Ca: ca}, true},
+		{&conn.TargetTls{Ca: ca, ServerName: "example.com"}, true},
+		{&conn.TargetTls{Ca: ca, ServerName: "other.test"}, false},
+		{&conn.TargetTls{}, false},
+		{&conn.TargetTls{Insecure: true}, true},
+		{&conn.TargetTls{Ca: "invalid"}, false},
+	} {
+		lk := conn.NewLink(common.CONN_TCP, addr, false, false, "127.0.0.1:1234", false, conn.LinkTargetTls(v.tls))
+		c, err := dialTarget(common.CONN_TCP, lk)
+		if (err == nil) != v.ok {
+			t.Fatalf("dial the target with %+v, error %v", v.tls, err)
+		}
+		if err != nil {
+			continue
+		}
+		io.WriteString(c, "GET / HTTP/1.0\r\nHost: example.com\r\n\r\n")
+		b, _ := io.ReadAll(c)
+		c.Close()
+		if len(b) < 2 || string(b[len(b)-2:]) != "ok" {
+			t.Fatalf("the response of the target is %q", b)
+		}
+	}
+}
+
+func TestSwitchServer(t *testing.T) {
+	s := NewRPClient("127.0.0.1:1, 127.0.0.1:2,,127.0.0.1:3", "vkey", "tcp", "", nil, 0)
+	if s.servers.Len() != 3 || s.svrAddr != "127.0.0.1:1" {
+		t.Fatalf("the servers are %v, the first one is %s", s.servers.addrs, s.svrAddr)
+	}
+	for _, want := range []string{"127.0.0.1:2", "127.0.0.1:3", "127.0.0.1:1"} {
+		if !s.switchServer() || s.svrAddr != want {
+			t.Fatalf("switch to the server %s, want %s", s.svrAddr, want)
+		}
+	}
+	// shared by the reconnections, one failure switches only once
+	servers := GetServerList("127.0.0.1:1, 127.0.0.1:2,,127.0.0.1:3")
+	if servers != s.servers {
+		t.Fatal("the server list is created again")
+	}
+	servers.Next("127.0.0.1:1")
+	servers.Next("127.0.0.1:1")
+	if servers.Get() != "127.0.0.1:2" {
+		t.Fatalf("the server is %s after the failure", servers.Get())
+	}
+	servers.Reset()
+	if servers.Get() != servers.Primary() {
+		t.Fatal("the server is not returned to the primary one")
+	}
+	if NewRPClient("127.0.0.1:4", "vkey", "tcp", "", nil, 0).switchServer() {
+		t.Fatal("the only server is switched")
+	}
+}
+
+func TestSetMuxNum(t *testing.T) {
+	defer func(n int) { MuxNum = n }(MuxNum)
+	MuxNum = 2
+	a := NewRPClient("127.0.0.1:1", "vkey", "tcp", "", nil, 0)
+	b := NewRPClient("127.0.0.1:2", "vkey", "tcp", "", nil, 0)
+	// the sessions to different servers do not share the number
+	a.tunnels = make([]*nps_mux.Mux, 3)
+	a.setMuxNum(3)
+	if a.getMuxNum() != 3 || b.getMuxNum() != 2 || MuxNum != 2 {
+		t.Fatalf("the numbers are %d and %d, the default is %d", a.getMuxNum(), b.getMuxNum(), MuxNum)
+	}
+}
+
+func TestServerTlsConfig(t *testing.T) {
+	defer crypt.SetClientTlsConfig(crypt.GetClientTlsConfig())
+	if err := InitTlsConfig("", "", &crypt.VerifyOption{Verify: true}); err != nil {
+		t.Fatal(err)
+	}
+	// each server of the failover is verified by its own name
+	for _, server := range []string{"a.test:8024", "b.test:8024"} {
+		if name := getServerTlsConfig(server).ServerName; name != common.GetIpByAddr(server) {
+			t.Fatalf("the server name of %s is %s", server, name)
+		}
+	}
+	if err := InitTlsConfig("", "", &crypt.VerifyOption{Verify: true, ServerName: "nps.test"}); err != nil {
+		t.Fatal(err)
+	}
+	if name := getServerTlsConfig("b.test:8024").ServerName; name != "nps.test" {
+		t.Fatalf("the configured server name is replaced by %s", name)
+	}
+}
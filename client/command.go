@@ -0,0 +1,308 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/config"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/version"
+	"github.com/astaxie/beego/logs"
+)
+
+// comma separated, or all
+var DisableCommand string
+
+// off unless enabled on the client, the profile can not turn them on
+// since they replace the config file or fetch any url
+var EnableCommand string
+
+const (
+	commandConfigWrite = "config_write"
+	commandTestHttp    = "test_http"
+)
+
+// empty unless started from a config file, reload and config need it
+var configPath string
+
+const maxStackSize = 1 << 20
+
+type commandReply struct {
+	data  interface{}
+	after func() // run after the result is sent
+	err   error
+}
+
+type diagnostics struct {
+	Version     string
+	CoreVersion string
+	Os          string
+	Arch        string
+	Server      string
+	ConfigFile  string `json:",omitempty"`
+	Goroutines  int
+	Tunnels     []tunnelStat
+	Interfaces  []interfaceStat
+	Stack       string `json:",omitempty"`
+}
+
+type tunnelStat struct {
+	NumConn   int
+	Latency   float64 // seconds
+	Bandwidth float64 // bytes per second
+	Closed    bool
+}
+
+type interfaceStat struct {
+	Name  string
+	Mtu   int
+	Flags string
+	Addrs []string
+}
+
+type testResult struct {
+	Target     string
+	Latency    float64 // milliseconds
+	LocalAddr  string  `json:",omitempty"`
+	StatusCode int     `json:",omitempty"`
+}
+
+func (s *TRPClient) handleCommand(src net.Conn) {
+	defer src.Close()
+	c := conn.NewConn(src)
+	cmd, err := c.GetCommand()
+	if err != nil {
+		logs.Warn("get the command from the server error %s", err.Error())
+		return
+	}
+	logs.Info("receive the command %s from the server", cmd.Name)
+	ch := make(chan *commandReply, 1)
+	go func() {
+		ch <- s.runCommand(cmd)
+	}()
+	var r *commandReply
+	select {
+	case r = <-ch:
+	case <-time.After(time.Duration(cmd.Timeout) * time.Second):
+		r = &commandReply{err: errors.New(fmt.Sprintf("the command %s is timeout", cmd.Name))}
+	}
+	result := new(conn.CommandResult)
+	if r.err != nil {
+		logs.Warn("the command %s error %s", cmd.Name, r.err.Error())
+		result.Error = r.err.Error()
+	} else if result.Data, err = json.Marshal(r.data); err != nil {
+		result.Error = err.Error()
+	}
+	if _, err = c.SendInfo(result, ""); err != nil {
+		logs.Warn("send the result of the command %s error %s", cmd.Name, err.Error())
+	}
+	if r.after != nil && r.err == nil {
+		time.Sleep(time.Second)
+		r.after()
+	}
+}
+
+func (s *TRPClient) runCommand(cmd *conn.Command) *commandReply {
+	if isCommandDisabled(cmd.Name) {
+		return &commandReply{err: errors.New(fmt.Sprintf("the command %s is disabled by the client", cmd.Name))}
+	}
+	switch cmd.Name {
+	case conn.COMMAND_RELOAD:
+		if configPath == "" {
+			return &commandReply{err: errors.New("the client is not started by the config file")}
+		}
+		if _, err := loadConfig(configPath); err != nil {
+			return &commandReply{err: err}
+		}
+		return &commandReply{data: "the config file " + configPath + " is reloaded", after: reloadConfig}
+	case conn.COMMAND_RESTART:
+		if common.IsWindows() {
+			return &commandReply{err: errors.New("the restart is not supported on windows, please restart the service")}
+		}
+		return &commandReply{data: "the client is restarted", after: restartProcess}
+	case conn.COMMAND_DIAGNOSE:
+		return &commandReply{data: s.diagnose(cmd.Arg("stack") == "true")}
+	case conn.COMMAND_TEST:
+		if cmd.Arg("type") == "http" && !inCommands(EnableCommand, commandTestHttp) {
+			return &commandReply{err: errors.New("the http test is not enabled by the client, add test_http to the enable_command")}
+		}
+		data, err := testTarget(cmd.Arg("type"), cmd.Arg("target"), time.Duration(cmd.Timeout)*time.Second)
+		return &commandReply{data: data, err: err}
+	case conn.COMMAND_CONFIG:
+		if configPath == "" {
+			return &commandReply{err: errors.New("the client is not started by the config file")}
+		}
+		if cmd.Arg("content") == "" {
+			b, err := ioutil.ReadFile(configPath)
+			return &commandReply{data: string(b), err: err}
+		}
+		if !inCommands(EnableCommand, commandConfigWrite) {
+			return &commandReply{err: errors.New("the replacement of the config file is not enabled by the client, add config_write to the enable_command")}
+		}
+		if err := replaceConfig(cmd.Arg("content")); err != nil {
+			return &commandReply{err: err}
+		}
+		return &commandReply{data: "the config file " + configPath + " is replaced and reloaded", after: reloadConfig}
+	}
+	return &commandReply{err: errors.New(fmt.Sprintf("the command %s is not supported by the client", cmd.Name))}
+}
+
+func isCommandDisabled(name string) bool {
+	return inCommands(DisableCommand, name) || isProfileCommandDisabled(name)
+}
+
+func inCommands(commands, name string) bool {
+	for _, v := range strings.Split(commands, ",") {
+		if v = strings.TrimSpace(v); v == "all" || v == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *TRPClient) diagnose(stack bool) *diagnostics {
+	d := &diagnostics{
+		Version:     version.VERSION,
+		CoreVersion: version.GetVersion(),
+		Os:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+		Server:      s.svrAddr,
+		ConfigFile:  configPath,
+		Goroutines:  runtime.NumGoroutine(),
+	}
+	s.tunnelLock.Lock()
+	for _, t := range s.tunnels {
+		d.Tunnels = append(d.Tunnels, tunnelStat{NumConn: t.NumConn(), Latency: t.Latency(), Bandwidth: t.Bandwidth(), Closed: t.IsClose})
+	}
+	s.tunnelLock.Unlock()
+	if interfaces, err := net.Interfaces(); err == nil {
+		for _, v := range interfaces {
+			i := interfaceStat{Name: v.Name, Mtu: v.MTU, Flags: v.Flags.String()}
+			if addrs, err := v.Addrs(); err == nil {
+				for _, addr := range addrs {
+					i.Addrs = append(i.Addrs, addr.String())
+				}
+			}
+			d.Interfaces = append(d.Interfaces, i)
+		}
+	}
+	if stack {
+		buf := new(strings.Builder)
+		pprof.Lookup("goroutine").WriteTo(buf, 1)
+		if d.Stack = buf.String(); len(d.Stack) > maxStackSize {
+			d.Stack = d.Stack[:maxStackSize]
+		}
+	}
+	return d
+}
+
+func testTarget(tp, target string, timeout time.Duration) (*testResult, error) {
+	if target == "" {
+		return nil, errors.New("the target is empty")
+	}
+	r := &testResult{Target: target}
+	start := time.Now()
+	switch tp {
+	case "http":
+		client := &http.Client{Timeout: timeout}
+		resp, err := client.Get(target)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		r.StatusCode = resp.StatusCode
+	case "", common.CONN_TCP:
+		c, err := net.DialTimeout(common.CONN_TCP, common.FormatAddress(target), timeout)
+		if err != nil {
+			return nil, err
+		}
+		r.LocalAddr = c.LocalAddr().String()
+		c.Close()
+	default:
+		return nil, errors.New(fmt.Sprintf("the type %s of the test is not supported", tp))
+	}
+	r.Latency = float64(time.Since(start).Microseconds()) / 1000
+	return r, nil
+}
+
+func loadConfig(path string) (*config.Config, error) {
+	cnf, err := config.NewConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if cnf.CommonConfig == nil {
+		return nil, errors.New("the common section of the config file is not found")
+	}
+	return cnf, nil
+}
+
+// the old file is kept as .bak
+func replaceConfig(content string) error {
+	tmp := configPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(content), 0600); err != nil {
+		return err
+	}
+	if _, err := loadConfig(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if b, err := ioutil.ReadFile(configPath); err == nil {
+		ioutil.WriteFile(configPath+".bak", b, 0600)
+	}
+	return os.Rename(tmp, configPath)
+}
+
+// closed by reload, so the config file is read again
+var (
+	configClients sync.Map
+	reloading     bool
+	reloadLock    sync.Mutex
+)
+
+func reloadConfig() {
+	reloadLock.Lock()
+	reloading = true
+	reloadLock.Unlock()
+	logs.Info("reload the config file %s", configPath)
+	configClients.Range(func(key, value interface{}) bool {
+		key.(*TRPClient).Close()
+		return true
+	})
+}
+
+func isReloading() bool {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	return reloading
+}
+
+func resetReloading() {
+	reloadLock.Lock()
+	reloading = false
+	reloadLock.Unlock()
+}
+
+// exec in place, so the pid stays the same for the service manager
+func restartProcess() {
+	path, err := os.Executable()
+	if err != nil {
+		logs.Error("restart the client error %s", err.Error())
+		return
+	}
+	logs.Info("restart the client")
+	if err := syscall.Exec(path, os.Args, os.Environ()); err != nil {
+		logs.Error("restart the client error %s", err.Error())
+	}
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ehang.io/nps/lib/conn"
+)
+
+func sendCommand(t *testing.T, s *TRPClient, cmd *conn.Command) *conn.CommandResult {
+	server, client := net.Pipe()
+	defer server.Close()
+	go s.handleCommand(client)
+	c := conn.NewConn(server)
+	if _, err := c.SendInfo(cmd, ""); err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.GetCommandResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestHandleCommand(t *testing.T) {
+	defer func(disable, enable, profile string) {
+		DisableCommand, EnableCommand, profileDisableCommand = disable, enable, profile
+	}(DisableCommand, EnableCommand, profileDisableCommand)
+	s := &TRPClient{svrAddr: "127.0.0.1:8024"}
+
+	r := sendCommand(t, s, conn.NewCommand(conn.COMMAND_DIAGNOSE, nil, 0))
+	d := new(diagnostics)
+	if err := json.Unmarshal(r.Data, d); r.Error != "" || err != nil || d.Server != s.svrAddr || d.Stack != "" {
+		t.Fatalf("the result of the diagnose is %s %s", r.Error, r.Data)
+	}
+	if r = sendCommand(t, s, conn.NewCommand("unknown", nil, 0)); r.Error == "" {
+		t.Fatal("the unknown command is run")
+	}
+
+	for _, v := range []struct{ disable, profile string }{{"restart, diagnose", ""}, {"all", ""}, {"", "diagnose"}} {
+		DisableCommand, profileDisableCommand = v.disable, v.profile
+		if r = sendCommand(t, s, conn.NewCommand(conn.COMMAND_DIAGNOSE, nil, 0)); r.Error == "" {
+			t.Fatalf("the command is run with disable_command %q, the profile %q", v.disable, v.profile)
+		}
+	}
+	DisableCommand, profileDisableCommand = "", ""
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	EnableCommand = ""
+	if r = sendCommand(t, s, conn.NewCommand(conn.COMMAND_TEST, map[string]string{"target": target.Listener.Addr().String()}, 0)); r.Error != "" {
+		t.Fatal(r.Error)
+	}
+	httpTest := conn.NewCommand(conn.COMMAND_TEST, map[string]string{"type": "http", "target": target.URL}, 0)
+	if r = sendCommand(t, s, httpTest); r.Error == "" {
+		t.Fatal("the http test is run by default")
+	}
+	EnableCommand = "config_write,test_http"
+	result := new(testResult)
+	if r = sendCommand(t, s, httpTest); r.Error != "" || json.Unmarshal(r.Data, result) != nil || result.StatusCode != 200 {
+		t.Fatalf("the result of the http test is %s %s", r.Error, r.Data)
+	}
+}
+
+func TestConfigCommand(t *testing.T) {
+	defer func(path, enable string) { configPath, EnableCommand = path, enable }(configPath, EnableCommand)
+	s := new(TRPClient)
+	configPath = ""
+	if r := s.runCommand(conn.NewCommand(conn.COMMAND_CONFIG, nil, 0)); r.err == nil {
+		t.Fatal("the config is read without the config file")
+	}
+	configPath = filepath.Join(t.TempDir(), "npc.conf")
+	old := "[common]\nserver_addr=127.0.0.1:8024\nvkey=a\n"
+	if err := os.WriteFile(configPath, []byte(old), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if r := s.runCommand(conn.NewCommand(conn.COMMAND_CONFIG, nil, 0)); r.err != nil || r.data != old {
+		t.Fatalf("the config is %v, error %v", r.data, r.err)
+	}
+
+	replace := func(content string) *commandReply {
+		return s.runCommand(conn.NewCommand(conn.COMMAND_CONFIG, map[string]string{"content": content}, 0))
+	}
+	content := "[common]\nserver_addr=127.0.0.1:8024\nvkey=b\n"
+	EnableCommand = ""
+	if r := replace(content); r.err == nil {
+		t.Fatal("the config file is replaced by default")
+	}
+	EnableCommand = "config_write"
+	if r := replace("[tcp]\nmode=tcp\n"); r.err == nil {
+		t.Fatal("the config without the common section is accepted")
+	}
+	if r := replace(content); r.err != nil || r.after == nil {
+		t.Fatalf("replace the config error %v", r.err)
+	}
+	if b, _ := os.ReadFile(configPath); string(b) != content {
+		t.Fatalf("the config file is %q", b)
+	}
+	if b, _ := os.ReadFile(configPath + ".bak"); string(b) != old {
+		t.Fatalf("the backup of the config file is %q", b)
+	}
+}
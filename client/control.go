@@ -18,6 +18,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"ehang.io/nps/lib/common"
@@ -40,6 +41,44 @@ func GetTlsEnable() bool {
 	return tlsEnable1
 }
 
+// shared by the bridge and the encrypted links
+func GetTlsConfig() *tls.Config {
+	return crypt.GetClientTlsConfig()
+}
+
+// the server name is the host of the dialed server unless it is set,
+// so the failover and the active-active servers are verified by their own names
+func getServerTlsConfig(server string) *tls.Config {
+	config := GetTlsConfig()
+	if config.ServerName == "" {
+		config.ServerName = common.GetIpByAddr(server)
+	}
+	return config
+}
+
+// a client certificate turns the tls on
+func InitTlsConfig(certFile, keyFile string, opt *crypt.VerifyOption) error {
+	config, err := crypt.NewClientTlsConfig(certFile, keyFile, opt)
+	if err != nil {
+		return err
+	}
+	crypt.SetClientTlsConfig(config)
+	if certFile != "" {
+		SetTlsEnable(true)
+	}
+	return nil
+}
+
+var wsOption = &conn.WsOption{}
+
+func SetWsOption(opt *conn.WsOption) {
+	wsOption = opt
+}
+
+func GetWsOption() *conn.WsOption {
+	return wsOption
+}
+
 func GetTaskStatus(path string) {
 	cnf, err := config.NewConfig(path)
 	if err != nil {
@@ -98,8 +137,19 @@ func GetTaskStatus(path string) {
 
 var errAdd = errors.New("The server returned an error, which port or host may have been occupied or not allowed to open.")
 
+// loops so the reload command reads the config file again
 func StartFromFile(path string) {
-	first := true
+	configPath = path
+	for {
+		startFromFile(path)
+		if !isReloading() {
+			return
+		}
+		resetReloading()
+	}
+}
+
+func startFromFile(path string) {
 	cnf, err := config.NewConfig(path)
 	if err != nil || cnf.CommonConfig == nil {
 		logs.Error("Config file %s loading error %s", path, err.Error())
@@ -108,9 +158,63 @@ func StartFromFile(path string) {
 	logs.Info("Loading configuration file %s successfully", path)
 
 	SetTlsEnable(cnf.CommonConfig.TlsEnable)
+	if err := InitTlsConfig(cnf.CommonConfig.TlsCertFile, cnf.CommonConfig.TlsKeyFile, &crypt.VerifyOption{
+		Verify:      cnf.CommonConfig.TlsVerify,
+		ServerName:  cnf.CommonConfig.TlsServerName,
+		CaFile:      cnf.CommonConfig.TlsCaFile,
+		Fingerprint: cnf.CommonConfig.TlsFingerprint,
+	}); err != nil {
+		logs.Error("load the tls config error %s", err.Error())
+		os.Exit(0)
+	}
+	if cnf.CommonConfig.MuxNum > 0 {
+		MuxNum = cnf.CommonConfig.MuxNum
+	}
+	if cnf.CommonConfig.ServerMode != "" {
+		ServerMode = cnf.CommonConfig.ServerMode
+	}
+	DisableCommand = cnf.CommonConfig.DisableCommand
+	EnableCommand = cnf.CommonConfig.EnableCommand
+	SetWsOption(&conn.WsOption{Path: cnf.CommonConfig.WsPath, Host: cnf.CommonConfig.WsHost, Header: conn.ParseWsHeader(cnf.CommonConfig.WsHeader)})
 	logs.Info("the version of client is %s, the core version of client is %s,tls enable is %t", version.VERSION, version.GetVersion(), GetTlsEnable())
+	if ServerMode != SERVER_MODE_ALL {
+		startFromConfig(cnf, true)
+		return
+	}
+	//active-active, register to every server, the local servers use the primary one
+	servers := SplitServer(cnf.CommonConfig.Server)
+	vkeys := strings.Split(cnf.CommonConfig.VKey, ",")
+	if len(vkeys) != 1 && len(vkeys) != len(servers) {
+		logs.Error("the number of the vkeys should be 1 or the same as the servers")
+		os.Exit(0)
+	}
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		c, err := cnf.Clone()
+		if err != nil {
+			logs.Error("copy the config error %s", err.Error())
+			os.Exit(0)
+		}
+		c.CommonConfig.Server = server
+		c.CommonConfig.VKey = vkeys[i%len(vkeys)]
+		wg.Add(1)
+		go func(primary bool) {
+			startFromConfig(c, primary)
+			wg.Done()
+		}(i == 0)
+	}
+	wg.Wait()
+}
+
+func startFromConfig(cnf *config.Config, localServer bool) {
+	first := true
+	servers := GetServerList(cnf.CommonConfig.Server)
 re:
-	if first || cnf.CommonConfig.AutoReconnection {
+	if isReloading() {
+		return
+	}
+	//always retry when there is another server
+	if first || cnf.CommonConfig.AutoReconnection || servers.Len() > 1 {
 		if !first {
 			logs.Info("Reconnecting...")
 			time.Sleep(time.Second * 5)
@@ -119,9 +223,14 @@ re:
 		return
 	}
 	first = false
-	c, err := NewConn(cnf.CommonConfig.Tp, cnf.CommonConfig.VKey, cnf.CommonConfig.Server, common.WORK_CONFIG, cnf.CommonConfig.ProxyUrl)
+	server := servers.Get()
+	c, err := NewConn(cnf.CommonConfig.Tp, cnf.CommonConfig.VKey, server, common.WORK_CONFIG, cnf.CommonConfig.ProxyUrl)
 	if err != nil {
 		logs.Error(err)
+		if servers.Len() > 1 {
+			servers.Next(server)
+			logs.Warn("switch to the server %s", servers.Get())
+		}
 		goto re
 	}
 	var isPub bool
@@ -178,8 +287,10 @@ re:
 	}
 
 	//create local server secret or p2p
-	for _, v := range cnf.LocalServer {
-		go StartLocalServer(v, cnf.CommonConfig)
+	if localServer {
+		for _, v := range cnf.LocalServer {
+			go StartLocalServer(v, cnf.CommonConfig)
+		}
 	}
 
 	c.Close()
@@ -188,11 +299,61 @@ re:
 	} else {
 		logs.Notice("web access login username:%s password:%s", cnf.CommonConfig.Client.WebUserName, cnf.CommonConfig.Client.WebPassword)
 	}
-	NewRPClient(cnf.CommonConfig.Server, vkey, cnf.CommonConfig.Tp, cnf.CommonConfig.ProxyUrl, cnf, cnf.CommonConfig.DisconnectTime).Start()
-	CloseLocalServer()
+	rpClient := NewRPClient(cnf.CommonConfig.Server, vkey, cnf.CommonConfig.Tp, cnf.CommonConfig.ProxyUrl, cnf, cnf.CommonConfig.DisconnectTime)
+	configClients.Store(rpClient, nil)
+	if isReloading() {
+		//reloaded while registering
+		rpClient.Close()
+	}
+	rpClient.Start()
+	configClients.Delete(rpClient)
+	if localServer {
+		CloseLocalServer()
+	}
 	goto re
 }
 
+// dial the server by the socks5 or http proxy
+func dialByProxy(proxyUrl string, server string) (net.Conn, error) {
+	u, err := url.Parse(proxyUrl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5":
+		n, err := proxy.FromURL(u, nil)
+		if err != nil {
+			return nil, err
+		}
+		return n.Dial("tcp", server)
+	default:
+		return NewHttpProxyConn(u, server)
+	}
+}
+
+// the server may be a cdn in front of nps
+func dialWs(isTls bool, server string, proxyUrl string) (net.Conn, error) {
+	var c net.Conn
+	var err error
+	if proxyUrl != "" {
+		c, err = dialByProxy(proxyUrl, server)
+	} else {
+		c, err = net.DialTimeout("tcp", server, time.Second*10)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if isTls {
+		c = tls.Client(c, getServerTlsConfig(server))
+	}
+	ws, err := conn.DialWs(c, server, isTls, GetWsOption())
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
 // Create a new connection with the server and verify it
 func NewConn(tp string, vkey string, server string, connType string, proxyUrl string) (*conn.Conn, error) {
 	var err error
@@ -200,27 +361,11 @@ func NewConn(tp string, vkey string, server string, connType string, proxyUrl st
 	var sess *kcp.UDPSession
 	if tp == "tcp" {
 		if proxyUrl != "" {
-			u, er := url.Parse(proxyUrl)
-			if er != nil {
-				return nil, er
-			}
-			switch u.Scheme {
-			case "socks5":
-				n, er := proxy.FromURL(u, nil)
-				if er != nil {
-					return nil, er
-				}
-				connection, err = n.Dial("tcp", server)
-			default:
-				connection, err = NewHttpProxyConn(u, server)
-			}
+			connection, err = dialByProxy(proxyUrl, server)
 		} else {
 			if GetTlsEnable() {
 				//tls 流量加密
-				conf := &tls.Config{
-					InsecureSkipVerify: true,
-				}
-				connection, err = tls.Dial("tcp", server, conf)
+				connection, err = tls.Dial("tcp", server, getServerTlsConfig(server))
 			} else {
 				connection, err = net.Dial("tcp", server)
 			}
@@ -242,6 +387,13 @@ func NewConn(tp string, vkey string, server string, connType string, proxyUrl st
 			//_, err = header.WriteTo(connection)
 			//_, err = io.WriteString(connection, "HELO")
 		}
+	} else if tp == "ws" || tp == "wss" {
+		connection, err = dialWs(tp == "wss", server, proxyUrl)
+	} else if tp == "quic" {
+		//the proxy is not supported by quic
+		config := getServerTlsConfig(server)
+		config.NextProtos = []string{conn.QuicAlpn}
+		connection, err = conn.DialQuic(server, config, time.Second*10)
 	} else {
 		sess, err = kcp.DialWithOptions(server, nil, 10, 3)
 		if err == nil {
@@ -269,10 +421,8 @@ func NewConn(tp string, vkey string, server string, connType string, proxyUrl st
 		logs.Error(err)
 		return nil, err
 	}
-	if crypt.Md5(version.GetVersion()) != string(b) {
-		//logs.Error("The client does not match the server version. The current core version of the client is", version.GetVersion())
-		//return nil, err
-	}
+	// only a server of the same core version negotiates, the old ones still work
+	negotiate := crypt.Md5(version.GetVersion()) == string(b)
 	if _, err := c.Write([]byte(common.Getverifyval(vkey))); err != nil {
 		return nil, err
 	}
@@ -281,6 +431,23 @@ func NewConn(tp string, vkey string, server string, connType string, proxyUrl st
 	} else if s == common.VERIFY_EER {
 		return nil, errors.New(fmt.Sprintf("Validation key %s incorrect", vkey))
 	}
+	if negotiate {
+		if _, err := c.SendInfo(version.NewCapability(), ""); err != nil {
+			return nil, err
+		}
+		capability, err := c.GetCapability()
+		if err != nil {
+			return nil, err
+		}
+		if capability.Error != "" {
+			return nil, errors.New(capability.Error)
+		}
+		if connType == common.WORK_MAIN {
+			logs.Info("the version of the server is %s, the features %v are enabled", capability.Version, capability.Features)
+		}
+	} else if connType == common.WORK_MAIN {
+		logs.Warn("the server is of the old core version, all of the new features are disabled, please upgrade it")
+	}
 	if _, err := c.Write([]byte(connType)); err != nil {
 		return nil, err
 	}
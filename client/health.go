@@ -16,6 +16,7 @@ import (
 
 var isStart bool
 var serverConn *conn.Conn
+var healthStop chan struct{}
 
 func heathCheck(healths []*file.Health, c *conn.Conn) bool {
 	serverConn = c
@@ -34,11 +35,19 @@ func heathCheck(healths []*file.Health, c *conn.Conn) bool {
 			v.HealthMap = make(map[string]int)
 		}
 	}
-	go session(healths, h)
+	healthStop = make(chan struct{})
+	go session(healths, h, healthStop)
 	return true
 }
 
-func session(healths []*file.Health, h *sheap.IntHeap) {
+func stopHealthCheck() {
+	if isStart {
+		close(healthStop)
+		isStart = false
+	}
+}
+
+func session(healths []*file.Health, h *sheap.IntHeap, stop chan struct{}) {
 	for {
 		if h.Len() == 0 {
 			logs.Error("health check error")
@@ -60,6 +69,9 @@ func session(healths []*file.Health, h *sheap.IntHeap) {
 					heap.Push(h, v.HealthNextTime.Unix())
 				}
 			}
+		case <-stop:
+			timer.Stop()
+			return
 		}
 	}
 }
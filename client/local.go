@@ -81,6 +81,10 @@ func StartLocalServer(l *config.LocalServer, config *config.CommonConfig) error
 	if l.Type != "secret" {
 		go handleUdpMonitor(config, l)
 	}
+	return newLocalServer(l, config).Start()
+}
+
+func newLocalServer(l *config.LocalServer, config *config.CommonConfig) proxy.Service {
 	task := &file.Tunnel{
 		Port:     l.Port,
 		ServerIp: "0.0.0.0",
@@ -101,26 +105,57 @@ func StartLocalServer(l *config.LocalServer, config *config.CommonConfig) error
 	switch l.Type {
 	case "p2ps":
 		logs.Info("successful start-up of local socks5 monitoring, port", l.Port)
-		return proxy.NewSock5ModeServer(p2pNetBridge, task).Start()
+		return proxy.NewSock5ModeServer(p2pNetBridge, task)
 	case "p2pt":
 		logs.Info("successful start-up of local tcp trans monitoring, port", l.Port)
-		return proxy.NewTunnelModeServer(proxy.HandleTrans, p2pNetBridge, task).Start()
-	case "p2p", "secret":
-		listener, err := net.ListenTCP("tcp", &net.TCPAddr{net.ParseIP("0.0.0.0"), l.Port, ""})
-		if err != nil {
-			logs.Error("local listener startup failed port %d, error %s", l.Port, err.Error())
-			return err
+		return proxy.NewTunnelModeServer(proxy.HandleTrans, p2pNetBridge, task)
+	}
+	return &localListener{l: l, config: config}
+}
+
+type localListener struct {
+	l        *config.LocalServer
+	config   *config.CommonConfig
+	listener *net.TCPListener
+	closed   bool
+	sync.Mutex
+}
+
+func (s *localListener) Start() error {
+	if s.l.Type != "p2p" && s.l.Type != "secret" {
+		return nil
+	}
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{net.ParseIP("0.0.0.0"), s.l.Port, ""})
+	if err != nil {
+		logs.Error("local listener startup failed port %d, error %s", s.l.Port, err.Error())
+		return err
+	}
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return listener.Close()
+	}
+	s.listener = listener
+	s.Unlock()
+	LocalServer = append(LocalServer, listener)
+	logs.Info("successful start-up of local tcp monitoring, port", s.l.Port)
+	conn.Accept(listener, func(c net.Conn) {
+		logs.Trace("new %s connection", s.l.Type)
+		if s.l.Type == "secret" {
+			handleSecret(c, s.config, s.l)
+		} else if s.l.Type == "p2p" {
+			handleP2PVisitor(c, s.config, s.l)
 		}
-		LocalServer = append(LocalServer, listener)
-		logs.Info("successful start-up of local tcp monitoring, port", l.Port)
-		conn.Accept(listener, func(c net.Conn) {
-			logs.Trace("new %s connection", l.Type)
-			if l.Type == "secret" {
-				handleSecret(c, config, l)
-			} else if l.Type == "p2p" {
-				handleP2PVisitor(c, config, l)
-			}
-		})
+	})
+	return nil
+}
+
+func (s *localListener) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	s.closed = true
+	if s.listener != nil {
+		return s.listener.Close()
 	}
 	return nil
 }
@@ -0,0 +1,133 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/config"
+	"ehang.io/nps/lib/file"
+	"ehang.io/nps/server/proxy"
+	"github.com/astaxie/beego/logs"
+)
+
+// the local servers and the health checks of the profile survive the reconnections
+var (
+	profileLock           sync.Mutex
+	profileLocals         = make(map[string]proxy.Service) // key -> running server
+	profileHealths        []*file.Health
+	profileHealthKey      string
+	profileDisableCommand string // on top of DisableCommand
+)
+
+// apply the differences without reconnecting
+func (s *TRPClient) pullProfile() {
+	c, err := NewConn(s.bridgeConnType, s.vKey, s.svrAddr, common.WORK_PROFILE, s.proxyUrl)
+	if err != nil {
+		logs.Error("pull the profile from the server error %s", err.Error())
+		return
+	}
+	p, err := c.GetProfile()
+	c.Close()
+	if err != nil {
+		logs.Error("pull the profile from the server error %s", err.Error())
+		return
+	}
+	if s.cnf != nil {
+		if !p.IsEmpty() {
+			logs.Warn("the client is started by the config file, the profile of the server is ignored")
+		}
+		return
+	}
+	cnf := new(config.Config)
+	if !p.IsEmpty() {
+		if cnf, err = parseProfile(p); err != nil {
+			logs.Error("parse the profile error %s", err.Error())
+			return
+		}
+	}
+	s.applyProfile(cnf)
+}
+
+func parseProfile(p *file.Profile) (cnf *config.Config, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprint(r))
+		}
+	}()
+	return config.NewConfigFromProfile(p.Content, p.Files)
+}
+
+// the server creates the tasks and the hosts
+func (s *TRPClient) applyProfile(cnf *config.Config) {
+	profileLock.Lock()
+	defer profileLock.Unlock()
+	commonConfig := cnf.CommonConfig
+	if commonConfig == nil {
+		commonConfig = &config.CommonConfig{Client: &file.Client{Cnf: new(file.Config)}}
+	}
+	commonConfig.Server = s.svrAddr
+	commonConfig.VKey = s.vKey
+	commonConfig.Tp = s.bridgeConnType
+	commonConfig.ProxyUrl = s.proxyUrl
+
+	profileDisableCommand = commonConfig.DisableCommand
+	num := MuxNum
+	if commonConfig.MuxNum > 0 {
+		num = commonConfig.MuxNum
+	}
+	if old := s.getMuxNum(); num != old {
+		logs.Info("the number of the data connections is changed from %d to %d by the profile", old, num)
+		s.setMuxNum(num)
+	}
+
+	// restart them on change, or to use the new signal connection
+	var key string
+	if len(cnf.Healths) > 0 {
+		b, _ := json.Marshal(cnf.Healths)
+		key = string(b)
+	}
+	if key != profileHealthKey {
+		logs.Info("the health checks are changed by the profile")
+		stopHealthCheck()
+		profileHealths, profileHealthKey = cnf.Healths, key
+	}
+	if len(profileHealths) > 0 {
+		heathCheck(profileHealths, s.signal)
+	}
+
+	locals := make(map[string]*config.LocalServer)
+	for _, l := range cnf.LocalServer {
+		locals[fmt.Sprintf("%s|%t|%+v", commonConfig.Server, commonConfig.Client.Cnf.Compress, *l)] = l
+	}
+	for key, svr := range profileLocals {
+		if _, ok := locals[key]; !ok {
+			svr.Close()
+			delete(profileLocals, key)
+		}
+	}
+	for key, l := range locals {
+		if _, ok := profileLocals[key]; ok {
+			continue
+		}
+		if l.Type != "secret" {
+			go handleUdpMonitor(commonConfig, l)
+		}
+		svr := newLocalServer(l, commonConfig)
+		profileLocals[key] = svr
+		go func(l *config.LocalServer) {
+			if err := svr.Start(); err != nil {
+				logs.Error("start the local server of the profile, port %d error %s", l.Port, err.Error())
+			}
+		}(l)
+	}
+	logs.Info("the profile is applied, health checks %d, local servers %d", len(profileHealths), len(profileLocals))
+}
+
+func isProfileCommandDisabled(name string) bool {
+	profileLock.Lock()
+	defer profileLock.Unlock()
+	return inCommands(profileDisableCommand, name)
+}
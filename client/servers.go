@@ -0,0 +1,124 @@
+package client
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"github.com/astaxie/beego/logs"
+)
+
+// how to pick one of the comma separated servers
+const (
+	SERVER_MODE_PRIORITY = "priority" // fail over to the next one, return to the primary when it is back
+	SERVER_MODE_ROUND    = "round"    // the next one after every disconnection
+	SERVER_MODE_ALL      = "all"      // active-active, a session per server, each with its own vkey and tunnels
+)
+
+var ServerMode = SERVER_MODE_PRIORITY
+
+var ServerCheckInterval = time.Second * 30
+
+// the selection state is kept across the reconnections
+type ServerList struct {
+	addrs []string
+	index int
+	sync.Mutex
+}
+
+var serverLists sync.Map
+
+func GetServerList(addr string) *ServerList {
+	if v, ok := serverLists.Load(addr); ok {
+		return v.(*ServerList)
+	}
+	v, _ := serverLists.LoadOrStore(addr, &ServerList{addrs: SplitServer(addr)})
+	return v.(*ServerList)
+}
+
+func SplitServer(addr string) []string {
+	addrs := make([]string, 0)
+	for _, v := range strings.Split(addr, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			addrs = append(addrs, v)
+		}
+	}
+	return addrs
+}
+
+func (s *ServerList) Len() int {
+	return len(s.addrs)
+}
+
+func (s *ServerList) Get() string {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.addrs) == 0 {
+		return ""
+	}
+	return s.addrs[s.index]
+}
+
+func (s *ServerList) Primary() string {
+	if len(s.addrs) == 0 {
+		return ""
+	}
+	return s.addrs[0]
+}
+
+// a no-op if addr is not the current one, so one failure switches once
+func (s *ServerList) Next(addr string) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.addrs) > 0 && s.addrs[s.index] == addr {
+		s.index = (s.index + 1) % len(s.addrs)
+	}
+}
+
+func (s *ServerList) Reset() {
+	s.Lock()
+	s.index = 0
+	s.Unlock()
+}
+
+// false if there is only one server
+func (s *TRPClient) switchServer() bool {
+	if s.servers.Len() <= 1 {
+		return false
+	}
+	s.servers.Next(s.svrAddr)
+	s.svrAddr = s.servers.Get()
+	logs.Warn("switch to the server %s", s.svrAddr)
+	return true
+}
+
+// close the client once the primary is back, so it reconnects there
+func (s *TRPClient) checkPrimary() {
+	primary := s.servers.Primary()
+	if ServerMode != SERVER_MODE_PRIORITY || s.svrAddr == primary {
+		return
+	}
+	vkey := s.vKey
+	if s.cnf != nil {
+		// the vkey of the public mode is assigned by the server, probe with the configured one
+		vkey = s.cnf.CommonConfig.VKey
+	}
+	ticker := time.NewTicker(ServerCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s.isClosed() {
+			return
+		}
+		c, err := NewConn(s.bridgeConnType, vkey, primary, common.WORK_PROBE, s.proxyUrl)
+		if err != nil {
+			logs.Trace("the primary server %s is not available, error %s", primary, err.Error())
+			continue
+		}
+		c.Close()
+		logs.Info("the primary server %s is available again, switch back to it", primary)
+		s.servers.Reset()
+		s.Close()
+		return
+	}
+}
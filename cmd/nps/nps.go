@@ -82,6 +82,7 @@ func main() {
 	}
 
 	bridge.ServerTlsEnable = beego.AppConfig.DefaultBool("tls_enable", false)
+	bridge.AllowLegacyClient = beego.AppConfig.DefaultBool("allow_legacy_client", true)
 
 	for _, v := range os.Args[1:] {
 		switch v {
@@ -232,8 +233,15 @@ func run() {
 	logs.Info("the config path is:" + common.GetRunPath())
 	logs.Info("the version of server is %s ,allow client core version to be %s,tls enable is %t", version.VERSION, version.GetVersion(), bridge.ServerTlsEnable)
 	connection.InitConnectionService()
-	//crypt.InitTls(filepath.Join(common.GetRunPath(), "conf", "server.pem"), filepath.Join(common.GetRunPath(), "conf", "server.key"))
-	crypt.InitTls()
+	crypt.InitTls(getConfFilePath(beego.AppConfig.String("bridge_cert_file")), getConfFilePath(beego.AppConfig.String("bridge_key_file")))
+	if beego.AppConfig.DefaultBool("mtls_enable", false) {
+		certFile, keyFile := getConfFilePath(beego.AppConfig.DefaultString("mtls_ca_cert_file", "conf/ca.pem")), getConfFilePath(beego.AppConfig.DefaultString("mtls_ca_key_file", "conf/ca.key"))
+		if err := crypt.InitCa(certFile, keyFile); err != nil {
+			logs.Error("init the ca error", err)
+			os.Exit(0)
+		}
+		logs.Info("mtls is enabled, the sha256 fingerprint of the ca is %s", crypt.GetCaFingerprint())
+	}
 	tool.InitAllowPort()
 	tool.StartSystemInfo()
 	timeout, err := beego.AppConfig.Int("disconnect_timeout")
@@ -242,3 +250,11 @@ func run() {
 	}
 	go server.StartNewServer(bridgePort, task, beego.AppConfig.String("bridge_type"), timeout)
 }
+
+// relative to the run path
+func getConfFilePath(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(common.GetRunPath(), path)
+}
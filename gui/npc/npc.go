@@ -53,7 +53,7 @@ func makeMainTab() *fyne.Container {
 
 	vKey := widget.NewEntry()
 	vKey.SetPlaceHolder("Vkey")
-	radio := widget.NewRadioGroup([]string{"tcp", "kcp"}, func(s string) { connType = s })
+	radio := widget.NewRadioGroup([]string{"tcp", "kcp", "quic"}, func(s string) { connType = s })
 	radio.Horizontal = true
 
 	button := widget.NewButton(status, func() {
@@ -0,0 +1,514 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HttpCache is a shared http response cache, the size is limited by bytes.
+// It is safe for concurrent access.
+type HttpCache struct {
+	// MaxBytes is the max bytes of all the entries, zero means no limit
+	MaxBytes int64
+	// MaxObjectBytes is the max body bytes of one entry
+	MaxObjectBytes int64
+
+	nowBytes int64
+	ll       *list.List
+	entries  map[string]*list.Element
+	varies   map[string]*httpVary
+	sync.Mutex
+}
+
+// the Vary of the responses of one url
+type httpVary struct {
+	names []string
+	keys  map[string]bool
+}
+
+// immutable, a refreshed entry replaces the old one
+type httpEntry struct {
+	key          string
+	primary      string
+	hostId       int
+	statusCode   int
+	header       http.Header
+	body         []byte
+	responseTime time.Time
+	initialAge   time.Duration
+	lifetime     time.Duration
+	size         int64
+}
+
+// HttpCacheState carries the result of Lookup to Store.
+type HttpCacheState struct {
+	hostId  int
+	primary string
+	method  string
+	header  http.Header
+	auth    bool
+	stale   *httpEntry
+}
+
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade", "Te", "Trailer", "Content-Length", "Age"}
+
+// NewHttpCache creates a new HttpCache.
+// If maxObjectBytes is 0, the max bytes of one entry is the same as maxBytes.
+func NewHttpCache(maxBytes, maxObjectBytes int64) *HttpCache {
+	if maxObjectBytes <= 0 || (maxBytes > 0 && maxObjectBytes > maxBytes) {
+		maxObjectBytes = maxBytes
+	}
+	return &HttpCache{
+		MaxBytes:       maxBytes,
+		MaxObjectBytes: maxObjectBytes,
+		ll:             list.New(),
+		entries:        make(map[string]*list.Element),
+		varies:         make(map[string]*httpVary),
+	}
+}
+
+// Lookup returns the fresh response of the request from the cache.
+// If there is no fresh response, the returned state should be passed to Store with the response of the target,
+// and the request may be changed to revalidate the stale entry. A nil state means the request does not use the cache.
+func (c *HttpCache) Lookup(hostId int, r *http.Request) (*http.Response, *HttpCacheState) {
+	primary := primaryKey(hostId, r)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		// unsafe methods invalidate the url
+		if r.Method != http.MethodOptions && r.Method != http.MethodTrace {
+			c.Lock()
+			c.removePrimary(primary)
+			c.Unlock()
+		}
+		return nil, nil
+	}
+	reqCc := parseCacheControl(r.Header)
+	if _, ok := reqCc["no-store"]; ok || r.Header.Get("Range") != "" {
+		return nil, nil
+	}
+	state := &HttpCacheState{
+		hostId:  hostId,
+		primary: primary,
+		method:  r.Method,
+		header:  r.Header.Clone(),
+		auth:    r.Header.Get("Authorization") != "",
+	}
+	e := c.get(primary, r.Header)
+	if e == nil {
+		return nil, state
+	}
+	now := time.Now()
+	age := e.age(now)
+	fresh := age < e.lifetime
+	if _, ok := reqCc["no-cache"]; ok || strings.Contains(strings.ToLower(r.Header.Get("Pragma")), "no-cache") {
+		fresh = false
+	}
+	if v, ok := reqCc["max-age"]; ok {
+		if maxAge, err := strconv.Atoi(v); err == nil && age > time.Duration(maxAge)*time.Second {
+			fresh = false
+		}
+	}
+	if fresh {
+		return e.response(state.request(), age), nil
+	}
+	etag, lastModified := e.header.Get("ETag"), e.header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		// can not be revalidated
+		c.Lock()
+		if ele, ok := c.entries[e.key]; ok && ele.Value.(*httpEntry) == e {
+			c.removeElement(ele)
+		}
+		c.Unlock()
+		return nil, state
+	}
+	// revalidate the stale entry if the client does not send its own conditions
+	if r.Header.Get("If-None-Match") == "" && r.Header.Get("If-Modified-Since") == "" {
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		if lastModified != "" {
+			r.Header.Set("If-Modified-Since", lastModified)
+		}
+		state.stale = e
+	}
+	return nil, state
+}
+
+// Store handles the response of the target, the response is stored if it is cacheable.
+// If the stale entry is validated by the target, the response from the cache is returned and hit is true.
+func (c *HttpCache) Store(state *HttpCacheState, ttl time.Duration, resp *http.Response) (*http.Response, bool) {
+	now := time.Now()
+	if resp.StatusCode == http.StatusNotModified && state.stale != nil {
+		resp.Body.Close()
+		e := state.stale.refresh(resp.Header, now, ttl)
+		c.add(e)
+		return e.response(state.request(), e.age(now)), true
+	}
+	if state.method != http.MethodGet || !isCacheableStatus(resp.StatusCode) {
+		return resp, false
+	}
+	respCc := parseCacheControl(resp.Header)
+	if _, ok := respCc["no-store"]; ok {
+		return resp, false
+	}
+	if _, ok := respCc["private"]; ok {
+		return resp, false
+	}
+	if len(resp.Header.Values("Set-Cookie")) > 0 {
+		return resp, false
+	}
+	if state.auth {
+		_, public := respCc["public"]
+		_, sMaxAge := respCc["s-maxage"]
+		_, mustRevalidate := respCc["must-revalidate"]
+		if !public && !sMaxAge && !mustRevalidate {
+			return resp, false
+		}
+	}
+	names, all := varyNames(resp.Header)
+	if all {
+		return resp, false
+	}
+	e := &httpEntry{
+		primary:      state.primary,
+		hostId:       state.hostId,
+		statusCode:   resp.StatusCode,
+		header:       storedHeader(resp.Header),
+		responseTime: now,
+	}
+	e.key = varyKey(state.primary, names, state.header)
+	e.setLifetime(resp.Header.Get("Age"), respCc, ttl)
+	if e.lifetime <= 0 && e.header.Get("ETag") == "" && e.header.Get("Last-Modified") == "" {
+		return resp, false
+	}
+	if c.MaxObjectBytes > 0 && resp.ContentLength > c.MaxObjectBytes {
+		return resp, false
+	}
+	// Content-Length may be missing, so the size is checked while reading
+	var body []byte
+	var err error
+	if c.MaxObjectBytes > 0 {
+		body, err = io.ReadAll(io.LimitReader(resp.Body, c.MaxObjectBytes+1))
+	} else {
+		body, err = io.ReadAll(resp.Body)
+	}
+	if err != nil || (c.MaxObjectBytes > 0 && int64(len(body)) > c.MaxObjectBytes) {
+		resp.Body = &readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, false
+	}
+	resp.Body.Close()
+	e.body = body
+	e.size = int64(len(e.key) + len(body))
+	for k, v := range e.header {
+		e.size += int64(len(k))
+		for _, s := range v {
+			e.size += int64(len(s))
+		}
+	}
+	c.add(e)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+	return resp, false
+}
+
+// Purge removes the entries of the host and returns how many were removed.
+func (c *HttpCache) Purge(hostId int) int {
+	c.Lock()
+	defer c.Unlock()
+	var n int
+	for ele := c.ll.Front(); ele != nil; {
+		next := ele.Next()
+		if ele.Value.(*httpEntry).hostId == hostId {
+			c.removeElement(ele)
+			n++
+		}
+		ele = next
+	}
+	return n
+}
+
+// Len returns the number of entries and their total size.
+func (c *HttpCache) Len() (int, int64) {
+	c.Lock()
+	defer c.Unlock()
+	return c.ll.Len(), c.nowBytes
+}
+
+func (c *HttpCache) get(primary string, header http.Header) *httpEntry {
+	c.Lock()
+	defer c.Unlock()
+	v, ok := c.varies[primary]
+	if !ok {
+		return nil
+	}
+	if ele, ok := c.entries[varyKey(primary, v.names, header)]; ok {
+		c.ll.MoveToFront(ele)
+		return ele.Value.(*httpEntry)
+	}
+	return nil
+}
+
+func (c *HttpCache) add(e *httpEntry) {
+	c.Lock()
+	defer c.Unlock()
+	if ele, ok := c.entries[e.key]; ok {
+		c.removeElement(ele)
+	}
+	names, _ := varyNames(e.header)
+	v, ok := c.varies[e.primary]
+	if ok && !isSameNames(v.names, names) {
+		// Vary changed, the old variants are unreachable
+		c.removePrimary(e.primary)
+		ok = false
+	}
+	if !ok {
+		v = &httpVary{names: names, keys: make(map[string]bool)}
+		c.varies[e.primary] = v
+	}
+	c.entries[e.key] = c.ll.PushFront(e)
+	v.keys[e.key] = true
+	c.nowBytes += e.size
+	for c.MaxBytes > 0 && c.nowBytes > c.MaxBytes && c.ll.Len() > 0 {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *HttpCache) removePrimary(primary string) {
+	if v, ok := c.varies[primary]; ok {
+		for key := range v.keys {
+			if ele, ok := c.entries[key]; ok {
+				c.removeElement(ele)
+			}
+		}
+		delete(c.varies, primary)
+	}
+}
+
+func (c *HttpCache) removeElement(ele *list.Element) {
+	e := c.ll.Remove(ele).(*httpEntry)
+	delete(c.entries, e.key)
+	c.nowBytes -= e.size
+	if v, ok := c.varies[e.primary]; ok {
+		delete(v.keys, e.key)
+		if len(v.keys) == 0 {
+			delete(c.varies, e.primary)
+		}
+	}
+}
+
+func (s *HttpCacheState) request() *http.Request {
+	return &http.Request{Method: s.method, Header: s.header}
+}
+
+// rfc7234 4.2.3
+func (e *httpEntry) age(now time.Time) time.Duration {
+	return e.initialAge + now.Sub(e.responseTime)
+}
+
+// rfc7234 4.2.1, the ttl of the host wins over the headers
+func (e *httpEntry) setLifetime(ageValue string, cc map[string]string, ttl time.Duration) {
+	if age, err := strconv.Atoi(ageValue); err == nil && age > 0 {
+		e.initialAge = time.Duration(age) * time.Second
+	}
+	date := e.responseTime
+	if t, err := http.ParseTime(e.header.Get("Date")); err == nil {
+		date = t
+	}
+	if apparentAge := e.responseTime.Sub(date); apparentAge > e.initialAge {
+		e.initialAge = apparentAge
+	}
+	e.lifetime = 0
+	if _, ok := cc["no-cache"]; ok {
+		return
+	}
+	if ttl > 0 {
+		e.lifetime = ttl
+		return
+	}
+	if v, ok := cc["s-maxage"]; ok {
+		e.lifetime = parseSeconds(v)
+	} else if v, ok := cc["max-age"]; ok {
+		e.lifetime = parseSeconds(v)
+	} else if v := e.header.Get("Expires"); v != "" {
+		// an invalid date means the response is expired
+		if t, err := http.ParseTime(v); err == nil {
+			e.lifetime = t.Sub(date)
+		}
+	} else if t, err := http.ParseTime(e.header.Get("Last-Modified")); err == nil {
+		// heuristic: 10% of the time since Last-Modified, at most one day
+		e.lifetime = date.Sub(t) / 10
+		if e.lifetime > 24*time.Hour {
+			e.lifetime = 24 * time.Hour
+		}
+	}
+}
+
+// rfc7234 4.3.4
+func (e *httpEntry) refresh(header http.Header, now time.Time, ttl time.Duration) *httpEntry {
+	n := &httpEntry{
+		key:          e.key,
+		primary:      e.primary,
+		hostId:       e.hostId,
+		statusCode:   e.statusCode,
+		header:       e.header.Clone(),
+		body:         e.body,
+		responseTime: now,
+		size:         e.size,
+	}
+	for k, v := range storedHeader(header) {
+		n.header[k] = v
+	}
+	n.setLifetime(header.Get("Age"), parseCacheControl(n.header), ttl)
+	return n
+}
+
+func (e *httpEntry) response(r *http.Request, age time.Duration) *http.Response {
+	header := e.header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	resp := &http.Response{
+		Status:        strconv.Itoa(e.statusCode) + " " + http.StatusText(e.statusCode),
+		StatusCode:    e.statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       r,
+	}
+	if e.statusCode == http.StatusOK && e.notModified(r) {
+		resp.Status = "304 " + http.StatusText(http.StatusNotModified)
+		resp.StatusCode = http.StatusNotModified
+		resp.Body = http.NoBody
+		resp.ContentLength = -1
+	}
+	return resp
+}
+
+// rfc7232 6
+func (e *httpEntry) notModified(r *http.Request) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(e.header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, v := range strings.Split(inm, ",") {
+			v = strings.TrimSpace(v)
+			if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		if lm, err := http.ParseTime(e.header.Get("Last-Modified")); err == nil {
+			return !lm.After(ims)
+		}
+	}
+	return false
+}
+
+// only GET is stored, so the method is not in the key
+func primaryKey(hostId int, r *http.Request) string {
+	return strconv.Itoa(hostId) + " " + r.URL.Scheme + "://" + r.Host + r.URL.RequestURI()
+}
+
+func varyKey(primary string, names []string, header http.Header) string {
+	if len(names) == 0 {
+		return primary
+	}
+	var b strings.Builder
+	b.WriteString(primary)
+	for _, name := range names {
+		b.WriteString("\n" + name + ":" + strings.Join(header.Values(name), ","))
+	}
+	return b.String()
+}
+
+// sorted, all is true for "Vary: *"
+func varyNames(header http.Header) (names []string, all bool) {
+	for _, line := range header.Values("Vary") {
+		for _, v := range strings.Split(line, ",") {
+			v = strings.TrimSpace(v)
+			if v == "*" {
+				return nil, true
+			}
+			if v != "" {
+				names = append(names, http.CanonicalHeaderKey(v))
+			}
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+func isSameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if a[k] != b[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// rfc7231 6.1
+func isCacheableStatus(code int) bool {
+	switch code {
+	case 200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501:
+		return true
+	}
+	return false
+}
+
+func storedHeader(header http.Header) http.Header {
+	h := header.Clone()
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+	return h
+}
+
+func parseCacheControl(header http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, line := range header.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, value := part, ""
+			if i := strings.IndexByte(part, '='); i >= 0 {
+				name, value = part[:i], strings.Trim(strings.TrimSpace(part[i+1:]), "\"")
+			}
+			cc[strings.ToLower(strings.TrimSpace(name))] = value
+		}
+	}
+	return cc
+}
+
+func parseSeconds(v string) time.Duration {
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return 0
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
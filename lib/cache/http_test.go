@@ -0,0 +1,208 @@
+package cache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// target is called only on a miss
+func cacheGet(c *HttpCache, r *http.Request, target func(r *http.Request) *http.Response) (body string, status int, hit bool) {
+	resp, state := c.Lookup(1, r)
+	if resp == nil {
+		resp = target(r)
+		if state != nil {
+			resp, hit = c.Store(state, 0, resp)
+		}
+	} else {
+		hit = true
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return string(b), resp.StatusCode, hit
+}
+
+func newResponse(status int, header http.Header, body string) *http.Response {
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{StatusCode: status, Header: header, Body: io.NopCloser(strings.NewReader(body)), ContentLength: int64(len(body))}
+}
+
+func TestHttpCacheFreshness(t *testing.T) {
+	c := NewHttpCache(1<<20, 0)
+	calls := 0
+	target := func(r *http.Request) *http.Response {
+		calls++
+		return newResponse(200, http.Header{"Cache-Control": {"max-age=60"}}, "a")
+	}
+	for i := 0; i < 3; i++ {
+		if body, _, _ := cacheGet(c, httptest.NewRequest("GET", "http://a.test/a.css", nil), target); body != "a" {
+			t.Fatalf("the body is %q", body)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("the target is called %d times", calls)
+	}
+	// the request can refuse the cached response
+	r := httptest.NewRequest("GET", "http://a.test/a.css", nil)
+	r.Header.Set("Cache-Control", "no-cache")
+	if _, _, hit := cacheGet(c, r, target); hit || calls != 2 {
+		t.Fatal("the no-cache request is served from the cache")
+	}
+	// the unsafe method invalidates the url
+	cacheGet(c, httptest.NewRequest("POST", "http://a.test/a.css", nil), target)
+	if n, _ := c.Len(); n != 0 {
+		t.Fatalf("%d entries are left after the post", n)
+	}
+
+	// not stored
+	for _, header := range []http.Header{
+		{"Cache-Control": {"no-store"}},
+		{"Cache-Control": {"private, max-age=60"}},
+		{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}},
+		{"Cache-Control": {"max-age=60"}, "Vary": {"*"}},
+		{},
+	} {
+		c.Purge(1)
+		cacheGet(c, httptest.NewRequest("GET", "http://a.test/b", nil), func(r *http.Request) *http.Response {
+			return newResponse(200, header.Clone(), "b")
+		})
+		if n, _ := c.Len(); n != 0 {
+			t.Fatalf("the response with %v is stored", header)
+		}
+	}
+	// the response of the request with the authorization is stored only if it is public
+	r = httptest.NewRequest("GET", "http://a.test/c", nil)
+	r.Header.Set("Authorization", "Basic YTpi")
+	cacheGet(c, r, target)
+	if n, _ := c.Len(); n != 0 {
+		t.Fatal("the response of the authorized request is stored")
+	}
+}
+
+func TestHttpCacheExpires(t *testing.T) {
+	c := NewHttpCache(1<<20, 0)
+	now := time.Now()
+	target := func(r *http.Request) *http.Response {
+		return newResponse(200, http.Header{
+			"Date":    {now.UTC().Format(http.TimeFormat)},
+			"Expires": {now.Add(-time.Minute).UTC().Format(http.TimeFormat)},
+			"Etag":    {`"v1"`},
+		}, "a")
+	}
+	cacheGet(c, httptest.NewRequest("GET", "http://a.test/", nil), target)
+	if _, _, hit := cacheGet(c, httptest.NewRequest("GET", "http://a.test/", nil), target); hit {
+		t.Fatal("the expired response is served without revalidation")
+	}
+	// the ttl of the host replaces the lifetime of the headers
+	resp, state := c.Lookup(1, httptest.NewRequest("GET", "http://a.test/ttl", nil))
+	if resp != nil {
+		t.Fatal("the response is found before it is stored")
+	}
+	c.Store(state, time.Minute, target(nil))
+	if resp, _ := c.Lookup(1, httptest.NewRequest("GET", "http://a.test/ttl", nil)); resp == nil {
+		t.Fatal("the response is not fresh within the ttl of the host")
+	}
+}
+
+func TestHttpCacheVary(t *testing.T) {
+	c := NewHttpCache(1<<20, 0)
+	target := func(r *http.Request) *http.Response {
+		return newResponse(200, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Encoding"}}, r.Header.Get("Accept-Encoding"))
+	}
+	get := func(encoding string) (string, bool) {
+		r := httptest.NewRequest("GET", "http://a.test/v", nil)
+		r.Header.Set("Accept-Encoding", encoding)
+		body, _, hit := cacheGet(c, r, target)
+		return body, hit
+	}
+	get("gzip")
+	get("br")
+	for _, encoding := range []string{"gzip", "br"} {
+		if body, hit := get(encoding); !hit || body != encoding {
+			t.Fatalf("the response of %s is %q, hit %t", encoding, body, hit)
+		}
+	}
+	if n, _ := c.Len(); n != 2 {
+		t.Fatalf("%d entries are stored, want 2", n)
+	}
+}
+
+func TestHttpCacheRevalidate(t *testing.T) {
+	c := NewHttpCache(1<<20, 0)
+	lastModified := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	var conditions []string
+	target := func(r *http.Request) *http.Response {
+		conditions = append(conditions, r.Header.Get("If-None-Match"))
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			return newResponse(304, http.Header{"Cache-Control": {"max-age=60"}}, "")
+		}
+		return newResponse(200, http.Header{"Cache-Control": {"max-age=0"}, "Etag": {`"v1"`}, "Last-Modified": {lastModified}}, "body")
+	}
+	cacheGet(c, httptest.NewRequest("GET", "http://a.test/r", nil), target)
+	// the stale entry is revalidated by the conditional request
+	body, status, hit := cacheGet(c, httptest.NewRequest("GET", "http://a.test/r", nil), target)
+	if body != "body" || status != 200 || !hit || len(conditions) != 2 || conditions[1] != `"v1"` {
+		t.Fatalf("the revalidation got %q %d %t, conditions %v", body, status, hit, conditions)
+	}
+	if _, _, hit := cacheGet(c, httptest.NewRequest("GET", "http://a.test/r", nil), target); !hit || len(conditions) != 2 {
+		t.Fatal("the revalidated entry is not fresh")
+	}
+	// the conditions of the visitor are answered from the cache
+	r := httptest.NewRequest("GET", "http://a.test/r", nil)
+	r.Header.Set("If-None-Match", `W/"v1"`)
+	if _, status, _ := cacheGet(c, r, target); status != 304 {
+		t.Fatalf("the status of the conditional request is %d", status)
+	}
+	r = httptest.NewRequest("GET", "http://a.test/r", nil)
+	r.Header.Set("If-Modified-Since", time.Now().UTC().Format(http.TimeFormat))
+	if _, status, _ := cacheGet(c, r, target); status != 304 {
+		t.Fatalf("the status of the request modified since now is %d", status)
+	}
+}
+
+func TestHttpCacheSize(t *testing.T) {
+	c := NewHttpCache(2048, 1024)
+	target := func(r *http.Request) *http.Response {
+		return newResponse(200, http.Header{"Cache-Control": {"max-age=60"}}, strings.Repeat("a", 700))
+	}
+	for _, path := range []string{"/1", "/2", "/3"} {
+		cacheGet(c, httptest.NewRequest("GET", "http://a.test"+path, nil), target)
+	}
+	// the oldest entry is removed to keep the total size
+	if n, size := c.Len(); n != 3-1 || size > 2048 {
+		t.Fatalf("%d entries of %d bytes are stored", n, size)
+	}
+	if resp, _ := c.Lookup(1, httptest.NewRequest("GET", "http://a.test/1", nil)); resp != nil {
+		t.Fatal("the oldest entry is not removed")
+	}
+	// the large response is passed without storing, the body is not lost
+	body, _, _ := cacheGet(c, httptest.NewRequest("GET", "http://a.test/large", nil), func(r *http.Request) *http.Response {
+		resp := newResponse(200, http.Header{"Cache-Control": {"max-age=60"}}, strings.Repeat("b", 2000))
+		resp.ContentLength = -1
+		return resp
+	})
+	if len(body) != 2000 {
+		t.Fatalf("the body of the large response is %d bytes", len(body))
+	}
+	if resp, _ := c.Lookup(1, httptest.NewRequest("GET", "http://a.test/large", nil)); resp != nil {
+		t.Fatal("the large response is stored")
+	}
+
+	// purge the entries of the host only
+	resp, state := c.Lookup(2, httptest.NewRequest("GET", "http://a.test/2", nil))
+	if resp != nil {
+		t.Fatal("the entry of the other host is used")
+	}
+	c.Store(state, 0, target(nil))
+	if n := c.Purge(1); n != 1 {
+		t.Fatalf("%d entries of the host are purged", n)
+	}
+	if n, _ := c.Len(); n != 1 {
+		t.Fatalf("%d entries are left after the purge", n)
+	}
+}
@@ -18,15 +18,21 @@ const (
 	WORK_P2P_END      = "p2pe"
 	WORK_P2P_LAST     = "p2pl"
 	WORK_STATUS       = "stus"
+	WORK_PROBE        = "prob"
+	WORK_PROFILE      = "prfl"
 	RES_MSG           = "msg0"
 	RES_CLOSE         = "clse"
 	NEW_UDP_CONN      = "udpc" //p2p udp conn
 	NEW_TASK          = "task"
 	NEW_CONF          = "conf"
 	NEW_HOST          = "host"
+	NEW_PROFILE       = "prof"
 	CONN_TCP          = "tcp"
 	CONN_UDP          = "udp"
 	CONN_TEST         = "TST"
+	CONN_CMD          = "cmd"
+	DIAL_SUCCESS      = "dlok" //dial result
+	DIAL_FAIL         = "dler"
 	DEFAULT_TIME      = "2006-01-02 15:04:05"
 	UnauthorizedBytes = `HTTP/1.1 401 Unauthorized
 Content-Type: text/plain; charset=utf-8
@@ -1,9 +1,12 @@
 package config
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"ehang.io/nps/lib/common"
@@ -19,6 +22,19 @@ type CommonConfig struct {
 	ProxyUrl         string
 	Client           *file.Client
 	DisconnectTime   int
+	MuxNum           int
+	ServerMode       string // priority, round or all
+	WsPath           string // websocket bridge
+	WsHost           string
+	WsHeader         string // Name:Value, one per line
+	TlsCertFile      string // issued by the ca of nps
+	TlsKeyFile       string
+	TlsVerify        bool   // by the system roots
+	TlsServerName    string // the host of the server address if empty
+	TlsCaFile        string
+	TlsFingerprint   string // sha256 of the spki of the server certificate or the ca
+	DisableCommand   string // comma separated, or all
+	EnableCommand    string // config_write, test_http
 }
 
 type LocalServer struct {
@@ -40,60 +56,103 @@ type Config struct {
 }
 
 func NewConfig(path string) (c *Config, err error) {
-	c = new(Config)
 	var b []byte
 	if b, err = common.ReadAllFromFile(path); err != nil {
 		return
-	} else {
-		if c.content, err = common.ParseStr(string(b)); err != nil {
+	}
+	return parseConfig(string(b), readLocalFile)
+}
+
+// the multi account files come from files instead of the disk
+func NewConfigFromProfile(content string, files map[string]string) (*Config, error) {
+	return parseConfig(content, func(name string) ([]byte, error) {
+		if v, ok := files[name]; ok {
+			return []byte(v), nil
+		}
+		return nil, os.ErrNotExist
+	})
+}
+
+// deep copy, so the sessions to different servers share no host, task or health
+func (c *Config) Clone() (*Config, error) {
+	n := *c
+	n.CommonConfig = new(CommonConfig)
+	n.Hosts, n.Tasks, n.Healths, n.LocalServer = nil, nil, nil, nil
+	for _, v := range []struct{ src, dst interface{} }{
+		{c.CommonConfig, n.CommonConfig},
+		{c.Hosts, &n.Hosts},
+		{c.Tasks, &n.Tasks},
+		{c.Healths, &n.Healths},
+		{c.LocalServer, &n.LocalServer},
+	} {
+		b, err := json.Marshal(v.src)
+		if err != nil {
 			return nil, err
 		}
-		if c.title, err = getAllTitle(c.content); err != nil {
-			return
+		if err := json.Unmarshal(b, v.dst); err != nil {
+			return nil, err
 		}
-		var nowIndex int
-		var nextIndex int
-		var nowContent string
-		for i := 0; i < len(c.title); i++ {
-			nowIndex = strings.Index(c.content, c.title[i]) + len(c.title[i])
-			if i < len(c.title)-1 {
-				nextIndex = strings.Index(c.content, c.title[i+1])
-			} else {
-				nextIndex = len(c.content)
-			}
-			nowContent = c.content[nowIndex:nextIndex]
+	}
+	return &n, nil
+}
 
-			if strings.Index(getTitleContent(c.title[i]), "secret") == 0 && !strings.Contains(nowContent, "mode") {
-				local := delLocalService(nowContent)
-				local.Type = "secret"
-				c.LocalServer = append(c.LocalServer, local)
-				continue
-			}
-			//except mode
-			if strings.Index(getTitleContent(c.title[i]), "p2p") == 0 && !strings.Contains(nowContent, "mode") {
-				local := delLocalService(nowContent)
-				local.Type = "p2p"
-				c.LocalServer = append(c.LocalServer, local)
-				continue
-			}
-			//health set
-			if strings.Index(getTitleContent(c.title[i]), "health") == 0 {
-				c.Healths = append(c.Healths, dealHealth(nowContent))
-				continue
-			}
-			switch c.title[i] {
-			case "[common]":
-				c.CommonConfig = dealCommon(nowContent)
-			default:
-				if strings.Index(nowContent, "host") > -1 {
-					h := dealHost(nowContent)
-					h.Remark = getTitleContent(c.title[i])
-					c.Hosts = append(c.Hosts, h)
-				} else {
-					t := dealTunnel(nowContent)
-					t.Remark = getTitleContent(c.title[i])
-					c.Tasks = append(c.Tasks, t)
-				}
+func readLocalFile(path string) ([]byte, error) {
+	if !common.FileExists(path) {
+		return nil, os.ErrNotExist
+	}
+	return common.ReadAllFromFile(path)
+}
+
+func parseConfig(content string, readFile func(name string) ([]byte, error)) (c *Config, err error) {
+	c = new(Config)
+	if c.content, err = common.ParseStr(content); err != nil {
+		return nil, err
+	}
+	if c.title, err = getAllTitle(c.content); err != nil {
+		return
+	}
+	var nowIndex int
+	var nextIndex int
+	var nowContent string
+	for i := 0; i < len(c.title); i++ {
+		nowIndex = strings.Index(c.content, c.title[i]) + len(c.title[i])
+		if i < len(c.title)-1 {
+			nextIndex = strings.Index(c.content, c.title[i+1])
+		} else {
+			nextIndex = len(c.content)
+		}
+		nowContent = c.content[nowIndex:nextIndex]
+
+		if strings.Index(getTitleContent(c.title[i]), "secret") == 0 && !strings.Contains(nowContent, "mode") {
+			local := delLocalService(nowContent)
+			local.Type = "secret"
+			c.LocalServer = append(c.LocalServer, local)
+			continue
+		}
+		//except mode
+		if strings.Index(getTitleContent(c.title[i]), "p2p") == 0 && !strings.Contains(nowContent, "mode") {
+			local := delLocalService(nowContent)
+			local.Type = "p2p"
+			c.LocalServer = append(c.LocalServer, local)
+			continue
+		}
+		//health set
+		if strings.Index(getTitleContent(c.title[i]), "health") == 0 {
+			c.Healths = append(c.Healths, dealHealth(nowContent))
+			continue
+		}
+		switch c.title[i] {
+		case "[common]":
+			c.CommonConfig = dealCommon(nowContent)
+		default:
+			if strings.Index(nowContent, "host") > -1 {
+				h := dealHost(nowContent)
+				h.Remark = getTitleContent(c.title[i])
+				c.Hosts = append(c.Hosts, h)
+			} else {
+				t := dealTunnel(nowContent, readFile)
+				t.Remark = getTitleContent(c.title[i])
+				c.Tasks = append(c.Tasks, t)
 			}
 		}
 	}
@@ -151,13 +210,54 @@ func dealCommon(s string) *CommonConfig {
 			common.InitPProfFromArg(item[1])
 		case "disconnect_timeout":
 			c.DisconnectTime = common.GetIntNoErrByStr(item[1])
+		case "server_mode":
+			c.ServerMode = item[1]
+		case "mux_num":
+			c.MuxNum = common.GetIntNoErrByStr(item[1])
 		case "tls_enable":
 			c.TlsEnable = common.GetBoolByStr(item[1])
+		case "ws_path":
+			c.WsPath = item[1]
+		case "ws_host":
+			c.WsHost = item[1]
+		case "tls_cert_file":
+			c.TlsCertFile = item[1]
+		case "tls_key_file":
+			c.TlsKeyFile = item[1]
+		case "tls_verify":
+			c.TlsVerify = common.GetBoolByStr(item[1])
+		case "tls_server_name":
+			c.TlsServerName = item[1]
+		case "tls_ca_file":
+			c.TlsCaFile = item[1]
+		case "tls_fingerprint":
+			c.TlsFingerprint = item[1]
+		case "disable_command":
+			c.DisableCommand = item[1]
+		case "enable_command":
+			c.EnableCommand = item[1]
+		default:
+			if strings.HasPrefix(item[0], "ws_header_") {
+				c.WsHeader += strings.TrimPrefix(item[0], "ws_header_") + ":" + strings.Join(item[1:], "=") + "\n"
+			}
 		}
 	}
 	return c
 }
 
+func setErrorPage(h *file.Host, code, page string) {
+	switch code {
+	case "404":
+		h.ErrorPage404 = page
+	case "502":
+		h.ErrorPage502 = page
+	case "503":
+		h.ErrorPage503 = page
+	case "504":
+		h.ErrorPage504 = page
+	}
+}
+
 func dealHost(s string) *file.Host {
 	h := &file.Host{}
 	h.Target = new(file.Target)
@@ -181,6 +281,69 @@ func dealHost(s string) *file.Host {
 			h.Scheme = item[1]
 		case "location":
 			h.Location = item[1]
+		case "no_cache":
+			h.NoCache = common.GetBoolByStr(item[1])
+		case "cache_ttl":
+			h.CacheTtl, _ = strconv.Atoi(item[1])
+		case "http_compress":
+			h.HttpCompress = common.GetBoolByStr(item[1])
+		case "compress_types":
+			h.CompressTypes = strings.Replace(item[1], ",", "\n", -1)
+		case "auth_users":
+			// the password and the url may contain =
+			h.AuthUsers = strings.Replace(strings.Join(item[1:], "="), ",", "\n", -1)
+		case "forward_auth_url":
+			h.ForwardAuthUrl = strings.TrimSpace(strings.Join(item[1:], "="))
+		case "forward_auth_headers":
+			h.ForwardAuthHeaders = item[1]
+		case "allow_ips":
+			h.AllowIps = strings.Replace(item[1], ",", "\n", -1)
+		case "deny_ips":
+			h.DenyIps = strings.Replace(item[1], ",", "\n", -1)
+		case "rate_limit":
+			h.RateLimit, _ = strconv.Atoi(item[1])
+		case "rate_burst":
+			h.RateBurst, _ = strconv.Atoi(item[1])
+		case "maintenance":
+			h.Maintenance = common.GetBoolByStr(item[1])
+		case "error_page_404", "error_page_502", "error_page_503", "error_page_504":
+			// the value is the path of the page
+			if b, err := common.ReadAllFromFile(item[1]); err == nil {
+				setErrorPage(h, strings.TrimPrefix(item[0], "error_page_"), string(b))
+			}
+		case "http2":
+			h.Http2 = common.GetBoolByStr(item[1])
+		case "backend_proto":
+			h.BackendProto = item[1]
+		case "target_tls_server_name":
+			h.TargetTlsServerName = item[1]
+		case "target_tls_insecure":
+			h.TargetTlsInsecure = common.GetBoolByStr(item[1])
+		case "target_tls_ca_file":
+			h.TargetTlsCa = readCertFile(item[1])
+		case "proxy_protocol":
+			h.ProxyProtocol, _ = strconv.Atoi(item[1])
+		case "inspect":
+			h.Inspect = common.GetBoolByStr(item[1])
+		case "inspect_credentials":
+			h.InspectCredentials = common.GetBoolByStr(item[1])
+		case "action":
+			h.Action = item[1]
+		case "static_status":
+			h.StaticStatus, _ = strconv.Atoi(item[1])
+		case "static_body":
+			// the value is the path of the body
+			if b, err := common.ReadAllFromFile(item[1]); err == nil {
+				h.StaticBody = string(b)
+			}
+		case "static_content_type":
+			h.StaticContentType = strings.Join(item[1:], "=")
+		case "redirect_url":
+			h.RedirectUrl = strings.TrimSpace(strings.Join(item[1:], "="))
+		case "redirect_code":
+			h.RedirectCode, _ = strconv.Atoi(item[1])
+		case "redirect_keep_path":
+			h.RedirectKeepPath = common.GetBoolByStr(item[1])
 		default:
 			if strings.Contains(item[0], "header") {
 				headerChange += strings.Replace(item[0], "header_", "", -1) + ":" + item[1] + "\n"
@@ -218,7 +381,15 @@ func dealHealth(s string) *file.Health {
 	return h
 }
 
-func dealTunnel(s string) *file.Tunnel {
+// empty if it can not be read
+func readCertFile(path string) string {
+	if b, err := common.ReadAllFromFile(path); err == nil {
+		return string(b)
+	}
+	return ""
+}
+
+func dealTunnel(s string, readFile func(name string) ([]byte, error)) *file.Tunnel {
 	t := &file.Tunnel{}
 	t.Target = new(file.Target)
 	for _, v := range splitStr(s) {
@@ -247,17 +418,33 @@ func dealTunnel(s string) *file.Tunnel {
 			t.LocalPath = item[1]
 		case "strip_pre":
 			t.StripPre = item[1]
+		case "proxy_protocol":
+			t.ProxyProtocol, _ = strconv.Atoi(item[1])
+		case "server_name":
+			t.ServerName = strings.Replace(item[1], ",", "\n", -1)
+		case "alpn":
+			t.Alpn = item[1]
+		case "cert_file":
+			t.CertFile = readCertFile(item[1])
+		case "key_file":
+			t.KeyFile = readCertFile(item[1])
+		case "client_ca_file":
+			t.ClientCa = readCertFile(item[1])
+		case "target_tls_ca_file":
+			t.TargetTlsCa = readCertFile(item[1])
+		case "target_tls":
+			t.TargetTls = common.GetBoolByStr(item[1])
+		case "target_tls_server_name":
+			t.TargetTlsServerName = item[1]
+		case "target_tls_insecure":
+			t.TargetTlsInsecure = common.GetBoolByStr(item[1])
 		case "multi_account":
 			t.MultiAccount = &file.MultiAccount{}
-			if common.FileExists(item[1]) {
-				if b, err := common.ReadAllFromFile(item[1]); err != nil {
+			if b, err := readFile(item[1]); err == nil {
+				if content, err := common.ParseStr(string(b)); err != nil {
 					panic(err)
 				} else {
-					if content, err := common.ParseStr(string(b)); err != nil {
-						panic(err)
-					} else {
-						t.MultiAccount.AccountMap = dealMultiUser(content)
-					}
+					t.MultiAccount.AccountMap = dealMultiUser(content)
 				}
 			}
 		}
@@ -67,3 +67,58 @@ func TestGetTitleContent(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestNewConfigFromProfile(t *testing.T) {
+	content := `[socks5]
+mode=socks5
+server_port=19009
+multi_account=multi_account.conf
+[secret_ssh]
+local_port=2001
+password=ssh2`
+	c, err := NewConfigFromProfile(content, map[string]string{"multi_account.conf": "user1=pass1\nuser2=pass2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Tasks) != 1 || c.Tasks[0].MultiAccount == nil || c.Tasks[0].MultiAccount.AccountMap["user2"] != "pass2" {
+		t.Fatal("the multi account file of the profile is not read")
+	}
+	if len(c.LocalServer) != 1 || c.LocalServer[0].Type != "secret" || c.LocalServer[0].Port != 2001 {
+		t.Fatal("the local server of the profile is not parsed")
+	}
+	if c, err = NewConfigFromProfile(content, nil); err != nil || len(c.Tasks[0].MultiAccount.AccountMap) != 0 {
+		t.Fatal("the multi account file which is not in the profile should be empty")
+	}
+}
+
+func TestClone(t *testing.T) {
+	c, err := NewConfigFromProfile(`[common]
+server_addr=127.0.0.1:8024,127.0.0.1:8025
+vkey=a
+[health_check]
+health_check_target=127.0.0.1:80
+[web]
+host=a.test
+target_addr=127.0.0.1:80
+[tcp]
+mode=tcp
+server_port=10000
+target_addr=127.0.0.1:22`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := c.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.CommonConfig.VKey = "b"
+	n.Hosts[0].Target.TargetStr = "127.0.0.1:81"
+	n.Tasks[0].Ports = "10001"
+	n.Healths[0].HealthCheckTarget = "127.0.0.1:81"
+	if c.CommonConfig.VKey != "a" || c.Hosts[0].Target.TargetStr != "127.0.0.1:80" || c.Tasks[0].Ports != "10000" || c.Healths[0].HealthCheckTarget != "127.0.0.1:80" {
+		t.Fatal("the config is shared by the copy")
+	}
+	if n.CommonConfig.Server != c.CommonConfig.Server || n.Hosts[0].Host != "a.test" || n.Tasks[0].Mode != "tcp" {
+		t.Fatalf("the config is not copied, %+v", n.CommonConfig)
+	}
+}
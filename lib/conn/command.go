@@ -0,0 +1,82 @@
+package conn
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+const (
+	COMMAND_RELOAD   = "reload" // reread the config file
+	COMMAND_RESTART  = "restart"
+	COMMAND_DIAGNOSE = "diagnose" // goroutines, mux connections and interfaces
+	COMMAND_TEST     = "test"     // tcp or http from the client
+	COMMAND_CONFIG   = "config"   // read, or replace and reload
+)
+
+var Commands = []string{COMMAND_RELOAD, COMMAND_RESTART, COMMAND_DIAGNOSE, COMMAND_TEST, COMMAND_CONFIG}
+
+// seconds
+const (
+	DefaultCommandTimeout = 10
+	MaxCommandTimeout     = 300
+)
+
+// the config file and the stack are sent whole
+const maxCommandSize = 4 << 20
+
+type Command struct {
+	Name    string
+	Args    map[string]string
+	Timeout int
+}
+
+type CommandResult struct {
+	Error string          `json:",omitempty"`
+	Data  json.RawMessage `json:",omitempty"`
+}
+
+func NewCommand(name string, args map[string]string, timeout int) *Command {
+	if timeout <= 0 {
+		timeout = DefaultCommandTimeout
+	} else if timeout > MaxCommandTimeout {
+		timeout = MaxCommandTimeout
+	}
+	return &Command{Name: name, Args: args, Timeout: timeout}
+}
+
+func (s *Command) Arg(name string) string {
+	return s.Args[name]
+}
+
+func (s *Conn) GetCommand() (c *Command, err error) {
+	err = s.getLargeInfo(&c)
+	if err == nil && c == nil {
+		err = errors.New("the command is empty")
+	}
+	return
+}
+
+func (s *Conn) GetCommandResult() (r *CommandResult, err error) {
+	err = s.getLargeInfo(&r)
+	if err == nil && r == nil {
+		err = errors.New("the result of the command is empty")
+	}
+	return
+}
+
+// may exceed the pool buffer
+func (s *Conn) getLargeInfo(t interface{}) error {
+	l, err := s.GetLen()
+	if err != nil {
+		return err
+	}
+	if l < 0 || l > maxCommandSize {
+		return errors.New("the size of the command is too large")
+	}
+	buf := make([]byte, l)
+	if _, err = io.ReadFull(s, buf); err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, t)
+}
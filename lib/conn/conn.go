@@ -3,6 +3,8 @@ package conn
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"ehang.io/nps/lib/goroutine"
 	"encoding/binary"
 	"encoding/json"
@@ -21,7 +23,9 @@ import (
 	"ehang.io/nps/lib/crypt"
 	"ehang.io/nps/lib/file"
 	"ehang.io/nps/lib/pmux"
+	"ehang.io/nps/lib/proxyproto"
 	"ehang.io/nps/lib/rate"
+	"ehang.io/nps/lib/version"
 	"github.com/xtaci/kcp-go"
 )
 
@@ -151,6 +155,12 @@ func (s *Conn) SetAlive(tp string) {
 		//conn.SetKeepAlivePeriod(time.Duration(2 * time.Second))
 	case *pmux.PortConn:
 		s.Conn.(*pmux.PortConn).SetReadDeadline(time.Time{})
+	case *proxyproto.Conn:
+		s.Conn.(*proxyproto.Conn).SetReadDeadline(time.Time{})
+	case *QuicConn:
+		s.Conn.(*QuicConn).SetReadDeadline(time.Time{})
+	case *WsConn:
+		s.Conn.(*WsConn).SetReadDeadline(time.Time{})
 	}
 }
 
@@ -163,15 +173,45 @@ func (s *Conn) SetReadDeadlineBySecond(t time.Duration) {
 		s.Conn.(*net.TCPConn).SetReadDeadline(time.Now().Add(time.Duration(t) * time.Second))
 	case *pmux.PortConn:
 		s.Conn.(*pmux.PortConn).SetReadDeadline(time.Now().Add(time.Duration(t) * time.Second))
+	case *proxyproto.Conn:
+		s.Conn.(*proxyproto.Conn).SetReadDeadline(time.Now().Add(time.Duration(t) * time.Second))
+	case *QuicConn:
+		s.Conn.(*QuicConn).SetReadDeadline(time.Now().Add(time.Duration(t) * time.Second))
+	case *WsConn:
+		s.Conn.(*WsConn).SetReadDeadline(time.Now().Add(time.Duration(t) * time.Second))
 	}
 }
 
+// nil if the connection is not tls or the client sent none
+func (s *Conn) GetPeerCertificate() *x509.Certificate {
+	var certs []*x509.Certificate
+	switch c := s.Conn.(type) {
+	case *tls.Conn:
+		certs = c.ConnectionState().PeerCertificates
+	case *QuicConn:
+		certs = c.conn.ConnectionState().TLS.PeerCertificates
+	case *WsConn:
+		certs = c.peerCerts
+	}
+	if len(certs) == 0 {
+		return nil
+	}
+	return certs[0]
+}
+
 // get link info from conn
 func (s *Conn) GetLinkInfo() (lk *Link, err error) {
 	err = s.getInfo(&lk)
 	return
 }
 
+func (s *Conn) GetCapability() (c *version.Capability, err error) {
+	if err = s.getInfo(&c); err == nil && c == nil {
+		err = errors.New("receive the capability error")
+	}
+	return
+}
+
 // send info for link
 func (s *Conn) SendHealthInfo(info, status string) (int, error) {
 	raw := bytes.NewBuffer([]byte{})
@@ -227,6 +267,12 @@ func (s *Conn) GetTaskInfo() (t *file.Tunnel, err error) {
 	return
 }
 
+// the multi account files may exceed the pool buffer
+func (s *Conn) GetProfile() (p *file.Profile, err error) {
+	err = s.getLargeInfo(&p)
+	return
+}
+
 // send  info
 func (s *Conn) SendInfo(t interface{}, flag string) (int, error) {
 	/*
@@ -374,12 +420,19 @@ func SetUdpSession(sess *kcp.UDPSession) {
 
 // conn1 mux conn
 func CopyWaitGroup(conn1, conn2 net.Conn, crypt bool, snappy bool, rate *rate.Rate,
-	flow *file.Flow, isServer bool, rb []byte, task *file.Tunnel) {
+	flows file.Flows, isServer bool, rb []byte, task *file.Tunnel) {
 	//var in, out int64
 	//var wg sync.WaitGroup
-	connHandle := GetConn(conn1, crypt, snappy, rate, isServer)
+	connHandle, err := GetConn(conn1, crypt, snappy, rate, isServer)
+	if err != nil {
+		logs.Warn("the tls handshake of the link error %s", err.Error())
+		conn2.Close()
+		return
+	}
 	if rb != nil {
 		connHandle.Write(rb)
+		// sent by the visitor
+		flows.AddTcp(int64(len(rb)), 0)
 	}
 	//go func(in *int64) {
 	//	wg.Add(1)
@@ -397,24 +450,28 @@ func CopyWaitGroup(conn1, conn2 net.Conn, crypt bool, snappy bool, rate *rate.Ra
 	//}
 	wg := new(sync.WaitGroup)
 	wg.Add(1)
-	err := goroutine.CopyConnsPool.Invoke(goroutine.NewConns(connHandle, conn2, flow, wg, task))
+	err = goroutine.CopyConnsPool.Invoke(goroutine.NewConns(connHandle, conn2, flows, wg, task))
 	wg.Wait()
 	if err != nil {
 		logs.Error(err)
 	}
 }
 
-// get crypt or snappy conn
-func GetConn(conn net.Conn, cpt, snappy bool, rt *rate.Rate, isServer bool) io.ReadWriteCloser {
+// get crypt or snappy conn, conn is closed if the tls handshake of the client fails
+func GetConn(conn net.Conn, cpt, snappy bool, rt *rate.Rate, isServer bool) (io.ReadWriteCloser, error) {
 	if cpt {
 		if isServer {
-			return rate.NewRateConn(crypt.NewTlsServerConn(conn), rt)
+			return rate.NewRateConn(crypt.NewTlsServerConn(conn), rt), nil
+		}
+		c, err := crypt.NewTlsClientConn(conn, "")
+		if err != nil {
+			return nil, err
 		}
-		return rate.NewRateConn(crypt.NewTlsClientConn(conn), rt)
+		return rate.NewRateConn(c, rt), nil
 	} else if snappy {
-		return rate.NewRateConn(NewSnappyConn(conn), rt)
+		return rate.NewRateConn(NewSnappyConn(conn), rt), nil
 	}
-	return rate.NewRateConn(conn, rt)
+	return rate.NewRateConn(conn, rt), nil
 }
 
 type LenConn struct {
@@ -21,13 +21,22 @@ type Link struct {
 	Compress   bool
 	LocalProxy bool
 	RemoteAddr string
+	DialResult bool // the client replies DIAL_SUCCESS or DIAL_FAIL
 	Option     Options
 }
 
 type Option func(*Options)
 
 type Options struct {
-	Timeout time.Duration
+	Timeout       time.Duration
+	ProxyProtocol int        // proxy protocol version, 0 means no header
+	Tls           *TargetTls // nil means plain tcp
+}
+
+type TargetTls struct {
+	ServerName string // the host of the target if empty
+	Insecure   bool
+	Ca         string // pem, the system roots if empty
 }
 
 var defaultTimeOut = time.Second * 5
@@ -61,3 +70,15 @@ func LinkTimeout(t time.Duration) Option {
 		opt.Timeout = t
 	}
 }
+
+func LinkProxyProtocol(version int) Option {
+	return func(opt *Options) {
+		opt.ProxyProtocol = version
+	}
+}
+
+func LinkTargetTls(t *TargetTls) Option {
+	return func(opt *Options) {
+		opt.Tls = t
+	}
+}
@@ -4,16 +4,18 @@ import (
 	"net"
 	"strings"
 
+	"ehang.io/nps/lib/proxyproto"
 	"github.com/astaxie/beego/logs"
 	"github.com/xtaci/kcp-go"
 )
 
 func NewTcpListenerAndProcess(addr string, f func(c net.Conn), listener *net.Listener) error {
 	var err error
-	*listener, err = net.Listen("tcp", addr)
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
+	*listener = proxyproto.NewListener(l)
 	Accept(*listener, f)
 	return nil
 }
@@ -0,0 +1,106 @@
+package conn
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/crypt"
+	"github.com/astaxie/beego/logs"
+	"github.com/quic-go/quic-go"
+)
+
+const QuicAlpn = "nps"
+
+// wait for the first stream
+var QuicStreamTimeout = 10 * time.Second
+
+// the keep alive holds the nat mapping and lets the server see a new client address quickly
+func newQuicConfig() *quic.Config {
+	return &quic.Config{
+		KeepAlivePeriod: 10 * time.Second,
+		MaxIdleTimeout:  30 * time.Second,
+	}
+}
+
+// the mux runs over the only stream. quic identifies the connection by its id,
+// so it survives the address change of the client
+type QuicConn struct {
+	*quic.Stream
+	conn      *quic.Conn
+	closeOnce sync.Once
+}
+
+func NewQuicConn(conn *quic.Conn, stream *quic.Stream) *QuicConn {
+	return &QuicConn{Stream: stream, conn: conn}
+}
+
+func (s *QuicConn) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *QuicConn) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *QuicConn) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		s.Stream.Close()
+		err = s.conn.CloseWithError(0, "")
+	})
+	return err
+}
+
+// the same certificate as tls_enable
+func NewQuicListenerAndProcess(addr string, f func(c net.Conn)) error {
+	config := crypt.GetServerTlsConfig()
+	config.NextProtos = []string{QuicAlpn}
+	l, err := quic.ListenAddr(addr, config, newQuicConfig())
+	if err != nil {
+		logs.Error(err)
+		return err
+	}
+	AcceptQuic(l, f)
+	return nil
+}
+
+// f gets the first stream of every connection
+func AcceptQuic(l *quic.Listener, f func(c net.Conn)) {
+	for {
+		c, err := l.Accept(context.Background())
+		if err != nil {
+			logs.Warn(err)
+			return
+		}
+		go func(c *quic.Conn) {
+			ctx, cancel := context.WithTimeout(c.Context(), QuicStreamTimeout)
+			defer cancel()
+			stream, err := c.AcceptStream(ctx)
+			if err != nil {
+				logs.Trace("accept the stream from %s error %s", c.RemoteAddr(), err.Error())
+				c.CloseWithError(0, "")
+				return
+			}
+			f(NewQuicConn(c, stream))
+		}(c)
+	}
+}
+
+// the tls config must offer QuicAlpn
+func DialQuic(server string, config *tls.Config, timeout time.Duration) (*QuicConn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	c, err := quic.DialAddr(ctx, server, config, newQuicConfig())
+	if err != nil {
+		return nil, err
+	}
+	stream, err := c.OpenStreamSync(ctx)
+	if err != nil {
+		c.CloseWithError(0, "")
+		return nil, err
+	}
+	return NewQuicConn(c, stream), nil
+}
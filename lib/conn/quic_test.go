@@ -0,0 +1,72 @@
+package conn
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/crypt"
+	"github.com/quic-go/quic-go"
+)
+
+func TestQuic(t *testing.T) {
+	defer func(timeout time.Duration) { QuicStreamTimeout = timeout }(QuicStreamTimeout)
+	QuicStreamTimeout = 200 * time.Millisecond
+	crypt.InitTls("", "")
+	config := crypt.GetServerTlsConfig()
+	config.NextProtos = []string{QuicAlpn}
+	l, err := quic.ListenAddr("127.0.0.1:0", config, newQuicConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	closed := make(chan struct{})
+	go AcceptQuic(l, func(c net.Conn) {
+		io.Copy(c, c)
+		c.Close()
+		close(closed)
+	})
+
+	clientConfig := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{QuicAlpn}}
+	c, err := DialQuic(l.Addr().String(), clientConfig, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// quic only announces the stream with the first data
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("read the echo %q error %v", buf, err)
+	}
+	if c.RemoteAddr().String() != l.Addr().String() {
+		t.Fatalf("the remote address is %s", c.RemoteAddr())
+	}
+	c.Close()
+	c.Close()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection of the server is not closed")
+	}
+
+	// the connection without the stream is closed by the server
+	qc, err := quic.DialAddr(context.Background(), l.Addr().String(), clientConfig, newQuicConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-qc.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection without the stream is not closed")
+	}
+
+	// the alpn of the bridge is required
+	if _, err := DialQuic(l.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h3"}}, time.Second); err == nil {
+		t.Fatal("the connection with the other alpn is accepted")
+	}
+}
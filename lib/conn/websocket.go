@@ -0,0 +1,184 @@
+package conn
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/crypt"
+	"ehang.io/nps/lib/proxyproto"
+	"github.com/astaxie/beego/logs"
+	"golang.org/x/net/websocket"
+)
+
+// empty disables the websocket bridge
+var WsBridgePath = "/ws"
+
+// on the http proxy port only these hosts serve the bridge path, the others are proxied
+var WsBridgeHosts []string
+
+// the mux data goes in binary frames
+type WsConn struct {
+	*websocket.Conn
+	local     net.Addr
+	remote    net.Addr
+	peerCerts []*x509.Certificate // wss only
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewWsConn(ws *websocket.Conn, local, remote net.Addr) *WsConn {
+	ws.PayloadType = websocket.BinaryFrame
+	return &WsConn{Conn: ws, local: local, remote: remote, closed: make(chan struct{})}
+}
+
+// websocket.Conn reports the urls, use the tcp addresses instead
+func (s *WsConn) LocalAddr() net.Addr {
+	return s.local
+}
+
+func (s *WsConn) RemoteAddr() net.Addr {
+	return s.remote
+}
+
+func (s *WsConn) Close() error {
+	err := s.Conn.Close()
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	return err
+}
+
+func IsWsBridgeRequest(r *http.Request) bool {
+	return WsBridgePath != "" && r.URL.Path == WsBridgePath && r.Method == http.MethodGet &&
+		strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+func IsWsBridgeHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, v := range WsBridgeHosts {
+		if strings.EqualFold(v, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns after the connection is closed
+func ServeWs(w http.ResponseWriter, r *http.Request, f func(c net.Conn)) {
+	server := websocket.Server{
+		// no origin check, npc is verified by the vkey
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			c := NewWsConn(ws, getWsLocalAddr(r), getWsRemoteAddr(r))
+			if r.TLS != nil {
+				c.peerCerts = r.TLS.PeerCertificates
+			}
+			f(c)
+			// the websocket server closes the connection when the handler returns
+			<-c.closed
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+// wss uses the same generated certificate as tls_enable
+func NewWsListenerAndProcess(addr string, isTls bool, f func(c net.Conn)) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		logs.Error(err)
+		return err
+	}
+	l = proxyproto.NewListener(l)
+	if isTls {
+		l = tls.NewListener(l, crypt.GetServerTlsConfig())
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(WsBridgePath, func(w http.ResponseWriter, r *http.Request) {
+		if !IsWsBridgeRequest(r) {
+			http.NotFound(w, r)
+			return
+		}
+		ServeWs(w, r, f)
+	})
+	return http.Serve(l, mux)
+}
+
+// the address forwarded by a trusted proxy such as the cdn wins
+func getWsRemoteAddr(r *http.Request) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" && proxyproto.IsTrusted(addr) {
+		if ip := net.ParseIP(strings.TrimSpace(strings.Split(forwarded, ",")[0])); ip != nil {
+			return &net.TCPAddr{IP: ip}
+		}
+	}
+	return addr
+}
+
+func getWsLocalAddr(r *http.Request) net.Addr {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return &net.TCPAddr{}
+}
+
+type WsOption struct {
+	Path   string
+	Host   string // the host of the server address if empty
+	Header http.Header
+}
+
+// c is already a tls connection for wss
+func DialWs(c net.Conn, server string, isTls bool, opt *WsOption) (*WsConn, error) {
+	scheme, origin := "ws://", "http://"
+	if isTls {
+		scheme, origin = "wss://", "https://"
+	}
+	host := server
+	if opt.Host != "" {
+		host = opt.Host
+	}
+	path := opt.Path
+	if path == "" {
+		path = WsBridgePath
+	}
+	config, err := websocket.NewConfig(scheme+host+path, origin+host)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range opt.Header {
+		config.Header[k] = v
+	}
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	ws, err := websocket.NewClient(config, c)
+	if err != nil {
+		return nil, errors.New("websocket handshake error " + err.Error())
+	}
+	c.SetDeadline(time.Time{})
+	return NewWsConn(ws, c.LocalAddr(), c.RemoteAddr()), nil
+}
+
+// Name:Value, one per line
+func ParseWsHeader(s string) http.Header {
+	header := make(http.Header)
+	for _, v := range strings.Split(s, "\n") {
+		kv := strings.SplitN(v, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			continue
+		}
+		header.Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+	return header
+}
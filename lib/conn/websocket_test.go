@@ -0,0 +1,80 @@
+package conn
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWsBridge(t *testing.T) {
+	received := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsWsBridgeRequest(r) {
+			http.NotFound(w, r)
+			return
+		}
+		received <- r.Host + " " + r.Header.Get("X-Custom")
+		ServeWs(w, r, func(c net.Conn) {
+			io.Copy(c, c)
+			c.Close()
+		})
+	}))
+	defer server.Close()
+
+	raw, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt := &WsOption{Host: "nps.test", Header: ParseWsHeader("X-Custom: value\ninvalid")}
+	c, err := DialWs(raw, server.Listener.Addr().String(), false, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if v := <-received; v != "nps.test value" {
+		t.Fatalf("the host and the header of the handshake are %q", v)
+	}
+	// larger than one frame
+	data := make([]byte, 64<<10)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go c.Write(data)
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != string(data) {
+		t.Fatalf("read the echo error %v", err)
+	}
+	if c.RemoteAddr().String() != server.Listener.Addr().String() {
+		t.Fatalf("the remote address is %s", c.RemoteAddr())
+	}
+}
+
+func TestIsWsBridgeRequest(t *testing.T) {
+	defer func(hosts []string) { WsBridgeHosts = hosts }(WsBridgeHosts)
+	WsBridgeHosts = []string{"nps.test"}
+	tests := []struct {
+		url     string
+		upgrade string
+		request bool
+		host    bool
+	}{
+		{"http://nps.test/ws", "websocket", true, true},
+		{"http://NPS.test:8080/ws", "WebSocket", true, true},
+		{"http://nps.test/ws/app", "websocket", false, true},
+		{"http://nps.test/ws", "", false, true},
+		// the path of the other hosts is proxied to their websocket apps
+		{"http://app.test/ws", "websocket", true, false},
+	}
+	for _, v := range tests {
+		r := httptest.NewRequest("GET", v.url, nil)
+		r.Header.Set("Upgrade", v.upgrade)
+		if got := IsWsBridgeRequest(r); got != v.request {
+			t.Errorf("%s %s is the bridge request %t, want %t", v.url, v.upgrade, got, v.request)
+		}
+		if got := IsWsBridgeHost(r.Host); got != v.host {
+			t.Errorf("%s is the bridge host %t, want %t", r.Host, got, v.host)
+		}
+	}
+}
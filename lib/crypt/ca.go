@@ -0,0 +1,204 @@
+package crypt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	caPem  []byte
+)
+
+var ClientCertDays = 3650
+
+// the ca is generated and saved if the files do not exist.
+// the bridge certificate is reissued by the ca, so npc can pin the ca
+func InitCa(certFile, keyFile string) error {
+	if _, err := os.Stat(certFile); os.IsNotExist(err) {
+		if err := generateCa(certFile, keyFile); err != nil {
+			return err
+		}
+	}
+	certPem, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return err
+	}
+	keyPem, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	pair, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		return err
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return errors.New("the key of the ca should be an ecdsa key")
+	}
+	c, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if !c.IsCA {
+		return errors.New("the certificate " + certFile + " is not a ca")
+	}
+	caCert, caKey, caPem = c, key, certPem
+	// keep the certificate loaded from the files
+	if certLoaded {
+		return nil
+	}
+	return issueServerCert()
+}
+
+func IsCaEnable() bool {
+	return caCert != nil
+}
+
+func GetCaPem() []byte {
+	return caPem
+}
+
+func GetCaFingerprint() string {
+	if caCert == nil {
+		return ""
+	}
+	return GetSpkiFingerprint(caCert)
+}
+
+// sha256 of the spki in hex
+func GetSpkiFingerprint(c *x509.Certificate) string {
+	sum := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// a client certificate is optional, but it must be issued by the ca
+func GetServerTlsConfig() *tls.Config {
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if caCert != nil {
+		pool := x509.NewCertPool()
+		pool.AddCert(caCert)
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config
+}
+
+// the serial number maps the certificate to the client
+func IssueClientCert(id int) (certPem, keyPem []byte, serial string, err error) {
+	if caCert == nil {
+		return nil, nil, "", errors.New("the ca is not enabled")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	sn, err := newSerialNumber()
+	if err != nil {
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber: sn,
+		Subject:      pkix.Name{Organization: []string{"NPS Org"}, CommonName: "nps-client-" + strconv.Itoa(id)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(0, 0, ClientCertDays),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return
+	}
+	certPem = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return certPem, keyPem, GetSerial(sn), nil
+}
+
+func GetSerial(sn *big.Int) string {
+	return strings.ToUpper(sn.Text(16))
+}
+
+// sent together with the ca
+func issueServerCert() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	sn, err := newSerialNumber()
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: sn,
+		Subject:      pkix.Name{Organization: []string{"NPS Org"}, CommonName: "nps"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     caCert.NotAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	cert = tls.Certificate{Certificate: [][]byte{der, caCert.Raw}, PrivateKey: key}
+	return nil
+}
+
+func generateCa(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	sn, err := newSerialNumber()
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          sn,
+		Subject:               pkix.Name{Organization: []string{"NPS Org"}, CommonName: "NPS CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(20, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(certFile), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
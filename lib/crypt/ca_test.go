@@ -0,0 +1,204 @@
+package crypt
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// returns the serial of the client certificate seen by the server
+func testHandshake(config *tls.Config) (string, error) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	serial := make(chan string, 1)
+	go func() {
+		c := tls.Server(server, GetServerTlsConfig())
+		if err := c.Handshake(); err != nil {
+			serial <- ""
+			return
+		}
+		if certs := c.ConnectionState().PeerCertificates; len(certs) > 0 {
+			serial <- GetSerial(certs[0].SerialNumber)
+		} else {
+			serial <- ""
+		}
+	}()
+	c := tls.Client(client, config)
+	err := c.Handshake()
+	if err != nil {
+		client.Close()
+	}
+	return <-serial, err
+}
+
+func TestClientCert(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := InitCa(caFile, filepath.Join(dir, "ca.key")); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { caCert, caKey, caPem = nil, nil, nil }()
+	certPem, keyPem, serial, err := IssueClientCert(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	ioutil.WriteFile(certFile, certPem, 0600)
+	ioutil.WriteFile(keyFile, keyPem, 0600)
+
+	// the client certificate is received and the server is verified by the pinned ca
+	config, err := NewClientTlsConfig(certFile, keyFile, &VerifyOption{CaFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := testHandshake(config); err != nil || got != serial {
+		t.Fatalf("got serial %q error %v, want %q", got, err, serial)
+	}
+
+	// the fingerprint of the ca is pinned
+	config, _ = NewClientTlsConfig("", "", &VerifyOption{Fingerprint: GetCaFingerprint()})
+	if got, err := testHandshake(config); err != nil || got != "" {
+		t.Fatalf("got serial %q error %v, want no certificate", got, err)
+	}
+
+	// the server is not the pinned one
+	config, _ = NewClientTlsConfig("", "", &VerifyOption{Fingerprint: strings.Repeat("0", 64)})
+	if _, err := testHandshake(config); err == nil || !strings.Contains(err.Error(), "fingerprint") {
+		t.Fatalf("want the fingerprint error, got %v", err)
+	}
+	otherCa := filepath.Join(t.TempDir(), "ca.pem")
+	if err := generateCa(otherCa, filepath.Join(filepath.Dir(otherCa), "ca.key")); err != nil {
+		t.Fatal(err)
+	}
+	config, _ = NewClientTlsConfig("", "", &VerifyOption{CaFile: otherCa})
+	if _, err := testHandshake(config); err == nil {
+		t.Fatal("the server certificate issued by the other ca is accepted")
+	}
+	// every option must pass
+	config, _ = NewClientTlsConfig("", "", &VerifyOption{CaFile: otherCa, Fingerprint: GetCaFingerprint()})
+	if _, err := testHandshake(config); err == nil {
+		t.Fatal("the server certificate issued by the other ca is accepted with the pinned fingerprint")
+	}
+	// the internal ca is not in the system roots
+	config, _ = NewClientTlsConfig("", "", &VerifyOption{Verify: true, ServerName: "nps"})
+	if _, err := testHandshake(config); err == nil || !strings.Contains(err.Error(), "verify the server certificate error") {
+		t.Fatalf("want the verification error, got %v", err)
+	}
+}
+
+func TestPinnedCaForgedLeaf(t *testing.T) {
+	dir := t.TempDir()
+	old := cert
+	if err := InitCa(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key")); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { caCert, caKey, caPem, cert = nil, nil, nil, old }()
+	// a self-signed leaf sent with the real ca, which is public
+	rawCert, rawKey, err := generateKeyPair("nps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := tls.X509KeyPair(rawCert, rawKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged.Certificate = append(forged.Certificate, caCert.Raw)
+	cert = forged
+	config, _ := NewClientTlsConfig("", "", &VerifyOption{Fingerprint: GetCaFingerprint()})
+	if _, err := testHandshake(config); err == nil {
+		t.Fatal("the forged certificate is accepted with the pinned ca")
+	}
+	// the leaf itself may be pinned
+	leaf, _ := x509.ParseCertificate(forged.Certificate[0])
+	config, _ = NewClientTlsConfig("", "", &VerifyOption{Fingerprint: GetSpkiFingerprint(leaf)})
+	if _, err := testHandshake(config); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewTlsClientConn(t *testing.T) {
+	dir := t.TempDir()
+	if err := InitCa(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key")); err != nil {
+		t.Fatal(err)
+	}
+	defer func(old *tls.Config) { caCert, caKey, caPem, clientTlsConfig = nil, nil, nil, old }(clientTlsConfig)
+	for _, fingerprint := range []string{GetCaFingerprint(), strings.Repeat("0", 64)} {
+		config, _ := NewClientTlsConfig("", "", &VerifyOption{Fingerprint: fingerprint})
+		SetClientTlsConfig(config)
+		server, client := net.Pipe()
+		go tls.Server(server, GetServerTlsConfig()).Handshake()
+		c, err := NewTlsClientConn(client, "")
+		server.Close()
+		if fingerprint == GetCaFingerprint() {
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Close()
+			continue
+		}
+		// the conn of the failed handshake is closed instead of returned
+		if err == nil || c != nil {
+			t.Fatal("the server which is not pinned is accepted")
+		}
+		if _, err := client.Write([]byte{0}); err != io.ErrClosedPipe {
+			t.Fatalf("the conn is not closed, %v", err)
+		}
+	}
+}
+
+func TestVerifyServerName(t *testing.T) {
+	defer func(old *tls.Config) { systemRoots, clientTlsConfig = nil, old }(clientTlsConfig)
+	systemRoots = x509.NewCertPool()
+	servers := make(map[string]tls.Certificate)
+	for _, name := range []string{"a.test", "b.test"} {
+		key, _ := rsa.GenerateKey(rand.Reader, 2048)
+		template := &x509.Certificate{SerialNumber: big.NewInt(1), DNSNames: []string{name},
+			NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, _ := x509.ParseCertificate(der)
+		systemRoots.AddCert(c)
+		servers[name] = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	config, err := NewClientTlsConfig("", "", &VerifyOption{Verify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetClientTlsConfig(config)
+	dial := func(server, name string) error {
+		s, c := net.Pipe()
+		go func() {
+			tls.Server(s, &tls.Config{Certificates: []tls.Certificate{servers[server]}}).Handshake()
+			s.Close()
+		}()
+		conn, err := NewTlsClientConn(c, name)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	// every server is verified by the name it is dialed with
+	for name := range servers {
+		if err := dial(name, name); err != nil {
+			t.Fatalf("verify the server %s error %v", name, err)
+		}
+	}
+	if dial("b.test", "a.test") == nil {
+		t.Fatal("the server of the other name is accepted")
+	}
+	if err := dial("a.test", ""); err == nil || !strings.Contains(err.Error(), "the server name is required") {
+		t.Fatalf("want the server name error, got %v", err)
+	}
+}
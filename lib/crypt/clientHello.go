@@ -47,6 +47,10 @@ func (m *ClientHelloMsg) GetServerName() string {
 	return m.serverName
 }
 
+func (m *ClientHelloMsg) GetAlpnProtocols() []string {
+	return m.alpnProtocols
+}
+
 func (m *ClientHelloMsg) Unmarshal(data []byte) bool {
 	if len(data) < 42 {
 		return false
@@ -7,20 +7,37 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
+	"io/ioutil"
 	"log"
 	"math/big"
 	"net"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/astaxie/beego/logs"
 )
 
 var (
-	cert tls.Certificate
+	cert       tls.Certificate
+	certLoaded bool // from the files, not generated
+	// shared by the bridge and the encrypted links
+	clientTlsConfig = &tls.Config{InsecureSkipVerify: true}
+	// nil means the system roots
+	systemRoots *x509.CertPool
 )
 
-func InitTls() {
+// generate one if the files are not set
+func InitTls(certFile, keyFile string) {
+	var err error
+	if certFile != "" && keyFile != "" {
+		if cert, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			log.Fatalln("Error loading the certificate", certFile, err)
+		}
+		certLoaded = true
+		return
+	}
 	c, k, err := generateKeyPair("NPS Org")
 	if err == nil {
 		cert, err = tls.X509KeyPair(c, k)
@@ -45,11 +62,114 @@ func NewTlsServerConn(conn net.Conn) net.Conn {
 	return tls.Server(conn, config)
 }
 
-func NewTlsClientConn(conn net.Conn) net.Conn {
-	conf := &tls.Config{
-		InsecureSkipVerify: true,
+func SetClientTlsConfig(config *tls.Config) {
+	clientTlsConfig = config
+}
+
+func GetClientTlsConfig() *tls.Config {
+	return clientTlsConfig.Clone()
+}
+
+// handshake now, so a verification error is returned instead of a later read error.
+// serverName is used unless the config sets one
+func NewTlsClientConn(conn net.Conn, serverName string) (net.Conn, error) {
+	config := GetClientTlsConfig()
+	if config.ServerName == "" {
+		config.ServerName = serverName
+	}
+	c := tls.Client(conn, config)
+	if err := c.Handshake(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// every option which is set must pass
+type VerifyOption struct {
+	Verify      bool   // by the system roots, unless CaFile is set
+	ServerName  string // the host of the dialed server if empty
+	CaFile      string // the host name is not checked, npc usually dials an ip
+	Fingerprint string // sha256 of the spki of any certificate in the chain
+}
+
+func (opt *VerifyOption) IsEmpty() bool {
+	return opt == nil || (!opt.Verify && opt.CaFile == "" && opt.Fingerprint == "")
+}
+
+// an empty option does not verify the server
+func NewClientTlsConfig(certFile, keyFile string, opt *VerifyOption) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: true, ServerName: opt.ServerName}
+	if certFile != "" {
+		pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	if opt.IsEmpty() {
+		return config, nil
+	}
+	var pool *x509.CertPool
+	if opt.CaFile != "" {
+		b, err := ioutil.ReadFile(opt.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.New("no certificate is found in the ca file " + opt.CaFile)
+		}
+	}
+	fingerprint := strings.ToLower(strings.Replace(opt.Fingerprint, ":", "", -1))
+	verify := opt.Verify || pool != nil
+	// the name is checked against the server of each dial, a pinned ca or fingerprint
+	// works without it
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		certs := cs.PeerCertificates
+		if len(certs) == 0 {
+			return errors.New("verify the server certificate error, the server does not send the certificate")
+		}
+		if fingerprint != "" && GetSpkiFingerprint(certs[0]) != fingerprint {
+			// a pinned ca must sign the server certificate
+			var ca *x509.Certificate
+			for _, c := range certs[1:] {
+				if GetSpkiFingerprint(c) == fingerprint {
+					ca = c
+					break
+				}
+			}
+			if ca == nil {
+				return errors.New("verify the server certificate error, the fingerprint " + GetSpkiFingerprint(certs[0]) + " does not match the pinned one")
+			}
+			options := x509.VerifyOptions{Roots: x509.NewCertPool(), Intermediates: x509.NewCertPool()}
+			options.Roots.AddCert(ca)
+			for _, c := range certs[1:] {
+				options.Intermediates.AddCert(c)
+			}
+			if _, err := certs[0].Verify(options); err != nil {
+				return errors.New("verify the server certificate error, " + err.Error())
+			}
+		}
+		if verify {
+			options := x509.VerifyOptions{Roots: pool, Intermediates: x509.NewCertPool()}
+			if pool == nil {
+				options.Roots = systemRoots
+				if cs.ServerName == "" {
+					return errors.New("verify the server certificate error, the server name is required by the system roots")
+				}
+				options.DNSName = cs.ServerName
+			}
+			for _, c := range certs[1:] {
+				options.Intermediates.AddCert(c)
+			}
+			if _, err := certs[0].Verify(options); err != nil {
+				return errors.New("verify the server certificate error, " + err.Error())
+			}
+		}
+		return nil
 	}
-	return tls.Client(conn, conf)
+	return config, nil
 }
 
 func generateKeyPair(CommonName string) (rawCert, rawKey []byte, err error) {
@@ -30,6 +30,7 @@ func GetDb() *DbUtils {
 		jsonDb.LoadTaskFromJsonFile()
 		jsonDb.LoadHostFromJsonFile()
 		jsonDb.LoadGlobalFromJsonFile()
+		jsonDb.MigrateFlow()
 		Db = &DbUtils{JsonDb: jsonDb}
 	})
 	return Db
@@ -92,6 +93,27 @@ func (s *DbUtils) GetIdByVerifyKey(vKey string, addr string) (id int, err error)
 	return 0, errors.New("not found")
 }
 
+func (s *DbUtils) GetIdByCertSerial(serial string, addr string) (id int, err error) {
+	var exist bool
+	s.JsonDb.Clients.Range(func(key, value interface{}) bool {
+		v := value.(*Client)
+		v.RLock()
+		matched := v.CertSerial != "" && v.CertSerial == serial
+		v.RUnlock()
+		if matched && v.Status {
+			v.Addr = common.GetIpByAddr(addr)
+			id = v.Id
+			exist = true
+			return false
+		}
+		return true
+	})
+	if exist {
+		return
+	}
+	return 0, errors.New("not found")
+}
+
 func (s *DbUtils) NewTask(t *Tunnel) (err error) {
 	s.JsonDb.Tasks.Range(func(key, value interface{}) bool {
 		v := value.(*Tunnel)
@@ -104,12 +126,57 @@ func (s *DbUtils) NewTask(t *Tunnel) (err error) {
 	if err != nil {
 		return
 	}
+	if err = s.CheckSniRoute(t); err != nil {
+		return
+	}
 	t.Flow = new(Flow)
 	s.JsonDb.Tasks.Store(t.Id, t)
 	s.JsonDb.StoreTasksToJsonFile()
 	return
 }
 
+// sni tunnels on one port can not route the same server name and alpn
+func (s *DbUtils) CheckSniRoute(t *Tunnel) (err error) {
+	if t.Mode != "sni" {
+		return
+	}
+	names := t.GetServerNames()
+	if len(names) == 0 {
+		return errors.New("the server name of the sni mode can not be empty")
+	}
+	alpn := t.GetAlpn()
+	s.JsonDb.Tasks.Range(func(key, value interface{}) bool {
+		v := value.(*Tunnel)
+		if v.Mode != "sni" || v.Port != t.Port || v.Id == t.Id {
+			return true
+		}
+		if !isAlpnOverlap(alpn, v.GetAlpn()) {
+			return true
+		}
+		for _, name := range v.GetServerNames() {
+			if common.InStrArr(names, name) {
+				err = errors.New(fmt.Sprintf("the server name %s of the port %d is used by the tunnel %d", name, t.Port, v.Id))
+				return false
+			}
+		}
+		return true
+	})
+	return
+}
+
+// a route with the alpn is tried before one without it, so they do not conflict
+func isAlpnOverlap(a, b []string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	for _, v := range a {
+		if common.InStrArr(b, v) {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *DbUtils) UpdateTask(t *Tunnel) error {
 	s.JsonDb.Tasks.Store(t.Id, t)
 	s.JsonDb.StoreTasksToJsonFile()
@@ -4,24 +4,22 @@ import (
 	"encoding/json"
 	"errors"
 	"github.com/astaxie/beego/logs"
-	"os"
 	"path/filepath"
-	"strings"
 	"sync"
-	"sync/atomic"
 
-	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/rate"
 )
 
 func NewJsonDb(runPath string) *JsonDb {
-	return &JsonDb{
+	s := &JsonDb{
 		RunPath:        runPath,
 		TaskFilePath:   filepath.Join(runPath, "conf", "tasks.json"),
 		HostFilePath:   filepath.Join(runPath, "conf", "hosts.json"),
 		ClientFilePath: filepath.Join(runPath, "conf", "clients.json"),
 		GlobalFilePath: filepath.Join(runPath, "conf", "global.json"),
 	}
+	s.Store = NewFileStore(s.ClientFilePath, s.TaskFilePath, s.HostFilePath, s.GlobalFilePath)
+	return s
 }
 
 type JsonDb struct {
@@ -38,10 +36,19 @@ type JsonDb struct {
 	HostFilePath     string //host file path
 	ClientFilePath   string //client file path
 	GlobalFilePath   string //global file path
+	Store            Store  //json files by default
+	// the cluster, see EnableCluster
+	nodeId   string
+	idStep   int32
+	idOffset int32
+	revLock  sync.Mutex
+	clock    int64
+	revs     map[string]map[int]*objRev // name -> id -> the revision saved or merged last
+	onChange func(changes []Change)
 }
 
 func (s *JsonDb) LoadTaskFromJsonFile() {
-	loadSyncMapFromFile(s.TaskFilePath, func(v string) {
+	s.loadSyncMap(STORE_TASKS, func(v string) {
 		var err error
 		post := new(Tunnel)
 		if json.Unmarshal([]byte(v), &post) != nil {
@@ -58,7 +65,7 @@ func (s *JsonDb) LoadTaskFromJsonFile() {
 }
 
 func (s *JsonDb) LoadClientFromJsonFile() {
-	loadSyncMapFromFile(s.ClientFilePath, func(v string) {
+	s.loadSyncMap(STORE_CLIENTS, func(v string) {
 		post := new(Client)
 		if json.Unmarshal([]byte(v), &post) != nil {
 			return
@@ -78,7 +85,7 @@ func (s *JsonDb) LoadClientFromJsonFile() {
 }
 
 func (s *JsonDb) LoadHostFromJsonFile() {
-	loadSyncMapFromFile(s.HostFilePath, func(v string) {
+	s.loadSyncMap(STORE_HOSTS, func(v string) {
 		var err error
 		post := new(Host)
 		if json.Unmarshal([]byte(v), &post) != nil {
@@ -95,7 +102,7 @@ func (s *JsonDb) LoadHostFromJsonFile() {
 }
 
 func (s *JsonDb) LoadGlobalFromJsonFile() {
-	loadSyncMapFromFileWithSingleJson(s.GlobalFilePath, func(v string) {
+	s.loadSingleJson(STORE_GLOBAL, func(v string) {
 		post := new(Glob)
 		if json.Unmarshal([]byte(v), &post) != nil {
 			return
@@ -104,6 +111,41 @@ func (s *JsonDb) LoadGlobalFromJsonFile() {
 	})
 }
 
+// before FlowVersion 1 both fields held the sum of the two directions,
+// halve them so that the sum is the real flow
+func (s *JsonDb) MigrateFlow() {
+	if s.Global == nil {
+		s.Global = new(Glob)
+	}
+	if s.Global.FlowVersion >= FlowVersion {
+		return
+	}
+	halve := func(f *Flow) {
+		if f != nil {
+			f.InletFlow /= 2
+			f.ExportFlow /= 2
+		}
+	}
+	s.Clients.Range(func(key, value interface{}) bool {
+		halve(value.(*Client).Flow)
+		return true
+	})
+	s.Tasks.Range(func(key, value interface{}) bool {
+		halve(value.(*Tunnel).Flow)
+		return true
+	})
+	s.Hosts.Range(func(key, value interface{}) bool {
+		halve(value.(*Host).Flow)
+		return true
+	})
+	s.Global.FlowVersion = FlowVersion
+	s.StoreClientsToJsonFile()
+	s.StoreTasksToJsonFile()
+	s.StoreHostToJsonFile()
+	s.StoreGlobalToJsonFile()
+	logs.Info("the flow data is migrated to the version %d", FlowVersion)
+}
+
 func (s *JsonDb) GetClient(id int) (c *Client, err error) {
 	if v, ok := s.Clients.Load(id); ok {
 		c = v.(*Client)
@@ -117,7 +159,7 @@ var hostLock sync.Mutex
 
 func (s *JsonDb) StoreHostToJsonFile() {
 	hostLock.Lock()
-	storeSyncMapToFile(s.Hosts, s.HostFilePath)
+	s.saveSyncMap(STORE_HOSTS, &s.Hosts)
 	hostLock.Unlock()
 }
 
@@ -125,7 +167,7 @@ var taskLock sync.Mutex
 
 func (s *JsonDb) StoreTasksToJsonFile() {
 	taskLock.Lock()
-	storeSyncMapToFile(s.Tasks, s.TaskFilePath)
+	s.saveSyncMap(STORE_TASKS, &s.Tasks)
 	taskLock.Unlock()
 }
 
@@ -133,7 +175,7 @@ var clientLock sync.Mutex
 
 func (s *JsonDb) StoreClientsToJsonFile() {
 	clientLock.Lock()
-	storeSyncMapToFile(s.Clients, s.ClientFilePath)
+	s.saveSyncMap(STORE_CLIENTS, &s.Clients)
 	clientLock.Unlock()
 }
 
@@ -141,120 +183,67 @@ var globalLock sync.Mutex
 
 func (s *JsonDb) StoreGlobalToJsonFile() {
 	globalLock.Lock()
-	storeGlobalToFile(s.Global, s.GlobalFilePath)
+	changes := s.diff(STORE_GLOBAL, s.objects(STORE_GLOBAL))
+	if b, err := json.Marshal(s.Global); err == nil {
+		s.save(STORE_GLOBAL, b, changes)
+	}
 	globalLock.Unlock()
 }
 
 func (s *JsonDb) GetClientId() int32 {
-	return atomic.AddInt32(&s.ClientIncreaseId, 1)
+	return s.nextId(&s.ClientIncreaseId)
 }
 
 func (s *JsonDb) GetTaskId() int32 {
-	return atomic.AddInt32(&s.TaskIncreaseId, 1)
+	return s.nextId(&s.TaskIncreaseId)
 }
 
 func (s *JsonDb) GetHostId() int32 {
-	return atomic.AddInt32(&s.HostIncreaseId, 1)
+	return s.nextId(&s.HostIncreaseId)
+}
+
+func (s *JsonDb) storeByName(name string) {
+	switch name {
+	case STORE_CLIENTS:
+		s.StoreClientsToJsonFile()
+	case STORE_TASKS:
+		s.StoreTasksToJsonFile()
+	case STORE_HOSTS:
+		s.StoreHostToJsonFile()
+	case STORE_GLOBAL:
+		s.StoreGlobalToJsonFile()
+	}
 }
 
-func loadSyncMapFromFile(filePath string, f func(value string)) {
-	b, err := common.ReadAllFromFile(filePath)
+func (s *JsonDb) loadSyncMap(name string, f func(value string)) {
+	b, err := s.Store.Load(name)
 	if err != nil {
 		panic(err)
 	}
-	for _, v := range strings.Split(string(b), "\n"+common.CONN_DATA_SEQ) {
+	for _, v := range splitStoreData(b) {
 		f(v)
 	}
 }
 
-func loadSyncMapFromFileWithSingleJson(filePath string, f func(value string)) {
-	if !common.FileExists(filePath) {
+func (s *JsonDb) loadSingleJson(name string, f func(value string)) {
+	b, err := s.Store.Load(name)
+	if err != nil || len(b) == 0 {
 		return
 	}
-
-	b, err := common.ReadAllFromFile(filePath)
-	if err != nil {
-		panic(err)
-	}
-
 	f(string(b))
 }
 
-func storeSyncMapToFile(m sync.Map, filePath string) {
-	file, err := os.Create(filePath + ".tmp")
-	// first create a temporary file to store
-	if err != nil {
-		panic(err)
-	}
-	m.Range(func(key, value interface{}) bool {
-		var b []byte
-		var err error
-		switch value.(type) {
-		case *Tunnel:
-			obj := value.(*Tunnel)
-			if obj.NoStore {
-				return true
-			}
-			b, err = json.Marshal(obj)
-		case *Host:
-			obj := value.(*Host)
-			if obj.NoStore {
-				return true
-			}
-			b, err = json.Marshal(obj)
-		case *Client:
-			obj := value.(*Client)
-			if obj.NoStore {
-				return true
-			}
-			b, err = json.Marshal(obj)
-		//case *Glob:
-		//	obj := value.(*Glob)
-		//	b, err = json.Marshal(obj)
-		default:
-			return true
-		}
-		if err != nil {
-			return true
-		}
-		_, err = file.Write(b)
-		if err != nil {
-			panic(err)
-		}
-		_, err = file.Write([]byte("\n" + common.CONN_DATA_SEQ))
-		if err != nil {
-			panic(err)
-		}
-		return true
-	})
-	_ = file.Sync()
-	_ = file.Close()
-	// must close file first, then rename it
-	err = os.Rename(filePath+".tmp", filePath)
-	if err != nil {
-		logs.Error(err, "store to file err, data will lost")
-	}
-	// replace the file, maybe provides atomic operation
+// diffed first, so the new revisions are saved too
+func (s *JsonDb) saveSyncMap(name string, m *sync.Map) {
+	changes := s.diff(name, storedObjects(m))
+	s.save(name, marshalSyncMap(m), changes)
 }
 
-func storeGlobalToFile(m *Glob, filePath string) {
-	file, err := os.Create(filePath + ".tmp")
-	// first create a temporary file to store
-	if err != nil {
-		panic(err)
-	}
-
-	var b []byte
-	b, err = json.Marshal(m)
-	_, err = file.Write(b)
-	if err != nil {
-		panic(err)
-	}
-	_ = file.Sync()
-	_ = file.Close()
-	// must close file first, then rename it
-	err = os.Rename(filePath+".tmp", filePath)
-	if err != nil {
+func (s *JsonDb) save(name string, b []byte, changes []Change) {
+	if err := s.Store.Save(name, b); err != nil {
 		logs.Error(err, "store to file err, data will lost")
 	}
+	if len(changes) > 0 {
+		s.onChange(changes)
+	}
 }
@@ -0,0 +1,213 @@
+package file
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateFlow(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "conf"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// the flows of the old version are the sum of the two directions
+	db := NewJsonDb(dir)
+	client := &Client{Id: 1, Cnf: &Config{}, Flow: &Flow{InletFlow: 300, ExportFlow: 300}}
+	db.Clients.Store(client.Id, client)
+	db.Tasks.Store(1, &Tunnel{Id: 1, Client: client, Flow: &Flow{InletFlow: 100, ExportFlow: 100}, Target: &Target{}})
+	db.Hosts.Store(1, &Host{Id: 1, Client: client, Flow: &Flow{InletFlow: 200, ExportFlow: 200}, Target: &Target{}})
+	db.Hosts.Store(2, &Host{Id: 2, Client: client, Target: &Target{}})
+	db.MigrateFlow()
+	if client.Flow.InletFlow != 150 || client.Flow.ExportFlow != 150 || db.Global.FlowVersion != FlowVersion {
+		t.Fatalf("the flow of the client is %d %d, version %d", client.Flow.InletFlow, client.Flow.ExportFlow, db.Global.FlowVersion)
+	}
+
+	// stored and not migrated twice
+	db = NewJsonDb(dir)
+	db.LoadClientFromJsonFile()
+	db.LoadTaskFromJsonFile()
+	db.LoadHostFromJsonFile()
+	db.LoadGlobalFromJsonFile()
+	db.MigrateFlow()
+	v, ok := db.Tasks.Load(1)
+	if !ok {
+		t.Fatal("the task is not stored")
+	}
+	task := v.(*Tunnel)
+	if v, ok = db.Hosts.Load(1); !ok {
+		t.Fatal("the host is not stored")
+	}
+	host := v.(*Host)
+	if task.Flow.InletFlow != 50 || host.Flow.ExportFlow != 100 || db.Global.FlowVersion != FlowVersion {
+		t.Fatalf("the stored flows are %d %d, version %d", task.Flow.InletFlow, host.Flow.ExportFlow, db.Global.FlowVersion)
+	}
+}
+
+func TestFlows(t *testing.T) {
+	defer func(v bool) { CountOverhead = v }(CountOverhead)
+	client, task := &Flow{FlowLimit: 1}, &Flow{}
+	flows := NewFlows(task, nil, client, task)
+	if len(flows) != 2 {
+		t.Fatalf("the flows are %d, want 2", len(flows))
+	}
+	CountOverhead = false
+	flows.AddTcp(1000, 3000)
+	flows.AddUdp(100, 0)
+	if task.InletFlow != 1100 || task.ExportFlow != 3000 || client.InletFlow != 1100 {
+		t.Fatalf("the flow is %d %d", task.InletFlow, task.ExportFlow)
+	}
+	// every segment and datagram has the headers
+	CountOverhead = true
+	task.InletFlow, task.ExportFlow = 0, 0
+	flows.AddTcp(1000, 3000)
+	flows.AddUdp(0, 100)
+	if task.InletFlow != 1000+tcpOverhead || task.ExportFlow != 3000+3*tcpOverhead+100+udpOverhead {
+		t.Fatalf("the flow with the overhead is %d %d", task.InletFlow, task.ExportFlow)
+	}
+	if flows.IsExceeded() {
+		t.Fatal("the flow under the limit is exceeded")
+	}
+	flows.Add(1<<20, 0)
+	if !flows.IsExceeded() || task.IsExceeded() {
+		t.Fatal("the limit of the client is not checked")
+	}
+}
+
+func TestMultiAccountFlow(t *testing.T) {
+	old := &MultiAccount{AccountMap: map[string]string{"a": "1", "b": "2"}}
+	old.GetFlow("a").Add(1, 2)
+	old.GetFlow("b").Add(3, 4)
+	if old.GetFlow("a") != old.GetFlow("a") {
+		t.Fatal("the flow of the account is created again")
+	}
+	// the flow of the removed account is dropped
+	m := &MultiAccount{AccountMap: map[string]string{"a": "new", "c": "3"}}
+	m.KeepFlow(old)
+	if m.GetFlow("a").ExportFlow != 2 || len(m.AccountFlow) != 1 {
+		t.Fatalf("the kept flows are %v", m.AccountFlow)
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := new(MultiAccount)
+	if err := json.Unmarshal(b, n); err != nil {
+		t.Fatal(err)
+	}
+	if n.AccountMap["c"] != "3" || n.AccountFlow["a"].InletFlow != 1 {
+		t.Fatalf("the accounts are not stored, %s", b)
+	}
+}
+
+func TestSetHealth(t *testing.T) {
+	target := &Target{TargetStr: "a:1\nb:1"}
+	h := new(Health)
+	target.SetHealth(h, "a:1", false)
+	// the report of the client does not recover the target removed by the probe
+	if target.SetClientHealth(h, "a:1", true) || !h.IsOffline("a:1") {
+		t.Fatal("the report of the client recovers the target")
+	}
+	target.SetClientHealth(h, "a:1", false)
+	target.SetHealth(h, "a:1", true)
+	if !h.IsOffline("a:1") {
+		t.Fatal("the probe recovers the target removed by the client")
+	}
+	for i := 0; i < 3; i++ {
+		if v, _ := target.GetRandomTarget(); v != "b:1" {
+			t.Fatalf("the offline target %s is selected", v)
+		}
+	}
+	target.SetClientHealth(h, "a:1", true)
+	if h.IsOffline("a:1") || len(target.TargetArr) != 2 {
+		t.Fatalf("the targets are %v", target.TargetArr)
+	}
+}
+
+func TestClusterStore(t *testing.T) {
+	newDb := func(node string, index int) (*JsonDb, *[]Change) {
+		dir := t.TempDir()
+		if err := os.MkdirAll(filepath.Join(dir, "conf"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		db := NewJsonDb(dir)
+		db.Global = new(Glob)
+		changes := new([]Change)
+		db.EnableCluster(node, index, 16, func(c []Change) {
+			*changes = append(*changes, c...)
+		})
+		return db, changes
+	}
+	a, changesA := newDb("a", 0)
+	b, changesB := newDb("b", 1)
+
+	// the nodes never allocate the same id
+	idA, idB := int(a.GetClientId()), int(b.GetClientId())
+	if idA != 16 || idB != 1 {
+		t.Fatalf("the ids are %d %d", idA, idB)
+	}
+	a.Clients.Store(idA, &Client{Id: idA, VerifyKey: "a", Cnf: &Config{}, Flow: new(Flow)})
+	a.StoreClientsToJsonFile()
+	b.Clients.Store(idB, &Client{Id: idB, VerifyKey: "b", Cnf: &Config{}, Flow: new(Flow)})
+	b.StoreClientsToJsonFile()
+	b.Merge(*changesA, b.ApplyClient)
+	a.Merge(*changesB, a.ApplyClient)
+	for _, db := range []*JsonDb{a, b} {
+		if c, err := db.GetClient(idA); err != nil || c.VerifyKey != "a" {
+			t.Fatal("the client of the node a is not merged")
+		}
+		if c, err := db.GetClient(idB); err != nil || c.VerifyKey != "b" {
+			t.Fatal("the client of the node b is not merged")
+		}
+	}
+	if id := int(b.GetClientId()); id != 17 {
+		t.Fatalf("the next id of the node b is %d", id)
+	}
+
+	// the flow and the merged objects are not sent again
+	*changesA, *changesB = nil, nil
+	c, _ := a.GetClient(idB)
+	c.Flow.Add(100, 100)
+	a.StoreClientsToJsonFile()
+	b.StoreClientsToJsonFile()
+	if len(*changesA) != 0 || len(*changesB) != 0 {
+		t.Fatalf("the changes %v %v are not expected", *changesA, *changesB)
+	}
+
+	// the newer revision wins on both nodes
+	c.Lock()
+	c.Remark = "old"
+	c.Unlock()
+	a.StoreClientsToJsonFile()
+	c, _ = b.GetClient(idB)
+	c.Lock()
+	c.Remark = "new"
+	c.Unlock()
+	b.StoreClientsToJsonFile()
+	b.StoreClientsToJsonFile()
+	c.Lock()
+	c.Remark = "newer"
+	c.Unlock()
+	b.StoreClientsToJsonFile()
+	a.Merge(b.Snapshot(), a.ApplyClient)
+	b.Merge(a.Snapshot(), b.ApplyClient)
+	for _, db := range []*JsonDb{a, b} {
+		if c, _ := db.GetClient(idB); c.Remark != "newer" {
+			t.Fatalf("the remark is %s", c.Remark)
+		}
+	}
+
+	// deleted by the snapshot, e.g. the node missed the deletion
+	b.Clients.Delete(idA)
+	b.StoreClientsToJsonFile()
+	a.Merge(b.Snapshot(), a.ApplyClient)
+	if _, err := a.GetClient(idA); err == nil {
+		t.Fatal("the deleted client is not merged")
+	}
+	a.StoreClientsToJsonFile()
+	b.Merge(a.Snapshot(), b.ApplyClient)
+	if _, err := b.GetClient(idA); err == nil {
+		t.Fatal("the deleted client is added again")
+	}
+}
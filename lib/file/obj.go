@@ -1,18 +1,25 @@
 package file
 
 import (
+	"crypto/sha256"
+	"encoding/json"
+	"net"
+	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/rate"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type Flow struct {
-	ExportFlow int64
-	InletFlow  int64
+	ExportFlow int64 // target -> visitor, download
+	InletFlow  int64 // visitor -> target, upload
 	FlowLimit  int64
 	sync.RWMutex
 }
@@ -24,6 +31,101 @@ func (s *Flow) Add(in, out int64) {
 	s.ExportFlow += int64(out)
 }
 
+// keep the counted flow, take only the limits
+func (s *Flow) withLimit(f *Flow) *Flow {
+	if s == nil {
+		if f == nil {
+			return new(Flow)
+		}
+		return f
+	}
+	if f != nil {
+		s.Lock()
+		s.FlowLimit = f.FlowLimit
+		s.Unlock()
+	}
+	return s
+}
+
+// FlowLimit is MB
+func (s *Flow) IsExceeded() bool {
+	s.RLock()
+	defer s.RUnlock()
+	return s.FlowLimit > 0 && (s.FlowLimit<<20) < (s.ExportFlow+s.InletFlow)
+}
+
+// see JsonDb.MigrateFlow
+const FlowVersion = 1
+
+// count the ip and tcp/udp headers
+var CountOverhead bool
+
+const (
+	tcpMss      = 1460
+	tcpOverhead = 40 // ipv4 + tcp
+	udpOverhead = 28 // ipv4 + udp
+)
+
+// e.g. the tunnel or host, the client and the account of one connection
+type Flows []*Flow
+
+// nil and repeated flows are skipped
+func NewFlows(flows ...*Flow) Flows {
+	f := make(Flows, 0, len(flows))
+	for _, v := range flows {
+		if v != nil && !f.has(v) {
+			f = append(f, v)
+		}
+	}
+	return f
+}
+
+func (f Flows) has(flow *Flow) bool {
+	for _, v := range f {
+		if v == flow {
+			return true
+		}
+	}
+	return false
+}
+
+func (f Flows) Add(in, out int64) {
+	for _, v := range f {
+		v.Add(in, out)
+	}
+}
+
+// the segments are estimated by the mss
+func (f Flows) AddTcp(in, out int64) {
+	if CountOverhead {
+		in += (in + tcpMss - 1) / tcpMss * tcpOverhead
+		out += (out + tcpMss - 1) / tcpMss * tcpOverhead
+	}
+	f.Add(in, out)
+}
+
+// one datagram
+func (f Flows) AddUdp(in, out int64) {
+	if CountOverhead {
+		if in > 0 {
+			in += udpOverhead
+		}
+		if out > 0 {
+			out += udpOverhead
+		}
+	}
+	f.Add(in, out)
+}
+
+func (f Flows) IsExceeded() bool {
+	for _, v := range f {
+		if v.IsExceeded() {
+			return true
+		}
+	}
+	return false
+}
+
 type Config struct {
 	U        string
 	P        string
@@ -54,9 +156,35 @@ type Client struct {
 	BlackIpList     []string
 	CreateTime      string
 	LastOnlineTime  string
+	CertSerial      string //serial of the client certificate
+	Profile         *Profile
+	Revision
 	sync.RWMutex
 }
 
+// edited on the server, the client applies it without reconnecting
+type Profile struct {
+	Content string            // npc.conf format
+	Files   map[string]string // name -> content
+}
+
+func (s *Client) GetProfile() *Profile {
+	s.RLock()
+	defer s.RUnlock()
+	return s.Profile
+}
+
+func (s *Profile) IsEmpty() bool {
+	return s == nil || strings.TrimSpace(s.Content) == ""
+}
+
+func (s *Profile) Equal(p *Profile) bool {
+	if s.IsEmpty() || p.IsEmpty() {
+		return s.IsEmpty() && p.IsEmpty()
+	}
+	return reflect.DeepEqual(s, p)
+}
+
 func NewClient(vKey string, noStore bool, noDisplay bool) *Client {
 	return &Client{
 		Cnf:       new(Config),
@@ -75,6 +203,36 @@ func NewClient(vKey string, noStore bool, noDisplay bool) *Client {
 	}
 }
 
+// update in place, the runtime states are kept
+func (s *Client) UpdateConfig(c *Client) {
+	s.Lock()
+	defer s.Unlock()
+	s.Cnf = c.Cnf
+	s.VerifyKey = c.VerifyKey
+	s.Remark = c.Remark
+	s.Status = c.Status
+	if s.Rate == nil || s.RateLimit != c.RateLimit {
+		if c.RateLimit > 0 {
+			s.Rate = rate.NewRate(int64(c.RateLimit * 1024))
+		} else {
+			s.Rate = rate.NewRate(int64(2 << 23))
+		}
+		s.Rate.Start()
+	}
+	s.RateLimit = c.RateLimit
+	s.Flow = s.Flow.withLimit(c.Flow)
+	s.NoDisplay = c.NoDisplay
+	s.MaxConn = c.MaxConn
+	s.WebUserName = c.WebUserName
+	s.WebPassword = c.WebPassword
+	s.ConfigConnAllow = c.ConfigConnAllow
+	s.MaxTunnelNum = c.MaxTunnelNum
+	s.BlackIpList = c.BlackIpList
+	s.CreateTime = c.CreateTime
+	s.CertSerial = c.CertSerial
+	s.Profile = c.Profile
+}
+
 func (s *Client) CutConn() {
 	atomic.AddInt32(&s.NowConn, 1)
 }
@@ -108,7 +266,8 @@ func (s *PortConfig) GetConn() bool {
 func (s *Client) HasTunnel(t *Tunnel) (exist bool) {
 	GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
 		v := value.(*Tunnel)
-		if v.Client.Id == s.Id && v.Port == t.Port && t.Port != 0 {
+		// sni tunnels share the port
+		if v.Client.Id == s.Id && common.InIntArr(v.GetPorts(), t.Port) && t.Port != 0 && (v.Mode != "sni" || t.Mode != "sni" || (v.ServerName == t.ServerName && v.Alpn == t.Alpn)) {
 			exist = true
 			return false
 		}
@@ -150,64 +309,408 @@ func (s *Client) HasHost(h *Host) bool {
 }
 
 type Tunnel struct {
-	Id           int
-	Port         int
-	S5User       string
-	PortConfig   *PortConfig
-	CreateTime   string
-	ServerIp     string
-	Mode         string
-	Status       bool
-	RunStatus    bool
-	Client       *Client
-	Ports        string
-	Flow         *Flow
-	Password     string
-	Remark       string
-	TargetAddr   string
-	NoStore      bool
-	IsHttp       bool
-	LocalPath    string
-	StripPre     string
-	Target       *Target
-	MultiAccount *MultiAccount
+	Id                  int
+	Port                int
+	S5User              string
+	PortConfig          *PortConfig
+	CreateTime          string
+	ServerIp            string
+	Mode                string
+	Status              bool
+	RunStatus           bool
+	Client              *Client
+	Ports               string
+	Flow                *Flow
+	Password            string
+	Remark              string
+	TargetAddr          string
+	NoStore             bool
+	FromProfile         bool // removed when the client disconnects
+	IsHttp              bool
+	LocalPath           string
+	StripPre            string
+	Target              *Target
+	MultiAccount        *MultiAccount
+	ProxyProtocol       int    // proxy protocol version to the target, 0 means no header
+	ServerName          string // sni mode, one per line, *.a.com for the sub domains, * for all
+	Alpn                string // sni mode, separated by comma, empty matches all
+	CertFile            string // tcpTls mode, pem, the default certificate if empty
+	KeyFile             string
+	ClientCa            string // pem, the visitors must present a certificate if it is set
+	TargetTls           bool   // the client dials the target with tls
+	TargetTlsServerName string // the host of the target if empty
+	TargetTlsInsecure   bool
+	TargetTlsCa         string // pem, the system roots if empty
+	Revision
 	Health
 	sync.RWMutex
 }
 
+// the flow and the health are ignored
+func (s *Tunnel) IsSameConfig(t *Tunnel) bool {
+	return s.getConfig() == t.getConfig()
+}
+
+func (s *Tunnel) getConfig() string {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return ""
+	}
+	m := make(map[string]interface{})
+	if json.Unmarshal(b, &m) != nil {
+		return ""
+	}
+	delete(m, "Flow")
+	delete(m, "RunStatus")
+	delete(m, "HealthRemoveArr")
+	delete(m, "ClientRemoveArr")
+	delete(m, "HealthNextTime")
+	delete(m, "Rev")
+	delete(m, "RevNode")
+	if s.Client != nil {
+		m["Client"] = s.Client.Id
+	}
+	if s.Target != nil {
+		m["Target"] = s.Target.TargetStr
+	}
+	if v, ok := m["PortConfig"].(map[string]interface{}); ok {
+		delete(v, "NowConn")
+	}
+	if v, ok := m["MultiAccount"].(map[string]interface{}); ok {
+		delete(v, "AccountFlow")
+	}
+	b, _ = json.Marshal(m)
+	return string(b)
+}
+
+func (s *Tunnel) GetServerNames() []string {
+	names := make([]string, 0)
+	for _, v := range strings.Split(strings.Replace(s.ServerName, ",", "\n", -1), "\n") {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			names = append(names, v)
+		}
+	}
+	return names
+}
+
+func (s *Tunnel) GetAlpn() []string {
+	alpn := make([]string, 0)
+	for _, v := range strings.Split(s.Alpn, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			alpn = append(alpn, v)
+		}
+	}
+	return alpn
+}
+
+// tcp or udp, a range of server ports to a range of target ports
+func (s *Tunnel) IsPortRange() bool {
+	return (s.Mode == "tcp" || s.Mode == "udp") && len(common.GetPorts(s.Ports)) > 1
+}
+
+func (s *Tunnel) GetPorts() []int {
+	if s.IsPortRange() {
+		return common.GetPorts(s.Ports)
+	}
+	return []int{s.Port}
+}
+
+// one tunnel per port, the flow and the client are shared with the range
+func (s *Tunnel) GetRangeTunnels() ([]*Tunnel, error) {
+	ports := common.GetPorts(s.Ports)
+	targets := common.GetPorts(s.Target.TargetStr)
+	if len(ports) != len(targets) {
+		return nil, errors.New("the number of the server ports and the target ports are not the same")
+	}
+	exist := make(map[int]bool)
+	tunnels := make([]*Tunnel, 0, len(ports))
+	for i, port := range ports {
+		if exist[port] {
+			return nil, errors.New("the server port " + strconv.Itoa(port) + " is repeated")
+		}
+		exist[port] = true
+		target := strconv.Itoa(targets[i])
+		if s.TargetAddr != "" {
+			target = s.TargetAddr + ":" + target
+		}
+		tunnels = append(tunnels, &Tunnel{
+			Id:                  s.Id,
+			Port:                port,
+			ServerIp:            s.ServerIp,
+			Mode:                s.Mode,
+			Status:              s.Status,
+			Client:              s.Client,
+			Flow:                s.Flow,
+			PortConfig:          s.PortConfig,
+			Password:            s.Password,
+			Remark:              s.Remark,
+			NoStore:             s.NoStore,
+			Target:              &Target{TargetStr: target, LocalProxy: s.Target.LocalProxy},
+			MultiAccount:        s.MultiAccount,
+			ProxyProtocol:       s.ProxyProtocol,
+			TargetTls:           s.TargetTls,
+			TargetTlsServerName: s.TargetTlsServerName,
+			TargetTlsInsecure:   s.TargetTlsInsecure,
+			TargetTlsCa:         s.TargetTlsCa,
+		})
+	}
+	return tunnels, nil
+}
+
 type Health struct {
 	HealthCheckTimeout  int
 	HealthMaxFail       int
 	HealthCheckInterval int
 	HealthNextTime      time.Time
-	HealthMap           map[string]int
+	HealthMap           map[string]int `json:"-"`
 	HttpHealthUrl       string
-	HealthRemoveArr     []string
+	HealthRemoveArr     []string // removed by the probes of nps
+	ClientRemoveArr     []string // removed by the reports of npc
 	HealthCheckType     string
 	HealthCheckTarget   string
 	sync.RWMutex
 }
 
 type Host struct {
-	Id           int
-	Host         string //host
-	HeaderChange string //header change
-	HostChange   string //host change
-	Location     string //url router
-	Remark       string //remark
-	Scheme       string //http https all
-	CertFilePath string
-	KeyFilePath  string
-	NoStore      bool
-	IsClose      bool
-	AutoHttps    bool // 自动https
-	Flow         *Flow
-	Client       *Client
-	Target       *Target //目标
-	Health       `json:"-"`
+	Id                  int
+	Host                string //host
+	HeaderChange        string //header change
+	HostChange          string //host change
+	Location            string //url router
+	Remark              string //remark
+	Scheme              string //http https all
+	CertFilePath        string
+	KeyFilePath         string
+	NoStore             bool
+	FromProfile         bool // removed when the client disconnects
+	IsClose             bool
+	AutoHttps           bool // 自动https
+	NoCache             bool
+	CacheTtl            int // seconds, overrides the response headers
+	CacheHit            int64
+	CacheMiss           int64
+	HttpCompress        bool   // br or gzip
+	CompressTypes       string // one per line
+	CompressRaw         int64
+	CompressOut         int64
+	AuthUsers           string // user:bcrypt hash, one per line
+	ForwardAuthUrl      string // allowed if it returns 2xx
+	ForwardAuthHeaders  string // copied to the request
+	authCache           map[string]bool
+	authCacheUsers      string
+	AllowIps            string // ip or cidr, one per line, empty means all
+	DenyIps             string
+	RateLimit           int // requests per second of one ip, 0 means unlimited
+	RateBurst           int
+	allowNets           []*net.IPNet
+	denyNets            []*net.IPNet
+	aclIps              string
+	Maintenance         bool   // 503 without connecting to the client
+	ErrorPage404        string // empty for the default page
+	ErrorPage502        string
+	ErrorPage503        string
+	ErrorPage504        string
+	Http2               bool   // offer h2 when nps terminates the https
+	BackendProto        string // empty (http/1.1), h2c or h2
+	TargetTlsServerName string // for h2, the host of the request if empty
+	TargetTlsInsecure   bool
+	TargetTlsCa         string // pem, the system roots if empty
+	ProxyProtocol       int    // proxy protocol version to the target, 0 means no header
+	Inspect             bool
+	InspectCredentials  bool   // redacted unless it is set, and then not replayed either
+	Action              string // proxy(default), static, redirect or dir, only proxy goes through the client
+	StaticStatus        int    // 200 if it is 0
+	StaticBody          string
+	StaticContentType   string // detected from the body if empty
+	RedirectUrl         string
+	RedirectCode        int    // 301, 302, 307 or 308, 302 if it is 0
+	RedirectKeepPath    bool   // append the path after the location and the query
+	StaticDir           string // a directory on the nps server
+	Flow                *Flow
+	Client              *Client
+	Target              *Target //目标
+	Revision
+	Health
 	sync.RWMutex
 }
 
+// the flow and the cache are ignored
+func (s *Host) IsSameConfig(h *Host) bool {
+	return s.getConfig() == h.getConfig()
+}
+
+func (s *Host) getConfig() string {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return ""
+	}
+	m := make(map[string]interface{})
+	if json.Unmarshal(b, &m) != nil {
+		return ""
+	}
+	for _, k := range []string{"Flow", "CacheHit", "CacheMiss", "CompressRaw", "CompressOut", "HealthRemoveArr", "ClientRemoveArr", "HealthNextTime", "Rev", "RevNode"} {
+		delete(m, k)
+	}
+	if s.Client != nil {
+		m["Client"] = s.Client.Id
+	}
+	if s.Target != nil {
+		m["Target"] = s.Target.TargetStr
+	}
+	b, _ = json.Marshal(m)
+	return string(b)
+}
+
+// checked by nps only when all the options are set
+func (s *Health) IsHealthCheck() bool {
+	return s.HealthCheckType != "" && s.HealthMaxFail > 0 && s.HealthCheckTimeout > 0 && s.HealthCheckInterval > 0
+}
+
+func (s *Health) IsOffline(target string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	return common.IsArrContains(s.HealthRemoveArr, target) || common.IsArrContains(s.ClientRemoveArr, target)
+}
+
+func (s *Host) IsProxy() bool {
+	return s.Action == "" || s.Action == "proxy"
+}
+
+func (s *Host) AddCacheCount(hit bool) {
+	s.Lock()
+	defer s.Unlock()
+	if hit {
+		s.CacheHit++
+	} else {
+		s.CacheMiss++
+	}
+}
+
+func (s *Host) AddCompressFlow(raw, out int64) {
+	s.Lock()
+	defer s.Unlock()
+	s.CompressRaw += raw
+	s.CompressOut += out
+}
+
+// bcrypt is slow, so the results are cached
+func (s *Host) CheckAuthUser(user, passwd string) bool {
+	sum := sha256.Sum256([]byte(user + ":" + passwd))
+	key := string(sum[:])
+	s.Lock()
+	users := s.AuthUsers
+	if s.authCache == nil || s.authCacheUsers != users || len(s.authCache) > 1000 {
+		s.authCache = make(map[string]bool)
+		s.authCacheUsers = users
+	}
+	ok, has := s.authCache[key]
+	s.Unlock()
+	if has {
+		return ok
+	}
+	ok = false
+	for _, v := range common.TrimArr(strings.Split(users, "\n")) {
+		if pair := strings.SplitN(v, ":", 2); len(pair) == 2 && pair[0] == user {
+			ok = bcrypt.CompareHashAndPassword([]byte(pair[1]), []byte(passwd)) == nil
+			break
+		}
+	}
+	s.Lock()
+	if s.authCacheUsers == users {
+		s.authCache[key] = ok
+	}
+	s.Unlock()
+	return ok
+}
+
+// the deny list wins over the allow list
+func (s *Host) IsIpAllowed(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	s.Lock()
+	if acl := s.AllowIps + "\x00" + s.DenyIps; s.aclIps != acl {
+		s.allowNets = ParseIpNets(s.AllowIps)
+		s.denyNets = ParseIpNets(s.DenyIps)
+		s.aclIps = acl
+	}
+	allowNets, denyNets := s.allowNets, s.denyNets
+	s.Unlock()
+	for _, v := range denyNets {
+		if v.Contains(addr) {
+			return false
+		}
+	}
+	if len(allowNets) == 0 {
+		return true
+	}
+	for _, v := range allowNets {
+		if v.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// separated by line or comma, invalid items are ignored
+func ParseIpNets(str string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, v := range common.TrimArr(strings.Split(strings.Replace(str, ",", "\n", -1), "\n")) {
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip == nil {
+				continue
+			} else if ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		if _, ipNet, err := net.ParseCIDR(v); err == nil {
+			nets = append(nets, ipNet)
+		}
+	}
+	return nets
+}
+
+// the passwords which are already hashed are kept
+func HashAuthUsers(users string) string {
+	arr := common.TrimArr(strings.Split(users, "\n"))
+	for i, v := range arr {
+		pair := strings.SplitN(v, ":", 2)
+		if len(pair) != 2 || pair[0] == "" {
+			continue
+		}
+		if _, err := bcrypt.Cost([]byte(pair[1])); err == nil {
+			continue
+		}
+		if b, err := bcrypt.GenerateFromPassword([]byte(pair[1]), bcrypt.DefaultCost); err == nil {
+			arr[i] = pair[0] + ":" + string(b)
+		}
+	}
+	return strings.Join(arr, "\n")
+}
+
+// either side may hold hashed passwords
+func IsSameAuthUsers(hashed, users string) bool {
+	a := common.TrimArr(strings.Split(hashed, "\n"))
+	b := common.TrimArr(strings.Split(users, "\n"))
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] == b[i] {
+			continue
+		}
+		x := strings.SplitN(a[i], ":", 2)
+		y := strings.SplitN(b[i], ":", 2)
+		if len(x) != 2 || len(y) != 2 || x[0] != y[0] || bcrypt.CompareHashAndPassword([]byte(x[1]), []byte(y[1])) != nil {
+			return false
+		}
+	}
+	return true
+}
+
 type Target struct {
 	nowIndex   int
 	TargetStr  string
@@ -217,12 +720,58 @@ type Target struct {
 }
 
 type MultiAccount struct {
-	AccountMap map[string]string // multi account and pwd
+	AccountMap  map[string]string // multi account and pwd
+	AccountFlow map[string]*Flow
+	sync.RWMutex
+}
+
+// created on the first use
+func (s *MultiAccount) GetFlow(user string) *Flow {
+	s.Lock()
+	defer s.Unlock()
+	if s.AccountFlow == nil {
+		s.AccountFlow = make(map[string]*Flow)
+	}
+	flow, ok := s.AccountFlow[user]
+	if !ok {
+		flow = new(Flow)
+		s.AccountFlow[user] = flow
+	}
+	return flow
+}
+
+// GetFlow may add flows while it is stored
+func (s *MultiAccount) MarshalJSON() ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return json.Marshal(struct {
+		AccountMap  map[string]string
+		AccountFlow map[string]*Flow
+	}{s.AccountMap, s.AccountFlow})
+}
+
+// the flows of the removed accounts are dropped
+func (s *MultiAccount) KeepFlow(old *MultiAccount) {
+	if old == nil {
+		return
+	}
+	old.RLock()
+	defer old.RUnlock()
+	for user, flow := range old.AccountFlow {
+		if _, ok := s.AccountMap[user]; ok {
+			if s.AccountFlow == nil {
+				s.AccountFlow = make(map[string]*Flow)
+			}
+			s.AccountFlow[user] = flow
+		}
+	}
 }
 
 func (s *Target) GetRandomTarget() (string, error) {
+	s.Lock()
+	defer s.Unlock()
 	if s.TargetArr == nil {
-		s.TargetArr = strings.Split(s.TargetStr, "\n")
+		s.TargetArr = common.TrimArr(strings.Split(s.TargetStr, "\n"))
 	}
 	if len(s.TargetArr) == 1 {
 		return s.TargetArr[0], nil
@@ -230,8 +779,6 @@ func (s *Target) GetRandomTarget() (string, error) {
 	if len(s.TargetArr) == 0 {
 		return "", errors.New("all inward-bending targets are offline")
 	}
-	s.Lock()
-	defer s.Unlock()
 	if s.nowIndex >= len(s.TargetArr)-1 {
 		s.nowIndex = -1
 	}
@@ -239,8 +786,52 @@ func (s *Target) GetRandomTarget() (string, error) {
 	return s.TargetArr[s.nowIndex], nil
 }
 
+// including the offline ones
+func (s *Target) GetTargets() []string {
+	return common.TrimArr(strings.Split(s.TargetStr, "\n"))
+}
+
+// the result of the probes of nps, returns true if the state changed
+func (s *Target) SetHealth(h *Health, target string, online bool) bool {
+	return s.setHealth(h, &h.HealthRemoveArr, target, online)
+}
+
+// the report of npc, it does not undo the result of the probes and vice versa
+func (s *Target) SetClientHealth(h *Health, target string, online bool) bool {
+	return s.setHealth(h, &h.ClientRemoveArr, target, online)
+}
+
+// a target is selected only if both sources think it is online
+func (s *Target) setHealth(h *Health, removed *[]string, target string, online bool) bool {
+	targets := s.GetTargets()
+	if !common.IsArrContains(targets, target) {
+		return false
+	}
+	s.Lock()
+	defer s.Unlock()
+	h.Lock()
+	defer h.Unlock()
+	if online == !common.IsArrContains(*removed, target) {
+		return false
+	}
+	if online {
+		*removed = common.RemoveArrVal(*removed, target)
+	} else {
+		*removed = append(*removed, target)
+	}
+	s.TargetArr = make([]string, 0, len(targets))
+	for _, v := range targets {
+		if !common.IsArrContains(h.HealthRemoveArr, v) && !common.IsArrContains(h.ClientRemoveArr, v) {
+			s.TargetArr = append(s.TargetArr, v)
+		}
+	}
+	return true
+}
+
 type Glob struct {
 	BlackIpList []string
+	FlowVersion int
+	Revision
 	sync.RWMutex
 }
 
@@ -0,0 +1,474 @@
+package file
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/rate"
+)
+
+const (
+	STORE_CLIENTS = "clients"
+	STORE_TASKS   = "tasks"
+	STORE_HOSTS   = "hosts"
+	STORE_GLOBAL  = "global"
+)
+
+// the data of a name is loaded and saved as a whole
+type Store interface {
+	Load(name string) ([]byte, error)
+	Save(name string, b []byte) error
+}
+
+type FileStore struct {
+	paths map[string]string
+}
+
+func NewFileStore(clientPath, taskPath, hostPath, globalPath string) *FileStore {
+	return &FileStore{paths: map[string]string{
+		STORE_CLIENTS: clientPath,
+		STORE_TASKS:   taskPath,
+		STORE_HOSTS:   hostPath,
+		STORE_GLOBAL:  globalPath,
+	}}
+}
+
+func (s *FileStore) Load(name string) ([]byte, error) {
+	return common.ReadAllFromFile(s.paths[name])
+}
+
+// first write a temporary file, then replace the file, maybe provides atomic operation
+func (s *FileStore) Save(name string, b []byte) error {
+	filePath := s.paths[name]
+	file, err := os.Create(filePath + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(b); err != nil {
+		file.Close()
+		return err
+	}
+	_ = file.Sync()
+	_ = file.Close()
+	// must close file first, then rename it
+	return os.Rename(filePath+".tmp", filePath)
+}
+
+func marshalSyncMap(m *sync.Map) []byte {
+	buf := bytes.NewBuffer(nil)
+	m.Range(func(key, value interface{}) bool {
+		var b []byte
+		var err error
+		switch v := value.(type) {
+		case *Tunnel:
+			if v.NoStore {
+				return true
+			}
+			b, err = json.Marshal(v)
+		case *Host:
+			if v.NoStore {
+				return true
+			}
+			b, err = json.Marshal(v)
+		case *Client:
+			if v.NoStore {
+				return true
+			}
+			b, err = json.Marshal(v)
+		default:
+			return true
+		}
+		if err != nil {
+			return true
+		}
+		buf.Write(b)
+		buf.WriteString("\n" + common.CONN_DATA_SEQ)
+		return true
+	})
+	return buf.Bytes()
+}
+
+func splitStoreData(b []byte) []string {
+	return strings.Split(string(b), "\n"+common.CONN_DATA_SEQ)
+}
+
+// the clients are updated in place, so the flow, the rate
+// and the connections are kept
+func (s *JsonDb) ApplyClient(c Change) {
+	if c.Data == nil {
+		s.Clients.Delete(c.Id)
+		return
+	}
+	post := new(Client)
+	if json.Unmarshal(c.Data, &post) != nil || post.Id != c.Id {
+		return
+	}
+	if old, err := s.GetClient(post.Id); err == nil {
+		old.UpdateConfig(post)
+		return
+	}
+	if post.RateLimit > 0 {
+		post.Rate = rate.NewRate(int64(post.RateLimit * 1024))
+	} else {
+		post.Rate = rate.NewRate(int64(2 << 23))
+	}
+	post.Rate.Start()
+	post.NowConn = 0
+	post.IsConnect = false
+	if post.Flow == nil {
+		post.Flow = new(Flow)
+	}
+	s.Clients.Store(post.Id, post)
+	bumpId(&s.ClientIncreaseId, post.Id)
+}
+
+// the hosts are looked up per request, so they are just replaced
+func (s *JsonDb) ApplyHost(c Change) {
+	if c.Data == nil {
+		s.Hosts.Delete(c.Id)
+		return
+	}
+	var err error
+	post := new(Host)
+	if json.Unmarshal(c.Data, &post) != nil || post.Id != c.Id || post.Client == nil {
+		return
+	}
+	if post.Client, err = s.GetClient(post.Client.Id); err != nil {
+		return
+	}
+	if old, err := s.getHost(post.Id); err == nil {
+		post.Flow = old.Flow.withLimit(post.Flow)
+	} else if post.Flow == nil {
+		post.Flow = new(Flow)
+	}
+	s.Hosts.Store(post.Id, post)
+	bumpId(&s.HostIncreaseId, post.Id)
+}
+
+// not applied, the caller restarts the task if it is changed
+func (s *JsonDb) ParseTask(c Change) (*Tunnel, error) {
+	var err error
+	post := new(Tunnel)
+	if err = json.Unmarshal(c.Data, &post); err != nil {
+		return nil, err
+	}
+	if post.Id != c.Id || post.Client == nil {
+		return nil, errors.New("the task is not valid")
+	}
+	if post.Client, err = s.GetClient(post.Client.Id); err != nil {
+		return nil, err
+	}
+	if old, err := s.getTask(post.Id); err == nil {
+		post.Flow = old.Flow.withLimit(post.Flow)
+	} else if post.Flow == nil {
+		post.Flow = new(Flow)
+	}
+	bumpId(&s.TaskIncreaseId, post.Id)
+	return post, nil
+}
+
+func (s *JsonDb) ApplyGlobal(b []byte) {
+	post := new(Glob)
+	if json.Unmarshal(b, &post) == nil {
+		s.Global = post
+	}
+}
+
+func (s *JsonDb) getHost(id int) (*Host, error) {
+	if v, ok := s.Hosts.Load(id); ok {
+		return v.(*Host), nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func (s *JsonDb) getTask(id int) (*Tunnel, error) {
+	if v, ok := s.Tasks.Load(id); ok {
+		return v.(*Tunnel), nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func bumpId(increaseId *int32, id int) {
+	for {
+		old := atomic.LoadInt32(increaseId)
+		if int32(id) <= old || atomic.CompareAndSwapInt32(increaseId, old, int32(id)) {
+			return
+		}
+	}
+}
+
+// the nodes of the cluster take the ids by turns, so they never allocate the same id
+func (s *JsonDb) nextId(increaseId *int32) int32 {
+	step := atomic.LoadInt32(&s.idStep)
+	for {
+		old := atomic.LoadInt32(increaseId)
+		id := old + 1
+		if step > 1 {
+			if id = old - old%step + s.idOffset; id <= old {
+				id += step
+			}
+		}
+		if atomic.CompareAndSwapInt32(increaseId, old, id) {
+			return id
+		}
+	}
+}
+
+// the version of an object in the cluster, the larger one wins and the node breaks the tie
+type Revision struct {
+	Rev     int64  `json:",omitempty"`
+	RevNode string `json:",omitempty"`
+}
+
+func (s *Revision) revision() *Revision {
+	return s
+}
+
+func (s Revision) newer(r Revision) bool {
+	return s.Rev > r.Rev || (s.Rev == r.Rev && s.RevNode > r.RevNode)
+}
+
+// an object saved by a node of the cluster, Data is nil if it is deleted
+type Change struct {
+	Name string
+	Id   int
+	Revision
+	Data []byte `json:",omitempty"`
+}
+
+type objRev struct {
+	Revision
+	config string
+	data   []byte
+}
+
+var storeNames = []string{STORE_CLIENTS, STORE_TASKS, STORE_HOSTS, STORE_GLOBAL}
+
+// the objects saved later are sent to onChange, the ids of the node are index, index+step and so on
+func (s *JsonDb) EnableCluster(nodeId string, index, step int, onChange func(changes []Change)) {
+	s.revLock.Lock()
+	defer s.revLock.Unlock()
+	s.nodeId = nodeId
+	s.idOffset = int32(index)
+	atomic.StoreInt32(&s.idStep, int32(step))
+	s.revs = make(map[string]map[int]*objRev)
+	for _, name := range storeNames {
+		s.revs[name] = make(map[int]*objRev)
+		for id, v := range s.objects(name) {
+			r := *v.(revisioned).revision()
+			b, _ := json.Marshal(v)
+			s.revs[name][id] = &objRev{Revision: r, config: configOf(v), data: b}
+			if r.Rev > s.clock {
+				s.clock = r.Rev
+			}
+		}
+	}
+	s.onChange = onChange
+}
+
+// all of the objects, the deleted ones too
+func (s *JsonDb) Snapshot() []Change {
+	s.revLock.Lock()
+	defer s.revLock.Unlock()
+	changes := make([]Change, 0)
+	// the clients first, the tasks and the hosts refer to them
+	for _, name := range storeNames {
+		for id, o := range s.revs[name] {
+			changes = append(changes, Change{Name: name, Id: id, Revision: o.Revision, Data: o.data})
+		}
+	}
+	return changes
+}
+
+// the newer changes are applied by f, then saved without a new revision
+func (s *JsonDb) Merge(changes []Change, f func(c Change)) {
+	names := make(map[string]bool)
+	for _, c := range changes {
+		if !s.isNewer(c) {
+			continue
+		}
+		f(c)
+		if s.accept(c) {
+			names[c.Name] = true
+		}
+	}
+	for _, name := range storeNames {
+		if names[name] {
+			s.storeByName(name)
+		}
+	}
+}
+
+func (s *JsonDb) isNewer(c Change) bool {
+	s.revLock.Lock()
+	defer s.revLock.Unlock()
+	revs, ok := s.revs[c.Name]
+	if !ok {
+		return false
+	}
+	if c.Rev > s.clock {
+		s.clock = c.Rev
+	}
+	old, ok := revs[c.Id]
+	return !ok || c.Revision.newer(old.Revision)
+}
+
+// not recorded if f could not apply it, e.g. the client of the host is not known yet
+func (s *JsonDb) accept(c Change) bool {
+	s.revLock.Lock()
+	defer s.revLock.Unlock()
+	revs := s.revs[c.Name]
+	if old, ok := revs[c.Id]; ok && !c.Revision.newer(old.Revision) {
+		return false
+	}
+	o := &objRev{Revision: c.Revision, data: c.Data}
+	v := s.object(c.Name, c.Id)
+	if c.Data != nil {
+		if v == nil {
+			return false
+		}
+		*v.(revisioned).revision() = c.Revision
+		o.config = configOf(v)
+	} else if v != nil {
+		return false
+	}
+	revs[c.Id] = o
+	return true
+}
+
+// the changed objects get a new revision, the flow and the other runtime states are ignored
+func (s *JsonDb) diff(name string, objs map[int]interface{}) []Change {
+	s.revLock.Lock()
+	defer s.revLock.Unlock()
+	revs, ok := s.revs[name]
+	if !ok {
+		return nil
+	}
+	changes := make([]Change, 0)
+	for id, v := range objs {
+		r := v.(revisioned).revision()
+		config := configOf(v)
+		if old, ok := revs[id]; ok && old.config == config {
+			if *r != old.Revision {
+				*r = old.Revision
+			}
+			continue
+		}
+		s.clock++
+		*r = Revision{Rev: s.clock, RevNode: s.nodeId}
+		b, _ := json.Marshal(v)
+		revs[id] = &objRev{Revision: *r, config: config, data: b}
+		changes = append(changes, Change{Name: name, Id: id, Revision: *r, Data: b})
+	}
+	for id, old := range revs {
+		if _, ok := objs[id]; !ok && old.data != nil {
+			s.clock++
+			r := Revision{Rev: s.clock, RevNode: s.nodeId}
+			revs[id] = &objRev{Revision: r}
+			changes = append(changes, Change{Name: name, Id: id, Revision: r})
+		}
+	}
+	return changes
+}
+
+type revisioned interface {
+	revision() *Revision
+}
+
+func (s *JsonDb) objects(name string) map[int]interface{} {
+	switch name {
+	case STORE_CLIENTS:
+		return storedObjects(&s.Clients)
+	case STORE_TASKS:
+		return storedObjects(&s.Tasks)
+	case STORE_HOSTS:
+		return storedObjects(&s.Hosts)
+	case STORE_GLOBAL:
+		if s.Global != nil {
+			return map[int]interface{}{0: s.Global}
+		}
+	}
+	return nil
+}
+
+func (s *JsonDb) object(name string, id int) interface{} {
+	var m *sync.Map
+	switch name {
+	case STORE_CLIENTS:
+		m = &s.Clients
+	case STORE_TASKS:
+		m = &s.Tasks
+	case STORE_HOSTS:
+		m = &s.Hosts
+	case STORE_GLOBAL:
+		if s.Global != nil && id == 0 {
+			return s.Global
+		}
+		return nil
+	}
+	if v, ok := m.Load(id); ok {
+		return v
+	}
+	return nil
+}
+
+func storedObjects(m *sync.Map) map[int]interface{} {
+	objs := make(map[int]interface{})
+	m.Range(func(key, value interface{}) bool {
+		switch v := value.(type) {
+		case *Tunnel:
+			if !v.NoStore {
+				objs[v.Id] = v
+			}
+		case *Host:
+			if !v.NoStore {
+				objs[v.Id] = v
+			}
+		case *Client:
+			if !v.NoStore {
+				objs[v.Id] = v
+			}
+		}
+		return true
+	})
+	return objs
+}
+
+// the runtime states are removed, so saving the flow is not a change
+func configOf(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	m := make(map[string]interface{})
+	if json.Unmarshal(b, &m) != nil {
+		return ""
+	}
+	for _, k := range []string{"Rev", "RevNode", "RunStatus", "IsConnect", "NowConn", "Addr", "Version", "LastOnlineTime", "Rate",
+		"HealthRemoveArr", "ClientRemoveArr", "HealthNextTime", "CacheHit", "CacheMiss", "CompressRaw", "CompressOut"} {
+		delete(m, k)
+	}
+	if v, ok := m["Flow"].(map[string]interface{}); ok {
+		m["Flow"] = v["FlowLimit"]
+	}
+	if v, ok := m["Client"].(map[string]interface{}); ok {
+		m["Client"] = v["Id"]
+	}
+	if v, ok := m["Target"].(map[string]interface{}); ok {
+		delete(v, "TargetArr")
+	}
+	if v, ok := m["PortConfig"].(map[string]interface{}); ok {
+		delete(v, "NowConn")
+	}
+	if v, ok := m["MultiAccount"].(map[string]interface{}); ok {
+		delete(v, "AccountFlow")
+	}
+	b, _ = json.Marshal(m)
+	return string(b)
+}
@@ -16,7 +16,8 @@ type connGroup struct {
 	dst    io.ReadWriteCloser
 	wg     *sync.WaitGroup
 	n      *int64
-	flow   *file.Flow
+	flows  file.Flows
+	in     bool // visitor -> target
 	task   *file.Tunnel
 	remote string
 }
@@ -30,19 +31,20 @@ type connGroup struct {
 //	}
 //}
 
-func newConnGroup(dst, src io.ReadWriteCloser, wg *sync.WaitGroup, n *int64, flow *file.Flow, task *file.Tunnel, remote string) connGroup {
+func newConnGroup(dst, src io.ReadWriteCloser, wg *sync.WaitGroup, n *int64, flows file.Flows, in bool, task *file.Tunnel, remote string) connGroup {
 	return connGroup{
 		src:    src,
 		dst:    dst,
 		wg:     wg,
 		n:      n,
-		flow:   flow,
+		flows:  flows,
+		in:     in,
 		task:   task,
 		remote: remote,
 	}
 }
 
-func CopyBuffer(dst io.Writer, src io.Reader, flow *file.Flow, task *file.Tunnel, remote string) (err error) {
+func CopyBuffer(dst io.Writer, src io.Reader, flows file.Flows, in bool, task *file.Tunnel, remote string) (err error) {
 	buf := common.CopyBuff.Get()
 	defer common.CopyBuff.Put(buf)
 	for {
@@ -77,10 +79,13 @@ func CopyBuffer(dst io.Writer, src io.Reader, flow *file.Flow, task *file.Tunnel
 			nw, ew := dst.Write(buf[0:nr])
 			if nw > 0 {
 				//written += int64(nw)
-				if flow != nil {
-					flow.Add(int64(nw), int64(nw))
-					// <<20 = 1024 * 1024
-					if flow.FlowLimit > 0 && (flow.FlowLimit<<20) < (flow.ExportFlow+flow.InletFlow) {
+				if len(flows) > 0 {
+					if in {
+						flows.AddTcp(int64(nw), 0)
+					} else {
+						flows.AddTcp(0, int64(nw))
+					}
+					if flows.IsExceeded() {
 						logs.Info("流量已经超出.........")
 						break
 					}
@@ -112,7 +117,7 @@ func copyConnGroup(group interface{}) {
 		return
 	}
 	var err error
-	err = CopyBuffer(cg.dst, cg.src, cg.flow, cg.task, cg.remote)
+	err = CopyBuffer(cg.dst, cg.src, cg.flows, cg.in, cg.task, cg.remote)
 	if err != nil {
 		cg.src.Close()
 		cg.dst.Close()
@@ -128,16 +133,16 @@ func copyConnGroup(group interface{}) {
 type Conns struct {
 	conn1 io.ReadWriteCloser // mux connection
 	conn2 net.Conn           // outside connection
-	flow  *file.Flow
+	flows file.Flows
 	wg    *sync.WaitGroup
 	task  *file.Tunnel
 }
 
-func NewConns(c1 io.ReadWriteCloser, c2 net.Conn, flow *file.Flow, wg *sync.WaitGroup, task *file.Tunnel) Conns {
+func NewConns(c1 io.ReadWriteCloser, c2 net.Conn, flows file.Flows, wg *sync.WaitGroup, task *file.Tunnel) Conns {
 	return Conns{
 		conn1: c1,
 		conn2: c2,
-		flow:  flow,
+		flows: flows,
 		wg:    wg,
 		task:  task,
 	}
@@ -150,9 +155,9 @@ func copyConns(group interface{}) {
 	wg.Add(2)
 	var in, out int64
 	remoteAddr := conns.conn2.RemoteAddr().String()
-	_ = connCopyPool.Invoke(newConnGroup(conns.conn1, conns.conn2, wg, &in, conns.flow, conns.task, remoteAddr))
+	_ = connCopyPool.Invoke(newConnGroup(conns.conn1, conns.conn2, wg, &in, conns.flows, true, conns.task, remoteAddr))
 	// outside to mux : incoming
-	_ = connCopyPool.Invoke(newConnGroup(conns.conn2, conns.conn1, wg, &out, conns.flow, conns.task, remoteAddr))
+	_ = connCopyPool.Invoke(newConnGroup(conns.conn2, conns.conn1, wg, &out, conns.flows, false, conns.task, remoteAddr))
 	// mux to outside : outgoing
 	wg.Wait()
 	//if conns.flow != nil {
@@ -35,6 +35,7 @@ type Mux struct {
 	newConnCh          chan *conn
 	id                 int32
 	closeChan          chan struct{}
+	done               chan struct{} // closed when the mux is closed
 	IsClose            bool
 	counter            *latencyCounter
 	bw                 *bandwidth
@@ -68,6 +69,7 @@ func NewMux(c net.Conn, connType string, pingCheckThreshold int) *Mux {
 		connMap:            NewConnMap(),
 		id:                 0,
 		closeChan:          make(chan struct{}, 1),
+		done:               make(chan struct{}),
 		newConnCh:          make(chan *conn),
 		bw:                 NewBandwidth(fd),
 		IsClose:            false,
@@ -100,6 +102,8 @@ func (s *Mux) NewConn() (*conn, error) {
 	select {
 	case <-conn.connStatusOkCh:
 		return conn, nil
+	case <-s.done:
+		return nil, errors.New("create connection fail，the mux has closed")
 	case <-timer.C:
 	}
 	return nil, errors.New("create connection fail，the server refused the connection")
@@ -120,6 +124,20 @@ func (s *Mux) Addr() net.Addr {
 	return s.conn.LocalAddr()
 }
 
+// seconds, measured by the ping
+func (s *Mux) Latency() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&s.latency))
+}
+
+// read bytes per second, 0 until it is measured
+func (s *Mux) Bandwidth() float64 {
+	return s.bw.Get()
+}
+
+func (s *Mux) NumConn() int {
+	return s.connMap.Size()
+}
+
 func (s *Mux) sendInfo(flag uint8, id int32, data interface{}) {
 	if s.IsClose {
 		return
@@ -330,11 +348,18 @@ func (s *Mux) Close() (err error) {
 	s.connMap.Close()
 	//s.connMap = nil
 	s.closeChan <- struct{}{}
+	close(s.done)
 	close(s.newConnCh)
 	// while target host close socket without finish steps, conn.Close method maybe blocked
 	// and tcp status change to CLOSE WAIT or TIME WAIT, so we close it in other goroutine
 	_ = s.conn.SetDeadline(time.Now().Add(time.Second * 5))
-	go s.conn.Close()
+	go func() {
+		_ = s.conn.Close()
+		// the fd duplicated for the bandwidth holds the socket open
+		if s.bw.fd != nil {
+			_ = s.bw.fd.Close()
+		}
+	}()
 	s.release()
 	return
 }
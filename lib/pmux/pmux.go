@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/proxyproto"
 	"github.com/astaxie/beego/logs"
 	"github.com/pkg/errors"
 )
@@ -60,11 +61,12 @@ func (pMux *PortMux) Start() error {
 	if err != nil {
 		return err
 	}
-	pMux.Listener, err = net.ListenTCP("tcp", tcpAddr)
+	listener, err := net.ListenTCP("tcp", tcpAddr)
 	if err != nil {
 		logs.Error(err)
 		os.Exit(0)
 	}
+	pMux.Listener = proxyproto.NewListener(listener)
 	go func() {
 		for {
 			conn, err := pMux.Listener.Accept()
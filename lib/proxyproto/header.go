@@ -0,0 +1,198 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const v1MaxLength = 107
+
+// network is tcp or udp, udp needs version 2
+func BuildHeader(version int, network string, src, dst net.Addr) ([]byte, error) {
+	srcIp, srcPort := getIpPort(src)
+	dstIp, dstPort := getIpPort(dst)
+	if srcIp != nil && dstIp != nil && (srcIp.To4() == nil) != (dstIp.To4() == nil) {
+		// mixed families, map the ipv4 one to ipv6
+		srcIp, dstIp = srcIp.To16(), dstIp.To16()
+	}
+	switch version {
+	case 1:
+		if network != "tcp" {
+			return nil, errors.New("the udp is not supported by the proxy protocol version 1")
+		}
+		if srcIp == nil || dstIp == nil {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		proto, srcStr, dstStr := "TCP4", srcIp.String(), dstIp.String()
+		if srcIp.To4() == nil || dstIp.To4() == nil {
+			proto, srcStr, dstStr = "TCP6", formatIpv6(srcIp), formatIpv6(dstIp)
+		}
+		return []byte("PROXY " + proto + " " + srcStr + " " + dstStr + " " + strconv.Itoa(srcPort) + " " + strconv.Itoa(dstPort) + "\r\n"), nil
+	case 2:
+		buf := bytes.NewBuffer(nil)
+		buf.Write(v2Signature)
+		// version 2, command PROXY
+		buf.WriteByte(0x21)
+		if srcIp == nil || dstIp == nil {
+			buf.WriteByte(0x00)
+			binary.Write(buf, binary.BigEndian, uint16(0))
+			return buf.Bytes(), nil
+		}
+		var family byte = 0x10
+		if srcIp.To4() == nil || dstIp.To4() == nil {
+			family = 0x20
+			srcIp, dstIp = srcIp.To16(), dstIp.To16()
+		} else {
+			srcIp, dstIp = srcIp.To4(), dstIp.To4()
+		}
+		if network == "udp" {
+			family |= 0x02
+		} else {
+			family |= 0x01
+		}
+		buf.WriteByte(family)
+		binary.Write(buf, binary.BigEndian, uint16(len(srcIp)*2+4))
+		buf.Write(srcIp)
+		buf.Write(dstIp)
+		binary.Write(buf, binary.BigEndian, uint16(srcPort))
+		binary.Write(buf, binary.BigEndian, uint16(dstPort))
+		return buf.Bytes(), nil
+	}
+	return nil, errors.New("unknown proxy protocol version " + strconv.Itoa(version))
+}
+
+func formatIpv6(ip net.IP) string {
+	if ip.To4() != nil {
+		return "::ffff:" + ip.String()
+	}
+	return ip.String()
+}
+
+func getIpPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	case nil:
+		return nil, 0
+	}
+	return ParseAddr(addr.String())
+}
+
+func ParseAddr(addr string) (net.IP, int) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, 0
+	}
+	return net.ParseIP(host), p
+}
+
+// the addresses are nil without a header or for the LOCAL command
+func ReadHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch b[0] {
+	case 'P':
+		return readV1Header(r)
+	case v2Signature[0]:
+		return readV2Header(r)
+	}
+	return nil, nil, nil
+}
+
+func readV1Header(r *bufio.Reader) (src, dst net.Addr, err error) {
+	if b, err := r.Peek(6); err != nil {
+		return nil, nil, err
+	} else if string(b) != "PROXY " {
+		return nil, nil, nil
+	}
+	var line []byte
+	for len(line) <= v1MaxLength {
+		var c byte
+		if c, err = r.ReadByte(); err != nil {
+			return nil, nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("the proxy protocol header is too long")
+	}
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errors.New("invalid proxy protocol header " + strconv.Quote(string(line)))
+	}
+	srcIp, dstIp := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIp == nil || dstIp == nil || err1 != nil || err2 != nil {
+		return nil, nil, errors.New("invalid proxy protocol header " + strconv.Quote(string(line)))
+	}
+	return &net.TCPAddr{IP: srcIp, Port: int(srcPort)}, &net.TCPAddr{IP: dstIp, Port: int(dstPort)}, nil
+}
+
+func readV2Header(r *bufio.Reader) (src, dst net.Addr, err error) {
+	b, err := r.Peek(16)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(b[:12], v2Signature) {
+		return nil, nil, nil
+	}
+	if b[12]>>4 != 2 {
+		return nil, nil, errors.New("unknown proxy protocol version " + strconv.Itoa(int(b[12]>>4)))
+	}
+	command, family := b[12]&0x0f, b[13]
+	length := int(binary.BigEndian.Uint16(b[14:16]))
+	if _, err = r.Discard(16); err != nil {
+		return nil, nil, err
+	}
+	body := make([]byte, length)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	// LOCAL, sent by the health checks of the load balancer
+	if command == 0x00 {
+		return nil, nil, nil
+	}
+	var ipLen int
+	switch family >> 4 {
+	case 1:
+		ipLen = 4
+	case 2:
+		ipLen = 16
+	default:
+		// unix sockets and AF_UNSPEC
+		return nil, nil, nil
+	}
+	if length < ipLen*2+4 {
+		return nil, nil, errors.New("the address length of the proxy protocol header is invalid")
+	}
+	srcIp, dstIp := net.IP(body[:ipLen]), net.IP(body[ipLen:ipLen*2])
+	srcPort := int(binary.BigEndian.Uint16(body[ipLen*2:]))
+	dstPort := int(binary.BigEndian.Uint16(body[ipLen*2+2:]))
+	if family&0x0f == 0x02 {
+		return &net.UDPAddr{IP: srcIp, Port: srcPort}, &net.UDPAddr{IP: dstIp, Port: dstPort}, nil
+	}
+	return &net.TCPAddr{IP: srcIp, Port: srcPort}, &net.TCPAddr{IP: dstIp, Port: dstPort}, nil
+}
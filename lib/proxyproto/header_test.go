@@ -0,0 +1,146 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestBuildHeader(t *testing.T) {
+	src, dst := &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1234}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}
+	tests := []struct {
+		version  int
+		network  string
+		src, dst net.Addr
+		want     string
+	}{
+		{1, "tcp", src, dst, "PROXY TCP4 192.168.1.1 10.0.0.1 1234 80\r\n"},
+		{1, "tcp", src6, dst, "PROXY TCP6 2001:db8::1 ::ffff:10.0.0.1 1234 80\r\n"},
+		{1, "tcp", nil, dst, "PROXY UNKNOWN\r\n"},
+		{2, "tcp", src, dst, "0d0a0d0a000d0a515549540a" + "21" + "11" + "000c" + "c0a80101" + "0a000001" + "04d2" + "0050"},
+		{2, "udp", src, dst, "0d0a0d0a000d0a515549540a" + "21" + "12" + "000c" + "c0a80101" + "0a000001" + "04d2" + "0050"},
+		{2, "tcp", nil, dst, "0d0a0d0a000d0a515549540a" + "21" + "00" + "0000"},
+	}
+	for _, v := range tests {
+		b, err := BuildHeader(v.version, v.network, v.src, v.dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := string(b)
+		if v.version == 2 {
+			got = hex.EncodeToString(b)
+		}
+		if got != v.want {
+			t.Errorf("the header of version %d %s %v is %q, want %q", v.version, v.network, v.src, got, v.want)
+		}
+	}
+	if _, err := BuildHeader(1, "udp", src, dst); err == nil {
+		t.Error("the udp header of version 1 is built")
+	}
+	if _, err := BuildHeader(3, "tcp", src, dst); err == nil {
+		t.Error("the header of an unknown version is built")
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	v2 := func(s string) string {
+		b, _ := hex.DecodeString("0d0a0d0a000d0a515549540a" + s)
+		return string(b)
+	}
+	tests := []struct {
+		header  string
+		src     string
+		network string
+		err     bool
+	}{
+		{"PROXY TCP4 192.168.1.1 10.0.0.1 1234 80\r\n", "192.168.1.1:1234", "tcp", false},
+		{"PROXY TCP6 2001:db8::1 ::1 1234 80\r\n", "[2001:db8::1]:1234", "tcp", false},
+		{"PROXY UNKNOWN ffff::1 ::1 1 2\r\n", "", "", false},
+		{"PROXY TCP4 192.168.1.1 10.0.0.1 1234\r\n", "", "", true},
+		{"PROXY TCP4 192.168.1.1 10.0.0.1 1234 65536\r\n", "", "", true},
+		{"PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n", "", "", true},
+		{v2("21" + "11" + "000c" + "c0a80101" + "0a000001" + "04d2" + "0050"), "192.168.1.1:1234", "tcp", false},
+		{v2("21" + "12" + "000c" + "c0a80101" + "0a000001" + "04d2" + "0050"), "192.168.1.1:1234", "udp", false},
+		// tlvs are skipped
+		{v2("21" + "21" + "0028" + "20010db8000000000000000000000001" + "00000000000000000000000000000001" + "04d2" + "0050" + "0300010a"), "[2001:db8::1]:1234", "tcp", false},
+		// LOCAL command
+		{v2("20" + "00" + "0000"), "", "", false},
+		{v2("21" + "11" + "0004" + "c0a80101"), "", "", true},
+		{v2("31" + "11" + "0000"), "", "", true},
+		// no header, the data is untouched
+		{"GET / HTTP/1.1\r\n", "", "", false},
+	}
+	for _, v := range tests {
+		r := bufio.NewReader(strings.NewReader(v.header + "data"))
+		src, dst, err := ReadHeader(r)
+		if (err != nil) != v.err {
+			t.Errorf("read %q error %v", v.header, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if v.src == "" {
+			if src != nil || dst != nil {
+				t.Errorf("the addresses of %q are %v %v", v.header, src, dst)
+			}
+		} else if src == nil || src.String() != v.src || src.Network() != v.network {
+			t.Errorf("the source of %q is %v, want %s %s", v.header, src, v.network, v.src)
+		}
+		want := "data"
+		if !strings.HasPrefix(v.header, "PROXY") && !strings.HasPrefix(v.header, "\r\n") {
+			want = v.header + want
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != want {
+			t.Errorf("the data after %q is %q", v.header, rest)
+		}
+	}
+}
+
+func TestConn(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1234}
+	for _, version := range []int{1, 2} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			client, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			c, err := NewTargetConn(client, version, src.String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			c.Write([]byte("hello"))
+			c.Close()
+		}()
+		server, err := l.Accept()
+		l.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := NewConn(server)
+		if c.RemoteAddr().String() != src.String() {
+			t.Fatalf("the remote address of version %d is %s", version, c.RemoteAddr())
+		}
+		if b, _ := io.ReadAll(c); !bytes.Equal(b, []byte("hello")) {
+			t.Fatalf("the data of version %d is %q", version, b)
+		}
+	}
+
+	// only the connections from the trusted ips are read
+	defer SetTrustedIps("")
+	SetTrustedIps("127.0.0.1")
+	if !IsTrusted(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}) || IsTrusted(src) {
+		t.Fatal("the trusted ips are not matched")
+	}
+}
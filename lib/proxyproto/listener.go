@@ -0,0 +1,112 @@
+package proxyproto
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego/logs"
+)
+
+var (
+	trustedNets   []*net.IPNet
+	HeaderTimeout = 5 * time.Second
+)
+
+// the load balancers which send the header, ips or cidrs separated by comma
+func SetTrustedIps(ips string) {
+	trustedNets = file.ParseIpNets(ips)
+}
+
+func IsTrusted(addr net.Addr) bool {
+	ip, _ := getIpPort(addr)
+	if ip == nil {
+		return false
+	}
+	for _, v := range trustedNets {
+		if v.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// only the connections from the trusted ips are parsed
+type Listener struct {
+	net.Listener
+}
+
+func NewListener(l net.Listener) net.Listener {
+	if len(trustedNets) == 0 {
+		return l
+	}
+	return &Listener{Listener: l}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil || !IsTrusted(c.RemoteAddr()) {
+		return c, err
+	}
+	return NewConn(c), nil
+}
+
+// the header is read lazily so a slow peer does not block the accept loop
+type Conn struct {
+	net.Conn
+	r        *bufio.Reader
+	once     sync.Once
+	src      net.Addr
+	err      error
+	deadline time.Time
+	sync.Mutex
+}
+
+func NewConn(c net.Conn) *Conn {
+	return &Conn{Conn: c, r: bufio.NewReader(c)}
+}
+
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(HeaderTimeout))
+		c.src, _, c.err = ReadHeader(c.r)
+		c.Lock()
+		c.Conn.SetReadDeadline(c.deadline)
+		c.Unlock()
+		if c.err != nil {
+			logs.Warn("read the proxy protocol header from %s error %s", c.Conn.RemoteAddr(), c.err.Error())
+		}
+	})
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.Lock()
+	c.deadline = t
+	c.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.Lock()
+	c.deadline = t
+	c.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
@@ -0,0 +1,41 @@
+package proxyproto
+
+import (
+	"net"
+)
+
+// for udp the header is prepended to every datagram
+func NewTargetConn(c net.Conn, version int, remoteAddr string) (net.Conn, error) {
+	ip, port := ParseAddr(remoteAddr)
+	var src net.Addr
+	if ip != nil {
+		src = &net.TCPAddr{IP: ip, Port: port}
+	}
+	if _, ok := c.(*net.UDPConn); ok {
+		header, err := BuildHeader(2, "udp", src, c.RemoteAddr())
+		if err != nil {
+			return nil, err
+		}
+		return &packetConn{Conn: c, header: header}, nil
+	}
+	header, err := BuildHeader(version, "tcp", src, c.RemoteAddr())
+	if err != nil {
+		return nil, err
+	}
+	if _, err = c.Write(header); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+type packetConn struct {
+	net.Conn
+	header []byte
+}
+
+func (c *packetConn) Write(b []byte) (int, error) {
+	if _, err := c.Conn.Write(append(append([]byte{}, c.header...), b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
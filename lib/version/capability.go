@@ -0,0 +1,55 @@
+package version
+
+// a feature is used only if both sides support it
+const (
+	FEATURE_DIAL_RESULT    = "dial_result"
+	FEATURE_TARGET_TLS     = "target_tls"
+	FEATURE_PROXY_PROTOCOL = "proxy_protocol"
+	FEATURE_COMMAND        = "command"
+	FEATURE_PROFILE        = "profile"
+)
+
+// a peer of another protocol is rejected
+const PROTOCOL = 1
+
+type Capability struct {
+	Protocol int
+	Version  string
+	Features []string
+	Error    string // why the server rejects the client
+}
+
+func NewCapability() *Capability {
+	return &Capability{
+		Protocol: PROTOCOL,
+		Version:  VERSION,
+		Features: []string{FEATURE_DIAL_RESULT, FEATURE_TARGET_TLS, FEATURE_PROXY_PROTOCOL, FEATURE_COMMAND, FEATURE_PROFILE},
+	}
+}
+
+// a peer of the legacy handshake has no feature
+func NewLegacyCapability(version string) *Capability {
+	return &Capability{Version: version, Features: []string{}}
+}
+
+func (s *Capability) Has(feature string) bool {
+	if s == nil {
+		return false
+	}
+	for _, v := range s.Features {
+		if v == feature {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Capability) Negotiate(peer *Capability) *Capability {
+	c := &Capability{Protocol: s.Protocol, Version: s.Version, Features: []string{}}
+	for _, v := range s.Features {
+		if peer.Has(v) {
+			c.Features = append(c.Features, v)
+		}
+	}
+	return c
+}
@@ -4,5 +4,8 @@ const VERSION = "0.26.21"
 
 // Compulsory minimum version, Minimum downward compatibility to this version
 func GetVersion() string {
-	return "0.26.0"
+	return "0.27.0"
 }
+
+// the core version which does not negotiate
+const LEGACY_VERSION = "0.26.0"
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/file"
+	"ehang.io/nps/server/cluster"
+	"ehang.io/nps/server/proxy"
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+)
+
+// the nodes take the ids by turns
+const maxClusterNodes = 16
+
+type clusterHandler struct {
+	sync.Mutex
+}
+
+func (s *clusterHandler) SendLinkInfo(clientId int, link *conn.Link, isFile bool) (net.Conn, error) {
+	return Bridge.SendLocalLinkInfo(clientId, link, isFile)
+}
+
+func (s *clusterHandler) GetClients() []int {
+	return Bridge.GetLocalClients()
+}
+
+func (s *clusterHandler) DisconnectClient(clientId int) {
+	Bridge.DelClient(clientId)
+}
+
+func (s *clusterHandler) Snapshot() []file.Change {
+	return file.GetDb().JsonDb.Snapshot()
+}
+
+// saved without broadcasting again
+func (s *clusterHandler) ApplyChanges(changes []file.Change) {
+	s.Lock()
+	defer s.Unlock()
+	file.GetDb().JsonDb.Merge(changes, applyChange)
+}
+
+func applyChange(c file.Change) {
+	switch c.Name {
+	case file.STORE_CLIENTS:
+		applyClient(c)
+	case file.STORE_HOSTS:
+		file.GetDb().JsonDb.ApplyHost(c)
+	case file.STORE_TASKS:
+		applyTask(c)
+	case file.STORE_GLOBAL:
+		if c.Data != nil {
+			file.GetDb().JsonDb.ApplyGlobal(c.Data)
+		}
+	}
+}
+
+func applyClient(c file.Change) {
+	old, err := file.GetDb().GetClient(c.Id)
+	if err != nil {
+		file.GetDb().JsonDb.ApplyClient(c)
+		return
+	}
+	vkey, certSerial, profile := old.VerifyKey, old.CertSerial, old.GetProfile()
+	file.GetDb().JsonDb.ApplyClient(c)
+	if v, err := file.GetDb().GetClient(c.Id); err != nil || !v.Status || v.VerifyKey != vkey || v.CertSerial != certSerial {
+		Bridge.DelClient(c.Id)
+	} else if !v.GetProfile().Equal(profile) {
+		// only the node holding the client applies it
+		go ApplyProfile(c.Id)
+	}
+}
+
+func applyTask(c file.Change) {
+	if c.Data == nil {
+		closeServer(c.Id)
+		file.GetDb().JsonDb.Tasks.Delete(c.Id)
+		return
+	}
+	t, err := file.GetDb().JsonDb.ParseTask(c)
+	if err != nil {
+		logs.Warn("the task %d of the cluster error %s", c.Id, err.Error())
+		return
+	}
+	if old, err := file.GetDb().GetTask(t.Id); err == nil {
+		if old.IsSameConfig(t) {
+			return
+		}
+		closeServer(old.Id)
+	}
+	file.GetDb().JsonDb.Tasks.Store(t.Id, t)
+	if t.Status {
+		AddTask(t)
+	}
+}
+
+// the status of the task is not saved
+func closeServer(id int) {
+	if v, ok := RunList.Load(id); ok {
+		if svr, ok := v.(proxy.Service); ok {
+			if err := svr.Close(); err != nil {
+				logs.Warn("stop server id %d error %s", id, err.Error())
+			}
+		}
+		RunList.Delete(id)
+	}
+}
+
+func startCluster() error {
+	if !beego.AppConfig.DefaultBool("cluster_enable", false) {
+		return nil
+	}
+	key := beego.AppConfig.String("cluster_key")
+	if key == "" {
+		return errors.New("the cluster_key is required by the cluster")
+	}
+	id := beego.AppConfig.String("cluster_node_id")
+	if id == "" {
+		id, _ = os.Hostname()
+	}
+	index, err := beego.AppConfig.Int("cluster_node_index")
+	if err != nil || index < 0 || index >= maxClusterNodes {
+		return errors.New("the cluster_node_index must be unique and from 0 to 15")
+	}
+	l, err := net.Listen("tcp", beego.AppConfig.DefaultString("cluster_addr", "0.0.0.0:8026"))
+	if err != nil {
+		return err
+	}
+	peers := make([]string, 0)
+	for _, v := range strings.Split(beego.AppConfig.String("cluster_peers"), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			peers = append(peers, v)
+		}
+	}
+	node := cluster.NewNode(id, key, peers, new(clusterHandler))
+	file.GetDb().JsonDb.EnableCluster(id, index, maxClusterNodes, node.BroadcastChanges)
+	Bridge.Cluster = node
+	node.Start(l)
+	logs.Info("the node %s of the cluster is listening on %s, peers %s", id, l.Addr(), strings.Join(peers, ","))
+	return nil
+}
@@ -0,0 +1,480 @@
+package cluster
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/crypt"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego/logs"
+)
+
+// The nodes share the config store by the objects saved, the newer revision wins,
+// broadcast the presence of the clients
+// and forward each link to the node holding the client's bridge connection.
+// A node sends its messages only on the connections it dialed.
+// Both sides prove the key with an hmac bound to the tls session.
+
+const (
+	flagControl = "ctrl"
+	flagLink    = "link"
+)
+
+const (
+	msgPresence   = "presence"
+	msgPresences  = "presences"  // sent after connecting
+	msgChanges    = "changes"    // the snapshot of the store is sent after connecting too
+	msgDisconnect = "disconnect" // the node holding the client disconnects it
+)
+
+// signed in the proof
+const (
+	flagDial   = "dial"
+	flagAccept = "accept"
+)
+
+const nonceSize = 32
+
+// the snapshot is sent as a whole
+const maxMessageSize = 64 << 20
+
+var RetryInterval = time.Second * 3
+
+type message struct {
+	Type     string
+	ClientId int           `json:",omitempty"`
+	Online   bool          `json:",omitempty"`
+	Clients  []int         `json:",omitempty"`
+	Changes  []file.Change `json:",omitempty"`
+}
+
+type hello struct {
+	Id   string
+	Auth string
+}
+
+type linkRequest struct {
+	ClientId int
+	File     bool // uses the file mux of the client
+	Link     *conn.Link
+}
+
+type linkResult struct {
+	Error string
+}
+
+type Handler interface {
+	SendLinkInfo(clientId int, link *conn.Link, isFile bool) (net.Conn, error)
+	// the objects of the store with the revisions
+	Snapshot() []file.Change
+	// saved by another node, only the newer ones are applied
+	ApplyChanges(changes []file.Change)
+	GetClients() []int
+	DisconnectClient(clientId int)
+}
+
+type Node struct {
+	Id       string
+	key      string
+	addrs    []string
+	handler  Handler
+	peers    sync.Map // node id -> *peer
+	presence sync.Map // client id -> node id, clients held by the other nodes
+	listener net.Listener
+	config   *tls.Config
+	closed   chan struct{}
+	once     sync.Once
+}
+
+type peer struct {
+	id   string
+	addr string
+	send chan *message
+	conn net.Conn
+}
+
+// addrs may contain the node itself, it is skipped after the handshake
+func NewNode(id, key string, addrs []string, handler Handler) *Node {
+	return &Node{
+		Id:      id,
+		key:     key,
+		addrs:   addrs,
+		handler: handler,
+		closed:  make(chan struct{}),
+	}
+}
+
+func (s *Node) Start(l net.Listener) {
+	s.listener = l
+	s.config = &tls.Config{Certificates: []tls.Certificate{crypt.GetCert()}, MinVersion: tls.VersionTLS13}
+	go s.serve()
+	for _, addr := range s.addrs {
+		go s.keepPeer(addr)
+	}
+}
+
+func (s *Node) Close() {
+	s.once.Do(func() {
+		close(s.closed)
+		if s.listener != nil {
+			s.listener.Close()
+		}
+		s.peers.Range(func(key, value interface{}) bool {
+			value.(*peer).conn.Close()
+			return true
+		})
+	})
+}
+
+func (s *Node) SetPresence(clientId int, online bool) {
+	s.broadcast(&message{Type: msgPresence, ClientId: clientId, Online: online})
+}
+
+func (s *Node) BroadcastChanges(changes []file.Change) {
+	s.broadcast(&message{Type: msgChanges, Changes: changes})
+}
+
+func (s *Node) DisconnectClient(clientId int) {
+	s.broadcast(&message{Type: msgDisconnect, ClientId: clientId})
+}
+
+func (s *Node) GetNode(clientId int) (string, bool) {
+	if v, ok := s.presence.Load(clientId); ok {
+		return v.(string), true
+	}
+	return "", false
+}
+
+func (s *Node) SendLinkInfo(clientId int, link *conn.Link, isFile bool) (net.Conn, error) {
+	id, ok := s.GetNode(clientId)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("the client %d is not connect", clientId))
+	}
+	v, ok := s.peers.Load(id)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("the node %s of the client %d is not connect", id, clientId))
+	}
+	c, _, err := s.dial(v.(*peer).addr, flagLink)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeMessage(c, &linkRequest{ClientId: clientId, File: isFile, Link: link}); err != nil {
+		c.Close()
+		return nil, err
+	}
+	// the peer may be waiting for the dial result
+	c.SetReadDeadline(time.Now().Add(link.Option.Timeout + 10*time.Second))
+	var result linkResult
+	if err := readMessage(c, &result); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetReadDeadline(time.Time{})
+	if result.Error != "" {
+		c.Close()
+		return nil, errors.New(result.Error)
+	}
+	return c, nil
+}
+
+func (s *Node) broadcast(m *message) {
+	s.peers.Range(func(key, value interface{}) bool {
+		p := value.(*peer)
+		select {
+		case p.send <- m:
+		default:
+			// too slow, reconnect and resend the presence and the snapshot
+			logs.Warn("the messages to the node %s are dropped, reconnect it", p.id)
+			p.conn.Close()
+		}
+		return true
+	})
+}
+
+func (s *Node) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Node) keepPeer(addr string) {
+	for !s.isClosed() {
+		c, id, err := s.dial(addr, flagControl)
+		if err != nil {
+			logs.Trace("connect to the node %s error %s", addr, err.Error())
+		} else if id == s.Id {
+			c.Close()
+			return
+		} else {
+			p := &peer{id: id, addr: addr, send: make(chan *message, 1024), conn: c}
+			s.peers.Store(id, p)
+			// the peer may have restarted or missed the changes, the later ones are queued
+			if writeMessage(c, &message{Type: msgPresences, Clients: s.handler.GetClients()}) == nil &&
+				writeMessage(c, &message{Type: msgChanges, Changes: s.handler.Snapshot()}) == nil {
+				logs.Info("connect to the node %s %s successfully", id, addr)
+				s.sendLoop(p)
+			}
+			s.peers.Delete(id)
+			c.Close()
+			logs.Warn("the connection to the node %s %s is closed", id, addr)
+		}
+		select {
+		case <-s.closed:
+		case <-time.After(RetryInterval):
+		}
+	}
+}
+
+func (s *Node) sendLoop(p *peer) {
+	// the peer sends nothing here, the read only returns on close
+	done := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, p.conn)
+		close(done)
+	}()
+	for {
+		select {
+		case m := <-p.send:
+			if err := writeMessage(p.conn, m); err != nil {
+				return
+			}
+		case <-done:
+			return
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *Node) dial(addr, flag string) (net.Conn, string, error) {
+	raw, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, "", err
+	}
+	// verified by the key instead of the certificate
+	c := tls.Client(raw, &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS13})
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	id, err := s.dialHandshake(c, flag)
+	if err != nil {
+		c.Close()
+		return nil, "", err
+	}
+	c.SetDeadline(time.Time{})
+	return c, id, nil
+}
+
+func (s *Node) dialHandshake(c *tls.Conn, flag string) (string, error) {
+	nonce := newNonce()
+	if _, err := c.Write([]byte(flag + nonce)); err != nil {
+		return "", err
+	}
+	b := make([]byte, len(nonce))
+	if _, err := io.ReadFull(c, b); err != nil {
+		return "", err
+	}
+	peerNonce := string(b)
+	auth, err := s.proof(c, flagDial, nonce, peerNonce)
+	if err != nil {
+		return "", err
+	}
+	if err := writeMessage(c, &hello{Id: s.Id, Auth: auth}); err != nil {
+		return "", err
+	}
+	var h hello
+	if err := readMessage(c, &h); err != nil {
+		return "", errors.New("the key of the cluster is not correct or the node is closed")
+	}
+	if auth, err = s.proof(c, flagAccept, nonce, peerNonce); err != nil || !hmac.Equal([]byte(h.Auth), []byte(auth)) {
+		return "", errors.New("the node " + c.RemoteAddr().String() + " does not know the key of the cluster")
+	}
+	return h.Id, nil
+}
+
+func (s *Node) serve() {
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			if !s.isClosed() {
+				logs.Error("accept the connection of the node error %s", err.Error())
+			}
+			return
+		}
+		go s.handle(c)
+	}
+}
+
+func (s *Node) handle(raw net.Conn) {
+	c := tls.Server(raw, s.config)
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	b := make([]byte, 4+nonceSize)
+	if _, err := io.ReadFull(c, b); err != nil {
+		c.Close()
+		return
+	}
+	flag, peerNonce := string(b[:4]), string(b[4:])
+	nonce := newNonce()
+	if _, err := c.Write([]byte(nonce)); err != nil {
+		c.Close()
+		return
+	}
+	var h hello
+	auth, err := s.proof(c, flagDial, peerNonce, nonce)
+	if err != nil || readMessage(c, &h) != nil || !hmac.Equal([]byte(h.Auth), []byte(auth)) {
+		logs.Warn("the node %s verification error, the key of the cluster is not correct", c.RemoteAddr())
+		c.Close()
+		return
+	}
+	if auth, err = s.proof(c, flagAccept, peerNonce, nonce); err != nil {
+		c.Close()
+		return
+	}
+	if err := writeMessage(c, &hello{Id: s.Id, Auth: auth}); err != nil {
+		c.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+	switch flag {
+	case flagControl:
+		s.receive(c, h.Id)
+	case flagLink:
+		s.forward(c, h.Id)
+	default:
+		c.Close()
+	}
+}
+
+// the hmac of the key over the side, the nonces and the tls keying material,
+// so a proof can not be replayed by the other side or relayed by a man in the middle
+func (s *Node) proof(c *tls.Conn, side string, nonces ...string) (string, error) {
+	state := c.ConnectionState()
+	ekm, err := state.ExportKeyingMaterial("nps cluster", nil, 32)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, []byte(s.key))
+	mac.Write([]byte(side))
+	mac.Write(ekm)
+	for _, v := range nonces {
+		mac.Write([]byte(v))
+	}
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func newNonce() string {
+	b := make([]byte, nonceSize/2)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// the presence of the peer is removed once the connection closes
+func (s *Node) receive(c net.Conn, id string) {
+	defer func() {
+		c.Close()
+		s.removePresence(id)
+	}()
+	for {
+		var m message
+		if err := readMessage(c, &m); err != nil {
+			return
+		}
+		switch m.Type {
+		case msgPresence:
+			if m.Online {
+				s.presence.Store(m.ClientId, id)
+			} else if v, ok := s.presence.Load(m.ClientId); ok && v.(string) == id {
+				s.presence.Delete(m.ClientId)
+			}
+		case msgPresences:
+			s.removePresence(id)
+			for _, clientId := range m.Clients {
+				s.presence.Store(clientId, id)
+			}
+		case msgChanges:
+			logs.Trace("%d changes of the store from the node %s", len(m.Changes), id)
+			s.handler.ApplyChanges(m.Changes)
+		case msgDisconnect:
+			s.handler.DisconnectClient(m.ClientId)
+		}
+	}
+}
+
+func (s *Node) removePresence(id string) {
+	s.presence.Range(func(key, value interface{}) bool {
+		if value.(string) == id {
+			s.presence.Delete(key)
+		}
+		return true
+	})
+}
+
+func (s *Node) forward(c net.Conn, id string) {
+	var req linkRequest
+	if err := readMessage(c, &req); err != nil || req.Link == nil {
+		c.Close()
+		return
+	}
+	target, err := s.handler.SendLinkInfo(req.ClientId, req.Link, req.File)
+	if err != nil {
+		writeMessage(c, &linkResult{Error: err.Error()})
+		c.Close()
+		return
+	}
+	if err := writeMessage(c, &linkResult{}); err != nil {
+		c.Close()
+		target.Close()
+		return
+	}
+	logs.Trace("forward the link of the client %d to %s from the node %s", req.ClientId, req.Link.Host, id)
+	go func() {
+		io.Copy(target, c)
+		target.Close()
+		c.Close()
+	}()
+	io.Copy(c, target)
+	c.Close()
+	target.Close()
+}
+
+// 4 bytes length, then the json
+func writeMessage(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(b))
+	binary.LittleEndian.PutUint32(buf, uint32(len(b)))
+	copy(buf[4:], b)
+	_, err = w.Write(buf)
+	return err
+}
+
+func readMessage(r io.Reader, v interface{}) error {
+	var l uint32
+	if err := binary.Read(r, binary.LittleEndian, &l); err != nil {
+		return err
+	}
+	if l > maxMessageSize {
+		return errors.New("the message is too large")
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,252 @@
+package cluster
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/crypt"
+	"ehang.io/nps/lib/file"
+)
+
+func init() {
+	RetryInterval = 100 * time.Millisecond
+	crypt.InitTls("", "")
+}
+
+type testHandler struct {
+	clients      sync.Map
+	changes      chan []file.Change
+	snapshot     []file.Change
+	disconnected chan int
+}
+
+func newTestHandler() *testHandler {
+	return &testHandler{changes: make(chan []file.Change, 10), disconnected: make(chan int, 10)}
+}
+
+func (s *testHandler) SendLinkInfo(clientId int, link *conn.Link, isFile bool) (net.Conn, error) {
+	if _, ok := s.clients.Load(clientId); !ok {
+		return nil, errors.New("the client is not connect")
+	}
+	a, b := net.Pipe()
+	go func() {
+		io.Copy(b, b)
+		b.Close()
+	}()
+	return a, nil
+}
+
+func (s *testHandler) Snapshot() []file.Change {
+	return s.snapshot
+}
+
+func (s *testHandler) ApplyChanges(changes []file.Change) {
+	if len(changes) > 0 {
+		s.changes <- changes
+	}
+}
+
+func (s *testHandler) DisconnectClient(clientId int) {
+	s.disconnected <- clientId
+}
+
+func (s *testHandler) GetClients() []int {
+	clients := make([]int, 0)
+	s.clients.Range(func(key, value interface{}) bool {
+		clients = append(clients, key.(int))
+		return true
+	})
+	return clients
+}
+
+func startNodes(t *testing.T, ids ...string) ([]*Node, []*testHandler) {
+	listeners := make([]net.Listener, 0)
+	addrs := make([]string, 0)
+	for range ids {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, l)
+		addrs = append(addrs, l.Addr().String())
+	}
+	nodes := make([]*Node, 0)
+	handlers := make([]*testHandler, 0)
+	for i, id := range ids {
+		h := newTestHandler()
+		n := NewNode(id, "key", addrs, h)
+		n.Start(listeners[i])
+		nodes = append(nodes, n)
+		handlers = append(handlers, h)
+	}
+	return nodes, handlers
+}
+
+func waitFor(t *testing.T, msg string, f func() bool) {
+	for i := 0; i < 100; i++ {
+		if f() {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal(msg)
+}
+
+func connected(n *Node, num int) func() bool {
+	return func() bool {
+		i := 0
+		n.peers.Range(func(key, value interface{}) bool {
+			i++
+			return true
+		})
+		return i == num
+	}
+}
+
+func TestCluster(t *testing.T) {
+	nodes, handlers := startNodes(t, "a", "b", "c")
+	defer func() {
+		for _, n := range nodes {
+			n.Close()
+		}
+	}()
+	for _, n := range nodes {
+		waitFor(t, "the nodes are not connected", connected(n, 2))
+	}
+
+	handlers[0].clients.Store(1, true)
+	nodes[0].SetPresence(1, true)
+	waitFor(t, "the presence is not received", func() bool {
+		id, ok := nodes[2].GetNode(1)
+		return ok && id == "a"
+	})
+
+	c, err := nodes[2].SendLinkInfo(1, conn.NewLink("tcp", "127.0.0.1:80", false, false, "", false), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil || string(b) != "hello" {
+		t.Fatalf("read the echo error %v %s", err, b)
+	}
+	c.Close()
+	if _, err := nodes[1].SendLinkInfo(2, conn.NewLink("tcp", "127.0.0.1:80", false, false, "", false), false); err == nil {
+		t.Fatal("the link of the client which is not connected should fail")
+	}
+
+	nodes[1].BroadcastChanges([]file.Change{{Name: file.STORE_TASKS, Id: 1, Data: []byte("data")}})
+	for _, i := range []int{0, 2} {
+		select {
+		case v := <-handlers[i].changes:
+			if len(v) != 1 || v[0].Name != file.STORE_TASKS || string(v[0].Data) != "data" {
+				t.Fatalf("the changes %v are not expected", v)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the changes are not received")
+		}
+	}
+
+	// the client is disconnected by all of the other nodes
+	nodes[2].DisconnectClient(1)
+	for _, i := range []int{0, 1} {
+		select {
+		case id := <-handlers[i].disconnected:
+			if id != 1 {
+				t.Fatalf("the client %d is disconnected", id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the disconnection is not received")
+		}
+	}
+
+	nodes[0].Close()
+	waitFor(t, "the presence of the closed node is not removed", func() bool {
+		_, ok := nodes[2].GetNode(1)
+		return !ok
+	})
+}
+
+func TestClusterKey(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewNode("a", "key", nil, newTestHandler())
+	a.Start(l)
+	defer a.Close()
+	b := NewNode("b", "other", []string{l.Addr().String()}, newTestHandler())
+	if _, _, err := b.dial(l.Addr().String(), flagControl); err == nil {
+		t.Fatal("the node with the wrong key should be rejected")
+	}
+	// the listener must prove the key too before it gets the store
+	if _, _, err := a.dial(l.Addr().String(), flagControl); err != nil {
+		t.Fatal(err)
+	}
+	fake, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.Close()
+	go func() {
+		raw, err := fake.Accept()
+		if err != nil {
+			return
+		}
+		c := tls.Server(raw, a.config)
+		defer c.Close()
+		b := make([]byte, 4+nonceSize)
+		io.ReadFull(c, b)
+		c.Write([]byte(newNonce()))
+		var h hello
+		readMessage(c, &h)
+		writeMessage(c, &hello{Id: "fake", Auth: h.Auth})
+	}()
+	if _, _, err := a.dial(fake.Addr().String(), flagControl); err == nil {
+		t.Fatal("the listener without the key should be rejected")
+	}
+}
+
+func TestClusterSnapshot(t *testing.T) {
+	la, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs := []string{la.Addr().String(), lb.Addr().String()}
+	ha, hb := newTestHandler(), newTestHandler()
+	ha.snapshot = []file.Change{{Name: file.STORE_CLIENTS, Id: 1, Data: []byte("{}")}}
+	a, b := NewNode("a", "key", addrs, ha), NewNode("b", "key", addrs, hb)
+	a.Start(la)
+	defer a.Close()
+	b.Start(lb)
+	defer b.Close()
+
+	// sent again each time the node connects, e.g. after the peer restarts
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			v, _ := a.peers.Load("b")
+			v.(*peer).conn.Close()
+		}
+		select {
+		case v := <-hb.changes:
+			if len(v) != 1 || v[0].Name != file.STORE_CLIENTS || v[0].Id != 1 {
+				t.Fatalf("the snapshot %v is not expected", v)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the snapshot is not received")
+		}
+		waitFor(t, "the nodes are not connected", connected(a, 1))
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"strconv"
 
 	"ehang.io/nps/lib/pmux"
+	"ehang.io/nps/lib/proxyproto"
 	"github.com/astaxie/beego"
 	"github.com/astaxie/beego/logs"
 )
@@ -21,6 +22,7 @@ func InitConnectionService() {
 	httpsPort = beego.AppConfig.String("https_proxy_port")
 	httpPort = beego.AppConfig.String("http_proxy_port")
 	webPort = beego.AppConfig.String("web_port")
+	proxyproto.SetTrustedIps(beego.AppConfig.String("proxy_protocol_trusted_ips"))
 
 	if httpPort == bridgePort || httpsPort == bridgePort || webPort == bridgePort {
 		port, err := strconv.Atoi(bridgePort)
@@ -42,7 +44,11 @@ func GetBridgeListener(tp string) (net.Listener, error) {
 	if pMux != nil {
 		return pMux.GetClientListener(), nil
 	}
-	return net.ListenTCP("tcp", &net.TCPAddr{net.ParseIP(beego.AppConfig.String("bridge_ip")), p, ""})
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{net.ParseIP(beego.AppConfig.String("bridge_ip")), p, ""})
+	if err != nil {
+		return nil, err
+	}
+	return proxyproto.NewListener(l), nil
 }
 
 func GetHttpListener() (net.Listener, error) {
@@ -81,5 +87,9 @@ func getTcpListener(ip, p string) (net.Listener, error) {
 	if ip == "" {
 		ip = "0.0.0.0"
 	}
-	return net.ListenTCP("tcp", &net.TCPAddr{net.ParseIP(ip), port, ""})
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{net.ParseIP(ip), port, ""})
+	if err != nil {
+		return nil, err
+	}
+	return proxyproto.NewListener(l), nil
 }
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"ehang.io/nps/bridge"
+	"ehang.io/nps/lib/config"
+	"ehang.io/nps/lib/file"
+	"ehang.io/nps/server/tool"
+	"github.com/astaxie/beego/logs"
+)
+
+var profileLock sync.Mutex
+
+// the changed tasks and hosts are created again and the others kept,
+// all of them are removed when the client disconnects
+func ApplyProfile(id int) {
+	profileLock.Lock()
+	defer profileLock.Unlock()
+	if _, ok := Bridge.Client.Load(id); !ok {
+		return
+	}
+	client, err := file.GetDb().GetClient(id)
+	if err != nil || client.NoStore {
+		return
+	}
+	cnf := new(config.Config)
+	if p := client.GetProfile(); !p.IsEmpty() {
+		if cnf, err = ParseProfile(p); err != nil {
+			logs.Error("parse the profile of the client %d error %s", id, err.Error())
+			return
+		}
+	}
+	applyProfileTasks(client, cnf.Tasks)
+	applyProfileHosts(client, cnf.Hosts)
+	// the client may have disconnected meanwhile, its tasks are already removed
+	if _, ok := Bridge.Client.Load(id); !ok {
+		DelTunnelAndHostByClientId(id, true)
+		return
+	}
+	Bridge.NotifyProfile(id)
+}
+
+// return the error of a multi account file instead of panicking
+func ParseProfile(p *file.Profile) (cnf *config.Config, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprint(r))
+		}
+	}()
+	return config.NewConfigFromProfile(p.Content, p.Files)
+}
+
+func applyProfileTasks(client *file.Client, tasks []*file.Tunnel) {
+	old := make(map[string]*file.Tunnel)
+	file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
+		if v := value.(*file.Tunnel); v.FromProfile && v.Client.Id == client.Id {
+			old[v.Remark] = v
+		}
+		return true
+	})
+	var news []*file.Tunnel
+	for _, t := range tasks {
+		// the file mode is served by the client registering the config file
+		if t.Mode == "file" {
+			logs.Warn("the file mode of the task %s is not supported by the profile of the client %d", t.Remark, client.Id)
+			continue
+		}
+		tls, err := bridge.SplitConfigTask(t, client)
+		if err != nil {
+			logs.Warn("the task of the profile of the client %d error %s", client.Id, err.Error())
+			continue
+		}
+		for _, tl := range tls {
+			tl.FromProfile = true
+			if v, ok := old[tl.Remark]; ok {
+				delete(old, tl.Remark)
+				tl.Id = v.Id
+				if v.IsSameConfig(tl) {
+					continue
+				}
+				// the new task may reuse the port
+				DelTask(v.Id)
+			}
+			news = append(news, tl)
+		}
+	}
+	for _, v := range old {
+		DelTask(v.Id)
+	}
+	for _, tl := range news {
+		tl.Id = int(file.GetDb().JsonDb.GetTaskId())
+		if client.HasTunnel(tl) {
+			logs.Warn("the port %d of the task %s of the profile is used by the other task of the client %d", tl.Port, tl.Remark, client.Id)
+			continue
+		}
+		if !tool.TestServerPort(tl.Port, tl.Mode) && tl.Mode != "secret" && tl.Mode != "p2p" {
+			logs.Warn("the port %d of the task %s of the profile of the client %d is not allowed or occupied", tl.Port, tl.Remark, client.Id)
+			continue
+		}
+		if err := file.GetDb().NewTask(tl); err != nil {
+			logs.Warn("add the task %s of the profile of the client %d error %s", tl.Remark, client.Id, err.Error())
+			continue
+		}
+		if err := AddTask(tl); err != nil {
+			logs.Warn("start the task %s of the profile of the client %d error %s", tl.Remark, client.Id, err.Error())
+		}
+	}
+}
+
+func applyProfileHosts(client *file.Client, hosts []*file.Host) {
+	old := make(map[string]*file.Host)
+	file.GetDb().JsonDb.Hosts.Range(func(key, value interface{}) bool {
+		if v := value.(*file.Host); v.FromProfile && v.Client.Id == client.Id {
+			old[v.Remark] = v
+		}
+		return true
+	})
+	var news []*file.Host
+	for _, h := range hosts {
+		h.FromProfile = true
+		h.NoStore = true
+		h.Flow = new(file.Flow)
+		v, ok := old[h.Remark]
+		if ok && file.IsSameAuthUsers(v.AuthUsers, h.AuthUsers) {
+			// keep the hashed passwords, a new salt would always mark the host changed
+			h.AuthUsers = v.AuthUsers
+		}
+		if err := bridge.PrepareConfigHost(h, client); err != nil {
+			logs.Warn(err)
+			continue
+		}
+		if ok {
+			delete(old, h.Remark)
+			h.Id = v.Id
+			if v.IsSameConfig(h) {
+				continue
+			}
+			file.GetDb().DelHost(v.Id)
+		}
+		news = append(news, h)
+	}
+	for _, v := range old {
+		file.GetDb().DelHost(v.Id)
+	}
+	for _, h := range news {
+		h.Id = int(file.GetDb().JsonDb.GetHostId())
+		if file.GetDb().IsHostExist(h) {
+			logs.Warn("the host %s of the profile of the client %d is used by the other client", h.Host, client.Id)
+			continue
+		}
+		if err := file.GetDb().NewHost(h); err != nil {
+			logs.Warn("add the host %s of the profile of the client %d error %s", h.Host, client.Id, err.Error())
+		}
+	}
+}
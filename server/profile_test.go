@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"ehang.io/nps/bridge"
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/version"
+)
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func profileTasks(id int) map[string]*file.Tunnel {
+	tasks := make(map[string]*file.Tunnel)
+	file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
+		if v := value.(*file.Tunnel); v.FromProfile && v.Client.Id == id {
+			tasks[v.Remark] = v
+		}
+		return true
+	})
+	return tasks
+}
+
+func profileHosts(id int) map[string]*file.Host {
+	hosts := make(map[string]*file.Host)
+	file.GetDb().JsonDb.Hosts.Range(func(key, value interface{}) bool {
+		if v := value.(*file.Host); v.FromProfile && v.Client.Id == id {
+			hosts[v.Host] = v
+		}
+		return true
+	})
+	return hosts
+}
+
+func initTestDb(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "conf"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"clients.json", "tasks.json", "hosts.json", "global.json"} {
+		if err := os.WriteFile(filepath.Join(dir, "conf", name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	common.ConfPath = dir
+}
+
+func TestApplyProfile(t *testing.T) {
+	initTestDb(t)
+	Bridge = bridge.NewTunnel(0, "tcp", false, sync.Map{}, 60)
+	client := file.NewClient("profile", false, false)
+	client.Id = 1
+	if err := file.GetDb().NewClient(client); err != nil {
+		t.Fatal(err)
+	}
+	apply := func(content string) {
+		client.Lock()
+		client.Profile = &file.Profile{Content: content}
+		client.Unlock()
+		ApplyProfile(client.Id)
+	}
+
+	port := freePort(t)
+	web := fmt.Sprintf("[tcp]\nmode=tcp\nserver_port=%d\ntarget_addr=127.0.0.1:80\n[web]\nhost=profile.test\ntarget_addr=127.0.0.1:80\n", port)
+	apply(web)
+	if len(profileTasks(client.Id)) != 0 {
+		t.Fatal("the profile of the client which is not connected is applied")
+	}
+
+	Bridge.Client.Store(client.Id, bridge.NewClient(nil, nil, nil, "0.26.0", version.NewLegacyCapability("0.26.0")))
+	apply(web)
+	tasks, hosts := profileTasks(client.Id), profileHosts(client.Id)
+	if len(tasks) != 1 || len(hosts) != 1 || hosts["profile.test"] == nil {
+		t.Fatalf("got %d tasks %d hosts, want 1 and 1", len(tasks), len(hosts))
+	}
+	tcp := tasks["tcp"]
+	if _, ok := RunList.Load(tcp.Id); !ok || !tcp.NoStore {
+		t.Fatal("the task of the profile is not started or it is stored")
+	}
+
+	apply(fmt.Sprintf("[tcp]\nmode=tcp\nserver_port=%d\ntarget_addr=127.0.0.1:80\n[web]\nhost=profile.test\ntarget_addr=127.0.0.1:81\n", port))
+	tasks, hosts = profileTasks(client.Id), profileHosts(client.Id)
+	if tasks["tcp"] != tcp {
+		t.Fatal("the unchanged task is created again")
+	}
+	if h := hosts["profile.test"]; h == nil || h.Target.TargetStr != "127.0.0.1:81" {
+		t.Fatal("the host is not changed")
+	}
+
+	apply("[web]\nhost=profile.test\ntarget_addr=127.0.0.1:81\n")
+	if len(profileTasks(client.Id)) != 0 {
+		t.Fatal("the removed task is kept")
+	}
+	if _, ok := RunList.Load(tcp.Id); ok {
+		t.Fatal("the removed task is not stopped")
+	}
+
+	Bridge.Client.Delete(client.Id)
+	DelTunnelAndHostByClientId(client.Id, true)
+	if len(profileHosts(client.Id)) != 0 {
+		t.Fatal("the host of the profile is kept after the client is disconnected")
+	}
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/cache"
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego/logs"
+)
+
+// the least recently used ips are dropped beyond it
+const rateLimitEntries = 65536
+
+var hostRateLimiter = &ipRateLimiter{buckets: cache.New(rateLimitEntries)}
+
+// token bucket of one ip
+type ipBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type ipRateLimiter struct {
+	buckets *cache.Cache
+	sync.Mutex
+}
+
+func (l *ipRateLimiter) Allow(hostId int, ip string, rate, burst int) bool {
+	if burst < 1 {
+		burst = rate
+	}
+	key := strconv.Itoa(hostId) + "/" + ip
+	now := time.Now()
+	l.Lock()
+	defer l.Unlock()
+	var b *ipBucket
+	if v, ok := l.buckets.Get(key); ok {
+		b = v.(*ipBucket)
+		b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+		b.last = now
+	} else {
+		b = &ipBucket{tokens: float64(burst), last: now}
+		l.buckets.Add(key, b)
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// shared with the https passthrough, which can only close the connection
+func isHostIpAllowed(host *file.Host, remoteAddr string) bool {
+	if ip := common.GetIpByAddr(remoteAddr); !host.IsIpAllowed(ip) {
+		logs.Warn("the ip %s is not allowed to visit the host %s", ip, host.Host)
+		return false
+	}
+	return true
+}
+
+func checkHostIp(host *file.Host, r *http.Request, remoteAddr string) *http.Response {
+	if !isHostIpAllowed(host, remoteAddr) {
+		return newStatusResponse(r, http.StatusForbidden)
+	}
+	ip := common.GetIpByAddr(remoteAddr)
+	if host.RateLimit > 0 && !hostRateLimiter.Allow(host.Id, ip, host.RateLimit, host.RateBurst) {
+		logs.Notice("the request rate of ip %s exceeds the limit of the host %s", ip, host.Host)
+		resp := newStatusResponse(r, http.StatusTooManyRequests)
+		resp.Header.Set("Retry-After", "1")
+		return resp
+	}
+	return nil
+}
+
+// maintenance, ip lists, rate and auth, in this order
+func checkHostAccess(host *file.Host, r *http.Request, remoteAddr string) *http.Response {
+	if host.Maintenance {
+		return newErrorResponse(host, r, http.StatusServiceUnavailable)
+	}
+	if resp := checkHostIp(host, r, remoteAddr); resp != nil {
+		return resp
+	}
+	return checkHostAuth(host, r, remoteAddr)
+}
+
+func newStatusResponse(r *http.Request, code int) *http.Response {
+	body := strconv.Itoa(code) + " " + http.StatusText(code)
+	resp := &http.Response{
+		Status:        body,
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}
+	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if code == http.StatusUnauthorized {
+		resp.Header.Set("WWW-Authenticate", `Basic realm="easyProxy"`)
+	}
+	return resp
+}
+
+func writeHttpResponse(rw http.ResponseWriter, resp *http.Response) {
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		rw.Header()[k] = v
+	}
+	rw.WriteHeader(resp.StatusCode)
+	io.Copy(rw, resp.Body)
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/cache"
+	"ehang.io/nps/lib/file"
+)
+
+func TestCheckHostIp(t *testing.T) {
+	host := &file.Host{Id: 2001, Host: "acl.test", AllowIps: "10.0.0.0/8, 2001:db8::/32\n192.168.1.1", DenyIps: "10.0.0.5\ninvalid"}
+	check := func(addr string) int {
+		if resp := checkHostIp(host, httptest.NewRequest("GET", "http://acl.test/", nil), addr); resp != nil {
+			return resp.StatusCode
+		}
+		return 200
+	}
+	tests := map[string]int{
+		"10.1.2.3:80":       200,
+		"192.168.1.1:80":    200,
+		"[2001:db8::1]:80":  200,
+		"10.0.0.5:80":       403,
+		"192.168.1.2:80":    403,
+		"[2001:db9::1]:80":  403,
+		"invalid address:1": 403,
+	}
+	for addr, want := range tests {
+		if got := check(addr); got != want {
+			t.Errorf("the status of %s is %d, want %d", addr, got, want)
+		}
+	}
+	// the lists are parsed again after they are changed
+	host.AllowIps = ""
+	if check("192.168.1.2:80") != 200 || check("10.0.0.5:80") != 403 {
+		t.Error("the changed lists are not used")
+	}
+}
+
+func TestIpRateLimiter(t *testing.T) {
+	l := &ipRateLimiter{buckets: cache.New(2)}
+	// burst defaults to the rate
+	for i := 0; i < 3; i++ {
+		if !l.Allow(1, "10.0.0.1", 3, 0) {
+			t.Fatalf("the request %d is denied within the burst", i)
+		}
+	}
+	if l.Allow(1, "10.0.0.1", 3, 0) {
+		t.Fatal("the request over the burst is allowed")
+	}
+	// the other ips and the other hosts have their own buckets
+	if !l.Allow(1, "10.0.0.2", 3, 0) || !l.Allow(2, "10.0.0.1", 3, 0) {
+		t.Fatal("the bucket is shared")
+	}
+	// the tokens are added with the rate
+	if !l.Allow(3, "10.0.0.1", 100, 1) || l.Allow(3, "10.0.0.1", 100, 1) {
+		t.Fatal("the burst of one request is not kept")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !l.Allow(3, "10.0.0.1", 100, 1) {
+		t.Fatal("the tokens are not added")
+	}
+
+	host := &file.Host{Id: 2002, Host: "rate.test", RateLimit: 1, RateBurst: 1}
+	r := httptest.NewRequest("GET", "http://rate.test/", nil)
+	if resp := checkHostIp(host, r, "10.0.0.1:80"); resp != nil {
+		t.Fatal("the first request is denied")
+	}
+	if resp := checkHostIp(host, r, "10.0.0.1:80"); resp == nil || resp.StatusCode != 429 || resp.Header.Get("Retry-After") != "1" {
+		t.Fatal("the request over the rate is not denied")
+	}
+}
+
+func TestHttpsPassthroughIp(t *testing.T) {
+	initTestDb(t)
+	target := httptest.NewTLSServer(http.NotFoundHandler())
+	defer target.Close()
+	client := &file.Client{Id: 2002, Cnf: &file.Config{}, Flow: &file.Flow{}}
+	host := &file.Host{Id: 2002, Host: "pass.test", Scheme: "all", Location: "/", DenyIps: "127.0.0.1",
+		Client: client, Flow: &file.Flow{}, Target: &file.Target{TargetStr: target.Listener.Addr().String()}}
+	file.GetDb().JsonDb.Clients.Store(client.Id, client)
+	file.GetDb().JsonDb.Hosts.Store(host.Id, host)
+	defer file.GetDb().JsonDb.Hosts.Delete(host.Id)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewHttpsServer(ln, dialBridge{}, nil)
+	go s.Start()
+	defer s.Close()
+	dial := func() error {
+		c, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", ln.Addr().String(), &tls.Config{ServerName: "pass.test", InsecureSkipVerify: true})
+		if err == nil {
+			c.Close()
+		}
+		return err
+	}
+	if dial() == nil {
+		t.Fatal("the denied ip passes through")
+	}
+	host.DenyIps = ""
+	if err := dial(); err != nil {
+		t.Fatal(err)
+	}
+}
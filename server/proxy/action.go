@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego/logs"
+)
+
+// the actions other than proxy are answered by nps itself
+func serveHostAction(rw http.ResponseWriter, r *http.Request, host *file.Host) {
+	if resp := checkHostAccess(host, r, r.RemoteAddr); resp != nil {
+		logs.Warn("the request is denied, status %d, host %s, remote address %s", resp.StatusCode, host.Host, r.RemoteAddr)
+		writeHttpResponse(rw, resp)
+		return
+	}
+	logs.Info("%s request, method %s, host %s, url %s, remote address %s, action %s", r.URL.Scheme, r.Method, r.Host, r.URL.Path, r.RemoteAddr, host.Action)
+	switch host.Action {
+	case "static":
+		serveStatic(rw, r, host)
+	case "redirect":
+		http.Redirect(rw, r, getRedirectUrl(host, r), getRedirectCode(host.RedirectCode))
+	case "dir":
+		if host.StaticDir == "" {
+			writeErrorPage(rw, host, r, http.StatusNotFound)
+			return
+		}
+		var h http.Handler = http.FileServer(http.Dir(host.StaticDir))
+		if location := strings.TrimSuffix(host.Location, "/"); location != "" {
+			h = http.StripPrefix(location, h)
+		}
+		h.ServeHTTP(rw, r)
+	default:
+		writeErrorPage(rw, host, r, http.StatusNotFound)
+	}
+}
+
+func serveStatic(rw http.ResponseWriter, r *http.Request, host *file.Host) {
+	code := host.StaticStatus
+	if code < 200 || code > 999 {
+		code = http.StatusOK
+	}
+	contentType := host.StaticContentType
+	if contentType == "" {
+		contentType = http.DetectContentType([]byte(host.StaticBody))
+	}
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Content-Length", strconv.Itoa(len(host.StaticBody)))
+	rw.WriteHeader(code)
+	if r.Method != http.MethodHead {
+		rw.Write([]byte(host.StaticBody))
+	}
+}
+
+func getRedirectCode(code int) int {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return code
+	}
+	return http.StatusFound
+}
+
+func getRedirectUrl(host *file.Host, r *http.Request) string {
+	u := host.RedirectUrl
+	if !host.RedirectKeepPath {
+		return u
+	}
+	// the path goes before the query of the redirect url
+	var query string
+	if i := strings.IndexByte(u, '?'); i >= 0 {
+		u, query = u[:i], u[i+1:]
+	}
+	if path := strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(host.Location, "/")); path != "" {
+		u = strings.TrimSuffix(u, "/") + path
+	}
+	if r.URL.RawQuery != "" {
+		if query != "" {
+			query += "&"
+		}
+		query += r.URL.RawQuery
+	}
+	if query != "" {
+		u += "?" + query
+	}
+	return u
+}
+
+// http.ResponseWriter over a hijacked connection, closed after the response
+type connResponseWriter struct {
+	w           *bufio.Writer
+	header      http.Header
+	wroteHeader bool
+}
+
+func newConnResponseWriter(c net.Conn) *connResponseWriter {
+	return &connResponseWriter{w: bufio.NewWriter(c), header: make(http.Header)}
+}
+
+func (w *connResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *connResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.header.Set("Connection", "close")
+	w.w.WriteString("HTTP/1.1 " + strconv.Itoa(code) + " " + http.StatusText(code) + "\r\n")
+	w.header.Write(w.w)
+	w.w.WriteString("\r\n")
+}
+
+func (w *connResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.w.Write(b)
+}
+
+func (w *connResponseWriter) Flush() error {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.w.Flush()
+}
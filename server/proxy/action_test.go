@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ehang.io/nps/lib/file"
+)
+
+func serveAction(host *file.Host, method, url string) *http.Response {
+	r := httptest.NewRequest(method, url, nil)
+	rw := httptest.NewRecorder()
+	serveHostAction(rw, r, host)
+	return rw.Result()
+}
+
+func TestServeHostAction(t *testing.T) {
+	client := &file.Client{Cnf: &file.Config{}}
+	host := &file.Host{Host: "action.test", Client: client, Action: "static", StaticStatus: 503, StaticBody: "<html>maintenance</html>"}
+	resp := serveAction(host, "GET", "http://action.test/")
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 503 || string(b) != host.StaticBody || resp.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("the static response is %d %q %s", resp.StatusCode, b, resp.Header.Get("Content-Type"))
+	}
+	host.StaticStatus, host.StaticContentType = 0, "application/json"
+	resp = serveAction(host, "HEAD", "http://action.test/")
+	b, _ = io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || len(b) != 0 || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("the static response of the head request is %d %q", resp.StatusCode, b)
+	}
+
+	host = &file.Host{Host: "action.test", Client: client, Action: "redirect", Location: "/old/", RedirectUrl: "https://new.test/", RedirectCode: 200}
+	if resp := serveAction(host, "GET", "http://action.test/old/a?b=1"); resp.StatusCode != 302 || resp.Header.Get("Location") != "https://new.test/" {
+		t.Fatalf("the redirection is %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	host.RedirectKeepPath, host.RedirectCode = true, 308
+	if resp := serveAction(host, "GET", "http://action.test/old/a?b=1"); resp.StatusCode != 308 || resp.Header.Get("Location") != "https://new.test/a?b=1" {
+		t.Fatalf("the redirection with the path is %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	host.RedirectUrl = "https://new.test/?c=2"
+	if u := getRedirectUrl(host, httptest.NewRequest("GET", "http://action.test/old/a?b=1", nil)); u != "https://new.test/a?c=2&b=1" {
+		t.Fatalf("the redirect url with the query is %s", u)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	host = &file.Host{Host: "action.test", Client: client, Action: "dir", Location: "/files", StaticDir: dir}
+	resp = serveAction(host, "GET", "http://action.test/files/a.txt")
+	if b, _ := io.ReadAll(resp.Body); resp.StatusCode != 200 || string(b) != "file" {
+		t.Fatalf("the file response is %d %q", resp.StatusCode, b)
+	}
+	if resp := serveAction(host, "GET", "http://action.test/files/../../etc/passwd"); resp.StatusCode == 200 {
+		t.Fatal("the file out of the directory is served")
+	}
+	host.StaticDir = ""
+	if resp := serveAction(host, "GET", "http://action.test/files/a.txt"); resp.StatusCode != 404 {
+		t.Fatalf("the status without the directory is %d", resp.StatusCode)
+	}
+
+	// the access of the host is checked before the action
+	host = &file.Host{Host: "action.test", Client: client, Action: "static", StaticBody: "ok", DenyIps: "192.0.2.0/24"}
+	if resp := serveAction(host, "GET", "http://action.test/"); resp.StatusCode != 403 {
+		t.Fatalf("the status of the denied ip is %d", resp.StatusCode)
+	}
+}
+
+func TestConnResponseWriter(t *testing.T) {
+	server, client := net.Pipe()
+	go func() {
+		w := newConnResponseWriter(server)
+		serveStatic(w, httptest.NewRequest("GET", "http://action.test/", nil), &file.Host{StaticBody: "hello"})
+		w.Flush()
+		server.Close()
+	}()
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || !resp.Close || string(b) != "hello" {
+		t.Fatalf("the response is %d %t %q", resp.StatusCode, resp.Close, b)
+	}
+}
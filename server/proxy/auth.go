@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego/logs"
+)
+
+var forwardAuthClient = &http.Client{
+	Timeout: 10 * time.Second,
+	// the redirect to the login page goes back to the visitor
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+var forwardAuthSkipHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length"}
+
+// the returned response is written to the visitor when the request is denied
+func checkHostAuth(host *file.Host, r *http.Request, remoteAddr string) *http.Response {
+	if host.AuthUsers != "" {
+		if user, passwd, ok := r.BasicAuth(); !ok || !host.CheckAuthUser(user, passwd) {
+			return newStatusResponse(r, http.StatusUnauthorized)
+		}
+	} else if host.Client.Cnf.U != "" && host.Client.Cnf.P != "" && !common.CheckAuth(r, host.Client.Cnf.U, host.Client.Cnf.P) {
+		return newStatusResponse(r, http.StatusUnauthorized)
+	}
+	if host.ForwardAuthUrl != "" {
+		return forwardAuth(host, r, remoteAddr)
+	}
+	return nil
+}
+
+func forwardAuth(host *file.Host, r *http.Request, remoteAddr string) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, host.ForwardAuthUrl, nil)
+	if err != nil {
+		logs.Warn("the forward auth url %s of host %s error %s", host.ForwardAuthUrl, host.Host, err.Error())
+		return newStatusResponse(r, http.StatusInternalServerError)
+	}
+	for k, v := range r.Header {
+		req.Header[k] = v
+	}
+	for _, v := range forwardAuthSkipHeaders {
+		req.Header.Del(v)
+	}
+	scheme := r.URL.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Proto", scheme)
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Uri", r.RequestURI)
+	req.Header.Set("X-Forwarded-For", common.GetIpByAddr(remoteAddr))
+	resp, err := forwardAuthClient.Do(req)
+	if err != nil {
+		logs.Warn("the forward auth of host %s error %s", host.Host, err.Error())
+		return newStatusResponse(r, http.StatusInternalServerError)
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+		// replaced, or the visitor can fake the identity
+		for _, name := range common.TrimArr(strings.Split(strings.Replace(host.ForwardAuthHeaders, ",", "\n", -1), "\n")) {
+			r.Header.Del(name)
+			for _, v := range resp.Header.Values(name) {
+				r.Header.Add(name, v)
+			}
+		}
+		return nil
+	}
+	logs.Info("the request of host %s is denied by the forward auth, status %d, remote address %s", host.Host, resp.StatusCode, remoteAddr)
+	// such as the redirect to the login page
+	header := resp.Header.Clone()
+	for _, v := range forwardAuthSkipHeaders {
+		header.Del(v)
+	}
+	denied := &http.Response{
+		Status:        resp.Status,
+		StatusCode:    resp.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          resp.Body,
+		ContentLength: resp.ContentLength,
+		Request:       r,
+	}
+	if denied.ContentLength < 0 {
+		denied.TransferEncoding = []string{"chunked"}
+	} else {
+		header.Set("Content-Length", resp.Header.Get("Content-Length"))
+	}
+	return denied
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"ehang.io/nps/lib/file"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCheckHostAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &file.Client{Cnf: &file.Config{U: "client", P: "secret"}}
+	host := &file.Host{Host: "auth.test", Client: client, AuthUsers: "other:x\nuser:" + string(hash)}
+	check := func(user, passwd string) int {
+		r := httptest.NewRequest("GET", "http://auth.test/", nil)
+		if user != "" {
+			r.SetBasicAuth(user, passwd)
+		}
+		if resp := checkHostAuth(host, r, "127.0.0.1:1234"); resp != nil {
+			return resp.StatusCode
+		}
+		return 200
+	}
+	// the users of the host replace the user of the client
+	for _, v := range []struct {
+		user, passwd string
+		want         int
+	}{
+		{"user", "pass", 200},
+		{"user", "wrong", 401},
+		{"other", "x", 401},
+		{"client", "secret", 401},
+		{"", "", 401},
+	} {
+		// again from the cache
+		for i := 0; i < 2; i++ {
+			if got := check(v.user, v.passwd); got != v.want {
+				t.Fatalf("the status of %s:%s is %d, want %d", v.user, v.passwd, got, v.want)
+			}
+		}
+	}
+	// the cached results are dropped when the users are changed
+	host.AuthUsers = "alice:" + string(hash)
+	if check("user", "pass") != 401 {
+		t.Fatal("the result of the old users is used")
+	}
+	host.AuthUsers = ""
+	if check("client", "secret") != 200 || check("user", "pass") != 401 {
+		t.Fatal("the user of the client is not checked")
+	}
+}
+
+func TestForwardAuth(t *testing.T) {
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Forwarded-Uri") == "/private?a=1" && r.Header.Get("X-Forwarded-Method") == "POST" &&
+			r.Header.Get("X-Forwarded-Host") == "auth.test" && r.Header.Get("X-Forwarded-For") == "10.0.0.1" &&
+			r.Header.Get("Cookie") == "token=ok" {
+			w.Header().Set("X-User", "alice")
+			return
+		}
+		w.Header().Set("Location", "https://login.test/")
+		w.WriteHeader(http.StatusFound)
+		w.Write([]byte("login"))
+	}))
+	defer auth.Close()
+	host := &file.Host{Host: "auth.test", Client: &file.Client{Cnf: &file.Config{}}, ForwardAuthUrl: auth.URL, ForwardAuthHeaders: "X-User"}
+	request := func(cookie string) *http.Request {
+		r := httptest.NewRequest("POST", "http://auth.test/private?a=1", nil)
+		r.RequestURI = "/private?a=1"
+		r.Header.Set("Cookie", cookie)
+		r.Header.Set("X-User", "fake")
+		return r
+	}
+
+	r := request("token=ok")
+	if resp := checkHostAuth(host, r, "10.0.0.1:1234"); resp != nil {
+		t.Fatalf("the request is denied with %d", resp.StatusCode)
+	}
+	// the header sent by the visitor is replaced by the auth url
+	if v := r.Header.Values("X-User"); len(v) != 1 || v[0] != "alice" {
+		t.Fatalf("the user header is %v", v)
+	}
+
+	// the redirection of the auth url is returned to the visitor
+	resp := checkHostAuth(host, request("token=bad"), "10.0.0.1:1234")
+	if resp == nil || resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "https://login.test/" {
+		t.Fatalf("the denied response is %+v", resp)
+	}
+	if b, _ := io.ReadAll(resp.Body); string(b) != "login" {
+		t.Fatalf("the body of the denied response is %q", b)
+	}
+	resp.Body.Close()
+
+	auth.Close()
+	if resp := checkHostAuth(host, request("token=ok"), "10.0.0.1:1234"); resp == nil || resp.StatusCode != http.StatusInternalServerError {
+		t.Fatal("the request is not denied when the auth url is down")
+	}
+}
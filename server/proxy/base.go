@@ -25,42 +25,28 @@ type NetBridge interface {
 
 // BaseServer struct
 type BaseServer struct {
-	id           int
-	bridge       NetBridge
-	task         *file.Tunnel
-	errorContent []byte
+	id     int
+	bridge NetBridge
+	task   *file.Tunnel
 	sync.Mutex
 }
 
 func NewBaseServer(bridge *bridge.Bridge, task *file.Tunnel) *BaseServer {
 	return &BaseServer{
-		bridge:       bridge,
-		task:         task,
-		errorContent: nil,
-		Mutex:        sync.Mutex{},
+		bridge: bridge,
+		task:   task,
+		Mutex:  sync.Mutex{},
 	}
 }
 
 // add the flow
 func (s *BaseServer) FlowAdd(in, out int64) {
-	s.Lock()
-	defer s.Unlock()
-	s.task.Flow.ExportFlow += out
-	s.task.Flow.InletFlow += in
+	s.task.Flow.Add(in, out)
 }
 
 // change the flow
 func (s *BaseServer) FlowAddHost(host *file.Host, in, out int64) {
-	s.Lock()
-	defer s.Unlock()
-	host.Flow.ExportFlow += out
-	host.Flow.InletFlow += in
-}
-
-// write fail bytes to the connection
-func (s *BaseServer) writeConnFail(c net.Conn) {
-	c.Write([]byte(common.ConnectionFailBytes))
-	c.Write(s.errorContent)
+	host.Flow.Add(in, out)
 }
 
 // auth check
@@ -75,7 +61,7 @@ func (s *BaseServer) auth(r *http.Request, c *conn.Conn, u, p string) error {
 
 // check flow limit of the client ,and decrease the allow num of client
 func (s *BaseServer) CheckFlowAndConnNum(client *file.Client) error {
-	if client.Flow.FlowLimit > 0 && (client.Flow.FlowLimit<<20) < (client.Flow.ExportFlow+client.Flow.InletFlow) {
+	if client.Flow.IsExceeded() {
 		return errors.New("Traffic exceeded")
 	}
 	if !client.GetConn() {
@@ -109,7 +95,7 @@ func in(target string, str_array []string) bool {
 
 // create a new connection and start bytes copying
 func (s *BaseServer) DealClient(c *conn.Conn, client *file.Client, addr string,
-	rb []byte, tp string, f func(), flow *file.Flow, localProxy bool, task *file.Tunnel) error {
+	rb []byte, tp string, f func(), flows file.Flows, localProxy bool, task *file.Tunnel, opts ...conn.Option) error {
 
 	// 判断访问地址是否在全局黑名单内
 	if IsGlobalBlackIp(c.RemoteAddr().String()) {
@@ -123,7 +109,7 @@ func (s *BaseServer) DealClient(c *conn.Conn, client *file.Client, addr string,
 		return nil
 	}
 
-	link := conn.NewLink(tp, addr, client.Cnf.Crypt, client.Cnf.Compress, c.Conn.RemoteAddr().String(), localProxy)
+	link := conn.NewLink(tp, addr, client.Cnf.Crypt, client.Cnf.Compress, c.Conn.RemoteAddr().String(), localProxy, opts...)
 	if target, err := s.bridge.SendLinkInfo(client.Id, link, s.task); err != nil {
 		logs.Warn("get connection from client id %d  error %s", client.Id, err.Error())
 		c.Close()
@@ -132,7 +118,8 @@ func (s *BaseServer) DealClient(c *conn.Conn, client *file.Client, addr string,
 		if f != nil {
 			f()
 		}
-		conn.CopyWaitGroup(target, c.Conn, link.Crypt, link.Compress, client.Rate, flow, true, rb, task)
+		flows = file.NewFlows(append(file.Flows{client.Flow}, flows...)...)
+		conn.CopyWaitGroup(target, c.Conn, link.Crypt, link.Compress, client.Rate, flows, true, rb, task)
 	}
 	return nil
 }
@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/file"
+	"github.com/andybalholm/brotli"
+)
+
+var CompressMinSize int64 = 1024
+
+// used when the host sets none
+var defaultCompressTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/x-javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"image/svg+xml",
+}
+
+// already compressed
+var compressedTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"font/woff2",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/octet-stream",
+	"application/pdf",
+}
+
+// the response is changed in place
+func compressResponse(host *file.Host, req *http.Request, resp *http.Response) *http.Response {
+	if !host.HttpCompress || req.Method == http.MethodHead || resp.Body == nil || resp.Body == http.NoBody {
+		return resp
+	}
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusPartialContent, http.StatusNotModified:
+		return resp
+	}
+	if resp.StatusCode < 200 || resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Range") != "" ||
+		strings.Contains(strings.ToLower(resp.Header.Get("Cache-Control")), "no-transform") {
+		return resp
+	}
+	if !isCompressType(host.CompressTypes, resp.Header.Get("Content-Type")) {
+		return resp
+	}
+	encoding := acceptEncoding(req.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return resp
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < CompressMinSize {
+		return resp
+	} else if resp.ContentLength < 0 {
+		// unknown length, peek to see whether the body is small
+		head := make([]byte, CompressMinSize)
+		n, err := io.ReadFull(resp.Body, head)
+		body := resp.Body
+		resp.Body = readCloser{io.MultiReader(bytes.NewReader(head[:n]), body), body}
+		if err != nil {
+			return resp
+		}
+	}
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Accept-Ranges")
+	resp.Header.Set("Content-Encoding", encoding)
+	resp.Header.Add("Vary", "Accept-Encoding")
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	resp.ContentLength = -1
+	resp.TransferEncoding = []string{"chunked"}
+	resp.Body = newCompressReader(host, encoding, resp.Body)
+	return resp
+}
+
+func acceptEncoding(accept string) string {
+	var best string
+	var bestQ float64
+	var wildcard = -1.0
+	quality := map[string]float64{}
+	for _, v := range strings.Split(accept, ",") {
+		item := strings.Split(v, ";")
+		name := strings.ToLower(strings.TrimSpace(item[0]))
+		q := 1.0
+		for _, p := range item[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if f, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if name == "*" {
+			wildcard = q
+		} else if name != "" {
+			quality[name] = q
+		}
+	}
+	// br wins a tie
+	for _, name := range []string{"br", "gzip"} {
+		q, ok := quality[name]
+		if !ok {
+			if wildcard < 0 {
+				continue
+			}
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+func isCompressType(types string, contentType string) bool {
+	contentType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	if contentType == "" {
+		return false
+	}
+	allow := defaultCompressTypes
+	if arr := common.TrimArr(strings.Split(strings.Replace(types, ",", "\n", -1), "\n")); len(arr) > 0 {
+		allow = arr
+	}
+	for _, v := range allow {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if v == contentType {
+			return true
+		}
+		// the already compressed types are only matched by the full name
+		if strings.HasSuffix(v, "/*") && strings.HasPrefix(contentType, v[:len(v)-1]) && !isCompressed(contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+func isCompressed(contentType string) bool {
+	if contentType == "image/svg+xml" {
+		return false
+	}
+	for _, v := range compressedTypes {
+		if strings.HasPrefix(contentType, v) {
+			return true
+		}
+	}
+	return false
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type countWriter struct {
+	io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (n int, err error) {
+	n, err = w.Writer.Write(p)
+	w.n += int64(n)
+	return
+}
+
+// the sizes are recorded when the body is done
+func newCompressReader(host *file.Host, encoding string, body io.ReadCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer body.Close()
+		out := &countWriter{Writer: pw}
+		var w compressWriter
+		if encoding == "br" {
+			w = brotli.NewWriterLevel(out, 4)
+		} else {
+			w, _ = gzip.NewWriterLevel(out, gzip.DefaultCompression)
+		}
+		raw, err := common.CopyBuffer(flushWriter{w}, body)
+		if err == nil || err == io.EOF {
+			err = w.Close()
+		}
+		host.AddCompressFlow(raw, out.n)
+		pw.CloseWithError(err)
+	}()
+	return readCloser{pr, pr}
+}
+
+type compressWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// flush on every read, or the streaming responses are delayed
+type flushWriter struct {
+	compressWriter
+}
+
+func (f flushWriter) Write(p []byte) (n int, err error) {
+	if n, err = f.compressWriter.Write(p); err != nil {
+		return
+	}
+	err = f.compressWriter.Flush()
+	return
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/file"
+	"github.com/andybalholm/brotli"
+)
+
+func TestAcceptEncoding(t *testing.T) {
+	tests := map[string]string{
+		"":                       "",
+		"gzip":                   "gzip",
+		"gzip, deflate, br":      "br",
+		"br;q=0.5, gzip":         "gzip",
+		"GZIP;q=0.8, br;q=0.8":   "br",
+		"br;q=0, gzip;q=0":       "",
+		"deflate, *;q=0.1":       "br",
+		"*;q=0.5, br;q=0":        "gzip",
+		"identity, deflate":      "",
+		"gzip;q=invalid, br;q=0": "gzip",
+	}
+	for accept, want := range tests {
+		if got := acceptEncoding(accept); got != want {
+			t.Errorf("the encoding of %q is %q, want %q", accept, got, want)
+		}
+	}
+}
+
+func TestIsCompressType(t *testing.T) {
+	tests := []struct {
+		types       string
+		contentType string
+		want        bool
+	}{
+		{"", "text/html; charset=utf-8", true},
+		{"", "application/json", true},
+		{"", "image/svg+xml", true},
+		{"", "image/png", false},
+		{"", "", false},
+		{"image/*", "image/png", false},
+		{"image/*\nimage/png", "image/png", true},
+		{"application/wasm, text/css", "application/wasm", true},
+		{"application/wasm, text/css", "text/html", false},
+	}
+	for _, v := range tests {
+		if got := isCompressType(v.types, v.contentType); got != v.want {
+			t.Errorf("%q with the types %q is compressed %t, want %t", v.contentType, v.types, got, v.want)
+		}
+	}
+}
+
+func TestCompressResponse(t *testing.T) {
+	defer func(size int64) { CompressMinSize = size }(CompressMinSize)
+	CompressMinSize = 16
+	body := strings.Repeat("compress the response body. ", 100)
+	host := &file.Host{HttpCompress: true}
+	compress := func(accept string, length int64, header http.Header) *http.Response {
+		req := httptest.NewRequest("GET", "http://a.test/", nil)
+		req.Header.Set("Accept-Encoding", accept)
+		if header == nil {
+			header = http.Header{}
+		}
+		if header.Get("Content-Type") == "" {
+			header.Set("Content-Type", "text/plain")
+		}
+		resp := &http.Response{StatusCode: 200, Header: header, ContentLength: length, Body: io.NopCloser(strings.NewReader(body))}
+		return compressResponse(host, req, resp)
+	}
+
+	for _, encoding := range []string{"gzip", "br"} {
+		resp := compress(encoding, -1, http.Header{"Etag": {`"v1"`}})
+		if resp.Header.Get("Content-Encoding") != encoding || resp.Header.Get("Vary") != "Accept-Encoding" || resp.Header.Get("ETag") != `W/"v1"` {
+			t.Fatalf("the headers of the %s response are %v", encoding, resp.Header)
+		}
+		var r io.Reader
+		if encoding == "gzip" {
+			gr, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = gr
+		} else {
+			r = brotli.NewReader(resp.Body)
+		}
+		if b, err := io.ReadAll(r); err != nil || string(b) != body {
+			t.Fatalf("read the %s body error %v", encoding, err)
+		}
+		resp.Body.Close()
+	}
+	// the sizes are recorded after the body is compressed
+	for i := 0; i < 20; i++ {
+		host.RLock()
+		raw := host.CompressRaw
+		host.RUnlock()
+		if raw == int64(2*len(body)) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	host.RLock()
+	if host.CompressRaw != int64(2*len(body)) || host.CompressOut <= 0 || host.CompressOut >= host.CompressRaw {
+		t.Errorf("the compress flow is %d %d", host.CompressRaw, host.CompressOut)
+	}
+	host.RUnlock()
+
+	// not compressed, the body is untouched
+	for name, resp := range map[string]*http.Response{
+		"identity":      compress("identity", -1, nil),
+		"small":         compress("gzip", 8, nil),
+		"encoded":       compress("gzip", -1, http.Header{"Content-Encoding": {"deflate"}}),
+		"no-transform":  compress("gzip", -1, http.Header{"Cache-Control": {"no-transform"}}),
+		"image":         compress("gzip", -1, http.Header{"Content-Type": {"image/jpeg"}}),
+		"content-range": compress("gzip", -1, http.Header{"Content-Range": {"bytes 0-9/100"}}),
+	} {
+		if resp.Header.Get("Content-Encoding") == "gzip" {
+			t.Errorf("the %s response is compressed", name)
+		}
+		if b, _ := io.ReadAll(resp.Body); string(b) != body {
+			t.Errorf("the body of the %s response is changed", name)
+		}
+	}
+	host.HttpCompress = false
+	if resp := compress("gzip", -1, nil); resp.Header.Get("Content-Encoding") != "" {
+		t.Error("the response of the host without compression is compressed")
+	}
+}
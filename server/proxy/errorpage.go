@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"html"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/file"
+)
+
+// 0 means no limit
+var ResponseHeaderTimeout time.Duration
+
+var (
+	defaultErrorPage     string
+	defaultErrorPageOnce sync.Once
+)
+
+func getDefaultErrorPage() string {
+	defaultErrorPageOnce.Do(func() {
+		if b, err := common.ReadAllFromFile(filepath.Join(common.GetRunPath(), "web", "static", "page", "error.html")); err != nil {
+			defaultErrorPage = "nps {{status}}"
+		} else {
+			defaultErrorPage = string(b)
+		}
+	})
+	return defaultErrorPage
+}
+
+// the host is nil if it is not found
+func getErrorPage(host *file.Host, code int) string {
+	if host != nil {
+		var page string
+		switch code {
+		case http.StatusNotFound:
+			page = host.ErrorPage404
+		case http.StatusBadGateway:
+			page = host.ErrorPage502
+		case http.StatusServiceUnavailable:
+			page = host.ErrorPage503
+		case http.StatusGatewayTimeout:
+			page = host.ErrorPage504
+		}
+		if strings.TrimSpace(page) != "" {
+			return page
+		}
+	}
+	return getDefaultErrorPage()
+}
+
+// reuse the request id of the visitor if it is valid
+func getRequestId(r *http.Request) string {
+	if r != nil {
+		if id := r.Header.Get("X-Request-Id"); id != "" && len(id) <= 128 {
+			return id
+		}
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// placeholders: {{status}} {{request_id}} {{host}} {{remark}}
+func renderErrorPage(host *file.Host, r *http.Request, code int, requestId string) []byte {
+	var hostName, remark string
+	if host != nil {
+		hostName, remark = host.Host, host.Remark
+	} else if r != nil {
+		hostName = r.Host
+	}
+	return []byte(strings.NewReplacer(
+		"{{status}}", strconv.Itoa(code)+" "+http.StatusText(code),
+		"{{request_id}}", html.EscapeString(requestId),
+		"{{host}}", html.EscapeString(hostName),
+		"{{remark}}", html.EscapeString(remark),
+	).Replace(getErrorPage(host, code)))
+}
+
+func newErrorResponse(host *file.Host, r *http.Request, code int) *http.Response {
+	requestId := getRequestId(r)
+	body := renderErrorPage(host, r, code, requestId)
+	resp := &http.Response{
+		Status:        strconv.Itoa(code) + " " + http.StatusText(code),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(strings.NewReader(string(body))),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}
+	resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	resp.Header.Set("Cache-Control", "no-store")
+	resp.Header.Set("X-Request-Id", requestId)
+	return resp
+}
+
+func writeErrorPage(rw http.ResponseWriter, host *file.Host, r *http.Request, code int) {
+	writeHttpResponse(rw, newErrorResponse(host, r, code))
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"ehang.io/nps/lib/file"
+)
+
+func TestErrorPage(t *testing.T) {
+	host := &file.Host{Host: "error.test", Remark: "<remark>", ErrorPage404: "404 {{host}}", ErrorPage502: "502 {{remark}}",
+		ErrorPage503: " \n", ErrorPage504: "{{status}} {{request_id}}"}
+	r := httptest.NewRequest("GET", "http://error.test/", nil)
+	r.Header.Set("X-Request-Id", "<id>")
+	tests := map[int]string{
+		404: "404 error.test",
+		502: "502 &lt;remark&gt;",
+		504: "504 Gateway Timeout &lt;id&gt;",
+	}
+	for code, want := range tests {
+		if got := string(renderErrorPage(host, r, code, getRequestId(r))); got != want {
+			t.Errorf("the page of %d is %q, want %q", code, got, want)
+		}
+	}
+	// the blank page and the page of the unknown host use the default one
+	for _, h := range []*file.Host{host, nil} {
+		if getErrorPage(h, 503) != getDefaultErrorPage() {
+			t.Errorf("the page of %v is not the default one", h)
+		}
+	}
+
+	resp := newErrorResponse(host, r, 404)
+	if resp.StatusCode != 404 || resp.Header.Get("X-Request-Id") != "<id>" || resp.Header.Get("Cache-Control") != "no-store" {
+		t.Fatalf("the error response is %+v", resp)
+	}
+	// an invalid request id is replaced
+	r.Header.Set("X-Request-Id", strings.Repeat("a", 129))
+	if id := getRequestId(r); len(id) != 16 || id == getRequestId(r) {
+		t.Fatalf("the new request id is %q", id)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestReverseProxyErrorStatus(t *testing.T) {
+	host := &file.Host{Host: "error.test", ErrorPage502: "bad gateway", ErrorPage504: "gateway timeout"}
+	p := &ReverseProxy{}
+	for err, want := range map[error]string{
+		errors.New("connection refused"): "bad gateway",
+		timeoutError{}:                   "gateway timeout",
+		os.ErrDeadlineExceeded:           "gateway timeout",
+	} {
+		r := httptest.NewRequest("GET", "http://error.test/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), "host", host))
+		rw := httptest.NewRecorder()
+		p.errHandler(rw, r, err)
+		if b, _ := io.ReadAll(rw.Body); string(b) != want {
+			t.Errorf("the page of the error %v is %q, want %q", err, b, want)
+		}
+	}
+}
@@ -10,15 +10,17 @@ import (
 	"ehang.io/nps/lib/file"
 	"ehang.io/nps/lib/goroutine"
 	"ehang.io/nps/server/connection"
+	"errors"
 	"github.com/astaxie/beego/logs"
 	"io"
 	"net"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type httpServer struct {
@@ -28,14 +30,21 @@ type httpServer struct {
 	httpServer    *http.Server
 	httpsServer   *http.Server
 	httpsListener net.Listener
-	useCache      bool
 	addOrigin     bool
-	cache         *cache.Cache
-	cacheLen      int
+	cache         *cache.HttpCache
+	backendConns  sync.Map // net.Conn -> *backendConns
 }
 
-func NewHttp(bridge *bridge.Bridge, c *file.Tunnel, httpPort, httpsPort int, useCache bool, cacheLen int, addOrigin bool) *httpServer {
-	httpServer := &httpServer{
+// responses are written back in the order of the requests
+type httpExchange struct {
+	req        *http.Request
+	resp       *http.Response // from the cache
+	cacheState *cache.HttpCacheState
+	record     *InspectRecord // nil if the inspection is off
+}
+
+func NewHttp(bridge *bridge.Bridge, c *file.Tunnel, httpPort, httpsPort int, httpCache *cache.HttpCache, addOrigin bool) *httpServer {
+	return &httpServer{
 		BaseServer: BaseServer{
 			task:   c,
 			bridge: bridge,
@@ -43,21 +52,13 @@ func NewHttp(bridge *bridge.Bridge, c *file.Tunnel, httpPort, httpsPort int, use
 		},
 		httpPort:  httpPort,
 		httpsPort: httpsPort,
-		useCache:  useCache,
-		cacheLen:  cacheLen,
+		cache:     httpCache,
 		addOrigin: addOrigin,
 	}
-	if useCache {
-		httpServer.cache = cache.New(cacheLen)
-	}
-	return httpServer
 }
 
 func (s *httpServer) Start() error {
 	var err error
-	if s.errorContent, err = common.ReadAllFromFile(filepath.Join(common.GetRunPath(), "web", "static", "page", "error.html")); err != nil {
-		s.errorContent = []byte("nps 404")
-	}
 	if s.httpPort > 0 {
 		s.httpServer = s.NewServer(s.httpPort, "http")
 		go func() {
@@ -81,7 +82,7 @@ func (s *httpServer) Start() error {
 				logs.Error(err)
 				os.Exit(0)
 			}
-			logs.Error(NewHttpsServer(s.httpsListener, s.bridge, s.useCache, s.cacheLen).Start())
+			logs.Error(NewHttpsServer(s.httpsListener, s.bridge, s.cache).Start())
 		}()
 	}
 	return nil
@@ -101,12 +102,20 @@ func (s *httpServer) Close() error {
 }
 
 func (s *httpServer) handleTunneling(w http.ResponseWriter, r *http.Request) {
+	// websocket bridge of npc
+	if conn.IsWsBridgeRequest(r) && conn.IsWsBridgeHost(r.Host) {
+		if b, ok := s.bridge.(*bridge.Bridge); ok {
+			conn.ServeWs(w, r, b.ProcessConn)
+			return
+		}
+	}
 
 	var host *file.Host
 	var err error
 	host, err = file.GetDb().GetInfoByHost(r.Host, r)
 	if err != nil {
 		logs.Debug("the url %s %s %s can't be parsed!", r.URL.Scheme, r.Host, r.RequestURI)
+		writeErrorPage(w, nil, r, http.StatusNotFound)
 		return
 	}
 
@@ -116,7 +125,21 @@ func (s *httpServer) handleTunneling(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if r.Header.Get("Upgrade") != "" {
+	if host.Maintenance {
+		writeErrorPage(w, host, r, http.StatusServiceUnavailable)
+		return
+	}
+
+	if !host.IsProxy() {
+		serveHostAction(w, r, host)
+		return
+	}
+
+	if isReverseProxyRequest(host, r) {
+		if resp := checkHostIp(host, r, r.RemoteAddr); resp != nil {
+			writeHttpResponse(w, resp)
+			return
+		}
 		rProxy := NewHttpReverseProxy(s)
 		rProxy.ServeHTTP(w, r)
 	} else {
@@ -148,12 +171,19 @@ func (s *httpServer) handleHttp(c *conn.Conn, r *http.Request) {
 		isReset    bool
 		wg         sync.WaitGroup
 		remoteAddr string
+		reader     *bufio.Reader
+		exchanges  chan *httpExchange
+		done       chan struct{}
+		// the first request is checked before dialing the target
+		accessChecked bool
+		// the error page when the target is not connected, 0 closes directly
+		failCode = http.StatusNotFound
 	)
 	defer func() {
 		if connClient != nil {
 			connClient.Close()
-		} else {
-			s.writeConnFail(c.Conn)
+		} else if failCode != 0 {
+			writeErrorResponse(c, host, r, failCode)
 		}
 		c.Close()
 	}()
@@ -169,113 +199,116 @@ reset:
 
 	// 判断访问地址是否在全局黑名单内
 	if IsGlobalBlackIp(c.RemoteAddr().String()) {
-		c.Close()
+		failCode = 0
 		return
 	}
 
 	if host, err = file.GetDb().GetInfoByHost(r.Host, r); err != nil {
 		logs.Notice("the url %s %s %s can't be parsed!, host %s, url %s, remote address %s", r.URL.Scheme, r.Host, r.RequestURI, r.Host, r.URL.Path, remoteAddr)
-		c.Close()
 		return
 	}
 
 	if err := s.CheckFlowAndConnNum(host.Client); err != nil {
 		logs.Warn("client id %d, host id %d, error %s, when https connection", host.Client.Id, host.Id, err.Error())
-		c.Close()
 		return
 	}
 	if !isReset {
 		defer host.Client.AddConn()
 	}
-	if err = s.auth(r, c, host.Client.Cnf.U, host.Client.Cnf.P); err != nil {
-		logs.Warn("auth error", err, r.RemoteAddr)
+	if resp := checkHostAccess(host, r, c.RemoteAddr().String()); resp != nil {
+		logs.Warn("the request is denied, status %d, host %s, remote address %s", resp.StatusCode, host.Host, r.RemoteAddr)
+		resp.Close = true
+		resp.Write(c)
+		resp.Body.Close()
+		failCode = 0
 		return
 	}
+	accessChecked = true
 	if targetAddr, err = host.Target.GetRandomTarget(); err != nil {
 		logs.Warn(err.Error())
+		failCode = http.StatusBadGateway
 		return
 	}
 
 	// 判断访问地址是否在黑名单内
 	if common.IsBlackIp(c.RemoteAddr().String(), host.Client.VerifyKey, host.Client.BlackIpList) {
-		c.Close()
+		failCode = 0
 		return
 	}
 
-	lk = conn.NewLink("http", targetAddr, host.Client.Cnf.Crypt, host.Client.Cnf.Compress, r.RemoteAddr, host.Target.LocalProxy)
+	lk = conn.NewLink("http", targetAddr, host.Client.Cnf.Crypt, host.Client.Cnf.Compress, r.RemoteAddr, host.Target.LocalProxy, conn.LinkProxyProtocol(host.ProxyProtocol))
 	if target, err = s.bridge.SendLinkInfo(host.Client.Id, lk, nil); err != nil {
 		logs.Notice("connect to target %s error %s", lk.Host, err)
+		failCode = http.StatusBadGateway
+		return
+	}
+	if connClient, err = conn.GetConn(target, lk.Crypt, lk.Compress, host.Client.Rate, true); err != nil {
+		failCode = http.StatusBadGateway
 		return
 	}
-	connClient = conn.GetConn(target, lk.Crypt, lk.Compress, host.Client.Rate, true)
 
 	//read from inc-client
-	go func() {
-		wg.Add(1)
-		isReset = false
-		defer connClient.Close()
-		defer func() {
-			wg.Done()
-			if !isReset {
-				c.Close()
-			}
-		}()
-
-		err1 := goroutine.CopyBuffer(c, connClient, host.Client.Flow, nil, "")
-		if err1 != nil {
-			return
+	exchanges = make(chan *httpExchange, 16)
+	done = make(chan struct{})
+	wg.Add(1)
+	go func(connClient io.ReadWriteCloser, host *file.Host, exchanges <-chan *httpExchange, done chan struct{}) {
+		defer wg.Done()
+		defer close(done)
+		if err := s.writeResponses(c, connClient, host, exchanges); err != nil {
+			connClient.Close()
+			c.Close()
 		}
+	}(connClient, host, exchanges, done)
 
-		resp, err := http.ReadResponse(bufio.NewReader(connClient), r)
-		if err != nil || resp == nil || r == nil {
-			// if there got broken pipe, http.ReadResponse will get a nil
-			//break
-			return
-		} else {
-			lenConn := conn.NewLenConn(c)
-			if err := resp.Write(lenConn); err != nil {
-				logs.Error(err)
-				//break
-				return
+	for {
+		ex := &httpExchange{req: r}
+		if !accessChecked {
+			if ex.resp = checkHostAccess(host, r, c.RemoteAddr().String()); ex.resp != nil {
+				logs.Warn("the request is denied, status %d, host %s, remote address %s", ex.resp.StatusCode, host.Host, r.RemoteAddr)
 			}
 		}
-	}()
-
-	for {
+		accessChecked = false
 		//if the cache start and the request is in the cache list, return the cache
-		if s.useCache {
-			if v, ok := s.cache.Get(filepath.Join(host.Host, r.URL.Path)); ok {
-				n, err := c.Write(v.([]byte))
-				if err != nil {
-					break
-				}
+		if ex.resp == nil && s.cache != nil && !host.NoCache {
+			if ex.resp, ex.cacheState = s.cache.Lookup(host.Id, r); ex.resp != nil {
 				logs.Trace("%s request, method %s, host %s, url %s, remote address %s, return cache", r.URL.Scheme, r.Method, r.Host, r.URL.Path, c.RemoteAddr().String())
-				host.Client.Flow.Add(int64(n), int64(n))
-				//if return cache and does not create a new conn with client and Connection is not set or close, close the connection.
-				if strings.ToLower(r.Header.Get("Connection")) == "close" || strings.ToLower(r.Header.Get("Connection")) == "" {
-					break
-				}
-				goto readReq
+				host.AddCacheCount(true)
 			}
 		}
 
-		//change the host and header and set proxy setting
-		common.ChangeHostAndHeader(r, host.HostChange, host.HeaderChange, c.Conn.RemoteAddr().String())
+		if ex.resp == nil {
+			//change the host and header and set proxy setting
+			common.ChangeHostAndHeader(r, host.HostChange, host.HeaderChange, c.Conn.RemoteAddr().String())
+
+			logs.Info("%s request, method %s, host %s, url %s, remote address %s, target %s", r.URL.Scheme, r.Method, r.Host, r.URL.Path, remoteAddr, lk.Host)
 
-		logs.Info("%s request, method %s, host %s, url %s, remote address %s, target %s", r.URL.Scheme, r.Method, r.Host, r.URL.Path, remoteAddr, lk.Host)
+			ex.record = newInspectRecord(host, remoteAddr)
+			ex.record.setRequest(r)
 
-		//write
-		lenConn = conn.NewLenConn(connClient)
-		//lenConn = conn.LenConn
-		if err := r.Write(lenConn); err != nil {
-			logs.Error(err)
+			//write
+			lenConn = conn.NewLenConn(connClient)
+			if err := r.Write(lenConn); err != nil {
+				logs.Error(err)
+				ex.record.save(err)
+				break
+			}
+			file.NewFlows(host.Flow, host.Client.Flow).AddTcp(int64(lenConn.Len), 0)
+		}
+
+		select {
+		case exchanges <- ex:
+		case <-done:
+			return
+		}
+		if r.Close {
 			break
 		}
-		host.Client.Flow.Add(int64(lenConn.Len), int64(lenConn.Len))
 
-	readReq:
 		//read req from connection
-		r, err = http.ReadRequest(bufio.NewReader(c))
+		if reader == nil {
+			reader = bufio.NewReader(c)
+		}
+		r, err = http.ReadRequest(reader)
 		if err != nil {
 			//break
 			return
@@ -287,15 +320,116 @@ reset:
 			logs.Notice("the url %s %s %s can't be parsed!", r.URL.Scheme, r.Host, r.RequestURI)
 			break
 		} else if host != hostTmp {
+			//wait for the responses of the old host
+			close(exchanges)
+			wg.Wait()
+			if !hostTmp.IsProxy() {
+				r.RemoteAddr = c.RemoteAddr().String()
+				w := newConnResponseWriter(c)
+				serveHostAction(w, r, hostTmp)
+				w.Flush()
+				return
+			}
 			host = hostTmp
 			isReset = true
 			connClient.Close()
+			connClient = nil
 			goto reset
 		}
 	}
+	close(exchanges)
 	wg.Wait()
 }
 
+func (s *httpServer) writeResponses(c *conn.Conn, connClient io.ReadWriteCloser, host *file.Host, exchanges <-chan *httpExchange) error {
+	reader := bufio.NewReader(connClient)
+	var responded bool
+	for ex := range exchanges {
+		resp := ex.resp
+		if resp == nil {
+			var err error
+			var timedOut int32
+			var timer *time.Timer
+			if ResponseHeaderTimeout > 0 {
+				timer = time.AfterFunc(ResponseHeaderTimeout, func() {
+					atomic.StoreInt32(&timedOut, 1)
+					connClient.Close()
+				})
+			}
+			for {
+				if resp, err = http.ReadResponse(reader, ex.req); err != nil {
+					ex.record.save(err)
+					// if there got broken pipe, http.ReadResponse will get a nil
+					if atomic.LoadInt32(&timedOut) == 1 {
+						writeErrorResponse(c, host, ex.req, http.StatusGatewayTimeout)
+					} else if !responded {
+						writeErrorResponse(c, host, ex.req, http.StatusBadGateway)
+					}
+					return err
+				}
+				// 1xx, keep reading for the final response
+				if resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+					if err = resp.Write(c); err != nil {
+						return err
+					}
+					continue
+				}
+				break
+			}
+			if timer != nil && !timer.Stop() {
+				// the connection is closed by the timer just now
+				resp.Body.Close()
+				err = errors.New("read the response timeout")
+				ex.record.save(err)
+				writeErrorResponse(c, host, ex.req, http.StatusGatewayTimeout)
+				return err
+			}
+			responded = true
+			ex.record.setResponse(resp)
+			if resp.StatusCode == http.StatusSwitchingProtocols {
+				if err = resp.Write(c); err != nil {
+					return err
+				}
+				flows := file.NewFlows(host.Flow, host.Client.Flow)
+				go goroutine.CopyBuffer(connClient, c, flows, true, nil, "")
+				goroutine.CopyBuffer(c, reader, flows, false, nil, "")
+				return errors.New("the upgraded connection is closed")
+			}
+			if ex.cacheState != nil {
+				var hit bool
+				resp, hit = s.cache.Store(ex.cacheState, time.Duration(host.CacheTtl)*time.Second, resp)
+				host.AddCacheCount(hit)
+			}
+		}
+		// chunked encoding is needed
+		if ex.req.ProtoAtLeast(1, 1) && resp.ProtoAtLeast(1, 1) {
+			resp = compressResponse(host, ex.req, resp)
+		}
+		lenConn := conn.NewLenConn(c)
+		err := resp.Write(lenConn)
+		resp.Body.Close()
+		flows := file.NewFlows(host.Flow, host.Client.Flow)
+		flows.AddTcp(0, int64(lenConn.Len))
+		if err != nil {
+			return err
+		}
+		if resp.Close {
+			return errors.New("the connection is closed by the target")
+		}
+		if flows.IsExceeded() {
+			return errors.New("Traffic exceeded")
+		}
+	}
+	return nil
+}
+
+// the connection is closed after the page
+func writeErrorResponse(c io.Writer, host *file.Host, r *http.Request, code int) {
+	resp := newErrorResponse(host, r, code)
+	resp.Close = true
+	resp.Write(c)
+}
+
 func resetReqMethod(method string) string {
 	if method == "ET" {
 		return "GET"
@@ -313,6 +447,8 @@ func (s *httpServer) NewServer(port int, scheme string) *http.Server {
 			r.URL.Scheme = scheme
 			s.handleTunneling(w, r)
 		}),
+		ConnContext: s.connContext,
+		ConnState:   s.connState,
 		// Disable HTTP/2.
 		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
 	}
@@ -342,9 +478,9 @@ func (s *httpServer) NewServerWithTls(port int, scheme string, l net.Listener, c
 			r.URL.Scheme = scheme
 			s.handleTunneling(w, r)
 		}),
-		// Disable HTTP/2.
-		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
-		TLSConfig:    config,
+		ConnContext: s.connContext,
+		ConnState:   s.connState,
+		TLSConfig:   &tls.Config{GetConfigForClient: getConfigForClient(config)},
 	}
 
 	return s2.ServeTLS(l, "", "")
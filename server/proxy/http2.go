@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego/logs"
+	"golang.org/x/net/http2"
+)
+
+var h2Transport = &http2.Transport{
+	AllowHTTP:       true,
+	ReadIdleTimeout: 30 * time.Second,
+}
+
+type backendConnsKey struct{}
+
+// the http2 connections opened for one visitor connection live and die with it
+type backendConns struct {
+	conns map[string]*http2.ClientConn
+	sync.Mutex
+}
+
+func newBackendConns() *backendConns {
+	return &backendConns{conns: make(map[string]*http2.ClientConn)}
+}
+
+func (b *backendConns) Close() {
+	b.Lock()
+	defer b.Unlock()
+	for k, cc := range b.conns {
+		cc.Close()
+		delete(b.conns, k)
+	}
+}
+
+func (s *httpServer) connContext(ctx context.Context, c net.Conn) context.Context {
+	b := newBackendConns()
+	s.backendConns.Store(c, b)
+	return context.WithValue(ctx, backendConnsKey{}, b)
+}
+
+func (s *httpServer) connState(c net.Conn, state http.ConnState) {
+	if state != http.StateClosed && state != http.StateHijacked {
+		return
+	}
+	if v, ok := s.backendConns.Load(c); ok {
+		s.backendConns.Delete(c)
+		v.(*backendConns).Close()
+	}
+}
+
+// otherwise the http/1.1 connection is copied directly
+func isReverseProxyRequest(host *file.Host, r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" || r.ProtoMajor == 2 || isH2Backend(host)
+}
+
+func isH2Backend(host *file.Host) bool {
+	return host.BackendProto == "h2c" || host.BackendProto == "h2"
+}
+
+// h2 is only offered to the hosts which enable it
+func getConfigForClient(config *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		c := config.Clone()
+		c.NextProtos = []string{"http/1.1"}
+		if host, err := file.GetDb().GetInfoByHost(hello.ServerName, buildHttpsRequest(hello.ServerName)); err == nil && host.Http2 {
+			c.NextProtos = []string{"h2", "http/1.1"}
+		}
+		return c, nil
+	}
+}
+
+type hostTransport struct {
+	h1     http.RoundTripper
+	bridge NetBridge
+}
+
+func newHostTransport(bridge NetBridge, responseHeaderTimeout time.Duration) *hostTransport {
+	local, _ := net.ResolveTCPAddr("tcp", "127.0.0.1")
+	return &hostTransport{bridge: bridge, h1: &http.Transport{
+		ResponseHeaderTimeout: responseHeaderTimeout,
+		DisableKeepAlives:     true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var (
+				host       *file.Host
+				target     net.Conn
+				err        error
+				connClient io.ReadWriteCloser
+				targetAddr string
+				lk         *conn.Link
+			)
+
+			r := ctx.Value("req").(*http.Request)
+			host = ctx.Value("host").(*file.Host)
+			targetAddr = ctx.Value("target").(string)
+
+			lk = conn.NewLink("http", targetAddr, host.Client.Cnf.Crypt, host.Client.Cnf.Compress, r.RemoteAddr, host.Target.LocalProxy, conn.LinkProxyProtocol(host.ProxyProtocol))
+			if target, err = bridge.SendLinkInfo(host.Client.Id, lk, nil); err != nil {
+				logs.Notice("connect to target %s error %s", lk.Host, err)
+				return nil, NewHTTPError(http.StatusBadGateway, "Cannot connect to the server")
+			}
+			if connClient, err = conn.GetConn(target, lk.Crypt, lk.Compress, host.Client.Rate, true); err != nil {
+				return nil, err
+			}
+			return &flowConn{
+				ReadWriteCloser: connClient,
+				fakeAddr:        local,
+				host:            host,
+			}, nil
+		},
+	}}
+}
+
+func (t *hostTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	host := r.Context().Value("host").(*file.Host)
+	if !isH2Backend(host) {
+		return t.h1.RoundTrip(r)
+	}
+	b, ok := r.Context().Value(backendConnsKey{}).(*backendConns)
+	if !ok {
+		return nil, errors.New("the visitor connection is not found")
+	}
+	cc, err := t.getClientConn(b, host, r)
+	if err != nil {
+		return nil, err
+	}
+	return cc.RoundTrip(r)
+}
+
+func (t *hostTransport) getClientConn(b *backendConns, host *file.Host, r *http.Request) (*http2.ClientConn, error) {
+	targetAddr := r.Context().Value("target").(string)
+	remoteAddr := r.Context().Value("req").(*http.Request).RemoteAddr
+	key := strconv.Itoa(host.Client.Id) + "/" + host.BackendProto + "/" + targetAddr
+	b.Lock()
+	defer b.Unlock()
+	if cc, ok := b.conns[key]; ok {
+		if cc.CanTakeNewRequest() {
+			return cc, nil
+		}
+		delete(b.conns, key)
+	}
+	lk := conn.NewLink(common.CONN_TCP, targetAddr, host.Client.Cnf.Crypt, host.Client.Cnf.Compress, remoteAddr, host.Target.LocalProxy, conn.LinkProxyProtocol(host.ProxyProtocol))
+	target, err := t.bridge.SendLinkInfo(host.Client.Id, lk, nil)
+	if err != nil {
+		logs.Notice("connect to target %s error %s", lk.Host, err)
+		return nil, NewHTTPError(http.StatusBadGateway, "Cannot connect to the target")
+	}
+	connClient, err := conn.GetConn(target, lk.Crypt, lk.Compress, host.Client.Rate, true)
+	if err != nil {
+		return nil, err
+	}
+	var c net.Conn = &flowConn{
+		ReadWriteCloser: connClient,
+		fakeAddr:        target.LocalAddr(),
+		host:            host,
+	}
+	if host.BackendProto == "h2" {
+		config, err := getBackendTlsConfig(host, r)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		tlsConn := tls.Client(c, config)
+		if err = tlsConn.Handshake(); err != nil {
+			c.Close()
+			return nil, err
+		}
+		if tlsConn.ConnectionState().NegotiatedProtocol != "h2" {
+			c.Close()
+			return nil, errors.New("the target " + targetAddr + " does not support h2")
+		}
+		c = tlsConn
+	}
+	cc, err := h2Transport.NewClientConn(c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	b.conns[key] = cc
+	return cc, nil
+}
+
+// intranet targets usually have self signed certificates, they are trusted by the ca or the insecure option of the host
+func getBackendTlsConfig(host *file.Host, r *http.Request) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         host.TargetTlsServerName,
+		NextProtos:         []string{"h2"},
+		InsecureSkipVerify: host.TargetTlsInsecure,
+	}
+	if config.ServerName == "" {
+		var err error
+		if config.ServerName, _, err = net.SplitHostPort(r.Host); err != nil {
+			config.ServerName = r.Host
+		}
+	}
+	if host.TargetTlsCa != "" {
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM([]byte(host.TargetTlsCa)) {
+			return nil, errors.New("the ca of the target is invalid")
+		}
+	}
+	return config, nil
+}
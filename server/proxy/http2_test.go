@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/file"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// dial the target directly instead of through the client
+type dialBridge struct{}
+
+func (dialBridge) SendLinkInfo(clientId int, link *conn.Link, t *file.Tunnel) (net.Conn, error) {
+	return net.Dial("tcp", link.Host)
+}
+
+// grpc like: echo every message and send the status in the trailers
+func grpcEchoHandler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Content-Type") != "application/grpc" {
+			t.Errorf("the request is not grpc, proto %s, content type %s", r.Proto, r.Header.Get("Content-Type"))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		buf := make([]byte, 1024)
+		for {
+			n, err := r.Body.Read(buf)
+			if n > 0 {
+				w.Write(buf[:n])
+				w.(http.Flusher).Flush()
+			}
+			if err != nil {
+				break
+			}
+		}
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "ok")
+	})
+}
+
+func newTestCert(t *testing.T) (certPem, keyPem []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "nps test"},
+		DNSNames:     []string{"h2c.test", "h2.test", "h1.test", "h2.untrusted.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func initTestDb(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "conf"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"clients.json", "tasks.json", "hosts.json", "global.json"} {
+		if err := os.WriteFile(filepath.Join(dir, "conf", name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	common.ConfPath = dir
+}
+
+func TestHttp2Proxy(t *testing.T) {
+	initTestDb(t)
+
+	// the h2c target
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2cServer := &http.Server{Handler: h2c.NewHandler(grpcEchoHandler(t), &http2.Server{})}
+	go h2cServer.Serve(l)
+	defer h2cServer.Close()
+
+	// the h2 target with tls
+	h2Server := httptest.NewUnstartedServer(grpcEchoHandler(t))
+	h2Server.EnableHTTP2 = true
+	h2Server.StartTLS()
+	defer h2Server.Close()
+
+	client := &file.Client{Id: 1, Cnf: &file.Config{}, Flow: &file.Flow{}}
+	hosts := []*file.Host{
+		{Id: 1, Host: "h2c.test", Http2: true, BackendProto: "h2c", Target: &file.Target{TargetStr: l.Addr().String()}},
+		{Id: 2, Host: "h2.test", Http2: true, BackendProto: "h2", Target: &file.Target{TargetStr: h2Server.Listener.Addr().String()},
+			TargetTlsServerName: "example.com", TargetTlsCa: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: h2Server.Certificate().Raw}))},
+		{Id: 3, Host: "h1.test", Target: &file.Target{TargetStr: l.Addr().String()}},
+		// the certificate of the target is verified by default
+		{Id: 4, Host: "h2.untrusted.test", Http2: true, BackendProto: "h2", Target: &file.Target{TargetStr: h2Server.Listener.Addr().String()}},
+	}
+	file.GetDb().JsonDb.Clients.Store(client.Id, client)
+	for _, h := range hosts {
+		h.Client, h.Flow, h.Scheme, h.Location = client, &file.Flow{}, "all", "/"
+		file.GetDb().JsonDb.Hosts.Store(h.Id, h)
+	}
+
+	// nps terminates the tls
+	s := NewHttp(nil, nil, 0, 0, nil, false)
+	s.bridge = dialBridge{}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	certPem, keyPem := newTestCert(t)
+	go s.NewServerWithTls(0, "https", ln, string(certPem), string(keyPem))
+
+	for _, name := range []string{"h2c.test", "h2.test"} {
+		t.Run(name, func(t *testing.T) {
+			tr := &http2.Transport{
+				TLSClientConfig: &tls.Config{ServerName: name, InsecureSkipVerify: true},
+			}
+			defer tr.CloseIdleConnections()
+			pr, pw := io.Pipe()
+			req, err := http.NewRequest("POST", "https://"+ln.Addr().String()+"/echo.Echo/Stream", pr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = name
+			req.Header.Set("Content-Type", "application/grpc")
+			req.Header.Set("Te", "trailers")
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+				t.Fatalf("status %d, proto %s", resp.StatusCode, resp.Proto)
+			}
+			// the message should be echoed before the request stream is closed
+			reader := bufio.NewReader(resp.Body)
+			for _, msg := range []string{"ping1", "ping2"} {
+				if _, err := pw.Write([]byte(msg)); err != nil {
+					t.Fatal(err)
+				}
+				buf := make([]byte, len(msg))
+				if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != msg {
+					t.Fatalf("read %q, %v, want %q", buf, err, msg)
+				}
+			}
+			pw.Close()
+			if _, err := io.ReadAll(reader); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Trailer.Get("Grpc-Status") != "0" || resp.Trailer.Get("Grpc-Message") != "ok" {
+				t.Fatalf("the trailers are not proxied, %v", resp.Trailer)
+			}
+		})
+	}
+
+	tr := &http2.Transport{TLSClientConfig: &tls.Config{ServerName: "h2.untrusted.test", InsecureSkipVerify: true}}
+	defer tr.CloseIdleConnections()
+	req, err := http.NewRequest("POST", "https://"+ln.Addr().String()+"/echo.Echo/Stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "h2.untrusted.test"
+	req.Header.Set("Content-Type", "application/grpc")
+	if resp, err := tr.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("the status of the untrusted target is %d", resp.StatusCode)
+	}
+
+	// h2 is only offered to the hosts which enable it
+	c, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: "h1.test", NextProtos: []string{"h2", "http/1.1"}, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if p := c.ConnectionState().NegotiatedProtocol; p == "h2" {
+		t.Fatalf("the protocol of the host without http2 is %s", p)
+	}
+}
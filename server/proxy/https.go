@@ -22,13 +22,10 @@ type HttpsServer struct {
 	hostIdCertMap    sync.Map
 }
 
-func NewHttpsServer(l net.Listener, bridge NetBridge, useCache bool, cacheLen int) *HttpsServer {
+func NewHttpsServer(l net.Listener, bridge NetBridge, httpCache *cache.HttpCache) *HttpsServer {
 	https := &HttpsServer{listener: l}
 	https.bridge = bridge
-	https.useCache = useCache
-	if useCache {
-		https.cache = cache.New(cacheLen)
-	}
+	https.cache = httpCache
 	return https
 }
 
@@ -181,6 +178,10 @@ func (https *HttpsServer) handleHttps2(c net.Conn, hostName string, rb []byte, r
 		logs.Debug("the url %s can't be parsed!", hostName)
 		return
 	}
+	if !isHostIpAllowed(host, c.RemoteAddr().String()) {
+		c.Close()
+		return
+	}
 	if err := https.CheckFlowAndConnNum(host.Client); err != nil {
 		logs.Debug("client id %d, host id %d, error %s, when https connection", host.Client.Id, host.Id, err.Error())
 		c.Close()
@@ -195,7 +196,7 @@ func (https *HttpsServer) handleHttps2(c net.Conn, hostName string, rb []byte, r
 		logs.Warn(err.Error())
 	}
 	logs.Info("new https connection,clientId %d,host %s,remote address %s", host.Client.Id, r.Host, c.RemoteAddr().String())
-	https.DealClient(conn.NewConn(c), host.Client, targetAddr, rb, common.CONN_TCP, nil, host.Client.Flow, host.Target.LocalProxy, nil)
+	https.DealClient(conn.NewConn(c), host.Client, targetAddr, rb, common.CONN_TCP, nil, file.Flows{host.Flow}, host.Target.LocalProxy, nil, conn.LinkProxyProtocol(host.ProxyProtocol))
 }
 
 // close
@@ -224,6 +225,10 @@ func (https *HttpsServer) handleHttps(c net.Conn) {
 		logs.Notice("the url %s can't be parsed!", hostName)
 		return
 	}
+	if !isHostIpAllowed(host, c.RemoteAddr().String()) {
+		c.Close()
+		return
+	}
 	if err := https.CheckFlowAndConnNum(host.Client); err != nil {
 		logs.Warn("client id %d, host id %d, error %s, when https connection", host.Client.Id, host.Id, err.Error())
 		c.Close()
@@ -238,7 +243,7 @@ func (https *HttpsServer) handleHttps(c net.Conn) {
 		logs.Warn(err.Error())
 	}
 	logs.Trace("new https connection,clientId %d,host %s,remote address %s", host.Client.Id, r.Host, c.RemoteAddr().String())
-	https.DealClient(conn.NewConn(c), host.Client, targetAddr, rb, common.CONN_TCP, nil, host.Client.Flow, host.Target.LocalProxy, nil)
+	https.DealClient(conn.NewConn(c), host.Client, targetAddr, rb, common.CONN_TCP, nil, file.Flows{host.Flow}, host.Target.LocalProxy, nil, conn.LinkProxyProtocol(host.ProxyProtocol))
 }
 
 type HttpsListener struct {
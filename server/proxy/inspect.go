@@ -0,0 +1,303 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/file"
+)
+
+var (
+	// per host
+	InspectSize           = 50
+	InspectBodySize int64 = 16 * 1024
+)
+
+var (
+	inspectId   int64
+	inspectList sync.Map // host id -> *inspectRecords
+)
+
+var inspectCredentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+const inspectRedacted = "[redacted]"
+
+type InspectRecord struct {
+	Id                int64
+	Time              string
+	Duration          int64 // milliseconds
+	RemoteAddr        string
+	Method            string
+	Url               string
+	Host              string
+	Proto             string
+	ReqHeader         http.Header
+	ReqBody           string
+	ReqBodySize       int64
+	ReqBodyTruncated  bool
+	ReqContentLength  int64 // -1 if unknown
+	Status            int
+	RespHeader        http.Header
+	RespBody          string
+	RespBodySize      int64
+	RespBodyTruncated bool
+	Error             string
+	Replay            bool
+	Redacted          bool
+	start             time.Time
+	hostId            int
+	reqBodyEOF        bool
+	reqBody           *captureBody
+	respBody          *captureBody
+	once              sync.Once
+}
+
+type inspectRecords struct {
+	records []*InspectRecord
+	sync.Mutex
+}
+
+type inspectRecordKey struct{}
+
+// nil if the inspection is off
+func newInspectRecord(host *file.Host, remoteAddr string) *InspectRecord {
+	if !host.Inspect || InspectSize <= 0 {
+		return nil
+	}
+	return &InspectRecord{
+		Id:         atomic.AddInt64(&inspectId, 1),
+		Time:       time.Now().Format(common.DEFAULT_TIME),
+		RemoteAddr: remoteAddr,
+		Redacted:   !host.InspectCredentials,
+		start:      time.Now(),
+		hostId:     host.Id,
+	}
+}
+
+func (rec *InspectRecord) cloneHeader(h http.Header) http.Header {
+	h = h.Clone()
+	if rec.Redacted {
+		for _, v := range inspectCredentialHeaders {
+			if _, ok := h[v]; ok {
+				h[v] = []string{inspectRedacted}
+			}
+		}
+	}
+	return h
+}
+
+func getInspectRecord(r *http.Request) *InspectRecord {
+	rec, _ := r.Context().Value(inspectRecordKey{}).(*InspectRecord)
+	return rec
+}
+
+// the body is captured while it is read
+func (rec *InspectRecord) setRequest(r *http.Request) {
+	if rec == nil {
+		return
+	}
+	rec.Method = r.Method
+	rec.Url = r.URL.RequestURI()
+	rec.Host = r.Host
+	rec.Proto = r.Proto
+	rec.ReqHeader = rec.cloneHeader(r.Header)
+	rec.ReqContentLength = r.ContentLength
+	if r.Body != nil && r.Body != http.NoBody {
+		rec.reqBody = &captureBody{ReadCloser: r.Body}
+		r.Body = rec.reqBody
+	}
+}
+
+// the record is saved when the body is closed
+func (rec *InspectRecord) setResponse(resp *http.Response) {
+	if rec == nil {
+		return
+	}
+	rec.Status = resp.StatusCode
+	rec.RespHeader = rec.cloneHeader(resp.Header)
+	if resp.Body == nil || resp.Body == http.NoBody {
+		rec.save(nil)
+		return
+	}
+	rec.respBody = &captureBody{ReadCloser: resp.Body, onClose: func() { rec.save(nil) }}
+	resp.Body = rec.respBody
+}
+
+func (rec *InspectRecord) save(err error) {
+	if rec == nil {
+		return
+	}
+	rec.once.Do(func() {
+		rec.Duration = int64(time.Since(rec.start) / time.Millisecond)
+		if err != nil {
+			rec.Error = err.Error()
+		}
+		if rec.reqBody != nil {
+			rec.ReqBody, rec.ReqBodySize, rec.ReqBodyTruncated = rec.reqBody.get()
+			rec.reqBodyEOF = rec.reqBody.isEOF()
+		}
+		if rec.respBody != nil {
+			rec.RespBody, rec.RespBodySize, rec.RespBodyTruncated = rec.respBody.get()
+		}
+		v, _ := inspectList.LoadOrStore(rec.hostId, &inspectRecords{})
+		list := v.(*inspectRecords)
+		list.Lock()
+		list.records = append(list.records, rec)
+		if len(list.records) > InspectSize {
+			list.records = list.records[len(list.records)-InspectSize:]
+		}
+		list.Unlock()
+	})
+}
+
+// newest first
+func GetInspectRecords(hostId int) []*InspectRecord {
+	records := make([]*InspectRecord, 0)
+	if v, ok := inspectList.Load(hostId); ok {
+		list := v.(*inspectRecords)
+		list.Lock()
+		for i := len(list.records) - 1; i >= 0; i-- {
+			records = append(records, list.records[i])
+		}
+		list.Unlock()
+	}
+	return records
+}
+
+func GetInspectRecord(hostId int, id int64) (*InspectRecord, error) {
+	for _, v := range GetInspectRecords(hostId) {
+		if v.Id == id {
+			return v, nil
+		}
+	}
+	return nil, errors.New("the record is not found")
+}
+
+func ClearInspectRecords(hostId int) {
+	inspectList.Delete(hostId)
+}
+
+func ReplayInspectRecord(bridge NetBridge, host *file.Host, id int64) (*InspectRecord, error) {
+	old, err := GetInspectRecord(host.Id, id)
+	if err != nil {
+		return nil, err
+	}
+	if old.ReqBodyTruncated {
+		return nil, errors.New("the request body is truncated and can not be replayed")
+	}
+	// the target may reply before it reads the whole body
+	if old.ReqBodySize != old.ReqContentLength && !old.reqBodyEOF {
+		return nil, errors.New("the request body is not read completely and can not be replayed")
+	}
+	targetAddr, err := host.Target.GetRandomTarget()
+	if err != nil {
+		return nil, err
+	}
+	scheme := "http"
+	if host.BackendProto == "h2" {
+		scheme = "https"
+	}
+	r, err := http.NewRequest(old.Method, scheme+"://"+targetAddr+old.Url, bytes.NewReader([]byte(old.ReqBody)))
+	if err != nil {
+		return nil, err
+	}
+	r.Header = old.ReqHeader.Clone()
+	for _, v := range forwardAuthSkipHeaders {
+		r.Header.Del(v)
+	}
+	if old.Redacted {
+		for _, v := range inspectCredentialHeaders {
+			r.Header.Del(v)
+		}
+	}
+	r.Host = old.Host
+	r.ContentLength = int64(len(old.ReqBody))
+	r.RemoteAddr = old.RemoteAddr
+	b := newBackendConns()
+	defer b.Close()
+	r = withTarget(r, host, targetAddr)
+	r = r.WithContext(context.WithValue(r.Context(), backendConnsKey{}, b))
+
+	rec := &InspectRecord{
+		Id:         atomic.AddInt64(&inspectId, 1),
+		Time:       time.Now().Format(common.DEFAULT_TIME),
+		RemoteAddr: old.RemoteAddr,
+		Replay:     true,
+		Redacted:   !host.InspectCredentials,
+		start:      time.Now(),
+		hostId:     host.Id,
+	}
+	rec.setRequest(r)
+	resp, err := newHostTransport(bridge, ResponseHeaderTimeout).RoundTrip(r)
+	if err != nil {
+		rec.save(err)
+		return rec, nil
+	}
+	rec.setResponse(resp)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return rec, nil
+}
+
+// keeps the first InspectBodySize bytes
+type captureBody struct {
+	io.ReadCloser
+	buf       bytes.Buffer
+	size      int64
+	truncated bool
+	eof       bool
+	onClose   func()
+	sync.Mutex
+}
+
+func (c *captureBody) Read(p []byte) (n int, err error) {
+	n, err = c.ReadCloser.Read(p)
+	if err == io.EOF {
+		c.Lock()
+		c.eof = true
+		c.Unlock()
+	}
+	if n > 0 {
+		c.Lock()
+		c.size += int64(n)
+		if left := InspectBodySize - int64(c.buf.Len()); left > 0 {
+			if int64(n) > left {
+				c.buf.Write(p[:left])
+				c.truncated = true
+			} else {
+				c.buf.Write(p[:n])
+			}
+		} else {
+			c.truncated = true
+		}
+		c.Unlock()
+	}
+	return
+}
+
+func (c *captureBody) Close() error {
+	err := c.ReadCloser.Close()
+	if c.onClose != nil {
+		c.onClose()
+	}
+	return err
+}
+
+func (c *captureBody) get() (string, int64, bool) {
+	c.Lock()
+	defer c.Unlock()
+	return c.buf.String(), c.size, c.truncated
+}
+
+func (c *captureBody) isEOF() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.eof
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"ehang.io/nps/lib/file"
+)
+
+func inspectRequest(t *testing.T, host *file.Host, body string) *InspectRecord {
+	rec := newInspectRecord(host, "127.0.0.1:1234")
+	if rec == nil {
+		t.Fatal("the request is not recorded")
+	}
+	r := httptest.NewRequest("POST", "http://inspect.test/hook?a=1", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set("Cookie", "session=secret")
+	r.Header.Set("X-Test", "value")
+	rec.setRequest(r)
+	io.ReadAll(r.Body)
+	resp := &http.Response{StatusCode: 201, Header: http.Header{"Set-Cookie": {"session=new"}}, Body: io.NopCloser(strings.NewReader("done"))}
+	rec.setResponse(resp)
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return rec
+}
+
+func TestInspectRecord(t *testing.T) {
+	defer func(size int64) { InspectBodySize = size }(InspectBodySize)
+	InspectBodySize = 4
+	host := &file.Host{Id: 1001, Inspect: true}
+	defer ClearInspectRecords(host.Id)
+
+	if newInspectRecord(&file.Host{Id: 1002}, "") != nil {
+		t.Fatal("the host without the inspection is recorded")
+	}
+	rec := inspectRequest(t, host, "123456")
+	got, err := GetInspectRecord(host.Id, rec.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Method != "POST" || got.Url != "/hook?a=1" || got.Status != 201 || got.RespBody != "done" {
+		t.Fatalf("the record is not expected %+v", got)
+	}
+	if got.ReqBody != "1234" || got.ReqBodySize != 6 || !got.ReqBodyTruncated {
+		t.Fatalf("the body is %q, size %d, truncated %t", got.ReqBody, got.ReqBodySize, got.ReqBodyTruncated)
+	}
+	// the credentials are not kept by default
+	for _, h := range []http.Header{got.ReqHeader, got.RespHeader} {
+		for _, name := range []string{"Authorization", "Cookie", "Set-Cookie"} {
+			if v := h.Get(name); v != "" && v != inspectRedacted {
+				t.Fatalf("the header %s is kept, %s", name, v)
+			}
+		}
+	}
+	if got.ReqHeader.Get("X-Test") != "value" || got.RespHeader.Get("Set-Cookie") != inspectRedacted {
+		t.Fatal("the other headers are not kept")
+	}
+
+	host.InspectCredentials = true
+	rec = inspectRequest(t, host, "")
+	if rec.ReqHeader.Get("Authorization") != "Bearer secret" || rec.RespHeader.Get("Set-Cookie") != "session=new" {
+		t.Fatal("the credentials are not kept when the host allows it")
+	}
+	if records := GetInspectRecords(host.Id); len(records) != 2 || records[0] != rec {
+		t.Fatal("the newest record is not the first")
+	}
+}
+
+func TestReplayInspectRecord(t *testing.T) {
+	defer func(size int64) { InspectBodySize = size }(InspectBodySize)
+	InspectBodySize = 1024
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Auth", r.Header.Get("Authorization"))
+		w.Write(b)
+	}))
+	defer target.Close()
+	client := &file.Client{Id: 1, Cnf: &file.Config{}, Flow: &file.Flow{}}
+	host := &file.Host{Id: 1003, Host: "inspect.test", Inspect: true, Client: client, Flow: &file.Flow{},
+		Target: &file.Target{TargetStr: target.Listener.Addr().String()}}
+	defer ClearInspectRecords(host.Id)
+
+	for _, keep := range []bool{false, true} {
+		host.InspectCredentials = keep
+		old := inspectRequest(t, host, "payload")
+		rec, err := ReplayInspectRecord(dialBridge{}, host, old.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Error != "" || rec.Status != 200 || rec.RespBody != "payload" || !rec.Replay {
+			t.Fatalf("the replay is not expected %+v", rec)
+		}
+		// the redacted credentials are not sent
+		want := ""
+		if keep {
+			want = "Bearer secret"
+		}
+		if v := rec.RespHeader.Get("X-Auth"); v != want {
+			t.Fatalf("the target received the authorization %q, want %q", v, want)
+		}
+	}
+
+	InspectBodySize = 2
+	old := inspectRequest(t, host, "payload")
+	if _, err := ReplayInspectRecord(dialBridge{}, host, old.Id); err == nil {
+		t.Fatal("the truncated request is replayed")
+	}
+
+	// the target replies before it reads the body
+	InspectBodySize = 1024
+	rec := newInspectRecord(host, "127.0.0.1:1234")
+	r := httptest.NewRequest("POST", "http://inspect.test/hook", strings.NewReader("payload"))
+	rec.setRequest(r)
+	r.Body.Read(make([]byte, 3))
+	rec.save(nil)
+	if rec.ReqBodySize != 3 || rec.ReqContentLength != 7 || rec.ReqBodyTruncated {
+		t.Fatalf("the body size is %d, content length %d", rec.ReqBodySize, rec.ReqContentLength)
+	}
+	if _, err := ReplayInspectRecord(dialBridge{}, host, rec.Id); err == nil {
+		t.Fatal("the partial request is replayed")
+	}
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"sync"
+
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego/logs"
+)
+
+// one server per port, started and closed together
+type RangeModeServer struct {
+	task      *file.Tunnel
+	newServer func(t *file.Tunnel) Service
+	servers   []Service
+	closed    bool
+	sync.Mutex
+}
+
+func NewRangeModeServer(task *file.Tunnel, newServer func(t *file.Tunnel) Service) *RangeModeServer {
+	return &RangeModeServer{task: task, newServer: newServer}
+}
+
+// all or nothing
+func (s *RangeModeServer) Start() error {
+	tunnels, err := s.task.GetRangeTunnels()
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	for _, t := range tunnels {
+		if svr := s.newServer(t); svr != nil {
+			s.servers = append(s.servers, svr)
+		}
+	}
+	servers := s.servers
+	s.Unlock()
+	errCh := make(chan error, len(servers))
+	for _, svr := range servers {
+		go func(svr Service) {
+			errCh <- svr.Start()
+		}(svr)
+	}
+	for range servers {
+		if err := <-errCh; err != nil {
+			s.Lock()
+			closed := s.closed
+			s.Unlock()
+			// the listeners return errors once the task is stopped
+			if closed {
+				return nil
+			}
+			logs.Warn("the port range tunnel %d start error %s, all the ports are closed", s.task.Id, err.Error())
+			s.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *RangeModeServer) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	s.closed = true
+	var err error
+	for _, svr := range s.servers {
+		if e := svr.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	s.servers = nil
+	return err
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/file"
+)
+
+// the listeners hold the ports until they are closed
+func listenPorts(t *testing.T, n int) []net.Listener {
+	var ls []net.Listener
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ls = append(ls, l)
+	}
+	return ls
+}
+
+func portOf(l net.Listener) string {
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
+func TestRangeModeServer(t *testing.T) {
+	initTestDb(t)
+	// the targets answer their own ports
+	targets := listenPorts(t, 2)
+	for _, l := range targets {
+		defer l.Close()
+		go func(l net.Listener) {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				io.WriteString(c, portOf(l))
+				c.Close()
+			}
+		}(l)
+	}
+	ports := listenPorts(t, 3)
+	for _, l := range ports {
+		l.Close()
+	}
+	newTask := func(ports string) *file.Tunnel {
+		return &file.Tunnel{Id: 1, Mode: "tcp", ServerIp: "127.0.0.1", Ports: ports, TargetAddr: "127.0.0.1",
+			Client: &file.Client{Id: 1, Cnf: &file.Config{}, Flow: &file.Flow{}}, Flow: &file.Flow{},
+			Target: &file.Target{TargetStr: portOf(targets[0]) + "," + portOf(targets[1])}}
+	}
+	newServer := func(t *file.Tunnel) Service {
+		return NewTunnelModeServer(ProcessTunnel, dialBridge{}, t)
+	}
+
+	task := newTask(portOf(ports[0]) + "," + portOf(ports[1]))
+	s := NewRangeModeServer(task, newServer)
+	done := make(chan error, 1)
+	go func() { done <- s.Start() }()
+	// every port is mapped to the target port at the same position
+	for i := range targets {
+		var b []byte
+		for j := 0; j < 50; j++ {
+			if c, err := net.Dial("tcp", "127.0.0.1:"+portOf(ports[i])); err == nil {
+				b, _ = io.ReadAll(c)
+				c.Close()
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if string(b) != portOf(targets[i]) {
+			t.Fatalf("the port %s is mapped to %q, want %s", portOf(ports[i]), b, portOf(targets[i]))
+		}
+	}
+	// the flow of the ports is added to the tunnel after the copy is done
+	for i := 0; i < 50; i++ {
+		task.Flow.RLock()
+		flow := task.Flow.ExportFlow
+		task.Flow.RUnlock()
+		if flow >= int64(len(portOf(targets[0]))+len(portOf(targets[1]))) {
+			break
+		} else if i == 49 {
+			t.Fatalf("the flow of the tunnel is %d", flow)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	s.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// all the ports are closed if one of them can not be listened
+	busy, err := net.Listen("tcp", "127.0.0.1:"+portOf(ports[2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	for i := 0; i < 20; i++ {
+		if err := NewRangeModeServer(newTask(portOf(ports[0])+","+portOf(ports[2])), newServer).Start(); err == nil {
+			t.Fatal("the port range is started with a busy port")
+		}
+		if c, err := net.Dial("tcp", "127.0.0.1:"+portOf(ports[0])); err == nil {
+			c.Close()
+			t.Fatal("the port is listened after the rollback")
+		}
+	}
+	if err := NewRangeModeServer(newTask(portOf(ports[0])), newServer).Start(); err == nil {
+		t.Fatal("the port range with different lengths is started")
+	}
+}
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/crypt"
+	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/proxyproto"
+	"github.com/astaxie/beego/logs"
+)
+
+var SniReadTimeout = 10 * time.Second
+
+var (
+	sniListeners = make(map[int]*sniListener)
+	sniLock      sync.RWMutex
+)
+
+// shared by the sni tunnels on one port
+type sniListener struct {
+	port     int
+	listener net.Listener
+	servers  map[int]*SniModeServer
+}
+
+// passes the tls through, the target is picked by the sni and the alpn of the client hello
+type SniModeServer struct {
+	BaseServer
+	port int // the task port may change before Close
+}
+
+func NewSniModeServer(bridge NetBridge, task *file.Tunnel) *SniModeServer {
+	s := new(SniModeServer)
+	s.bridge = bridge
+	s.task = task
+	return s
+}
+
+// the first tunnel of the port listens
+func (s *SniModeServer) Start() error {
+	sniLock.Lock()
+	defer sniLock.Unlock()
+	s.port = s.task.Port
+	l, ok := sniListeners[s.port]
+	if !ok {
+		listener, err := net.Listen("tcp", s.task.ServerIp+":"+strconv.Itoa(s.port))
+		if err != nil {
+			return err
+		}
+		l = &sniListener{port: s.port, listener: proxyproto.NewListener(listener), servers: make(map[int]*SniModeServer)}
+		sniListeners[s.port] = l
+		go conn.Accept(l.listener, l.handle)
+	}
+	l.servers[s.task.Id] = s
+	return nil
+}
+
+// the last tunnel of the port closes the listener
+func (s *SniModeServer) Close() error {
+	sniLock.Lock()
+	defer sniLock.Unlock()
+	l, ok := sniListeners[s.port]
+	if !ok {
+		return nil
+	}
+	delete(l.servers, s.task.Id)
+	if len(l.servers) == 0 {
+		delete(sniListeners, s.port)
+		return l.listener.Close()
+	}
+	return nil
+}
+
+func (l *sniListener) handle(c net.Conn) {
+	hello, rb, err := readClientHello(c)
+	if err != nil {
+		logs.Trace("read the client hello from %s error %s", c.RemoteAddr(), err.Error())
+		c.Close()
+		return
+	}
+	s := l.route(hello.GetServerName(), hello.GetAlpnProtocols())
+	if s == nil {
+		logs.Notice("no tunnel of the port %d matches the server name %s, remote address %s", l.port, hello.GetServerName(), c.RemoteAddr())
+		c.Close()
+		return
+	}
+	if err := s.CheckFlowAndConnNum(s.task.Client); err != nil {
+		logs.Warn("client id %d, task id %d, error %s, when sni connection", s.task.Client.Id, s.task.Id, err.Error())
+		c.Close()
+		return
+	}
+	defer s.task.Client.AddConn()
+	targetAddr, err := s.task.Target.GetRandomTarget()
+	if err != nil {
+		logs.Warn("sni port %d, client id %d, task id %d connect error %s", s.task.Port, s.task.Client.Id, s.task.Id, err.Error())
+		c.Close()
+		return
+	}
+	logs.Trace("new sni connection, server name %s, local port %d, client %d, remote address %s", hello.GetServerName(), s.task.Port, s.task.Client.Id, c.RemoteAddr())
+	s.DealClient(conn.NewConn(c), s.task.Client, targetAddr, rb, common.CONN_TCP, nil, file.Flows{s.task.Flow}, s.task.Target.LocalProxy, s.task, conn.LinkProxyProtocol(s.task.ProxyProtocol))
+}
+
+// the most specific server name wins, then the one with the alpn
+func (l *sniListener) route(serverName string, alpn []string) *SniModeServer {
+	serverName = strings.ToLower(serverName)
+	sniLock.RLock()
+	defer sniLock.RUnlock()
+	var best *SniModeServer
+	var bestScore int
+	for _, s := range l.servers {
+		score := matchServerName(s.task.GetServerNames(), serverName) * 2
+		if score == 0 {
+			continue
+		}
+		if taskAlpn := s.task.GetAlpn(); len(taskAlpn) > 0 {
+			if !matchAlpn(taskAlpn, alpn) {
+				continue
+			}
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = s, score
+		}
+	}
+	return best
+}
+
+// 0 for no match, exact > wildcard > *
+func matchServerName(names []string, serverName string) (score int) {
+	for _, v := range names {
+		switch {
+		case v == serverName && serverName != "":
+			return 1 << 16
+		case v == "*":
+			if score < 1 {
+				score = 1
+			}
+		case strings.HasPrefix(v, "*.") && strings.HasSuffix(serverName, v[1:]):
+			if len(v) > score {
+				score = len(v)
+			}
+		}
+	}
+	return
+}
+
+func matchAlpn(taskAlpn, alpn []string) bool {
+	for _, v := range alpn {
+		if common.InStrArr(taskAlpn, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// the bytes read are returned to be replayed to the target
+func readClientHello(c net.Conn) (*crypt.ClientHelloMsg, []byte, error) {
+	c.SetReadDeadline(time.Now().Add(SniReadTimeout))
+	defer c.SetReadDeadline(time.Time{})
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(c, header); err != nil {
+		return nil, nil, err
+	}
+	// handshake
+	if header[0] != 0x16 {
+		return nil, nil, errors.New("not a tls handshake")
+	}
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	if length > 1<<14+2048 {
+		return nil, nil, errors.New("the tls record is too long")
+	}
+	rb := make([]byte, 5+length)
+	copy(rb, header)
+	if _, err := io.ReadFull(c, rb[5:]); err != nil {
+		return nil, nil, err
+	}
+	hello := new(crypt.ClientHelloMsg)
+	if !hello.Unmarshal(rb[5:]) {
+		return nil, nil, errors.New("invalid client hello")
+	}
+	return hello, rb, nil
+}
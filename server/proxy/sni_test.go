@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"ehang.io/nps/lib/file"
+)
+
+func TestSniRoute(t *testing.T) {
+	l := &sniListener{servers: make(map[int]*SniModeServer)}
+	for id, v := range map[int][2]string{
+		1: {"*", ""},
+		2: {"*.test", ""},
+		3: {"*.a.test", ""},
+		4: {"b.a.test, c.test", ""},
+		5: {"b.a.test", "h2"},
+	} {
+		l.servers[id] = &SniModeServer{BaseServer: BaseServer{task: &file.Tunnel{Id: id, ServerName: v[0], Alpn: v[1]}}}
+	}
+	tests := []struct {
+		serverName string
+		alpn       []string
+		want       int
+	}{
+		{"other.com", nil, 1},
+		{"", nil, 1},
+		{"x.test", nil, 2},
+		{"x.a.test", nil, 3},
+		{"C.TEST", nil, 4},
+		{"b.a.test", []string{"http/1.1"}, 4},
+		{"b.a.test", []string{"h2", "http/1.1"}, 5},
+	}
+	for _, v := range tests {
+		s := l.route(v.serverName, v.alpn)
+		if s == nil || s.task.Id != v.want {
+			t.Errorf("the server name %s with %v is routed to %v, want %d", v.serverName, v.alpn, s, v.want)
+		}
+	}
+	delete(l.servers, 1)
+	if s := l.route("other.com", nil); s != nil {
+		t.Errorf("the unmatched server name is routed to %d", s.task.Id)
+	}
+}
+
+func TestSniModeServer(t *testing.T) {
+	initTestDb(t)
+	var targets []*httptest.Server
+	for _, name := range []string{"a", "b"} {
+		name := name
+		s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+		defer s.Close()
+		targets = append(targets, s)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	client := &file.Client{Id: 1, Cnf: &file.Config{}, Flow: &file.Flow{}}
+	var servers []*SniModeServer
+	for i, name := range []string{"a.test", "*.b.test"} {
+		task := &file.Tunnel{Id: i + 1, Mode: "sni", Port: port, ServerIp: "127.0.0.1", ServerName: name, Client: client, Flow: &file.Flow{},
+			Target: &file.Target{TargetStr: targets[i].Listener.Addr().String()}}
+		s := NewSniModeServer(dialBridge{}, task)
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, s)
+	}
+
+	get := func(serverName string) (string, error) {
+		tr := &http.Transport{TLSClientConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true}}
+		defer tr.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: tr}).Get("https://" + l.Addr().String() + "/")
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		return string(b), err
+	}
+	for serverName, want := range map[string]string{"a.test": "a", "x.b.test": "b"} {
+		if got, err := get(serverName); err != nil || got != want {
+			t.Fatalf("the server name %s is routed to %q, error %v", serverName, got, err)
+		}
+	}
+	if _, err := get("c.test"); err == nil {
+		t.Fatal("the unmatched server name is connected")
+	}
+
+	// the port is listened until the last tunnel is closed
+	servers[0].Close()
+	if got, err := get("x.b.test"); err != nil || got != "b" {
+		t.Fatalf("the other tunnel of the port is closed, %q %v", got, err)
+	}
+	servers[1].Close()
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Fatal("the port is listened after all the tunnels are closed")
+	}
+}
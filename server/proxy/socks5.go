@@ -52,7 +52,7 @@ type Sock5ModeServer struct {
 }
 
 // req
-func (s *Sock5ModeServer) handleRequest(c net.Conn) {
+func (s *Sock5ModeServer) handleRequest(c net.Conn, flows file.Flows) {
 	/*
 		The SOCKS request is formed as follows:
 		+----+-----+-------+------+----------+----------+
@@ -73,11 +73,11 @@ func (s *Sock5ModeServer) handleRequest(c net.Conn) {
 
 	switch header[1] {
 	case connectMethod:
-		s.handleConnect(c)
+		s.handleConnect(c, flows)
 	case bindMethod:
 		s.handleBind(c)
 	case associateMethod:
-		s.handleUDP(c)
+		s.handleUDP(c, flows)
 	default:
 		s.sendReply(c, commandNotSupported)
 		c.Close()
@@ -106,7 +106,7 @@ func (s *Sock5ModeServer) sendReply(c net.Conn, rep uint8) {
 }
 
 // do conn
-func (s *Sock5ModeServer) doConnect(c net.Conn, command uint8) {
+func (s *Sock5ModeServer) doConnect(c net.Conn, command uint8, flows file.Flows) {
 	addrType := make([]byte, 1)
 	c.Read(addrType)
 	var host string
@@ -142,13 +142,13 @@ func (s *Sock5ModeServer) doConnect(c net.Conn, command uint8) {
 	}
 	s.DealClient(conn.NewConn(c), s.task.Client, addr, nil, ltype, func() {
 		s.sendReply(c, succeeded)
-	}, s.task.Flow, s.task.Target.LocalProxy, nil)
+	}, flows, s.task.Target.LocalProxy, nil, conn.LinkProxyProtocol(s.task.ProxyProtocol))
 	return
 }
 
 // conn
-func (s *Sock5ModeServer) handleConnect(c net.Conn) {
-	s.doConnect(c, connectMethod)
+func (s *Sock5ModeServer) handleConnect(c net.Conn, flows file.Flows) {
+	s.doConnect(c, connectMethod, flows)
 }
 
 // passive mode
@@ -173,8 +173,9 @@ func (s *Sock5ModeServer) sendUdpReply(writeConn net.Conn, c net.Conn, rep uint8
 
 }
 
-func (s *Sock5ModeServer) handleUDP(c net.Conn) {
+func (s *Sock5ModeServer) handleUDP(c net.Conn, flows file.Flows) {
 	defer c.Close()
+	flows = file.NewFlows(append(file.Flows{s.task.Client.Flow}, flows...)...)
 	addrType := make([]byte, 1)
 	c.Read(addrType)
 	var host string
@@ -200,7 +201,7 @@ func (s *Sock5ModeServer) handleUDP(c net.Conn) {
 	//读取端口
 	var port uint16
 	binary.Read(c, binary.BigEndian, &port)
-	logs.Warn(host, string(port))
+	logs.Warn(host, strconv.Itoa(int(port)))
 	replyAddr, err := net.ResolveUDPAddr("udp", s.task.ServerIp+":0")
 	if err != nil {
 		logs.Error("build local reply addr error", err)
@@ -216,7 +217,7 @@ func (s *Sock5ModeServer) handleUDP(c net.Conn) {
 	s.sendUdpReply(c, reply, succeeded, common.GetServerIpByClientIp(c.RemoteAddr().(*net.TCPAddr).IP))
 	defer reply.Close()
 	// new a tunnel to client
-	link := conn.NewLink("udp5", "", s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, c.RemoteAddr().String(), false)
+	link := conn.NewLink("udp5", "", s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, c.RemoteAddr().String(), false, conn.LinkProxyProtocol(s.task.ProxyProtocol))
 	target, err := s.bridge.SendLinkInfo(s.task.Client.Id, link, s.task)
 	if err != nil {
 		logs.Warn("get connection from client id %d  error %s", s.task.Client.Id, err.Error())
@@ -243,6 +244,7 @@ func (s *Sock5ModeServer) handleUDP(c net.Conn) {
 				logs.Error("write data to client error", err.Error())
 				return
 			}
+			flows.AddUdp(int64(n), 0)
 		}
 	}()
 
@@ -265,6 +267,7 @@ func (s *Sock5ModeServer) handleUDP(c net.Conn) {
 				logs.Warn("write data to user ", err.Error())
 				return
 			}
+			flows.AddUdp(0, int64(l))
 		}
 	}()
 
@@ -302,42 +305,47 @@ func (s *Sock5ModeServer) handleConn(c net.Conn) {
 		c.Close()
 		return
 	}
+	flows := file.Flows{s.task.Flow}
 	if (s.task.Client.Cnf.U != "" && s.task.Client.Cnf.P != "") || (s.task.MultiAccount != nil && len(s.task.MultiAccount.AccountMap) > 0) {
 		buf[1] = UserPassAuth
 		c.Write(buf)
-		if err := s.Auth(c); err != nil {
+		user, err := s.Auth(c)
+		if err != nil {
 			c.Close()
 			logs.Warn("Validation failed:", err)
 			return
 		}
+		if s.task.MultiAccount != nil {
+			flows = append(flows, s.task.MultiAccount.GetFlow(user))
+		}
 	} else {
 		buf[1] = 0
 		c.Write(buf)
 	}
-	s.handleRequest(c)
+	s.handleRequest(c, flows)
 }
 
-// socks5 auth
-func (s *Sock5ModeServer) Auth(c net.Conn) error {
+// socks5 auth, returns the user
+func (s *Sock5ModeServer) Auth(c net.Conn) (string, error) {
 	header := []byte{0, 0}
 	if _, err := io.ReadAtLeast(c, header, 2); err != nil {
-		return err
+		return "", err
 	}
 	if header[0] != userAuthVersion {
-		return errors.New("验证方式不被支持")
+		return "", errors.New("验证方式不被支持")
 	}
 	userLen := int(header[1])
 	user := make([]byte, userLen)
 	if _, err := io.ReadAtLeast(c, user, userLen); err != nil {
-		return err
+		return "", err
 	}
 	if _, err := c.Read(header[:1]); err != nil {
-		return errors.New("密码长度获取错误")
+		return "", errors.New("密码长度获取错误")
 	}
 	passLen := int(header[0])
 	pass := make([]byte, passLen)
 	if _, err := io.ReadAtLeast(c, pass, passLen); err != nil {
-		return err
+		return "", err
 	}
 
 	var U, P string
@@ -345,12 +353,12 @@ func (s *Sock5ModeServer) Auth(c net.Conn) error {
 		// enable multi user auth
 		U = string(user)
 		if len(U) == 0 {
-			return errors.New("验证不通过")
+			return "", errors.New("验证不通过")
 		}
 		var ok bool
 		P, ok = s.task.MultiAccount.AccountMap[U]
 		if !ok {
-			return errors.New("验证不通过")
+			return "", errors.New("验证不通过")
 		}
 	} else {
 		U = s.task.Client.Cnf.U
@@ -359,14 +367,14 @@ func (s *Sock5ModeServer) Auth(c net.Conn) error {
 
 	if string(user) == U && string(pass) == P {
 		if _, err := c.Write([]byte{userAuthVersion, authSuccess}); err != nil {
-			return err
+			return "", err
 		}
-		return nil
+		return U, nil
 	} else {
 		if _, err := c.Write([]byte{userAuthVersion, authFailure}); err != nil {
-			return err
+			return "", err
 		}
-		return errors.New("验证不通过")
+		return "", errors.New("验证不通过")
 	}
 }
 
@@ -11,6 +11,7 @@ import (
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/conn"
 	"ehang.io/nps/lib/file"
+	"ehang.io/nps/lib/proxyproto"
 	"ehang.io/nps/server/connection"
 	"github.com/astaxie/beego"
 	"github.com/astaxie/beego/logs"
@@ -20,6 +21,7 @@ type TunnelModeServer struct {
 	BaseServer
 	process  process
 	listener net.Listener
+	closed   bool
 }
 
 // tcp|http|host
@@ -33,7 +35,20 @@ func NewTunnelModeServer(process process, bridge NetBridge, task *file.Tunnel) *
 
 // 开始
 func (s *TunnelModeServer) Start() error {
-	return conn.NewTcpListenerAndProcess(s.task.ServerIp+":"+strconv.Itoa(s.task.Port), func(c net.Conn) {
+	l, err := net.Listen("tcp", s.task.ServerIp+":"+strconv.Itoa(s.task.Port))
+	if err != nil {
+		return err
+	}
+	// closed while listening, e.g. by the rollback of a port range
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		l.Close()
+		return errors.New("the server is closed")
+	}
+	s.listener = proxyproto.NewListener(l)
+	s.Unlock()
+	conn.Accept(s.listener, func(c net.Conn) {
 		if err := s.CheckFlowAndConnNum(s.task.Client); err != nil {
 			logs.Warn("client id %d, task id %d,error %s, when tcp connection", s.task.Client.Id, s.task.Id, err.Error())
 			c.Close()
@@ -42,11 +57,18 @@ func (s *TunnelModeServer) Start() error {
 		logs.Trace("new tcp connection,local port %d,client %d,remote address %s", s.task.Port, s.task.Client.Id, c.RemoteAddr())
 		s.process(conn.NewConn(c), s)
 		s.task.Client.AddConn()
-	}, &s.listener)
+	})
+	return nil
 }
 
 // close
 func (s *TunnelModeServer) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	s.closed = true
+	if s.listener == nil {
+		return nil
+	}
 	return s.listener.Close()
 }
 
@@ -104,7 +126,7 @@ func ProcessTunnel(c *conn.Conn, s *TunnelModeServer) error {
 		return err
 	}
 
-	return s.DealClient(c, s.task.Client, targetAddr, nil, common.CONN_TCP, nil, s.task.Client.Flow, s.task.Target.LocalProxy, s.task)
+	return s.DealClient(c, s.task.Client, targetAddr, nil, common.CONN_TCP, nil, file.Flows{s.task.Flow}, s.task.Target.LocalProxy, s.task, conn.LinkProxyProtocol(s.task.ProxyProtocol), linkTargetTls(s.task))
 }
 
 // http proxy
@@ -123,6 +145,6 @@ func ProcessHttp(c *conn.Conn, s *TunnelModeServer) error {
 	if err := s.auth(r, c, s.task.Client.Cnf.U, s.task.Client.Cnf.P); err != nil {
 		return err
 	}
-	return s.DealClient(c, s.task.Client, addr, rb, common.CONN_TCP, nil, s.task.Client.Flow, s.task.Target.LocalProxy, nil)
+	return s.DealClient(c, s.task.Client, addr, rb, common.CONN_TCP, nil, file.Flows{s.task.Flow}, s.task.Target.LocalProxy, nil, conn.LinkProxyProtocol(s.task.ProxyProtocol))
 
 }
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"path/filepath"
+	"time"
+
+	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/crypt"
+	"ehang.io/nps/lib/file"
+	"github.com/astaxie/beego"
+	"github.com/astaxie/beego/logs"
+)
+
+var TlsHandshakeTimeout = 10 * time.Second
+
+// nps terminates the tls and sends the plaintext to the target through the client
+type TlsModeServer struct {
+	*TunnelModeServer
+}
+
+func NewTlsModeServer(bridge NetBridge, task *file.Tunnel) *TlsModeServer {
+	return &TlsModeServer{TunnelModeServer: NewTunnelModeServer(nil, bridge, task)}
+}
+
+func (s *TlsModeServer) Start() error {
+	config, err := getTunnelTlsConfig(s.task)
+	if err != nil {
+		return err
+	}
+	s.process = func(c *conn.Conn, s *TunnelModeServer) error {
+		return processTls(c, s, config)
+	}
+	return s.TunnelModeServer.Start()
+}
+
+func processTls(c *conn.Conn, s *TunnelModeServer, config *tls.Config) error {
+	tlsConn := tls.Server(c.Conn, config)
+	tlsConn.SetDeadline(time.Now().Add(TlsHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		logs.Trace("tls handshake with %s error %s, task id %d", c.RemoteAddr(), err.Error(), s.task.Id)
+		tlsConn.Close()
+		return err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return ProcessTunnel(conn.NewConn(tlsConn), s)
+}
+
+func getTunnelTlsConfig(t *file.Tunnel) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if t.CertFile != "" && t.KeyFile != "" {
+		if cert, err = tls.X509KeyPair([]byte(t.CertFile), []byte(t.KeyFile)); err != nil {
+			return nil, err
+		}
+	} else {
+		cert = getDefaultCert()
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if t.ClientCa != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(t.ClientCa)) {
+			return nil, errors.New("the client ca is invalid")
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// https_default_cert_file, or a generated one if it can not be loaded
+func getDefaultCert() tls.Certificate {
+	certFile, keyFile := beego.AppConfig.String("https_default_cert_file"), beego.AppConfig.String("https_default_key_file")
+	if certFile != "" && keyFile != "" {
+		if !filepath.IsAbs(certFile) {
+			certFile = filepath.Join(common.GetRunPath(), certFile)
+		}
+		if !filepath.IsAbs(keyFile) {
+			keyFile = filepath.Join(common.GetRunPath(), keyFile)
+		}
+		if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+			return cert
+		} else {
+			logs.Warn("load the default certificate error %s, the generated certificate is used", err.Error())
+		}
+	}
+	return crypt.GetCert()
+}
+
+func linkTargetTls(t *file.Tunnel) conn.Option {
+	if !t.TargetTls {
+		return conn.LinkTargetTls(nil)
+	}
+	return conn.LinkTargetTls(&conn.TargetTls{
+		ServerName: t.TargetTlsServerName,
+		Insecure:   t.TargetTlsInsecure,
+		Ca:         t.TargetTlsCa,
+	})
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/file"
+)
+
+// start on a free port and wait until it accepts
+func startTestServer(t *testing.T, task *file.Tunnel, start func() error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	task.ServerIp, task.Port = "127.0.0.1", l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	go start()
+	for i := 0; i < 50; i++ {
+		if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+			c.Close()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("the server is not started")
+}
+
+func TestTlsModeServer(t *testing.T) {
+	initTestDb(t)
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	certPem, keyPem := newTestCert(t)
+	client := &file.Client{Id: 1, Cnf: &file.Config{}, Flow: &file.Flow{}}
+	task := &file.Tunnel{Id: 1, Mode: "tcpTls", CertFile: string(certPem), KeyFile: string(keyPem), Client: client, Flow: &file.Flow{},
+		Target: &file.Target{TargetStr: target.Addr().String()}}
+	s := NewTlsModeServer(dialBridge{}, task)
+	startTestServer(t, task, s.Start)
+	defer s.Close()
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the plaintext is sent to the target
+	echo := func(config *tls.Config) error {
+		c, err := tls.Dial("tcp", task.ServerIp+":"+strconv.Itoa(task.Port), config)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		if !bytes.Equal(c.ConnectionState().PeerCertificates[0].Raw, cert.Certificate[0]) {
+			t.Fatal("the certificate of the tunnel is not used")
+		}
+		if _, err := c.Write([]byte("hello")); err != nil {
+			return err
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return err
+		}
+		if string(buf) != "hello" {
+			t.Fatalf("the echo is %q", buf)
+		}
+		return nil
+	}
+	if err := echo(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the certificate of the visitor is required if the ca is set
+	s.Close()
+	task.ClientCa = string(certPem)
+	s = NewTlsModeServer(dialBridge{}, task)
+	startTestServer(t, task, s.Start)
+	defer s.Close()
+	if err := echo(&tls.Config{InsecureSkipVerify: true}); err == nil {
+		t.Fatal("the visitor without the certificate is connected")
+	}
+	if err := echo(&tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{cert}}); err != nil {
+		t.Fatal(err)
+	}
+
+	task.ClientCa = "invalid"
+	if _, err := getTunnelTlsConfig(task); err == nil {
+		t.Fatal("the invalid ca is used")
+	}
+}
@@ -10,13 +10,14 @@ import (
 
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/file"
 )
 
 func HandleTrans(c *conn.Conn, s *TunnelModeServer) error {
 	if addr, err := getAddress(c.Conn); err != nil {
 		return err
 	} else {
-		return s.DealClient(c, s.task.Client, addr, nil, common.CONN_TCP, nil, s.task.Flow, s.task.Target.LocalProxy, nil)
+		return s.DealClient(c, s.task.Client, addr, nil, common.CONN_TCP, nil, file.Flows{s.task.Flow}, s.task.Target.LocalProxy, nil, conn.LinkProxyProtocol(s.task.ProxyProtocol))
 	}
 }
 
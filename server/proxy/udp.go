@@ -1,126 +1,306 @@
 package proxy
 
 import (
+	"errors"
 	"io"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"ehang.io/nps/bridge"
 	"ehang.io/nps/lib/common"
 	"ehang.io/nps/lib/conn"
 	"ehang.io/nps/lib/file"
 	"github.com/astaxie/beego/logs"
 )
 
+var (
+	UdpIdleTimeout = 60 * time.Second
+	// per tunnel, 0 means unlimited
+	UdpMaxSessions = 0
+	// packets per session waiting for the client, the rest are dropped
+	UdpQueueSize = 64
+)
+
 type UdpModeServer struct {
 	BaseServer
-	addrMap  sync.Map
-	listener *net.UDPConn
+	listener    *net.UDPConn
+	sessions    map[string]*udpSession
+	lock        sync.Mutex
+	done        chan struct{}
+	closeOnce   sync.Once
+	IdleTimeout time.Duration
+	MaxSessions int
+	QueueSize   int
 }
 
-func NewUdpModeServer(bridge *bridge.Bridge, task *file.Tunnel) *UdpModeServer {
+// one source address, one connection through the client
+type udpSession struct {
+	addr      *net.UDPAddr
+	target    io.ReadWriteCloser
+	queue     chan []byte
+	active    int64 // unix nano of the last packet
+	closed    chan struct{}
+	closeOnce sync.Once
+	sync.Mutex
+}
+
+func NewUdpModeServer(bridge NetBridge, task *file.Tunnel) *UdpModeServer {
 	s := new(UdpModeServer)
 	s.bridge = bridge
 	s.task = task
+	s.sessions = make(map[string]*udpSession)
+	s.done = make(chan struct{})
+	s.IdleTimeout = UdpIdleTimeout
+	s.MaxSessions = UdpMaxSessions
+	s.QueueSize = UdpQueueSize
 	return s
 }
 
 // 开始
 func (s *UdpModeServer) Start() error {
-	var err error
 	if s.task.ServerIp == "" {
 		s.task.ServerIp = "0.0.0.0"
 	}
-	s.listener, err = net.ListenUDP("udp", &net.UDPAddr{net.ParseIP(s.task.ServerIp), s.task.Port, ""})
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(s.task.ServerIp), Port: s.task.Port})
 	if err != nil {
 		return err
 	}
+	// closed while listening, e.g. by the rollback of a port range
+	s.lock.Lock()
+	select {
+	case <-s.done:
+		s.lock.Unlock()
+		listener.Close()
+		return errors.New("the server is closed")
+	default:
+	}
+	s.listener = listener
+	s.lock.Unlock()
+	go s.checkIdle()
 	for {
 		buf := common.BufPoolUdp.Get().([]byte)
 		n, addr, err := s.listener.ReadFromUDP(buf)
 		if err != nil {
+			common.BufPoolUdp.Put(buf)
 			if strings.Contains(err.Error(), "use of closed network connection") {
 				break
 			}
 			continue
 		}
-
-		// 判断访问地址是否在全局黑名单内
-		if IsGlobalBlackIp(addr.String()) {
-			break
-		}
-
-		// 判断访问地址是否在黑名单内
-		if common.IsBlackIp(addr.String(), s.task.Client.VerifyKey, s.task.Client.BlackIpList) {
-			break
+		// drop the packet only, the other sources go on
+		if IsGlobalBlackIp(addr.String()) || common.IsBlackIp(addr.String(), s.task.Client.VerifyKey, s.task.Client.BlackIpList) {
+			common.BufPoolUdp.Put(buf)
+			continue
 		}
-
-		logs.Trace("New udp connection,client %d,remote address %s", s.task.Client.Id, addr)
-		go s.process(addr, buf[:n])
+		s.dispatch(addr, buf[:n])
 	}
 	return nil
 }
 
-func (s *UdpModeServer) process(addr *net.UDPAddr, data []byte) {
-	if v, ok := s.addrMap.Load(addr.String()); ok {
-		clientConn, ok := v.(io.ReadWriteCloser)
-		if ok {
-			_, err := clientConn.Write(data)
-			if err != nil {
-				logs.Warn(err)
-				return
-			}
-			s.task.Client.Flow.Add(int64(len(data)), int64(len(data)))
+func (s *UdpModeServer) dispatch(addr *net.UDPAddr, data []byte) {
+	s.lock.Lock()
+	session, ok := s.sessions[addr.String()]
+	if !ok {
+		if s.MaxSessions > 0 && len(s.sessions) >= s.MaxSessions {
+			s.lock.Unlock()
+			logs.Trace("the udp sessions of the task %d exceed the limit %d, remote address %s", s.task.Id, s.MaxSessions, addr)
+			common.BufPoolUdp.Put(data[:cap(data)])
+			return
 		}
-	} else {
 		if err := s.CheckFlowAndConnNum(s.task.Client); err != nil {
+			s.lock.Unlock()
 			logs.Warn("client id %d, task id %d,error %s, when udp connection", s.task.Client.Id, s.task.Id, err.Error())
+			common.BufPoolUdp.Put(data[:cap(data)])
 			return
 		}
-		defer s.task.Client.AddConn()
-		link := conn.NewLink(common.CONN_UDP, s.task.Target.TargetStr, s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, addr.String(), s.task.Target.LocalProxy)
-		if clientConn, err := s.bridge.SendLinkInfo(s.task.Client.Id, link, s.task); err != nil {
-			return
-		} else {
-			target := conn.GetConn(clientConn, s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, nil, true)
-			s.addrMap.Store(addr.String(), target)
-			defer target.Close()
+		session = &udpSession{addr: addr, queue: make(chan []byte, s.QueueSize), closed: make(chan struct{})}
+		session.touch()
+		s.sessions[addr.String()] = session
+		logs.Trace("New udp connection,client %d,remote address %s", s.task.Client.Id, addr)
+		go s.process(session)
+	}
+	s.lock.Unlock()
+	if !session.enqueue(data) {
+		logs.Trace("the udp session %s is closed or its queue is full, the packet is dropped", addr)
+		common.BufPoolUdp.Put(data[:cap(data)])
+	}
+}
 
+func (s *UdpModeServer) process(session *udpSession) {
+	defer s.closeSession(session)
+	targetAddr, err := s.task.Target.GetRandomTarget()
+	if err != nil {
+		logs.Warn("udp port %d, client id %d, task id %d connect error %s", s.task.Port, s.task.Client.Id, s.task.Id, err.Error())
+		return
+	}
+	link := conn.NewLink(common.CONN_UDP, targetAddr, s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, session.addr.String(), s.task.Target.LocalProxy, conn.LinkProxyProtocol(s.task.ProxyProtocol))
+	clientConn, err := s.bridge.SendLinkInfo(s.task.Client.Id, link, s.task)
+	if err != nil {
+		logs.Warn("get connection from client id %d  error %s", s.task.Client.Id, err.Error())
+		return
+	}
+	target, err := conn.GetConn(clientConn, s.task.Client.Cnf.Crypt, s.task.Client.Cnf.Compress, s.task.Client.Rate, true)
+	if err != nil {
+		logs.Warn(err)
+		return
+	}
+	if !session.setTarget(target) {
+		target.Close()
+		return
+	}
+	go s.readTarget(session, target)
+	for {
+		select {
+		case data := <-session.queue:
 			_, err := target.Write(data)
+			common.BufPoolUdp.Put(data[:cap(data)])
 			if err != nil {
 				logs.Warn(err)
 				return
 			}
+			session.touch()
+			s.flows().AddUdp(int64(len(data)), 0)
+		case <-session.closed:
+			return
+		}
+	}
+}
 
-			buf := common.BufPoolUdp.Get().([]byte)
-			defer common.BufPoolUdp.Put(buf)
-
-			s.task.Client.Flow.Add(int64(len(data)), int64(len(data)))
-			for {
-				clientConn.SetReadDeadline(time.Now().Add(time.Duration(60) * time.Second))
-				if n, err := target.Read(buf); err != nil {
-					s.addrMap.Delete(addr.String())
-					logs.Warn(err)
-					return
-				} else {
-					_, err := s.listener.WriteTo(buf[:n], addr)
-					if err != nil {
-						logs.Warn(err)
-						return
-					}
-					s.task.Client.Flow.Add(int64(n), int64(n))
+func (s *UdpModeServer) readTarget(session *udpSession, target io.ReadWriteCloser) {
+	defer s.closeSession(session)
+	buf := common.BufPoolUdp.Get().([]byte)
+	defer common.BufPoolUdp.Put(buf)
+	for {
+		n, err := target.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := s.listener.WriteToUDP(buf[:n], session.addr); err != nil {
+			logs.Warn(err)
+			return
+		}
+		session.touch()
+		s.flows().AddUdp(0, int64(n))
+	}
+}
+
+func (s *UdpModeServer) checkIdle() {
+	interval := s.IdleTimeout / 2
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			deadline := time.Now().Add(-s.IdleTimeout).UnixNano()
+			s.lock.Lock()
+			var idle []*udpSession
+			for _, session := range s.sessions {
+				if atomic.LoadInt64(&session.active) < deadline {
+					idle = append(idle, session)
 				}
-				//if err := s.CheckFlowAndConnNum(s.task.Client); err != nil {
-				//	logs.Warn("client id %d, task id %d,error %s, when udp connection", s.task.Client.Id, s.task.Id, err.Error())
-				//	return
-				//}
 			}
+			s.lock.Unlock()
+			for _, session := range idle {
+				logs.Trace("the udp session %s of the task %d is idle, close it", session.addr, s.task.Id)
+				s.closeSession(session)
+			}
+		case <-s.done:
+			return
 		}
 	}
 }
 
+func (s *UdpModeServer) closeSession(session *udpSession) {
+	session.closeOnce.Do(func() {
+		s.lock.Lock()
+		if s.sessions[session.addr.String()] == session {
+			delete(s.sessions, session.addr.String())
+		}
+		s.lock.Unlock()
+		session.Lock()
+		close(session.closed)
+		if session.target != nil {
+			session.target.Close()
+		}
+		session.Unlock()
+		// drain the queue
+		for {
+			select {
+			case data := <-session.queue:
+				common.BufPoolUdp.Put(data[:cap(data)])
+			default:
+				s.task.Client.AddConn()
+				return
+			}
+		}
+	})
+}
+
+func (s *UdpModeServer) flows() file.Flows {
+	return file.NewFlows(s.task.Flow, s.task.Client.Flow)
+}
+
+func (s *UdpModeServer) SessionNum() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.sessions)
+}
+
 func (s *UdpModeServer) Close() error {
-	return s.listener.Close()
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	s.lock.Lock()
+	sessions := make([]*udpSession, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	listener := s.listener
+	s.lock.Unlock()
+	for _, session := range sessions {
+		s.closeSession(session)
+	}
+	if listener == nil {
+		return nil
+	}
+	return listener.Close()
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.active, time.Now().UnixNano())
+}
+
+// under the lock of close, so the queue is not filled after it is drained
+func (s *udpSession) enqueue(data []byte) bool {
+	s.Lock()
+	defer s.Unlock()
+	select {
+	case <-s.closed:
+		return false
+	default:
+	}
+	select {
+	case s.queue <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+// false if the session is closed before the target is connected
+func (s *udpSession) setTarget(target io.ReadWriteCloser) bool {
+	s.Lock()
+	defer s.Unlock()
+	select {
+	case <-s.closed:
+		return false
+	default:
+		s.target = target
+		return true
+	}
 }
@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/file"
+)
+
+// every packet is answered with ack: and the packet, the connection is recorded when it is closed
+type udpEchoBridge struct {
+	sync.Mutex
+	hosts  []string
+	closed chan string
+}
+
+func newUdpEchoBridge() *udpEchoBridge {
+	return &udpEchoBridge{closed: make(chan string, 10)}
+}
+
+func (b *udpEchoBridge) SendLinkInfo(clientId int, link *conn.Link, t *file.Tunnel) (net.Conn, error) {
+	b.Lock()
+	b.hosts = append(b.hosts, link.Host)
+	b.Unlock()
+	server, client := net.Pipe()
+	go func() {
+		defer func() { b.closed <- link.Host }()
+		defer client.Close()
+		buf := make([]byte, 2048)
+		for {
+			n, err := client.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err := client.Write(append([]byte("ack:"), buf[:n]...)); err != nil {
+				return
+			}
+		}
+	}()
+	return server, nil
+}
+
+func (b *udpEchoBridge) getHosts() []string {
+	b.Lock()
+	defer b.Unlock()
+	return append([]string{}, b.hosts...)
+}
+
+func newUdpTestServer(t *testing.T, bridge NetBridge, target string) (*UdpModeServer, *file.Client) {
+	initTestDb(t)
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.LocalAddr().(*net.UDPAddr).Port
+	l.Close()
+	client := file.NewClient("udp-test", true, true)
+	client.Id = 1
+	task := &file.Tunnel{Id: 1, Port: port, ServerIp: "127.0.0.1", Mode: "udp", Status: true, Client: client,
+		Flow: new(file.Flow), Target: &file.Target{TargetStr: target}}
+	s := NewUdpModeServer(bridge, task)
+	t.Cleanup(func() { s.Close() })
+	return s, client
+}
+
+func startUdpTestServer(t *testing.T, s *UdpModeServer) {
+	go s.Start()
+	time.Sleep(100 * time.Millisecond)
+}
+
+func dialUdpTestServer(t *testing.T, s *UdpModeServer) *net.UDPConn {
+	c, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: s.task.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// empty if there is no answer in time
+func udpExchange(t *testing.T, c *net.UDPConn, data string, timeout time.Duration) string {
+	if _, err := c.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	c.SetReadDeadline(time.Now().Add(timeout))
+	n, err := c.Read(buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[:n])
+}
+
+func TestUdpSessionFlow(t *testing.T) {
+	bridge := newUdpEchoBridge()
+	s, client := newUdpTestServer(t, bridge, "127.0.0.1:53")
+	startUdpTestServer(t, s)
+	c := dialUdpTestServer(t, s)
+	for i := 0; i < 3; i++ {
+		if got := udpExchange(t, c, "hello", time.Second); got != "ack:hello" {
+			t.Fatalf("the answer %d is %q", i, got)
+		}
+	}
+	if hosts := bridge.getHosts(); len(hosts) != 1 {
+		t.Fatalf("the packets of one source should use one session, got %d connections", len(hosts))
+	}
+	// the flow is added after the packet is sent
+	time.Sleep(100 * time.Millisecond)
+	client.Flow.RLock()
+	in, out := client.Flow.InletFlow, client.Flow.ExportFlow
+	client.Flow.RUnlock()
+	if in != 15 || out != 27 {
+		t.Fatalf("the flow of the client is in %d out %d, want in 15 out 27", in, out)
+	}
+	s.task.Flow.RLock()
+	in, out = s.task.Flow.InletFlow, s.task.Flow.ExportFlow
+	s.task.Flow.RUnlock()
+	if in != 15 || out != 27 {
+		t.Fatalf("the flow of the task is in %d out %d, want in 15 out 27", in, out)
+	}
+}
+
+func TestUdpBlackIp(t *testing.T) {
+	bridge := newUdpEchoBridge()
+	s, client := newUdpTestServer(t, bridge, "127.0.0.1:53")
+	client.BlackIpList = []string{"127.0.0.2"}
+	startUdpTestServer(t, s)
+	black, err := net.DialUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.2")}, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: s.task.Port})
+	if err != nil {
+		t.Skip("can not bind 127.0.0.2: ", err)
+	}
+	defer black.Close()
+	if got := udpExchange(t, black, "hello", 200*time.Millisecond); got != "" {
+		t.Fatalf("the black ip should not be answered, got %q", got)
+	}
+	if n := s.SessionNum(); n != 0 || len(bridge.getHosts()) != 0 {
+		t.Fatalf("the black ip should not create a session, sessions %d, connections %d", n, len(bridge.getHosts()))
+	}
+	// the tunnel is still running for the other sources after the packets of the black ip
+	c := dialUdpTestServer(t, s)
+	if got := udpExchange(t, c, "hello", time.Second); got != "ack:hello" {
+		t.Fatalf("the tunnel should keep running after the black ip, got %q", got)
+	}
+}
+
+func TestUdpIdleTimeout(t *testing.T) {
+	bridge := newUdpEchoBridge()
+	s, client := newUdpTestServer(t, bridge, "127.0.0.1:53")
+	s.IdleTimeout = 100 * time.Millisecond
+	startUdpTestServer(t, s)
+	c := dialUdpTestServer(t, s)
+	if got := udpExchange(t, c, "hello", time.Second); got != "ack:hello" {
+		t.Fatalf("the answer is %q", got)
+	}
+	select {
+	case <-bridge.closed:
+	case <-time.After(time.Second):
+		t.Fatal("the idle session is not closed")
+	}
+	if n := s.SessionNum(); n != 0 {
+		t.Fatalf("the idle session is not removed, sessions %d", n)
+	}
+	if n := atomic.LoadInt32(&client.NowConn); n != 0 {
+		t.Fatalf("the connection of the client is not released, now %d", n)
+	}
+	// a new session is created for the next packet
+	if got := udpExchange(t, c, "again", time.Second); got != "ack:again" {
+		t.Fatalf("the answer after the timeout is %q", got)
+	}
+	if hosts := bridge.getHosts(); len(hosts) != 2 {
+		t.Fatalf("want 2 connections after the timeout, got %d", len(hosts))
+	}
+}
+
+func TestUdpMaxSessions(t *testing.T) {
+	bridge := newUdpEchoBridge()
+	s, _ := newUdpTestServer(t, bridge, "127.0.0.1:53")
+	s.MaxSessions = 1
+	startUdpTestServer(t, s)
+	c1 := dialUdpTestServer(t, s)
+	c2 := dialUdpTestServer(t, s)
+	if got := udpExchange(t, c1, "one", time.Second); got != "ack:one" {
+		t.Fatalf("the answer of the first session is %q", got)
+	}
+	if got := udpExchange(t, c2, "two", 200*time.Millisecond); got != "" {
+		t.Fatalf("the session over the limit should not be answered, got %q", got)
+	}
+	if got := udpExchange(t, c1, "one", time.Second); got != "ack:one" {
+		t.Fatalf("the first session should not be affected, got %q", got)
+	}
+}
+
+func TestUdpLoadBalance(t *testing.T) {
+	bridge := newUdpEchoBridge()
+	s, _ := newUdpTestServer(t, bridge, "127.0.0.1:5301\n127.0.0.1:5302")
+	startUdpTestServer(t, s)
+	for i := 0; i < 4; i++ {
+		c := dialUdpTestServer(t, s)
+		if got := udpExchange(t, c, strconv.Itoa(i), time.Second); got != "ack:"+strconv.Itoa(i) {
+			t.Fatalf("the answer of the session %d is %q", i, got)
+		}
+	}
+	count := make(map[string]int)
+	for _, v := range bridge.getHosts() {
+		count[v]++
+	}
+	if count["127.0.0.1:5301"] != 2 || count["127.0.0.1:5302"] != 2 {
+		t.Fatalf("the sessions are not balanced, %v", count)
+	}
+}
+
+func TestUdpSessionEnqueue(t *testing.T) {
+	s, _ := newUdpTestServer(t, newUdpEchoBridge(), "127.0.0.1:53")
+	session := &udpSession{addr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}, queue: make(chan []byte, 1), closed: make(chan struct{})}
+	if !session.enqueue([]byte("a")) || session.enqueue([]byte("b")) {
+		t.Fatal("the packet over the queue size is enqueued")
+	}
+	s.closeSession(session)
+	// the packet dispatched after the close is not left in the queue
+	if session.enqueue([]byte("c")) || len(session.queue) != 0 {
+		t.Fatalf("the closed session has %d packets", len(session.queue))
+	}
+}
@@ -42,38 +42,46 @@ func (rp *HttpReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 		err        error
 	)
 	if host, err = file.GetDb().GetInfoByHost(req.Host, req); err != nil {
-		rw.WriteHeader(http.StatusNotFound)
-		rw.Write([]byte(req.Host + " not found"))
+		writeErrorPage(rw, nil, req, http.StatusNotFound)
 		return
 	}
-	if host.Client.Cnf.U != "" && host.Client.Cnf.P != "" && !common.CheckAuth(req, host.Client.Cnf.U, host.Client.Cnf.P) {
-		rw.WriteHeader(http.StatusUnauthorized)
-		rw.Write([]byte("Unauthorized"))
+	if resp := checkHostAuth(host, req, req.RemoteAddr); resp != nil {
+		writeHttpResponse(rw, resp)
 		return
 	}
 	if targetAddr, err = host.Target.GetRandomTarget(); err != nil {
-		rw.WriteHeader(http.StatusBadGateway)
-		rw.Write([]byte("502 Bad Gateway"))
+		writeErrorPage(rw, host, req, http.StatusBadGateway)
 		return
 	}
 	host.Client.CutConn()
 
-	req = req.WithContext(context.WithValue(req.Context(), "host", host))
-	req = req.WithContext(context.WithValue(req.Context(), "target", targetAddr))
-	req = req.WithContext(context.WithValue(req.Context(), "req", req))
+	req = withTarget(req, host, targetAddr)
+	if rec := newInspectRecord(host, req.RemoteAddr); rec != nil {
+		req = req.WithContext(context.WithValue(req.Context(), inspectRecordKey{}, rec))
+	}
 
 	rp.proxy.ServeHTTP(rw, req, host)
 
 	defer host.Client.AddConn()
 }
 
+// the transports read them from the context, shared with the replay of the inspection
+func withTarget(req *http.Request, host *file.Host, targetAddr string) *http.Request {
+	req = req.WithContext(context.WithValue(req.Context(), "host", host))
+	req = req.WithContext(context.WithValue(req.Context(), "target", targetAddr))
+	return req.WithContext(context.WithValue(req.Context(), "req", req))
+}
+
+// reads come from the target
 func (c *flowConn) Read(p []byte) (n int, err error) {
 	n, err = c.ReadWriteCloser.Read(p)
+	file.NewFlows(c.host.Flow, c.host.Client.Flow).AddTcp(0, int64(n))
 	return n, err
 }
 
 func (c *flowConn) Write(p []byte) (n int, err error) {
 	n, err = c.ReadWriteCloser.Write(p)
+	file.NewFlows(c.host.Flow, c.host.Client.Flow).AddTcp(int64(n), 0)
 	return n, err
 }
 
@@ -101,36 +109,21 @@ func NewHttpReverseProxy(s *httpServer) *HttpReverseProxy {
 		Director: func(r *http.Request) {
 			host := r.Context().Value("host").(*file.Host)
 			common.ChangeHostAndHeader(r, host.HostChange, host.HeaderChange, "")
+			r.URL.Scheme = "http"
+			if host.BackendProto == "h2" {
+				r.URL.Scheme = "https"
+			}
+			r.URL.Host = r.Context().Value("target").(string)
+			getInspectRecord(r).setRequest(r)
 		},
-		Transport: &http.Transport{
-			ResponseHeaderTimeout: rp.responseHeaderTimeout,
-			DisableKeepAlives:     true,
-			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				var (
-					host       *file.Host
-					target     net.Conn
-					err        error
-					connClient io.ReadWriteCloser
-					targetAddr string
-					lk         *conn.Link
-				)
-
-				r := ctx.Value("req").(*http.Request)
-				host = ctx.Value("host").(*file.Host)
-				targetAddr = ctx.Value("target").(string)
-
-				lk = conn.NewLink("http", targetAddr, host.Client.Cnf.Crypt, host.Client.Cnf.Compress, r.RemoteAddr, host.Target.LocalProxy)
-				if target, err = s.bridge.SendLinkInfo(host.Client.Id, lk, nil); err != nil {
-					logs.Notice("connect to target %s error %s", lk.Host, err)
-					return nil, NewHTTPError(http.StatusBadGateway, "Cannot connect to the server")
-				}
-				connClient = conn.GetConn(target, lk.Crypt, lk.Compress, host.Client.Rate, true)
-				return &flowConn{
-					ReadWriteCloser: connClient,
-					fakeAddr:        local,
-					host:            host,
-				}, nil
-			},
+		// grpc and the other streaming responses
+		FlushInterval: -1,
+		Transport:     newHostTransport(s.bridge, rp.responseHeaderTimeout),
+		ModifyResponse: func(resp *http.Response) error {
+			host := resp.Request.Context().Value("host").(*file.Host)
+			getInspectRecord(resp.Request).setResponse(resp)
+			compressResponse(host, resp.Request, resp)
+			return nil
 		},
 		ErrorHandler: func(rw http.ResponseWriter, req *http.Request, err error) {
 			logs.Warn("do http proxy request error: %v", err)
@@ -150,12 +143,14 @@ func NewHttpReverseProxy(s *httpServer) *HttpReverseProxy {
 		host = ctx.Value("host").(*file.Host)
 		targetAddr = ctx.Value("target").(string)
 
-		lk = conn.NewLink("tcp", targetAddr, host.Client.Cnf.Crypt, host.Client.Cnf.Compress, r.RemoteAddr, host.Target.LocalProxy)
+		lk = conn.NewLink("tcp", targetAddr, host.Client.Cnf.Crypt, host.Client.Cnf.Compress, r.RemoteAddr, host.Target.LocalProxy, conn.LinkProxyProtocol(host.ProxyProtocol))
 		if target, err = s.bridge.SendLinkInfo(host.Client.Id, lk, nil); err != nil {
 			logs.Notice("connect to target %s error %s", lk.Host, err)
 			return nil, NewHTTPError(http.StatusBadGateway, "Cannot connect to the target")
 		}
-		connClient = conn.GetConn(target, lk.Crypt, lk.Compress, host.Client.Rate, true)
+		if connClient, err = conn.GetConn(target, lk.Crypt, lk.Compress, host.Client.Rate, true); err != nil {
+			return nil, err
+		}
 		return &flowConn{
 			ReadWriteCloser: connClient,
 			fakeAddr:        local,
@@ -201,23 +196,24 @@ func NewReverseProxy(orp *httputil.ReverseProxy) *ReverseProxy {
 }
 
 func (p *ReverseProxy) errHandler(rw http.ResponseWriter, r *http.Request, e error) {
-	if e == io.EOF {
-		rw.WriteHeader(521)
-		//rw.Write(getWaitingPageContent())
-	} else {
-		if httperr, ok := e.(*HTTPError); ok {
-			rw.WriteHeader(httperr.HTTPCode)
-		} else {
-			rw.WriteHeader(http.StatusNotFound)
-		}
-		rw.Write([]byte("error: " + e.Error()))
+	logs.Warn("do http proxy request error: %v", e)
+	getInspectRecord(r).save(e)
+	code := http.StatusBadGateway
+	if httperr, ok := e.(*HTTPError); ok {
+		code = httperr.HTTPCode
+	} else if neterr, ok := e.(net.Error); ok && neterr.Timeout() {
+		code = http.StatusGatewayTimeout
 	}
+	host, _ := r.Context().Value("host").(*file.Host)
+	writeErrorPage(rw, host, r, code)
 }
 
 func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request, host *file.Host) {
 	if IsWebsocketRequest(req) {
 		p.serveWebSocket(rw, req, host)
+		return
 	}
+	p.ReverseProxy.ServeHTTP(rw, req)
 }
 
 func (p *ReverseProxy) serveWebSocket(rw http.ResponseWriter, req *http.Request, host *file.Host) {
@@ -227,12 +223,14 @@ func (p *ReverseProxy) serveWebSocket(rw http.ResponseWriter, req *http.Request,
 	}
 	targetConn, err := p.WebSocketDialContext(req.Context(), "tcp", "")
 	if err != nil {
-		rw.WriteHeader(501)
+		p.errHandler(rw, req, err)
 		return
 	}
 	defer targetConn.Close()
 
 	p.Director(req)
+	// the frames of the websocket are not recorded
+	getInspectRecord(req).save(nil)
 
 	hijacker, ok := rw.(http.Hijacker)
 	if !ok {
@@ -253,18 +251,24 @@ func (p *ReverseProxy) serveWebSocket(rw http.ResponseWriter, req *http.Request,
 
 func Join(c1 io.ReadWriteCloser, c2 io.ReadWriteCloser, host *file.Host) (inCount int64, outCount int64) {
 	var wait sync.WaitGroup
-	pipe := func(to io.ReadWriteCloser, from io.ReadWriteCloser, count *int64) {
+	// c1 is the visitor, c2 the target
+	var flows file.Flows
+	if _, ok := c2.(*flowConn); !ok {
+		// otherwise flowConn counts them
+		flows = file.NewFlows(host.Flow, host.Client.Flow)
+	}
+	pipe := func(to io.ReadWriteCloser, from io.ReadWriteCloser, count *int64, in bool) {
 		defer to.Close()
 		defer from.Close()
 		defer wait.Done()
-		goroutine.CopyBuffer(to, from, host.Client.Flow, nil, "")
+		goroutine.CopyBuffer(to, from, flows, in, nil, "")
 		//*count, _ = io.Copy(to, from)
 	}
 
 	wait.Add(2)
 
-	go pipe(c1, c2, &inCount)
-	go pipe(c2, c1, &outCount)
+	go pipe(c1, c2, &outCount, false)
+	go pipe(c2, c1, &inCount, true)
 	wait.Wait()
 	return
 }
@@ -3,6 +3,7 @@ package server
 import (
 	"ehang.io/nps/lib/version"
 	"errors"
+	"fmt"
 	"math"
 	"os"
 	"sort"
@@ -12,7 +13,9 @@ import (
 	"time"
 
 	"ehang.io/nps/bridge"
+	"ehang.io/nps/lib/cache"
 	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
 	"ehang.io/nps/lib/file"
 	"ehang.io/nps/server/proxy"
 	"ehang.io/nps/server/tool"
@@ -25,8 +28,9 @@ import (
 )
 
 var (
-	Bridge  *bridge.Bridge
-	RunList sync.Map //map[int]interface{}
+	Bridge    *bridge.Bridge
+	RunList   sync.Map //map[int]interface{}
+	httpCache *cache.HttpCache
 )
 
 func init() {
@@ -66,13 +70,15 @@ func DealBridgeTask() {
 					file.GetDb().DelClient(id)
 				}
 			}
+		case id := <-Bridge.ApplyProfile:
+			go ApplyProfile(id)
 		case tunnel := <-Bridge.OpenTask:
 			StartTask(tunnel.Id)
 		case s := <-Bridge.SecretChan:
 			logs.Trace("New secret connection, addr", s.Conn.Conn.RemoteAddr())
 			if t := file.GetDb().GetTaskByMd5Password(s.Password); t != nil {
 				if t.Status {
-					go proxy.NewBaseServer(Bridge, t).DealClient(s.Conn, t.Client, t.Target.TargetStr, nil, common.CONN_TCP, nil, t.Flow, t.Target.LocalProxy, nil)
+					go proxy.NewBaseServer(Bridge, t).DealClient(s.Conn, t.Client, t.Target.TargetStr, nil, common.CONN_TCP, nil, file.Flows{t.Flow}, t.Target.LocalProxy, nil, conn.LinkProxyProtocol(t.ProxyProtocol))
 				} else {
 					s.Conn.Close()
 					logs.Trace("This key %s cannot be processed,status is close", s.Password)
@@ -85,9 +91,28 @@ func DealBridgeTask() {
 	}
 }
 
+// read once at the start
+func initProxyOptions() {
+	//the idle timeout is second
+	proxy.UdpIdleTimeout = time.Duration(beego.AppConfig.DefaultInt("udp_idle_timeout", 60)) * time.Second
+	proxy.UdpMaxSessions = beego.AppConfig.DefaultInt("udp_max_sessions", 0)
+	proxy.UdpQueueSize = beego.AppConfig.DefaultInt("udp_queue_size", 64)
+	proxy.CompressMinSize = beego.AppConfig.DefaultInt64("http_compress_min_size", 1024)
+	//the size of the body is KB
+	proxy.InspectSize = beego.AppConfig.DefaultInt("http_inspect_size", 50)
+	proxy.InspectBodySize = beego.AppConfig.DefaultInt64("http_inspect_body_size", 16) << 10
+	proxy.ResponseHeaderTimeout = time.Duration(beego.AppConfig.DefaultInt("http_response_timeout", 60)) * time.Second
+}
+
 // start a new server
 func StartNewServer(bridgePort int, cnf *file.Tunnel, bridgeType string, bridgeDisconnect int) {
+	file.CountOverhead = beego.AppConfig.DefaultBool("flow_count_overhead", false)
+	initProxyOptions()
 	Bridge = bridge.NewTunnel(bridgePort, bridgeType, common.GetBoolByStr(beego.AppConfig.String("ip_limit")), RunList, bridgeDisconnect)
+	if err := startCluster(); err != nil {
+		logs.Error("start the cluster error", err)
+		os.Exit(0)
+	}
 	go func() {
 		if err := Bridge.StartTunnel(); err != nil {
 			logs.Error("start server bridge error", err)
@@ -126,6 +151,11 @@ func dealClientFlow() {
 // new a server by mode name
 func NewMode(Bridge *bridge.Bridge, c *file.Tunnel) proxy.Service {
 	var service proxy.Service
+	if c.IsPortRange() {
+		return proxy.NewRangeModeServer(c, func(t *file.Tunnel) proxy.Service {
+			return NewMode(Bridge, t)
+		})
+	}
 	switch c.Mode {
 	case "tcp", "file":
 		service = proxy.NewTunnelModeServer(proxy.ProcessTunnel, Bridge, c)
@@ -137,6 +167,10 @@ func NewMode(Bridge *bridge.Bridge, c *file.Tunnel) proxy.Service {
 		service = proxy.NewTunnelModeServer(proxy.HandleTrans, Bridge, c)
 	case "udp":
 		service = proxy.NewUdpModeServer(Bridge, c)
+	case "tcpTls":
+		service = proxy.NewTlsModeServer(Bridge, c)
+	case "sni":
+		service = proxy.NewSniModeServer(Bridge, c)
 	case "webServer":
 		InitFromCsv()
 		t := &file.Tunnel{
@@ -149,10 +183,18 @@ func NewMode(Bridge *bridge.Bridge, c *file.Tunnel) proxy.Service {
 	case "httpHostServer":
 		httpPort, _ := beego.AppConfig.Int("http_proxy_port")
 		httpsPort, _ := beego.AppConfig.Int("https_proxy_port")
-		useCache, _ := beego.AppConfig.Bool("http_cache")
-		cacheLen, _ := beego.AppConfig.Int("http_cache_length")
 		addOrigin, _ := beego.AppConfig.Bool("http_add_origin_header")
-		service = proxy.NewHttp(Bridge, c, httpPort, httpsPort, useCache, cacheLen, addOrigin)
+		if useCache, _ := beego.AppConfig.Bool("http_cache"); useCache && httpCache == nil {
+			//the size of all the cache is MB and the size of one response is KB
+			objectSize := beego.AppConfig.DefaultInt64("http_cache_object_size", 1024) << 10
+			cacheSize := beego.AppConfig.DefaultInt64("http_cache_size", 64) << 20
+			if length, err := beego.AppConfig.Int64("http_cache_length"); err == nil && length > 0 && beego.AppConfig.String("http_cache_size") == "" {
+				logs.Warn("http_cache_length is replaced by http_cache_size, the cache size is set to %d responses of http_cache_object_size", length)
+				cacheSize = length * objectSize
+			}
+			httpCache = cache.NewHttpCache(cacheSize, objectSize)
+		}
+		service = proxy.NewHttp(Bridge, c, httpPort, httpsPort, httpCache, addOrigin)
 	}
 	return service
 }
@@ -173,7 +215,7 @@ func StopServer(id int) error {
 			return err
 		} else {
 			t.Status = false
-			logs.Info("close port %d,remark %s,client id %d,task id %d", t.Port, t.Remark, t.Client.Id, t.Id)
+			logs.Info("close port %s,remark %s,client id %d,task id %d", getTaskPorts(t), t.Remark, t.Client.Id, t.Id)
 			file.GetDb().UpdateTask(t)
 		}
 		//delete(RunList, id)
@@ -191,15 +233,15 @@ func AddTask(t *file.Tunnel) error {
 		RunList.Store(t.Id, nil)
 		return nil
 	}
-	if b := tool.TestServerPort(t.Port, t.Mode); !b && t.Mode != "httpHostServer" {
-		logs.Error("taskId %d start error port %d open failed", t.Id, t.Port)
+	if b := tool.TestServerPorts(t.GetPorts(), t.Mode); !b && t.Mode != "httpHostServer" {
+		logs.Error("taskId %d start error port %s open failed", t.Id, getTaskPorts(t))
 		return errors.New("the port open error")
 	}
 	if minute, err := beego.AppConfig.Int("flow_store_interval"); err == nil && minute > 0 {
 		go flowSession(time.Minute * time.Duration(minute))
 	}
 	if svr := NewMode(Bridge, t); svr != nil {
-		logs.Info("tunnel task %s start mode：%s port %d", t.Remark, t.Mode, t.Port)
+		logs.Info("tunnel task %s start mode：%s port %s", t.Remark, t.Mode, getTaskPorts(t))
 		//RunList[t.Id] = svr
 		RunList.Store(t.Id, svr)
 		go func() {
@@ -216,6 +258,13 @@ func AddTask(t *file.Tunnel) error {
 	return nil
 }
 
+func getTaskPorts(t *file.Tunnel) string {
+	if t.IsPortRange() {
+		return t.Ports
+	}
+	return strconv.Itoa(t.Port)
+}
+
 // start task
 func StartTask(id int) error {
 	if t, err := file.GetDb().GetTask(id); err != nil {
@@ -239,6 +288,29 @@ func DelTask(id int) error {
 	return file.GetDb().DelTask(id)
 }
 
+func PurgeHostCache(id int) (int, error) {
+	if httpCache == nil {
+		return 0, errors.New("the http cache is not enabled")
+	}
+	return httpCache.Purge(id), nil
+}
+
+func GetInspectRecords(id int) []*proxy.InspectRecord {
+	return proxy.GetInspectRecords(id)
+}
+
+func ClearInspectRecords(id int) {
+	proxy.ClearInspectRecords(id)
+}
+
+func ReplayInspectRecord(id int, recordId int64) (*proxy.InspectRecord, error) {
+	h, err := file.GetDb().GetHostById(id)
+	if err != nil {
+		return nil, err
+	}
+	return proxy.ReplayInspectRecord(Bridge, h, recordId)
+}
+
 // get task list by page num
 func GetTunnel(start, length int, typeVal string, clientId int, search string, sortField string, order string) ([]*file.Tunnel, int) {
 	all_list := make([]*file.Tunnel, 0) //store all Tunnel
@@ -296,15 +368,11 @@ func GetTunnel(start, length int, typeVal string, clientId int, search string, s
 			if (typeVal != "" && v.Mode != typeVal || (clientId != 0 && v.Client.Id != clientId)) || (typeVal == "" && clientId != v.Client.Id) {
 				continue
 			}
-			if search != "" && !(v.Id == common.GetIntNoErrByStr(search) || v.Port == common.GetIntNoErrByStr(search) || strings.Contains(v.Password, search) || strings.Contains(v.Remark, search) || strings.Contains(v.Target.TargetStr, search)) {
+			if search != "" && !(v.Id == common.GetIntNoErrByStr(search) || common.InIntArr(v.GetPorts(), common.GetIntNoErrByStr(search)) || strings.Contains(v.Password, search) || strings.Contains(v.Remark, search) || strings.Contains(v.Target.TargetStr, search)) {
 				continue
 			}
 			cnt++
-			if _, ok := Bridge.Client.Load(v.Client.Id); ok {
-				v.Client.IsConnect = true
-			} else {
-				v.Client.IsConnect = false
-			}
+			v.Client.IsConnect = isClientConnect(v.Client.Id)
 			if start--; start < 0 {
 				if length--; length >= 0 {
 					if _, ok := RunList.Load(v.Id); ok {
@@ -337,7 +405,7 @@ func dealClientData() {
 			v.LastOnlineTime = time.Now().Format("2006-01-02 15:04:05")
 			v.Version = vv.(*bridge.Client).Version
 		} else {
-			v.IsConnect = false
+			v.IsConnect = isClientConnect(v.Id)
 		}
 		//v.Flow.InletFlow = 0
 		//v.Flow.ExportFlow = 0
@@ -372,6 +440,18 @@ func dealClientData() {
 	return
 }
 
+// held by this node or another node of the cluster
+func isClientConnect(id int) bool {
+	if _, ok := Bridge.Client.Load(id); ok {
+		return true
+	}
+	if Bridge.Cluster != nil {
+		_, ok := Bridge.Cluster.GetNode(id)
+		return ok
+	}
+	return false
+}
+
 // delete all host and tasks by client id
 func DelTunnelAndHostByClientId(clientId int, justDelNoStore bool) {
 	var ids []int
@@ -407,6 +487,16 @@ func DelTunnelAndHostByClientId(clientId int, justDelNoStore bool) {
 // close the client
 func DelClientConnect(clientId int) {
 	Bridge.DelClient(clientId)
+	if Bridge.Cluster != nil {
+		Bridge.Cluster.DisconnectClient(clientId)
+	}
+}
+
+func SendCommand(clientId int, cmd *conn.Command) (*conn.CommandResult, error) {
+	if !common.InStrArr(conn.Commands, cmd.Name) {
+		return nil, errors.New(fmt.Sprintf("the command %s is not supported", cmd.Name))
+	}
+	return Bridge.SendCommand(clientId, cmd)
 }
 
 func GetDashboardData() map[string]interface{} {
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/file"
 	"github.com/astaxie/beego"
 	"github.com/shirou/gopsutil/v3/cpu"
 	"github.com/shirou/gopsutil/v3/load"
@@ -43,6 +44,9 @@ func TestServerPort(p int, m string) (b bool) {
 			return false
 		}
 	}
+	if m == "sni" && isSniPort(p) {
+		return true
+	}
 	if m == "udp" {
 		b = common.TestUdpPort(p)
 	} else {
@@ -51,6 +55,28 @@ func TestServerPort(p int, m string) (b bool) {
 	return
 }
 
+// all the ports of a range must be free
+func TestServerPorts(ps []int, m string) bool {
+	for _, p := range ps {
+		if !TestServerPort(p, m) {
+			return false
+		}
+	}
+	return true
+}
+
+func isSniPort(p int) (b bool) {
+	file.GetDb().JsonDb.Tasks.Range(func(key, value interface{}) bool {
+		v := value.(*file.Tunnel)
+		if v.Mode == "sni" && v.Port == p && v.Status {
+			b = true
+			return false
+		}
+		return true
+	})
+	return
+}
+
 func GenerateServerPort(m string) int {
 	for {
 		//生成随机数 1024 - 65535
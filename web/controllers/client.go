@@ -2,10 +2,13 @@ package controllers
 
 import (
 	"ehang.io/nps/lib/common"
+	"ehang.io/nps/lib/conn"
+	"ehang.io/nps/lib/crypt"
 	"ehang.io/nps/lib/file"
 	"ehang.io/nps/lib/rate"
 	"ehang.io/nps/server"
 	"github.com/astaxie/beego"
+	"sort"
 	"strings"
 	"time"
 )
@@ -102,6 +105,11 @@ func (s *ClientController) Edit() {
 		} else {
 			s.Data["c"] = c
 			s.Data["BlackIpList"] = strings.Join(c.BlackIpList, "\r\n")
+			s.Data["mtls"] = crypt.IsCaEnable()
+			if c.Profile != nil {
+				s.Data["profile"] = c.Profile.Content
+				s.Data["profilefiles"] = formatProfileFiles(c.Profile.Files)
+			}
 		}
 		s.SetInfo("edit client")
 		s.display()
@@ -187,6 +195,143 @@ func (s *ClientController) ChangeStatus() {
 	s.AjaxErr("modified fail")
 }
 
+// 签发客户端证书，旧证书立即失效
+func (s *ClientController) IssueCert() {
+	if s.GetSession("isAdmin") == nil || !s.GetSession("isAdmin").(bool) {
+		s.AjaxErr("the certificate can only be managed by the administrator")
+	}
+	id := s.GetIntNoErr("id")
+	c, err := file.GetDb().GetClient(id)
+	if err != nil {
+		s.AjaxErr("client ID not found")
+	}
+	certPem, keyPem, serial, err := crypt.IssueClientCert(c.Id)
+	if err != nil {
+		s.AjaxErr(err.Error())
+	}
+	c.Lock()
+	revoke := c.CertSerial != ""
+	c.CertSerial = serial
+	c.Unlock()
+	file.GetDb().JsonDb.StoreClientsToJsonFile()
+	if revoke {
+		server.DelClientConnect(c.Id)
+	}
+	data := ajax("issue success", 1)
+	data["serial"] = serial
+	data["cert"] = string(certPem)
+	data["key"] = string(keyPem)
+	data["ca"] = string(crypt.GetCaPem())
+	data["fingerprint"] = crypt.GetCaFingerprint()
+	s.Data["json"] = data
+	s.ServeJSON()
+	s.StopRun()
+}
+
+// 吊销客户端证书，使用该证书的连接立即断开
+func (s *ClientController) RevokeCert() {
+	if s.GetSession("isAdmin") == nil || !s.GetSession("isAdmin").(bool) {
+		s.AjaxErr("the certificate can only be managed by the administrator")
+	}
+	id := s.GetIntNoErr("id")
+	c, err := file.GetDb().GetClient(id)
+	if err != nil {
+		s.AjaxErr("client ID not found")
+	}
+	c.Lock()
+	c.CertSerial = ""
+	c.Unlock()
+	file.GetDb().JsonDb.StoreClientsToJsonFile()
+	server.DelClientConnect(c.Id)
+	s.AjaxOk("revoke success")
+}
+
+// 向客户端发送命令，返回命令的结果
+func (s *ClientController) Command() {
+	if s.GetSession("isAdmin") == nil || !s.GetSession("isAdmin").(bool) {
+		s.AjaxErr("the commands can only be sent by the administrator")
+	}
+	id := s.GetIntNoErr("id")
+	if _, err := file.GetDb().GetClient(id); err != nil {
+		s.AjaxErr("client ID not found")
+	}
+	args := map[string]string{
+		"type":    s.getEscapeString("type"),
+		"target":  s.getEscapeString("target"),
+		"stack":   s.getEscapeString("stack"),
+		"content": s.GetString("content"),
+	}
+	start := time.Now()
+	result, err := server.SendCommand(id, conn.NewCommand(s.getEscapeString("command"), args, s.GetIntNoErr("timeout")))
+	if err != nil {
+		s.AjaxErr(err.Error())
+	}
+	if result.Error != "" {
+		s.AjaxErr(result.Error)
+	}
+	data := ajax("command success", 1)
+	data["result"] = result.Data
+	data["duration"] = time.Since(start).Milliseconds()
+	s.Data["json"] = data
+	s.ServeJSON()
+	s.StopRun()
+}
+
+// 保存客户端的集中配置，客户端连接的节点创建其中的隧道和域名，并通知客户端拉取
+func (s *ClientController) Profile() {
+	if s.GetSession("isAdmin") == nil || !s.GetSession("isAdmin").(bool) {
+		s.AjaxErr("the profile can only be edited by the administrator")
+	}
+	id := s.GetIntNoErr("id")
+	c, err := file.GetDb().GetClient(id)
+	if err != nil {
+		s.AjaxErr("client ID not found")
+	}
+	p := &file.Profile{Content: s.GetString("content"), Files: parseProfileFiles(s.GetString("files"))}
+	if p.IsEmpty() {
+		p = nil
+	} else if _, err := server.ParseProfile(p); err != nil {
+		s.AjaxErr("profile error " + err.Error())
+	}
+	c.Lock()
+	c.Profile = p
+	c.Unlock()
+	file.GetDb().JsonDb.StoreClientsToJsonFile()
+	server.ApplyProfile(id)
+	s.AjaxOk("save success")
+}
+
+// [name] on a line, then the content
+func formatProfileFiles(files map[string]string) string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString("[" + name + "]\n" + strings.TrimRight(files[name], "\r\n") + "\n")
+	}
+	return b.String()
+}
+
+func parseProfileFiles(s string) map[string]string {
+	files := make(map[string]string)
+	var name string
+	for _, line := range strings.Split(strings.Replace(s, "\r\n", "\n", -1), "\n") {
+		if t := strings.TrimSpace(line); strings.HasPrefix(t, "[") && strings.HasSuffix(t, "]") {
+			name = strings.TrimSpace(t[1 : len(t)-1])
+			files[name] = ""
+		} else if name != "" {
+			files[name] += line + "\n"
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	return files
+}
+
 // 删除客户端
 func (s *ClientController) Del() {
 	id := s.GetIntNoErr("id")
@@ -44,6 +44,18 @@ func (s *IndexController) Socks5() {
 	s.display("index/list")
 }
 
+func (s *IndexController) TcpTls() {
+	s.SetInfo("tcp+tls")
+	s.SetType("tcpTls")
+	s.display("index/list")
+}
+
+func (s *IndexController) Sni() {
+	s.SetInfo("sni")
+	s.SetType("sni")
+	s.display("index/list")
+}
+
 func (s *IndexController) Http() {
 	s.SetInfo("http proxy")
 	s.SetType("httpProxy")
@@ -100,6 +112,21 @@ func authStrToMap(userString string) map[string]string {
 	return authMap
 }
 
+// 目标可能已修改，重置检查状态
+func (s *IndexController) setHealth(h *file.Health) {
+	h.Lock()
+	defer h.Unlock()
+	h.HealthCheckType = s.getEscapeString("health_check_type")
+	h.HealthCheckTimeout = s.GetIntNoErr("health_check_timeout")
+	h.HealthMaxFail = s.GetIntNoErr("health_check_max_failed")
+	h.HealthCheckInterval = s.GetIntNoErr("health_check_interval")
+	h.HttpHealthUrl = s.getEscapeString("health_http_url")
+	h.HealthNextTime = time.Time{}
+	h.HealthMap = nil
+	h.HealthRemoveArr = nil
+	h.ClientRemoveArr = nil
+}
+
 func (s *IndexController) Add() {
 	if s.Ctx.Request.Method == "GET" {
 		s.Data["type"] = s.getEscapeString("type")
@@ -127,18 +154,31 @@ func (s *IndexController) Add() {
 				MaxConn:    s.GetIntNoErr("max_conn"),
 				ExpireTime: s.getEscapeString("expire_time"),
 			},
-			CreateTime:   time.Now().Format(common.DEFAULT_TIME),
-			MultiAccount: &file.MultiAccount{AccountMap: authStrToMap(s.getEscapeString("S5User"))},
+			CreateTime:    time.Now().Format(common.DEFAULT_TIME),
+			MultiAccount:  &file.MultiAccount{AccountMap: authStrToMap(s.getEscapeString("S5User"))},
+			ProxyProtocol: s.GetIntNoErr("proxy_protocol"),
+			ServerName:    s.getEscapeString("server_name"),
+			Alpn:          s.getEscapeString("alpn"),
+			// pem不转义
+			CertFile:            strings.TrimSpace(s.GetString("cert_file")),
+			KeyFile:             strings.TrimSpace(s.GetString("key_file")),
+			ClientCa:            strings.TrimSpace(s.GetString("client_ca")),
+			TargetTls:           s.GetBoolNoErr("target_tls"),
+			TargetTlsServerName: s.getEscapeString("target_tls_server_name"),
+			TargetTlsInsecure:   s.GetBoolNoErr("target_tls_insecure"),
+			TargetTlsCa:         strings.TrimSpace(s.GetString("target_tls_ca")),
 		}
+		s.setHealth(&t.Health)
 		//if t.Mode == "socks5" && t.S5User == "" {
 		//	s.AjaxErr("The account number cannot be empty")
 		//	return
 		//}
+		s.setPortRange(t, s.getEscapeString("port"))
 		if t.Port <= 0 {
 			t.Port = tool.GenerateServerPort(t.Mode)
 		}
 
-		if !tool.TestServerPort(t.Port, t.Mode) {
+		if !tool.TestServerPorts(t.GetPorts(), t.Mode) {
 			s.AjaxErr("The port cannot be opened because it may has been occupied or is no longer allowed.")
 		}
 		var err error
@@ -184,31 +224,44 @@ func (s *IndexController) Edit() {
 		if t, err := file.GetDb().GetTask(id); err != nil {
 			s.error()
 		} else {
+			if err := file.GetDb().CheckSniRoute(&file.Tunnel{Id: id, Mode: s.getEscapeString("type"), Port: s.GetIntNoErr("port"),
+				ServerName: s.getEscapeString("server_name"), Alpn: s.getEscapeString("alpn")}); err != nil {
+				s.AjaxErr(err.Error())
+				return
+			}
+			// 修改隧道前先检查端口
+			rt := &file.Tunnel{Mode: s.getEscapeString("type"), Port: s.GetIntNoErr("port"), Target: &file.Target{TargetStr: s.getEscapeString("target")}}
+			s.setPortRange(rt, s.getEscapeString("port"))
 			if client, err := file.GetDb().GetClient(s.GetIntNoErr("client_id")); err != nil {
 				s.AjaxErr("modified error,the client is not exist")
 				return
 			} else {
 				t.Client = client
 			}
-			if s.GetIntNoErr("port") != t.Port {
-				t.Port = s.GetIntNoErr("port")
-
-				if t.Port <= 0 {
-					t.Port = tool.GenerateServerPort(t.Mode)
-				}
-
-				if !tool.TestServerPort(s.GetIntNoErr("port"), t.Mode) {
-					s.AjaxErr("The port cannot be opened because it may has been occupied or is no longer allowed.")
-					return
+			if rt.Port <= 0 {
+				rt.Port = tool.GenerateServerPort(rt.Mode)
+			}
+			// 隧道自身占用的端口不检查
+			var ports []int
+			for _, p := range rt.GetPorts() {
+				if !common.InIntArr(t.GetPorts(), p) {
+					ports = append(ports, p)
 				}
 			}
+			if !tool.TestServerPorts(ports, rt.Mode) {
+				s.AjaxErr("The port cannot be opened because it may has been occupied or is no longer allowed.")
+				return
+			}
+			t.Port = rt.Port
+			t.Ports = rt.Ports
+			t.TargetAddr = rt.TargetAddr
 			//if t.Mode == "socks5" && s.getEscapeString("S5User") == "" {
 			//	s.AjaxErr("The account number cannot be empty")
 			//	return
 			//}
 			t.ServerIp = s.getEscapeString("server_ip")
 			t.Mode = s.getEscapeString("type")
-			t.Target = &file.Target{TargetStr: s.getEscapeString("target")}
+			t.Target = rt.Target
 			t.Password = s.getEscapeString("password")
 			t.Id = id
 			t.LocalPath = s.getEscapeString("local_path")
@@ -222,7 +275,20 @@ func (s *IndexController) Edit() {
 				MaxConn:    s.GetIntNoErr("max_conn"),
 				ExpireTime: s.getEscapeString("expire_time"),
 			}
-			t.MultiAccount = &file.MultiAccount{AccountMap: authStrToMap(s.getEscapeString("S5User"))}
+			ma := &file.MultiAccount{AccountMap: authStrToMap(s.getEscapeString("S5User"))}
+			ma.KeepFlow(t.MultiAccount)
+			t.MultiAccount = ma
+			t.ProxyProtocol = s.GetIntNoErr("proxy_protocol")
+			t.ServerName = s.getEscapeString("server_name")
+			t.Alpn = s.getEscapeString("alpn")
+			t.CertFile = strings.TrimSpace(s.GetString("cert_file"))
+			t.KeyFile = strings.TrimSpace(s.GetString("key_file"))
+			t.ClientCa = strings.TrimSpace(s.GetString("client_ca"))
+			t.TargetTls = s.GetBoolNoErr("target_tls")
+			t.TargetTlsServerName = s.getEscapeString("target_tls_server_name")
+			t.TargetTlsInsecure = s.GetBoolNoErr("target_tls_insecure")
+			t.TargetTlsCa = strings.TrimSpace(s.GetString("target_tls_ca"))
+			s.setHealth(&t.Health)
 			file.GetDb().UpdateTask(t)
 			server.StopServer(t.Id)
 			server.StartTask(t.Id)
@@ -288,9 +354,54 @@ func (s *IndexController) DelHost() {
 	if err := file.GetDb().DelHost(id); err != nil {
 		s.AjaxErr("delete error")
 	}
+	server.PurgeHostCache(id)
+	server.ClearInspectRecords(id)
 	s.AjaxOk("delete success")
 }
 
+func (s *IndexController) PurgeCache() {
+	id := s.GetIntNoErr("id")
+	if _, err := file.GetDb().GetHostById(id); err != nil {
+		s.AjaxErr("the host is not exist")
+	}
+	if _, err := server.PurgeHostCache(id); err != nil {
+		s.AjaxErr(err.Error())
+	}
+	s.AjaxOk("purge success")
+}
+
+func (s *IndexController) HostInspect() {
+	id := s.GetIntNoErr("id")
+	if s.Ctx.Request.Method == "GET" {
+		s.Data["menu"] = "host"
+		if h, err := file.GetDb().GetHostById(id); err != nil {
+			s.error()
+		} else {
+			s.Data["h"] = h
+		}
+		s.SetInfo("inspect")
+		s.display("index/hinspect")
+	} else {
+		list := server.GetInspectRecords(id)
+		s.AjaxTable(list, len(list), len(list), nil)
+	}
+}
+
+func (s *IndexController) HostInspectClear() {
+	server.ClearInspectRecords(s.GetIntNoErr("id"))
+	s.AjaxOk("clear success")
+}
+
+func (s *IndexController) HostReplay() {
+	recordId, _ := s.GetInt64("record_id")
+	rec, err := server.ReplayInspectRecord(s.GetIntNoErr("id"), recordId)
+	if err != nil {
+		s.AjaxErr(err.Error())
+	}
+	s.Data["json"] = map[string]interface{}{"status": 1, "msg": "replay success", "data": rec}
+	s.ServeJSON()
+}
+
 func (s *IndexController) AddHost() {
 	if s.Ctx.Request.Method == "GET" {
 		s.Data["client_id"] = s.getEscapeString("client_id")
@@ -300,19 +411,54 @@ func (s *IndexController) AddHost() {
 	} else {
 		id := int(file.GetDb().JsonDb.GetHostId())
 		h := &file.Host{
-			Id:           id,
-			Host:         s.getEscapeString("host"),
-			Target:       &file.Target{TargetStr: s.getEscapeString("target"), LocalProxy: s.GetBoolNoErr("local_proxy")},
-			HeaderChange: s.getEscapeString("header"),
-			HostChange:   s.getEscapeString("hostchange"),
-			Remark:       s.getEscapeString("remark"),
-			Location:     s.getEscapeString("location"),
-			Flow:         &file.Flow{},
-			Scheme:       s.getEscapeString("scheme"),
-			KeyFilePath:  s.getEscapeString("key_file_path"),
-			CertFilePath: s.getEscapeString("cert_file_path"),
-			AutoHttps:    s.GetBoolNoErr("AutoHttps"),
+			Id:            id,
+			Host:          s.getEscapeString("host"),
+			Target:        &file.Target{TargetStr: s.getEscapeString("target"), LocalProxy: s.GetBoolNoErr("local_proxy")},
+			HeaderChange:  s.getEscapeString("header"),
+			HostChange:    s.getEscapeString("hostchange"),
+			Remark:        s.getEscapeString("remark"),
+			Location:      s.getEscapeString("location"),
+			Flow:          &file.Flow{},
+			Scheme:        s.getEscapeString("scheme"),
+			KeyFilePath:   s.getEscapeString("key_file_path"),
+			CertFilePath:  s.getEscapeString("cert_file_path"),
+			AutoHttps:     s.GetBoolNoErr("AutoHttps"),
+			NoCache:       s.GetBoolNoErr("no_cache"),
+			CacheTtl:      s.GetIntNoErr("cache_ttl"),
+			HttpCompress:  s.GetBoolNoErr("http_compress"),
+			CompressTypes: s.getEscapeString("compress_types"),
+			// 密码经过hash，url中可能有&，不转义
+			AuthUsers:           file.HashAuthUsers(s.GetString("auth_users")),
+			ForwardAuthUrl:      strings.TrimSpace(s.GetString("forward_auth_url")),
+			ForwardAuthHeaders:  s.getEscapeString("forward_auth_headers"),
+			AllowIps:            s.getEscapeString("allow_ips"),
+			DenyIps:             s.getEscapeString("deny_ips"),
+			RateLimit:           s.GetIntNoErr("rate_limit"),
+			RateBurst:           s.GetIntNoErr("rate_burst"),
+			Maintenance:         s.GetBoolNoErr("maintenance"),
+			ErrorPage404:        s.GetString("error_page_404"),
+			ErrorPage502:        s.GetString("error_page_502"),
+			ErrorPage503:        s.GetString("error_page_503"),
+			ErrorPage504:        s.GetString("error_page_504"),
+			Http2:               s.GetBoolNoErr("http2"),
+			BackendProto:        s.getEscapeString("backend_proto"),
+			TargetTlsServerName: s.getEscapeString("target_tls_server_name"),
+			TargetTlsInsecure:   s.GetBoolNoErr("target_tls_insecure"),
+			TargetTlsCa:         strings.TrimSpace(s.GetString("target_tls_ca")),
+			ProxyProtocol:       s.GetIntNoErr("proxy_protocol"),
+			Inspect:             s.GetBoolNoErr("inspect"),
+			InspectCredentials:  s.GetBoolNoErr("inspect_credentials"),
+			Action:              s.getEscapeString("action"),
+			StaticStatus:        s.GetIntNoErr("static_status"),
+			StaticBody:          s.GetString("static_body"),
+			StaticContentType:   s.getEscapeString("static_content_type"),
+			RedirectUrl:         strings.TrimSpace(s.GetString("redirect_url")),
+			RedirectCode:        s.GetIntNoErr("redirect_code"),
+			RedirectKeepPath:    s.GetBoolNoErr("redirect_keep_path"),
+			StaticDir:           s.GetString("static_dir"),
 		}
+		s.checkHostAction(h.Action, h.RedirectUrl, h.StaticDir)
+		s.setHealth(&h.Health)
 		var err error
 		if h.Client, err = file.GetDb().GetClient(s.GetIntNoErr("client_id")); err != nil {
 			s.AjaxErr("add error the client can not be found")
@@ -328,6 +474,53 @@ func (s *IndexController) AddHost() {
 	}
 }
 
+// 端口范围如9001-9009,10001，目标如10.1.50.2:8001-8009,10002
+func (s *IndexController) setPortRange(t *file.Tunnel, port string) {
+	t.Ports, t.TargetAddr = "", ""
+	if !strings.ContainsAny(port, "-,") {
+		return
+	}
+	ports := common.GetPorts(port)
+	if len(ports) == 0 {
+		s.AjaxErr("The port range is not correct")
+	}
+	t.Port = ports[0]
+	if len(ports) == 1 {
+		return
+	}
+	if t.Mode != "tcp" && t.Mode != "udp" {
+		s.AjaxErr("The port range is only supported by tcp and udp")
+	}
+	t.Ports = port
+	// 省略ip时为127.0.0.1
+	if i := strings.LastIndex(t.Target.TargetStr, ":"); i >= 0 {
+		t.TargetAddr, t.Target.TargetStr = strings.TrimSpace(t.Target.TargetStr[:i]), strings.TrimSpace(t.Target.TargetStr[i+1:])
+	}
+	if _, err := t.GetRangeTunnels(); err != nil {
+		s.AjaxErr(err.Error())
+	}
+}
+
+// 只有管理员可以使用服务端目录
+func (s *IndexController) checkHostAction(action, redirectUrl, staticDir string) {
+	switch action {
+	case "", "proxy", "static":
+	case "redirect":
+		if redirectUrl == "" {
+			s.AjaxErr("the redirect url can not be empty")
+		}
+	case "dir":
+		if s.GetSession("isAdmin") == nil || !s.GetSession("isAdmin").(bool) {
+			s.AjaxErr("the directory can only be served by the administrator")
+		}
+		if staticDir == "" {
+			s.AjaxErr("the directory can not be empty")
+		}
+	default:
+		s.AjaxErr("unknown action")
+	}
+}
+
 func (s *IndexController) EditHost() {
 	id := s.GetIntNoErr("id")
 	if s.Ctx.Request.Method == "GET" {
@@ -353,6 +546,7 @@ func (s *IndexController) EditHost() {
 					return
 				}
 			}
+			s.checkHostAction(s.getEscapeString("action"), strings.TrimSpace(s.GetString("redirect_url")), s.GetString("static_dir"))
 			if client, err := file.GetDb().GetClient(s.GetIntNoErr("client_id")); err != nil {
 				s.AjaxErr("modified error,the client is not exist")
 			} else {
@@ -369,6 +563,43 @@ func (s *IndexController) EditHost() {
 			h.CertFilePath = s.getEscapeString("cert_file_path")
 			h.Target.LocalProxy = s.GetBoolNoErr("local_proxy")
 			h.AutoHttps = s.GetBoolNoErr("AutoHttps")
+			h.NoCache = s.GetBoolNoErr("no_cache")
+			h.CacheTtl = s.GetIntNoErr("cache_ttl")
+			h.HttpCompress = s.GetBoolNoErr("http_compress")
+			h.CompressTypes = s.getEscapeString("compress_types")
+			h.AuthUsers = file.HashAuthUsers(s.GetString("auth_users"))
+			h.ForwardAuthUrl = strings.TrimSpace(s.GetString("forward_auth_url"))
+			h.ForwardAuthHeaders = s.getEscapeString("forward_auth_headers")
+			h.AllowIps = s.getEscapeString("allow_ips")
+			h.DenyIps = s.getEscapeString("deny_ips")
+			h.RateLimit = s.GetIntNoErr("rate_limit")
+			h.RateBurst = s.GetIntNoErr("rate_burst")
+			h.Maintenance = s.GetBoolNoErr("maintenance")
+			h.ErrorPage404 = s.GetString("error_page_404")
+			h.ErrorPage502 = s.GetString("error_page_502")
+			h.ErrorPage503 = s.GetString("error_page_503")
+			h.ErrorPage504 = s.GetString("error_page_504")
+			h.Http2 = s.GetBoolNoErr("http2")
+			h.BackendProto = s.getEscapeString("backend_proto")
+			h.TargetTlsServerName = s.getEscapeString("target_tls_server_name")
+			h.TargetTlsInsecure = s.GetBoolNoErr("target_tls_insecure")
+			h.TargetTlsCa = strings.TrimSpace(s.GetString("target_tls_ca"))
+			h.ProxyProtocol = s.GetIntNoErr("proxy_protocol")
+			h.Inspect = s.GetBoolNoErr("inspect")
+			h.InspectCredentials = s.GetBoolNoErr("inspect_credentials")
+			h.Action = s.getEscapeString("action")
+			h.StaticStatus = s.GetIntNoErr("static_status")
+			h.StaticBody = s.GetString("static_body")
+			h.StaticContentType = s.getEscapeString("static_content_type")
+			h.RedirectUrl = strings.TrimSpace(s.GetString("redirect_url"))
+			h.RedirectCode = s.GetIntNoErr("redirect_code")
+			h.RedirectKeepPath = s.GetBoolNoErr("redirect_keep_path")
+			h.StaticDir = s.GetString("static_dir")
+			if !h.Inspect {
+				server.ClearInspectRecords(h.Id)
+			}
+			s.setHealth(&h.Health)
+			server.PurgeHostCache(h.Id)
 			file.GetDb().JsonDb.StoreHostToJsonFile()
 		}
 		s.AjaxOk("modified success")
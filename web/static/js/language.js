@@ -144,6 +144,9 @@ function submitform(action, url, postdata) {
         case 'start':
         case 'stop':
         case 'delete':
+        case 'purge':
+        case 'clear':
+        case 'revoke':
             var langobj = languages['content']['confirm'][action];
             action = (langobj[languages['current']] || langobj[languages['default']] || 'Are you sure you want to ' + action + ' it?');
             if (! confirm(action)) return;
@@ -200,4 +203,23 @@ function changeunit(limit) {
         return sizeStr.substring(0, index) + sizeStr.substr(index + 3, 2);
     }
     return size;
-}
\ No newline at end of file
+}
+function healthstate(row) {
+    if (!row.Target || !row.HealthCheckType && !row.HealthRemoveArr) {
+        return "";
+    }
+    var state = "";
+    var targets = row.Target.TargetStr.split("\n");
+    for (var i = 0; i < targets.length; i++) {
+        var target = targets[i].trim();
+        if (target == "") {
+            continue;
+        }
+        if (row.HealthRemoveArr && row.HealthRemoveArr.indexOf(target) >= 0) {
+            state += target + ' <span class="badge badge-badge" langtag="word-offline"></span>&emsp;';
+        } else {
+            state += target + ' <span class="badge badge-primary" langtag="word-online"></span>&emsp;';
+        }
+    }
+    return '<br/><br><b langtag="word-healthstate"></b>: ' + state;
+}